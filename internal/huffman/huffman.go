@@ -0,0 +1,87 @@
+// Package huffman computes length-limited Huffman codes.
+package huffman
+
+import "sort"
+
+type node struct {
+	weight      int
+	symbol      int // the symbol of the leaf, or -1 for packages.
+	left, right *node
+}
+
+// Lengths returns the optimal code lengths for the symbol frequencies freq,
+// none of which is longer than maxBits.
+// It uses the package-merge algorithm.
+//
+// The symbols whose frequency is zero have no codes, and their lengths are 0.
+// If only one symbol has non-zero frequency, its length is 1.
+// Lengths panics if the symbols can't be encoded in maxBits.
+func Lengths(freq []int, maxBits int) []uint8 {
+	lengths := make([]uint8, len(freq))
+
+	leaves := make([]*node, 0, len(freq))
+	for sym, f := range freq {
+		if f > 0 {
+			leaves = append(leaves, &node{weight: f, symbol: sym})
+		}
+	}
+	switch len(leaves) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[leaves[0].symbol] = 1
+		return lengths
+	}
+	if len(leaves) > 1<<maxBits {
+		panic("huffman: too many symbols")
+	}
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return leaves[i].weight < leaves[j].weight
+	})
+
+	list := leaves
+	for i := 1; i < maxBits; i++ {
+		// package the items in pairs.
+		packages := make([]*node, 0, len(list)/2)
+		for j := 0; j+1 < len(list); j += 2 {
+			packages = append(packages, &node{
+				weight: list[j].weight + list[j+1].weight,
+				symbol: -1,
+				left:   list[j],
+				right:  list[j+1],
+			})
+		}
+
+		// merge the packages with the leaves.
+		merged := make([]*node, 0, len(leaves)+len(packages))
+		a, b := leaves, packages
+		for len(a) > 0 && len(b) > 0 {
+			if a[0].weight <= b[0].weight {
+				merged = append(merged, a[0])
+				a = a[1:]
+			} else {
+				merged = append(merged, b[0])
+				b = b[1:]
+			}
+		}
+		merged = append(merged, a...)
+		merged = append(merged, b...)
+		list = merged
+	}
+
+	// The length of a symbol is the number of times
+	// it appears in the first 2n-2 items.
+	var count func(n *node)
+	count = func(n *node) {
+		if n.symbol >= 0 {
+			lengths[n.symbol]++
+			return
+		}
+		count(n.left)
+		count(n.right)
+	}
+	for _, n := range list[:2*len(leaves)-2] {
+		count(n)
+	}
+	return lengths
+}
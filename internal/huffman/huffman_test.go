@@ -0,0 +1,73 @@
+package huffman
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLengths(t *testing.T) {
+	tests := []struct {
+		freq    []int
+		maxBits int
+		want    []uint8
+	}{
+		{
+			freq:    []int{},
+			maxBits: 15,
+			want:    []uint8{},
+		},
+		{
+			freq:    []int{0, 5, 0},
+			maxBits: 15,
+			want:    []uint8{0, 1, 0},
+		},
+		{
+			freq:    []int{1, 1},
+			maxBits: 15,
+			want:    []uint8{1, 1},
+		},
+		{
+			freq:    []int{1, 1, 2, 4, 8},
+			maxBits: 15,
+			want:    []uint8{4, 4, 3, 2, 1},
+		},
+		{
+			// Fibonacci frequencies make the deepest tree.
+			freq:    []int{1, 1, 2, 3, 5, 8, 13},
+			maxBits: 4,
+			want:    []uint8{4, 4, 3, 3, 3, 2, 2},
+		},
+	}
+	for i, tt := range tests {
+		got := Lengths(tt.freq, tt.maxBits)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%d: unexpected lengths (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestLengths_Kraft(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		freq := make([]int, 2+r.Intn(300))
+		for j := range freq {
+			// exponential distribution makes long codes.
+			freq[j] = 1 << r.Intn(20)
+		}
+		lengths := Lengths(freq, 15)
+
+		// The code must be complete.
+		var sum int
+		for _, l := range lengths {
+			if l == 0 || l > 15 {
+				t.Fatalf("unexpected length: %d", l)
+			}
+			sum += 1 << (15 - l)
+		}
+		if sum != 1<<15 {
+			t.Errorf("the code is not complete: %d", sum)
+		}
+	}
+}
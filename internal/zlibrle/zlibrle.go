@@ -0,0 +1,376 @@
+// Package zlibrle implements a zlib compressor with the run-length encoding strategy.
+// It is the same as Z_RLE strategy of the zlib library: match distances are limited to one,
+// and the matches are encoded with the dynamic Huffman codes.
+// It is fast and effective for the filtered image data of PNG.
+package zlibrle
+
+import (
+	"errors"
+	"hash"
+	"hash/adler32"
+	"io"
+	"math/bits"
+
+	"github.com/shogo82148/go-imaging/internal/huffman"
+)
+
+const (
+	minMatchLength = 3
+	maxMatchLength = 258
+
+	// maxTokens is the maximum number of tokens in a block.
+	maxTokens = 1 << 15
+
+	// endBlockMarker is the literal/length code of the end of a block.
+	endBlockMarker = 256
+
+	numLiteralCodes    = 286
+	numDistanceCodes   = 30
+	numCodeLengthCodes = 19
+
+	maxLiteralBits    = 15
+	maxCodeLengthBits = 7
+)
+
+// The base lengths and the number of extra bits of the length codes 257-285.
+var lengthBase = [29]uint16{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+	35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258,
+}
+
+var lengthExtraBits = [29]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+	3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0,
+}
+
+// The order of the code length code lengths in the block header.
+var codeLengthOrder = [numCodeLengthCodes]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// token is a literal or a match with distance one.
+// literals are 0-255, and matches are matchFlag | length.
+type token uint32
+
+const matchFlag token = 1 << 16
+
+var errClosed = errors.New("zlibrle: write to closed writer")
+
+// Writer is a zlib compressor with the run-length encoding strategy.
+type Writer struct {
+	w           io.Writer
+	adler       hash.Hash32
+	wroteHeader bool
+	closed      bool
+	err         error
+
+	// the tokens of the current block.
+	tokens []token
+
+	// prev is the last byte written, or -1 if no byte is written.
+	prev int
+	// run is the number of bytes that are equal to prev and not tokenized yet.
+	run int
+
+	// output bit buffer.
+	buf   []byte
+	bits  uint64
+	nbits uint
+}
+
+// NewWriter returns a new Writer that writes compressed data to w.
+func NewWriter(w io.Writer) *Writer {
+	z := &Writer{
+		adler:  adler32.New(),
+		tokens: make([]token, 0, maxTokens),
+	}
+	z.Reset(w)
+	return z
+}
+
+// Reset discards the Writer's state and makes it equivalent to the result of NewWriter
+// but writing to w instead.
+func (z *Writer) Reset(w io.Writer) {
+	z.w = w
+	z.adler.Reset()
+	z.wroteHeader = false
+	z.closed = false
+	z.err = nil
+	z.tokens = z.tokens[:0]
+	z.prev = -1
+	z.run = 0
+	z.buf = z.buf[:0]
+	z.bits = 0
+	z.nbits = 0
+}
+
+// Write writes a compressed form of p to the underlying io.Writer.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errClosed
+	}
+	if !z.wroteHeader {
+		z.writeHeader()
+	}
+	z.adler.Write(p)
+
+	for _, c := range p {
+		if int(c) == z.prev {
+			z.run++
+			if z.run == maxMatchLength {
+				z.emit(matchFlag | maxMatchLength)
+				z.run = 0
+			}
+			continue
+		}
+		z.flushRun()
+		z.emit(token(c))
+		z.prev = int(c)
+	}
+	return len(p), z.err
+}
+
+// Close flushes the remaining data and writes the zlib footer.
+// It does not close the underlying io.Writer.
+func (z *Writer) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	if !z.wroteHeader {
+		z.writeHeader()
+	}
+	z.flushRun()
+	z.writeBlock(true)
+
+	// align to a byte boundary.
+	if z.nbits > 0 {
+		z.writeBits(0, 8-z.nbits)
+	}
+	z.buf = z.adler.Sum(z.buf)
+	z.flush()
+	return z.err
+}
+
+func (z *Writer) writeHeader() {
+	z.wroteHeader = true
+	// CMF: deflate with 32K window, FLG: fastest compression level, no dictionary.
+	z.buf = append(z.buf, 0x78, 0x01)
+}
+
+// flushRun tokenizes the pending run.
+func (z *Writer) flushRun() {
+	if z.run >= minMatchLength {
+		z.emit(matchFlag | token(z.run))
+	} else {
+		for i := 0; i < z.run; i++ {
+			z.emit(token(z.prev))
+		}
+	}
+	z.run = 0
+}
+
+func (z *Writer) emit(t token) {
+	z.tokens = append(z.tokens, t)
+	if len(z.tokens) == maxTokens {
+		z.writeBlock(false)
+	}
+}
+
+func (z *Writer) writeBits(b uint32, n uint) {
+	z.bits |= uint64(b) << z.nbits
+	z.nbits += n
+	for z.nbits >= 8 {
+		z.buf = append(z.buf, byte(z.bits))
+		z.bits >>= 8
+		z.nbits -= 8
+	}
+}
+
+func (z *Writer) flush() {
+	if z.err != nil || len(z.buf) == 0 {
+		return
+	}
+	_, z.err = z.w.Write(z.buf)
+	z.buf = z.buf[:0]
+}
+
+// lengthCode returns the index of the length code for the match length.
+func lengthCode(length int) int {
+	i := 0
+	for i+1 < len(lengthBase) && int(lengthBase[i+1]) <= length {
+		i++
+	}
+	return i
+}
+
+// ensureTwoCodes makes at least two symbols have non-zero frequencies
+// so that the Huffman code is complete.
+func ensureTwoCodes(freq []int) {
+	n := 0
+	for _, f := range freq {
+		if f > 0 {
+			n++
+		}
+	}
+	for i := 0; n < 2; i++ {
+		if freq[i] == 0 {
+			freq[i] = 1
+			n++
+		}
+	}
+}
+
+// canonicalCodes returns the canonical Huffman codes of the lengths,
+// in the bit-reversed order for writing them LSB first.
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for i, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		codes[i] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+		next[l]++
+	}
+	return codes
+}
+
+// writeBlock writes the tokens as a block with the dynamic Huffman codes.
+func (z *Writer) writeBlock(final bool) {
+	// count the frequencies.
+	litFreq := make([]int, numLiteralCodes)
+	distFreq := make([]int, numDistanceCodes)
+	for _, t := range z.tokens {
+		if t&matchFlag != 0 {
+			litFreq[257+lengthCode(int(t&^matchFlag))]++
+			distFreq[0]++
+		} else {
+			litFreq[t]++
+		}
+	}
+	litFreq[endBlockMarker]++
+	ensureTwoCodes(litFreq)
+	ensureTwoCodes(distFreq)
+
+	litLengths := huffman.Lengths(litFreq, maxLiteralBits)
+	distLengths := huffman.Lengths(distFreq, maxLiteralBits)
+	numLit := numLiteralCodes
+	for numLit > 257 && litLengths[numLit-1] == 0 {
+		numLit--
+	}
+	numDist := numDistanceCodes
+	for numDist > 1 && distLengths[numDist-1] == 0 {
+		numDist--
+	}
+
+	// run-length encode the code lengths.
+	lengths := make([]uint8, 0, numLit+numDist)
+	lengths = append(lengths, litLengths[:numLit]...)
+	lengths = append(lengths, distLengths[:numDist]...)
+	type clToken struct {
+		code  uint8
+		extra uint8
+	}
+	var clTokens []clToken
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		j := i + 1
+		for j < len(lengths) && lengths[j] == l {
+			j++
+		}
+		run := j - i
+		if l == 0 {
+			for run >= 11 {
+				r := min(run, 138)
+				clTokens = append(clTokens, clToken{18, uint8(r - 11)})
+				run -= r
+			}
+			if run >= 3 {
+				clTokens = append(clTokens, clToken{17, uint8(run - 3)})
+				run = 0
+			}
+		} else {
+			clTokens = append(clTokens, clToken{l, 0})
+			run--
+			for run >= 3 {
+				r := min(run, 6)
+				clTokens = append(clTokens, clToken{16, uint8(r - 3)})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			clTokens = append(clTokens, clToken{l, 0})
+		}
+		i = j
+	}
+	clFreq := make([]int, numCodeLengthCodes)
+	for _, t := range clTokens {
+		clFreq[t.code]++
+	}
+	ensureTwoCodes(clFreq)
+	clLengths := huffman.Lengths(clFreq, maxCodeLengthBits)
+	numCL := numCodeLengthCodes
+	for numCL > 4 && clLengths[codeLengthOrder[numCL-1]] == 0 {
+		numCL--
+	}
+
+	// write the block header.
+	if final {
+		z.writeBits(1, 1)
+	} else {
+		z.writeBits(0, 1)
+	}
+	z.writeBits(2, 2) // compressed with dynamic Huffman codes
+	z.writeBits(uint32(numLit-257), 5)
+	z.writeBits(uint32(numDist-1), 5)
+	z.writeBits(uint32(numCL-4), 4)
+	for _, i := range codeLengthOrder[:numCL] {
+		z.writeBits(uint32(clLengths[i]), 3)
+	}
+	clCodes := canonicalCodes(clLengths)
+	for _, t := range clTokens {
+		z.writeBits(uint32(clCodes[t.code]), uint(clLengths[t.code]))
+		switch t.code {
+		case 16:
+			z.writeBits(uint32(t.extra), 2)
+		case 17:
+			z.writeBits(uint32(t.extra), 3)
+		case 18:
+			z.writeBits(uint32(t.extra), 7)
+		}
+	}
+
+	// write the data.
+	litCodes := canonicalCodes(litLengths)
+	distCodes := canonicalCodes(distLengths)
+	for _, t := range z.tokens {
+		if t&matchFlag == 0 {
+			z.writeBits(uint32(litCodes[t]), uint(litLengths[t]))
+			continue
+		}
+		length := int(t &^ matchFlag)
+		code := lengthCode(length)
+		z.writeBits(uint32(litCodes[257+code]), uint(litLengths[257+code]))
+		z.writeBits(uint32(length-int(lengthBase[code])), uint(lengthExtraBits[code]))
+		z.writeBits(uint32(distCodes[0]), uint(distLengths[0]))
+	}
+	z.writeBits(uint32(litCodes[endBlockMarker]), uint(litLengths[endBlockMarker]))
+
+	z.tokens = z.tokens[:0]
+	z.flush()
+}
@@ -0,0 +1,91 @@
+package zlibrle
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func compressDecompress(t *testing.T, data []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// write in small pieces to test the state between writes.
+	for p := data; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zlib.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("data mismatch: got %d bytes, want %d bytes", len(got), len(data))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	t.Run("empty", func(t *testing.T) {
+		compressDecompress(t, []byte{})
+	})
+
+	t.Run("single byte", func(t *testing.T) {
+		compressDecompress(t, []byte{42})
+	})
+
+	t.Run("zeros", func(t *testing.T) {
+		compressDecompress(t, make([]byte, 100000))
+	})
+
+	t.Run("random", func(t *testing.T) {
+		data := make([]byte, 100000)
+		r.Read(data)
+		compressDecompress(t, data)
+	})
+
+	t.Run("runs", func(t *testing.T) {
+		var data []byte
+		for len(data) < 300000 {
+			c := byte(r.Intn(4))
+			n := r.Intn(600)
+			data = append(data, bytes.Repeat([]byte{c}, n)...)
+		}
+		compressDecompress(t, data)
+	})
+}
+
+func TestWriter_Reset(t *testing.T) {
+	data := bytes.Repeat([]byte("aaaabbbbbbbbccd"), 1000)
+
+	var buf1, buf2 bytes.Buffer
+	w := NewWriter(&buf1)
+	w.Write(data)
+	w.Close()
+
+	w.Reset(&buf2)
+	w.Write(data)
+	w.Close()
+
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Error("output mismatch after Reset")
+	}
+	if _, err := w.Write(data); err == nil {
+		t.Error("want error, got nil")
+	}
+}
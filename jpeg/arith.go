@@ -0,0 +1,461 @@
+package jpeg
+
+import "io"
+
+// aritab is the probability estimation state machine of table D.3, in the
+// same compact representation as libjpeg: the Qe value is in the bits 16-31,
+// Next_Index_MPS is in the bits 8-15, Switch_MPS is the bit 7 and
+// Next_Index_LPS is in the bits 0-6.
+var aritab = [...]uint32{
+	0x5a1d0181, 0x2586020e, 0x11140310, 0x080b0412, 0x03d80514, 0x01da0617,
+	0x00e50719, 0x006f081c, 0x0036091e, 0x001a0a21, 0x000d0b23, 0x00060c09,
+	0x00030d0a, 0x00010d0c, 0x5a7f0f8f, 0x3f251024, 0x2cf21126, 0x207c1227,
+	0x17b91328, 0x1182142a, 0x0cef152b, 0x09a1162d, 0x072f172e, 0x055c1830,
+	0x04061931, 0x03031a33, 0x02401b34, 0x01b11c36, 0x01441d38, 0x00f51e39,
+	0x00b71f3b, 0x008a203c, 0x0068213e, 0x004e223f, 0x003b2320, 0x002c0921,
+	0x5ae125a5, 0x484c2640, 0x3a0d2741, 0x2ef12843, 0x261f2944, 0x1f332a45,
+	0x19a82b46, 0x15182c48, 0x11772d49, 0x0e742e4a, 0x0bfb2f4b, 0x09f8304d,
+	0x0861314e, 0x0706324f, 0x05cd3330, 0x04de3432, 0x040f3532, 0x03633633,
+	0x02d43734, 0x025c3835, 0x01f83936, 0x01a43a37, 0x01603b38, 0x01253c39,
+	0x00f63d3a, 0x00cb3e3b, 0x00ab3f3d, 0x008f203d, 0x5b1241c1, 0x4d044250,
+	0x412c4351, 0x37d84452, 0x2fe84553, 0x293c4654, 0x23794756, 0x1edf4857,
+	0x1aa94957, 0x174e4a48, 0x14244b48, 0x119c4c4a, 0x0f6b4d4a, 0x0d514e4b,
+	0x0bb64f4d, 0x0a40304d, 0x583251d0, 0x4d1c5258, 0x438e5359, 0x3bdd545a,
+	0x34ee555b, 0x2eae565c, 0x299a575d, 0x25164756, 0x557059d8, 0x4ca95a5f,
+	0x44d95b60, 0x3e225c61, 0x38245d63, 0x32b45e63, 0x2e17565d, 0x56a860df,
+	0x4f466165, 0x47e56266, 0x41cf6367, 0x3c3d6468, 0x375e5d63, 0x52316669,
+	0x4c0f676a, 0x4639686b, 0x415e6367, 0x56276ae9, 0x50e76b6c, 0x4b85676d,
+	0x55976d6e, 0x504f6b6f, 0x5a106fee, 0x55226d70, 0x59eb6ff0,
+	// This last entry is used for the fixed probability estimate of 0.5,
+	// as recommended in section 10.3 of ITU-T T.851.
+	0x5a1d7171,
+}
+
+// arithFixed is the state of the statistics bin with the fixed probability
+// estimate of 0.5.
+const arithFixed = 113
+
+// arithDecoder is the state of the arithmetic decoder, specified in annex D.
+type arithDecoder struct {
+	c  uint32 // The C register.
+	a  uint32 // The A register.
+	ct int    // The bit counter, or negative while reading the initial bytes.
+	// marker is whether the decoder has reached a marker. The rest of the
+	// data is zeros after that.
+	marker bool
+
+	// dcStats and acStats are the statistics bins of each conditioning table,
+	// as specified in section F.1.4.4.
+	dcStats [maxTh + 1][64]uint8
+	acStats [maxTh + 1][256]uint8
+	// dcContext is the conditioning category of the DC difference of each
+	// component, as specified in section F.1.4.4.1.2.
+	dcContext [maxComponents]int
+}
+
+// reset initializes the arithmetic decoder at the start of a scan or a
+// restart interval.
+func (a *arithDecoder) reset() {
+	*a = arithDecoder{ct: -16}
+}
+
+// errShortArithmeticData means that an unexpected EOF occurred while
+// decoding arithmetic-coded data.
+var errShortArithmeticData = FormatError("short arithmetic-coded data")
+
+// errBadArithmeticCode means that the arithmetic-coded data has a value
+// that is too large.
+var errBadArithmeticCode = FormatError("bad arithmetic code")
+
+// readArithByte returns the next byte of the arithmetic-coded data, removing
+// the stuffed zero bytes. Unlike the Huffman-coded data, the data may reach
+// a marker before the decoding is complete, and the decoder then reads zeros
+// as specified in section D.2.6. The marker is left for the caller.
+func (d *decoder) readArithByte() (byte, error) {
+	if d.arith.marker {
+		return 0, nil
+	}
+	x, err := d.readByte()
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, errShortArithmeticData
+		}
+		return 0, err
+	}
+	if x != 0xff {
+		return x, nil
+	}
+	// Section B.1.1.2 allows any number of fill bytes before a marker.
+	for x == 0xff {
+		if x, err = d.readByte(); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errShortArithmeticData
+			}
+			return 0, err
+		}
+	}
+	if x == 0x00 {
+		return 0xff, nil
+	}
+	// Unread the marker, which is still in the buffer.
+	d.bytes.i -= 2
+	d.arith.marker = true
+	return 0, nil
+}
+
+// skipArithData skips the rest of the arithmetic-coded data of the current
+// restart interval, up to the next marker. The encoder may write the bytes
+// that the decoder doesn't need.
+func (d *decoder) skipArithData() error {
+	for !d.arith.marker {
+		if _, err := d.readArithByte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeArith decodes a binary decision with the statistics bin st, as
+// specified in section D.2.
+func (d *decoder) decodeArith(st *uint8) (int, error) {
+	a := &d.arith
+	// Renormalization and data input, as specified in section D.2.6.
+	for a.a < 0x8000 {
+		a.ct--
+		if a.ct < 0 {
+			data, err := d.readArithByte()
+			if err != nil {
+				return 0, err
+			}
+			a.c = a.c<<8 | uint32(data)
+			a.ct += 8
+			if a.ct < 0 {
+				// Section D.2.7 reads two initial bytes into C.
+				a.ct++
+				if a.ct == 0 {
+					// A becomes 0x10000 after the loop.
+					a.a = 0x8000
+				}
+			}
+		}
+		a.a <<= 1
+	}
+
+	sv := *st
+	qe := aritab[sv&0x7f]
+	nl := uint8(qe) // Next_Index_LPS and Switch_MPS.
+	qe >>= 8
+	nm := uint8(qe) // Next_Index_MPS.
+	qe >>= 8
+
+	// The decoding and the probability estimation, as specified in sections
+	// D.2.4 and D.2.5.
+	temp := a.a - qe
+	a.a = temp
+	temp <<= a.ct
+	if a.c >= temp {
+		a.c -= temp
+		// Conditional LPS exchange.
+		if a.a < qe {
+			a.a = qe
+			*st = sv&0x80 ^ nm
+		} else {
+			a.a = qe
+			*st = sv&0x80 ^ nl
+			sv ^= 0x80
+		}
+	} else if a.a < 0x8000 {
+		// Conditional MPS exchange.
+		if a.a < qe {
+			*st = sv&0x80 ^ nl
+			sv ^= 0x80
+		} else {
+			*st = sv&0x80 ^ nm
+		}
+	}
+	return int(sv >> 7), nil
+}
+
+// decodeArithMagnitude decodes the magnitude category and the magnitude bit
+// pattern of a non-zero value, as specified in section F.2.4.3. stats are the
+// statistics bins of the table, st is the bin of the first decision of the
+// magnitude category, x1 is the bin of the second decision and x2 is the
+// first bin of the following decisions. It returns the magnitude of the value
+// and m, the largest power of two not greater than the magnitude minus one,
+// or zero.
+func (d *decoder) decodeArithMagnitude(stats []uint8, st, x1, x2 int) (v, m int32, err error) {
+	bit, err := d.decodeArith(&stats[st])
+	if err != nil || bit == 0 {
+		return 1, 0, err
+	}
+	if bit, err = d.decodeArith(&stats[x1]); err != nil || bit == 0 {
+		return 2, 1, err
+	}
+	m = 2
+	for st = x2; ; st++ {
+		if bit, err = d.decodeArith(&stats[st]); err != nil {
+			return 0, 0, err
+		}
+		if bit == 0 {
+			break
+		}
+		if m <<= 1; m == 0x8000 {
+			return 0, 0, errBadArithmeticCode
+		}
+	}
+	// The bits of the magnitude pattern share the bin st+14.
+	v = m
+	for mask := m >> 1; mask != 0; mask >>= 1 {
+		if bit, err = d.decodeArith(&stats[st+14]); err != nil {
+			return 0, 0, err
+		}
+		if bit != 0 {
+			v |= mask
+		}
+	}
+	return v + 1, m, nil
+}
+
+// decodeArithBlock decodes the coefficients of a block from the arithmetic-
+// coded data, as specified in sections F.2.4 and G.1.3. The DC coefficients
+// of the sequential and the first progressive scans are accumulated in dc.
+func (d *decoder) decodeArithBlock(b *block, s scanComponent, zigStart, zigEnd int32, ah, al uint32, dc *[maxComponents]int32) error {
+	if zigStart == 0 {
+		if ah != 0 {
+			// Refining a DC coefficient uses the fixed probability estimate.
+			st := uint8(arithFixed)
+			bit, err := d.decodeArith(&st)
+			if err != nil {
+				return err
+			}
+			if bit != 0 {
+				b[0] |= 1 << al
+			}
+			return nil
+		}
+		diff, err := d.decodeArithDC(s.compIndex, s.td)
+		if err != nil {
+			return err
+		}
+		dc[s.compIndex] += diff
+		b[0] = dc[s.compIndex] << al
+		zigStart++
+	}
+	if zigStart > zigEnd {
+		return nil
+	}
+	if ah != 0 {
+		return d.refineArithAC(b, s.ta, zigStart, zigEnd, al)
+	}
+	return d.decodeArithAC(b, s.ta, zigStart, zigEnd, al)
+}
+
+// decodeArithDC decodes the difference of a DC coefficient, as specified in
+// section F.2.4.1.
+func (d *decoder) decodeArithDC(compIndex, tb uint8) (int32, error) {
+	stats := d.arith.dcStats[tb][:]
+	// The conditioning category of the previous difference selects the
+	// statistics bin S0, as per table F.4.
+	s0 := d.arith.dcContext[compIndex]
+	bit, err := d.decodeArith(&stats[s0])
+	if err != nil {
+		return 0, err
+	}
+	if bit == 0 {
+		d.arith.dcContext[compIndex] = 0
+		return 0, nil
+	}
+	sign, err := d.decodeArith(&stats[s0+1])
+	if err != nil {
+		return 0, err
+	}
+	v, m, err := d.decodeArithMagnitude(stats, s0+2+sign, 20, 21)
+	if err != nil {
+		return 0, err
+	}
+
+	// Classify the difference for the next one, as specified in section
+	// F.1.4.4.1.2.
+	l, u := d.arithDCConditioning(tb)
+	switch {
+	case m < int32(1)<<l>>1:
+		d.arith.dcContext[compIndex] = 0
+	case m > int32(1)<<u>>1:
+		d.arith.dcContext[compIndex] = 12 + 4*sign
+	default:
+		d.arith.dcContext[compIndex] = 4 + 4*sign
+	}
+	if sign != 0 {
+		v = -v
+	}
+	return v, nil
+}
+
+// decodeArithAC decodes the AC coefficients of a block in the spectral band
+// [zigStart, zigEnd], as specified in sections F.2.4.2 and G.1.3.2.
+func (d *decoder) decodeArithAC(b *block, tb uint8, zigStart, zigEnd int32, al uint32) error {
+	stats := d.arith.acStats[tb][:]
+	kx := d.arithACConditioning(tb)
+	for zig := zigStart; zig <= zigEnd; zig++ {
+		// Each coefficient has three statistics bins: the end of block
+		// decision, the zero decision and the first magnitude decision.
+		st := 3 * int(zig-1)
+		eob, err := d.decodeArith(&stats[st])
+		if err != nil {
+			return err
+		}
+		if eob != 0 {
+			break
+		}
+		for {
+			bit, err := d.decodeArith(&stats[st+1])
+			if err != nil {
+				return err
+			}
+			if bit != 0 {
+				break
+			}
+			zig++
+			st += 3
+			if zig > zigEnd {
+				return errBadArithmeticCode
+			}
+		}
+
+		fixed := uint8(arithFixed)
+		sign, err := d.decodeArith(&fixed)
+		if err != nil {
+			return err
+		}
+		x2 := 217
+		if zig <= kx {
+			x2 = 189
+		}
+		v, _, err := d.decodeArithMagnitude(stats, st+2, st+2, x2)
+		if err != nil {
+			return err
+		}
+		if sign != 0 {
+			v = -v
+		}
+		b[unzig[zig]] = v << al
+	}
+	return nil
+}
+
+// refineArithAC decodes a successive approximation refinement of the AC
+// coefficients of a block, as specified in section G.1.3.3.
+func (d *decoder) refineArithAC(b *block, tb uint8, zigStart, zigEnd int32, al uint32) error {
+	stats := d.arith.acStats[tb][:]
+	delta := int32(1) << al
+	// eobx is the end of block of the previous stage.
+	eobx := zigEnd
+	for eobx > 0 && b[unzig[eobx]] == 0 {
+		eobx--
+	}
+	for zig := zigStart; zig <= zigEnd; zig++ {
+		st := 3 * int(zig-1)
+		if zig > eobx {
+			eob, err := d.decodeArith(&stats[st])
+			if err != nil {
+				return err
+			}
+			if eob != 0 {
+				break
+			}
+		}
+		for {
+			c := &b[unzig[zig]]
+			if *c != 0 {
+				// Refine a coefficient that was non-zero in the previous stage.
+				bit, err := d.decodeArith(&stats[st+2])
+				if err != nil {
+					return err
+				}
+				if bit != 0 {
+					if *c >= 0 {
+						*c += delta
+					} else {
+						*c -= delta
+					}
+				}
+				break
+			}
+			bit, err := d.decodeArith(&stats[st+1])
+			if err != nil {
+				return err
+			}
+			if bit != 0 {
+				// A newly non-zero coefficient.
+				fixed := uint8(arithFixed)
+				sign, err := d.decodeArith(&fixed)
+				if err != nil {
+					return err
+				}
+				*c = delta
+				if sign != 0 {
+					*c = -delta
+				}
+				break
+			}
+			zig++
+			st += 3
+			if zig > zigEnd {
+				return errBadArithmeticCode
+			}
+		}
+	}
+	return nil
+}
+
+// Specified in section B.2.4.3.
+func (d *decoder) processDAC(n int) error {
+	for n > 0 {
+		if n < 2 {
+			return FormatError("DAC has wrong length")
+		}
+		if err := d.readFull(d.tmp[:2]); err != nil {
+			return err
+		}
+		n -= 2
+		tc := d.tmp[0] >> 4
+		tb := d.tmp[0] & 0x0f
+		cs := d.tmp[1]
+		if tc > maxTc || tb > maxTh {
+			return FormatError("bad Tc or Tb value")
+		}
+		switch tc {
+		case dcTable:
+			// The lower bound L must not be greater than the upper bound U.
+			if cs&0x0f > cs>>4 {
+				return FormatError("bad DC conditioning value")
+			}
+		case acTable:
+			if cs < 1 || 63 < cs {
+				return FormatError("bad AC conditioning value")
+			}
+		}
+		d.arithCond[tc][tb] = cs
+		d.arithCondDefined[tc][tb] = true
+	}
+	return nil
+}
+
+// arithDCConditioning returns the bounds L and U of the DC conditioning table
+// tb, as specified in section F.1.4.4.1.2. The default is L = 0 and U = 1.
+func (d *decoder) arithDCConditioning(tb uint8) (l, u int) {
+	if !d.arithCondDefined[dcTable][tb] {
+		return 0, 1
+	}
+	cs := d.arithCond[dcTable][tb]
+	return int(cs & 0x0f), int(cs >> 4)
+}
+
+// arithACConditioning returns the value Kx of the AC conditioning table tb,
+// as specified in section F.1.4.4.2. The default is 5.
+func (d *decoder) arithACConditioning(tb uint8) int32 {
+	if !d.arithCondDefined[acTable][tb] {
+		return 5
+	}
+	return int32(d.arithCond[acTable][tb])
+}
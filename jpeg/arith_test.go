@@ -0,0 +1,621 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// arithEncoder is the arithmetic encoder of annex D, for the tests. It is
+// the same algorithm as jcarith.c in libjpeg.
+type arithEncoder struct {
+	out []byte
+
+	c, a   uint32
+	ct     int
+	sc, zc int // The numbers of the stacked 0xff bytes and the pending zero bytes.
+	buffer int // The pending output byte, or -1.
+
+	dcStats   [maxTh + 1][64]uint8
+	acStats   [maxTh + 1][256]uint8
+	dcContext [maxComponents]int
+	lastDC    [maxComponents]int32
+
+	// l, u and kx are the conditioning tables.
+	l, u, kx [maxTh + 1]int
+}
+
+func newArithEncoder(dac []byte) *arithEncoder {
+	a := &arithEncoder{}
+	for i := range a.l {
+		a.l[i], a.u[i], a.kx[i] = 0, 1, 5
+	}
+	for i := 0; i+1 < len(dac); i += 2 {
+		tc, tb, cs := dac[i]>>4, dac[i]&0x0f, int(dac[i+1])
+		if tc > maxTc || tb > maxTh {
+			continue
+		}
+		if tc == dcTable {
+			a.l[tb], a.u[tb] = cs&0x0f, cs>>4
+		} else {
+			a.kx[tb] = cs
+		}
+	}
+	return a
+}
+
+// reset initializes the encoder at the start of a scan or a restart
+// interval.
+func (a *arithEncoder) reset() {
+	a.c, a.a, a.ct = 0, 0x10000, 11
+	a.sc, a.zc, a.buffer = 0, 0, -1
+	a.dcStats = [maxTh + 1][64]uint8{}
+	a.acStats = [maxTh + 1][256]uint8{}
+	a.dcContext = [maxComponents]int{}
+	a.lastDC = [maxComponents]int32{}
+}
+
+func (a *arithEncoder) emit(b int) {
+	a.out = append(a.out, byte(b))
+}
+
+func (a *arithEncoder) emitZeros() {
+	for ; a.zc > 0; a.zc-- {
+		a.emit(0x00)
+	}
+}
+
+// emitCarry outputs the buffer byte with the carry, which converts the
+// stacked 0xff bytes to zeros.
+func (a *arithEncoder) emitCarry() {
+	if a.buffer >= 0 {
+		a.emitZeros()
+		a.emit(a.buffer + 1)
+		if a.buffer+1 == 0xff {
+			a.emit(0x00)
+		}
+	}
+	a.zc += a.sc
+	a.sc = 0
+}
+
+// emitStacked outputs the buffer byte and the stacked 0xff bytes, which no
+// longer overflow.
+func (a *arithEncoder) emitStacked() {
+	if a.buffer == 0 {
+		a.zc++
+	} else if a.buffer >= 0 {
+		a.emitZeros()
+		a.emit(a.buffer)
+	}
+	if a.sc > 0 {
+		a.emitZeros()
+		for ; a.sc > 0; a.sc-- {
+			a.emit(0xff)
+			a.emit(0x00)
+		}
+	}
+}
+
+// encode encodes the binary decision val with the statistics bin st.
+func (a *arithEncoder) encode(st *uint8, val int) {
+	sv := *st
+	qe := aritab[sv&0x7f]
+	nl := uint8(qe)
+	qe >>= 8
+	nm := uint8(qe)
+	qe >>= 8
+
+	a.a -= qe
+	if val != int(sv>>7) {
+		// Encode the less probable symbol.
+		if a.a >= qe {
+			a.c += a.a
+			a.a = qe
+		}
+		*st = sv&0x80 ^ nl
+	} else {
+		// Encode the more probable symbol.
+		if a.a >= 0x8000 {
+			return
+		}
+		if a.a < qe {
+			a.c += a.a
+			a.a = qe
+		}
+		*st = sv&0x80 ^ nm
+	}
+
+	// Renormalization and data output.
+	for {
+		a.a <<= 1
+		a.c <<= 1
+		if a.ct--; a.ct == 0 {
+			temp := int(a.c >> 19)
+			switch {
+			case temp > 0xff:
+				a.emitCarry()
+				a.buffer = temp & 0xff
+			case temp == 0xff:
+				a.sc++
+			default:
+				a.emitStacked()
+				a.buffer = temp
+			}
+			a.c &= 0x7ffff
+			a.ct += 8
+		}
+		if a.a >= 0x8000 {
+			break
+		}
+	}
+}
+
+// finish flushes the encoder at the end of a scan or a restart interval.
+func (a *arithEncoder) finish() {
+	// Find the value in the interval with the most trailing zero bits.
+	if temp := (a.a - 1 + a.c) & 0xffff0000; temp < a.c {
+		a.c = temp + 0x8000
+	} else {
+		a.c = temp
+	}
+	a.c <<= a.ct
+	if a.c&0xf8000000 != 0 {
+		a.emitCarry()
+	} else {
+		a.emitStacked()
+	}
+	// The trailing zero bytes are omitted.
+	if a.c&0x7fff800 != 0 {
+		a.emitZeros()
+		a.emit(int(a.c>>19) & 0xff)
+		if (a.c>>19)&0xff == 0xff {
+			a.emit(0x00)
+		}
+		if a.c&0x7f800 != 0 {
+			a.emit(int(a.c>>11) & 0xff)
+			if (a.c>>11)&0xff == 0xff {
+				a.emit(0x00)
+			}
+		}
+	}
+}
+
+// encodeMagnitude encodes the magnitude v >= 1 of a non-zero value, with the
+// same bins as decodeArithMagnitude. It returns the value m of the
+// conditioning.
+func (a *arithEncoder) encodeMagnitude(stats []uint8, st, x1, x2 int, v int32) int32 {
+	v--
+	if v == 0 {
+		a.encode(&stats[st], 0)
+		return 0
+	}
+	a.encode(&stats[st], 1)
+	m := int32(1)
+	st = x1
+	if v2 := v >> 1; v2 != 0 {
+		a.encode(&stats[x1], 1)
+		m = 2
+		for st = x2; v2>>1 != 0; st++ {
+			a.encode(&stats[st], 1)
+			m <<= 1
+			v2 >>= 1
+		}
+	}
+	a.encode(&stats[st], 0)
+	for mask := m >> 1; mask != 0; mask >>= 1 {
+		bit := 0
+		if v&mask != 0 {
+			bit = 1
+		}
+		a.encode(&stats[st+14], bit)
+	}
+	return m
+}
+
+func (a *arithEncoder) encodeDC(ci, tb int, v int32) {
+	stats := a.dcStats[tb][:]
+	s0 := a.dcContext[ci]
+	if v == 0 {
+		a.encode(&stats[s0], 0)
+		a.dcContext[ci] = 0
+		return
+	}
+	a.encode(&stats[s0], 1)
+	sign := 0
+	if v < 0 {
+		sign, v = 1, -v
+	}
+	a.encode(&stats[s0+1], sign)
+	m := a.encodeMagnitude(stats, s0+2+sign, 20, 21, v)
+	switch {
+	case m < int32(1)<<a.l[tb]>>1:
+		a.dcContext[ci] = 0
+	case m > int32(1)<<a.u[tb]>>1:
+		a.dcContext[ci] = 12 + 4*sign
+	default:
+		a.dcContext[ci] = 4 + 4*sign
+	}
+}
+
+// pointTransform returns the coefficients of b in zig-zag order, divided by
+// 2^al with rounding towards zero.
+func pointTransform(b *block, al int) (coef [blockSize]int32) {
+	for zig := range coef {
+		if v := b[unzig[zig]]; v >= 0 {
+			coef[zig] = v >> al
+		} else {
+			coef[zig] = -(-v >> al)
+		}
+	}
+	return coef
+}
+
+func (a *arithEncoder) encodeAC(tb int, b *block, ss, se, al int) {
+	stats := a.acStats[tb][:]
+	coef := pointTransform(b, al)
+	ke := se
+	for ke > 0 && coef[ke] == 0 {
+		ke--
+	}
+	k := ss
+	for ; k <= ke; k++ {
+		st := 3 * (k - 1)
+		a.encode(&stats[st], 0)
+		for coef[k] == 0 {
+			a.encode(&stats[st+1], 0)
+			st += 3
+			k++
+		}
+		a.encode(&stats[st+1], 1)
+		v := coef[k]
+		fixed := uint8(arithFixed)
+		if v > 0 {
+			a.encode(&fixed, 0)
+		} else {
+			a.encode(&fixed, 1)
+			v = -v
+		}
+		x2 := 217
+		if k <= a.kx[tb] {
+			x2 = 189
+		}
+		a.encodeMagnitude(stats, st+2, st+2, x2, v)
+	}
+	if k <= se {
+		a.encode(&stats[3*(k-1)], 1)
+	}
+}
+
+func (a *arithEncoder) refineAC(tb int, b *block, ss, se, al int) {
+	stats := a.acStats[tb][:]
+	coef := pointTransform(b, al)
+	ke := se
+	for ke > 0 && coef[ke] == 0 {
+		ke--
+	}
+	// kex is the end of block of the previous stage.
+	kex := ke
+	for kex > 0 && coef[kex]/2 == 0 {
+		kex--
+	}
+	k := ss
+	for ; k <= ke; k++ {
+		st := 3 * (k - 1)
+		if k > kex {
+			a.encode(&stats[st], 0)
+		}
+		for {
+			v := coef[k]
+			if v != 0 {
+				if v/2 != 0 {
+					// A previously non-zero coefficient.
+					a.encode(&stats[st+2], int(max(v, -v)&1))
+				} else {
+					a.encode(&stats[st+1], 1)
+					fixed := uint8(arithFixed)
+					if v > 0 {
+						a.encode(&fixed, 0)
+					} else {
+						a.encode(&fixed, 1)
+					}
+				}
+				break
+			}
+			a.encode(&stats[st+1], 0)
+			st += 3
+			k++
+		}
+	}
+	if k <= se {
+		a.encode(&stats[3*(k-1)], 1)
+	}
+}
+
+func (a *arithEncoder) encodeBlock(b *block, ci, tb int, s *Scan, progressive bool) {
+	switch {
+	case !progressive:
+		a.encodeDC(ci, tb, b[0]-a.lastDC[ci])
+		a.lastDC[ci] = b[0]
+		a.encodeAC(tb, b, 1, blockSize-1, 0)
+	case s.Ss == 0 && s.Ah == 0:
+		dc := b[0] >> s.Al
+		a.encodeDC(ci, tb, dc-a.lastDC[ci])
+		a.lastDC[ci] = dc
+	case s.Ss == 0:
+		fixed := uint8(arithFixed)
+		a.encode(&fixed, int(b[0]>>s.Al)&1)
+	case s.Ah == 0:
+		a.encodeAC(tb, b, s.Ss, s.Se, s.Al)
+	default:
+		a.refineAC(tb, b, s.Ss, s.Se, s.Al)
+	}
+}
+
+// encodeScan returns the arithmetic-coded data of the scan s, traversing
+// the saved coefficients of e as writeScanData does.
+func (a *arithEncoder) encodeScan(e *encoder, s *Scan) []byte {
+	a.out = nil
+	a.reset()
+	restart := func(mcu, n int) {
+		if e.ri > 0 && mcu%e.ri == 0 && mcu < n {
+			a.finish()
+			a.out = append(a.out, 0xff, uint8(rst0Marker+(mcu/e.ri-1)%8))
+			a.reset()
+		}
+	}
+	mxx, myy := e.mcuSize(e.size)
+	if len(s.Components) > 1 {
+		for my := 0; my < myy; my++ {
+			for mx := 0; mx < mxx; mx++ {
+				for _, ci := range s.Components {
+					h, v := e.comp[ci].h, e.comp[ci].v
+					for j := 0; j < h*v; j++ {
+						bx := h*mx + j%h
+						by := v*my + j/h
+						a.encodeBlock(&e.coeffs[ci][by*mxx*h+bx], ci, int(e.comp[ci].tq), s, e.progressive)
+					}
+				}
+				restart(my*mxx+mx+1, mxx*myy)
+			}
+		}
+	} else {
+		ci := s.Components[0]
+		h, v := e.comp[ci].h, e.comp[ci].v
+		h0, v0 := e.comp[0].h, e.comp[0].v
+		bxx := ((e.size.X*h+h0-1)/h0 + 7) / 8
+		byy := ((e.size.Y*v+v0-1)/v0 + 7) / 8
+		for by := 0; by < byy; by++ {
+			for bx := 0; bx < bxx; bx++ {
+				a.encodeBlock(&e.coeffs[ci][by*mxx*h+bx], ci, int(e.comp[ci].tq), s, e.progressive)
+				restart(by*bxx+bx+1, bxx*byy)
+			}
+		}
+	}
+	a.finish()
+	return a.out
+}
+
+// encodeArith encodes m with the arithmetic coding, using the coefficients
+// and the scan script of the Huffman encoder with the options o. dac is the
+// content of the DAC marker, if any.
+func encodeArith(t *testing.T, m image.Image, o *Options, dac []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var e encoder
+	if err := e.init(&buf, m, o); err != nil {
+		t.Fatal(err)
+	}
+	e.write([]byte{0xff, soiMarker})
+	if e.nComp == 4 {
+		e.writeAdobe()
+	}
+	e.writeDQT()
+	if e.progressive {
+		e.writeSOF(sof10Marker, e.size)
+	} else {
+		e.writeSOF(sof9Marker, e.size)
+	}
+	if dac != nil {
+		e.writeMarkerHeader(dacMarker, 2+len(dac))
+		e.write(dac)
+	}
+	if e.ri > 0 {
+		e.writeDRI()
+	}
+	e.saveCoeffs(m)
+	a := newArithEncoder(dac)
+	for i := range e.scans {
+		s := &e.scans[i]
+		e.writeSOSHeader(s)
+		e.write(a.encodeScan(&e, s))
+	}
+	e.write([]byte{0xff, eoiMarker})
+	e.flush()
+	if e.err != nil {
+		t.Fatal(e.err)
+	}
+	return buf.Bytes()
+}
+
+// arithTestImage returns an image that has both smooth areas and noise, so
+// that the coefficients have a wide range of magnitudes.
+func arithTestImage(w, h int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{uint8(x * 5), uint8(y * 7), uint8(x * y), 0xff}
+			if (x/16+y/16)%2 == 0 {
+				c.R, c.G, c.B = uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestDecodeArithmetic(t *testing.T) {
+	rgba := arithTestImage(83, 61)
+	gray := image.NewGray(rgba.Bounds())
+	cmyk := image.NewCMYK(rgba.Bounds())
+	for y := 0; y < 61; y++ {
+		for x := 0; x < 83; x++ {
+			gray.Set(x, y, rgba.At(x, y))
+			cmyk.Set(x, y, rgba.At(x, y))
+		}
+	}
+
+	tests := []struct {
+		name string
+		m    image.Image
+		o    *Options
+		dac  []byte
+	}{
+		{"gray", gray, &Options{Quality: 90}, nil},
+		{"gray/quality100", gray, &Options{Quality: 100}, nil},
+		{"ycbcr/420", rgba, &Options{Quality: 75}, nil},
+		{"ycbcr/444", rgba, &Options{Quality: 100, Subsampling: Subsampling444}, nil},
+		{"ycbcr/422/restart", rgba, &Options{Quality: 80, Subsampling: Subsampling422, RestartInterval: 3}, nil},
+		{"cmyk", cmyk, &Options{Quality: 85}, nil},
+		{"progressive/gray", gray, &Options{Quality: 90, Progressive: true}, nil},
+		{"progressive/ycbcr", rgba, &Options{Quality: 100, Progressive: true}, nil},
+		{"progressive/restart", rgba, &Options{Quality: 75, Progressive: true, RestartInterval: 2}, nil},
+		{"progressive/ycck", cmyk, &Options{Quality: 90, Progressive: true, YCCK: true, Subsampling: Subsampling420}, nil},
+		// The DC tables have L = 2 and U = 6, and the AC tables have Kx = 2
+		// and 40.
+		{"conditioning", rgba, &Options{Quality: 95}, []byte{0x00, 0x62, 0x01, 0x31, 0x10, 2, 0x11, 40}},
+		{"progressive/conditioning", rgba, &Options{Quality: 95, Progressive: true}, []byte{0x00, 0x62, 0x01, 0x31, 0x10, 2, 0x11, 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The Huffman-coded image has the same coefficients.
+			var buf bytes.Buffer
+			if err := Encode(&buf, tt.m, tt.o); err != nil {
+				t.Fatal(err)
+			}
+			want, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := encodeArith(t, tt.m, tt.o, tt.dac)
+			got, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("got bounds %v, want %v", got.Bounds(), want.Bounds())
+			}
+			b := want.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got.At(x, y) != want.At(x, y) {
+						t.Fatalf("(%d, %d): got %v, want %v", x, y, got.At(x, y), want.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeArithmetic_Libjpeg(t *testing.T) {
+	// The arithmetic-coded files are transcoded by libjpeg-turbo from the
+	// Huffman-coded ones, so they have the same coefficients.
+	// The restart files have the restart interval of 3 MCUs, and non-default
+	// conditioning parameters in their DAC segments.
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"video-001.q50.420.arith.jpeg", "video-001.q50.420.jpeg"},
+		{"video-001.q50.420.arith.progressive.jpeg", "video-001.q50.420.jpeg"},
+		{"video-001.q50.420.arith.restart.jpeg", "video-001.q50.420.jpeg"},
+		{"video-001.q50.420.arith.restart.progressive.jpeg", "video-001.q50.420.jpeg"},
+		{"video-005.gray.q50.arith.progressive.jpeg", "video-005.gray.q50.jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			got, err := decodeFile("../testdata/" + tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := decodeFile("../testdata/" + tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalPlanes(got, want) {
+				t.Error("the images differ")
+			}
+		})
+	}
+}
+
+func TestDecodeArithmetic_TrailingZeros(t *testing.T) {
+	m := arithTestImage(48, 32)
+	o := &Options{Quality: 90, RestartInterval: 1}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, o); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encoder omits the trailing zero bytes of each restart interval, but
+	// it may also write them.
+	data := encodeArith(t, m, o, nil)
+	for n := uint8(0); n < 8; n++ {
+		data = bytes.ReplaceAll(data, []byte{0xff, rst0Marker + n}, []byte{0x00, 0x00, 0x00, 0xff, rst0Marker + n})
+	}
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if got.At(x, y) != want.At(x, y) {
+				t.Fatalf("(%d, %d): got %v, want %v", x, y, got.At(x, y), want.At(x, y))
+			}
+		}
+	}
+}
+
+func TestDecodeArithmetic_Truncated(t *testing.T) {
+	m := arithTestImage(32, 32)
+	data := encodeArith(t, m, &Options{Quality: 90}, nil)
+	// Drop the data after the first half of the scan.
+	sos := bytes.Index(data, []byte{0xff, sosMarker})
+	data = data[:sos+(len(data)-sos)/2]
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestDecodeArithmetic_BadDAC(t *testing.T) {
+	m := arithTestImage(16, 16)
+	tests := []struct {
+		name string
+		dac  []byte
+	}{
+		{"L > U", []byte{0x00, 0x23}},
+		{"Kx = 0", []byte{0x10, 0}},
+		{"Kx = 64", []byte{0x10, 64}},
+		{"bad Tb", []byte{0x04, 0x10}},
+		{"bad Tc", []byte{0x20, 0x10}},
+		{"odd length", []byte{0x00, 0x10, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The encoder uses the default conditioning for the invalid tables.
+			data := encodeArith(t, m, &Options{Quality: 90}, tt.dac)
+			if _, err := Decode(bytes.NewReader(data)); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+)
+
+// Block is a block of 8x8 quantized DCT coefficients in natural (not zig-zag)
+// order: the element 8*v+u is the coefficient whose horizontal frequency is
+// u and vertical frequency is v. The DCT coefficient is the product of the
+// quantized coefficient and the quantizer of the same position in the
+// QuantTable.
+type Block [blockSize]int32
+
+// Coefficients are the quantized DCT coefficients of a JPEG image, with the
+// quantization tables and the sampling factors needed to interpret them.
+type Coefficients struct {
+	// Width and Height are the size of the image in pixels.
+	Width, Height int
+
+	// Precision is the sample precision in bits, which is 8 or 12.
+	Precision int
+
+	// Components are the components of the image, in the order of the frame
+	// header.
+	Components []ComponentCoefficients
+
+	// Adobe reports whether the image has the Adobe APP14 marker, and
+	// AdobeTransform is the color transform flag of the marker:
+	// 0 for RGB or CMYK, 1 for YCbCr, and 2 for YCCK.
+	Adobe          bool
+	AdobeTransform uint8
+}
+
+// ComponentCoefficients are the quantized DCT coefficients of a component.
+type ComponentCoefficients struct {
+	// ID is the component identifier.
+	ID uint8
+
+	// H and V are the horizontal and vertical sampling factors. Those of the
+	// first component are the largest, and divisible by those of the others.
+	H, V int
+
+	// QuantTable is the quantization table of the component. The components
+	// that share a table share the pointer too.
+	QuantTable *QuantTable
+
+	// BlocksWide and BlocksHigh are the numbers of the blocks in a row and in
+	// a column. The blocks cover the whole MCUs (Minimum Coded Units), so the
+	// blocks at the right and bottom edges may be outside the image.
+	BlocksWide, BlocksHigh int
+
+	// Blocks are the blocks of the component in raster order.
+	Blocks []Block
+}
+
+// DecodeCoefficients reads a JPEG image from r and returns its quantized DCT
+// coefficients, without the IDCT and the color conversion.
+// Lossless images aren't supported, because they have no DCT coefficients.
+func DecodeCoefficients(r io.Reader) (*Coefficients, error) {
+	var d decoder
+	d.coeffsOnly = true
+	if err := d.processSegments(r); err != nil {
+		return nil, err
+	}
+	return d.coefficients()
+}
+
+// coefficients returns the coefficients saved by the decoder in the
+// coeffsOnly mode. The blocks are shared with the decoder.
+func (d *decoder) coefficients() (*Coefficients, error) {
+	scanned := false
+	for _, b := range d.progCoeffs[:d.nComp] {
+		scanned = scanned || b != nil
+	}
+	if !scanned {
+		return nil, FormatError("missing SOS marker")
+	}
+
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	mxx := (d.width + 8*h0 - 1) / (8 * h0)
+	myy := (d.height + 8*v0 - 1) / (8 * v0)
+	c := &Coefficients{
+		Width:          d.width,
+		Height:         d.height,
+		Precision:      d.precision,
+		Components:     make([]ComponentCoefficients, d.nComp),
+		Adobe:          d.adobeTransformValid,
+		AdobeTransform: d.adobeTransform,
+	}
+	var quant [maxTq + 1]*QuantTable
+	for i, comp := range d.comp[:d.nComp] {
+		q := quant[comp.tq]
+		if q == nil {
+			q = new(QuantTable)
+			for zig, x := range d.quant[comp.tq] {
+				q[unzig[zig]] = uint16(x)
+			}
+			quant[comp.tq] = q
+		}
+		blocks := d.progCoeffs[i]
+		if blocks == nil {
+			// The component has no scans.
+			blocks = make([]Block, mxx*myy*comp.h*comp.v)
+		}
+		c.Components[i] = ComponentCoefficients{
+			ID:         comp.c,
+			H:          comp.h,
+			V:          comp.v,
+			QuantTable: q,
+			BlocksWide: mxx * comp.h,
+			BlocksHigh: myy * comp.v,
+			Blocks:     blocks,
+		}
+	}
+	return c, nil
+}
+
+// EncodeCoefficients writes the quantized DCT coefficients c to w as a JPEG
+// image with the given options. The Progressive, ScanScript,
+// OptimizeHuffman, RestartInterval and RestartRows fields of the options are
+// used, and the others are ignored. Default parameters are used if a nil
+// *Options is passed.
+//
+// The coefficients must have 8-bit precision, and at most two quantization
+// tables. They are in the range from -1024 to 1023 for the DC coefficients,
+// and from -1023 to 1023 for the AC coefficients. The Adobe APP14 marker is
+// written if c.Adobe is true.
+//
+// The progressive format doesn't code the AC coefficients of the blocks
+// outside the image, so they are decoded as zeros.
+func EncodeCoefficients(w io.Writer, c *Coefficients, o *Options) error {
+	var e encoder
+	if err := e.initCoefficients(w, c, o); err != nil {
+		return err
+	}
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	// Write the image.
+	if c.Adobe {
+		e.writeAdobeTransform(c.AdobeTransform)
+	}
+	e.writeCoeffs()
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
+
+// initCoefficients initializes the encoder to write the coefficients c to w
+// with the given options. The blocks are shared with c.
+func (e *encoder) initCoefficients(w io.Writer, c *Coefficients, o *Options) error {
+	if c.Width <= 0 || c.Height <= 0 {
+		return errors.New("jpeg: invalid image size")
+	}
+	if c.Width >= 1<<16 || c.Height >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+	if c.Precision != 8 {
+		return errors.New("jpeg: unsupported precision")
+	}
+	if n := len(c.Components); n != 1 && n != 3 && n != 4 {
+		return errors.New("jpeg: invalid number of components")
+	}
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	e.size = image.Pt(c.Width, c.Height)
+	e.nComp = len(c.Components)
+
+	// The encoder has two quantization tables, which are shared by the
+	// components in the order of their first use.
+	nQuant := 0
+	totalHV := 0
+	c0 := &c.Components[0]
+	for i := range c.Components {
+		cc := &c.Components[i]
+		if cc.QuantTable == nil {
+			return errors.New("jpeg: invalid quantization table")
+		}
+		var q [blockSize]uint16
+		for zig := range q {
+			q[zig] = cc.QuantTable[unzig[zig]]
+			if q[zig] == 0 {
+				return errors.New("jpeg: invalid quantization table")
+			}
+		}
+		tq := 0
+		for tq < nQuant && e.quant[tq] != q {
+			tq++
+		}
+		if tq == nQuant {
+			if nQuant == int(nQuantIndex) {
+				return errors.New("jpeg: more than two quantization tables")
+			}
+			e.quant[tq] = q
+			nQuant++
+		}
+
+		if cc.H < 1 || cc.H > 4 || cc.V < 1 || cc.V > 4 || cc.H == 3 || cc.V == 3 ||
+			c0.H%cc.H != 0 || c0.V%cc.V != 0 {
+			return errors.New("jpeg: invalid sampling factors")
+		}
+		totalHV += cc.H * cc.V
+		for _, prev := range c.Components[:i] {
+			if prev.ID == cc.ID {
+				return errors.New("jpeg: repeated component identifier")
+			}
+		}
+		e.comp[i] = component{h: cc.H, v: cc.V, c: cc.ID, tq: uint8(tq)}
+	}
+	if nQuant == 1 {
+		// Both tables are written, so the unused one is a copy.
+		e.quant[1] = e.quant[0]
+	}
+	if e.nComp > 1 && totalHV > 10 {
+		// The interleaved scans can't have more than 10 blocks in an MCU,
+		// as per section B.2.3.
+		return errors.New("jpeg: invalid sampling factors")
+	}
+
+	mxx, myy := e.mcuSize(e.size)
+	for i, cc := range c.Components {
+		if cc.BlocksWide != mxx*cc.H || cc.BlocksHigh != myy*cc.V || len(cc.Blocks) != cc.BlocksWide*cc.BlocksHigh {
+			return errors.New("jpeg: invalid number of blocks")
+		}
+		// These are the limits of libjpeg, which the standard Huffman tables
+		// can encode.
+		for j := range cc.Blocks {
+			b := &cc.Blocks[j]
+			if b[0] < -1024 || b[0] > 1023 {
+				return errors.New("jpeg: DCT coefficient out of range")
+			}
+			for _, x := range b[1:] {
+				if x < -1023 || x > 1023 {
+					return errors.New("jpeg: DCT coefficient out of range")
+				}
+			}
+		}
+		e.coeffs[i] = cc.Blocks
+	}
+	return e.initCoding(o)
+}
@@ -0,0 +1,263 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func decodeFileCoefficients(t *testing.T, filename string) (*Coefficients, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DecodeCoefficients(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, data
+}
+
+// reconstructPlane returns the samples of the component cc, reconstructed in
+// the same way as the decoder.
+func reconstructPlane(cc *ComponentCoefficients) (pix []byte, stride int) {
+	stride = 8 * cc.BlocksWide
+	pix = make([]byte, stride*8*cc.BlocksHigh)
+	for by := 0; by < cc.BlocksHigh; by++ {
+		for bx := 0; bx < cc.BlocksWide; bx++ {
+			b := cc.Blocks[by*cc.BlocksWide+bx]
+			for i := range b {
+				b[i] *= int32(cc.QuantTable[i])
+			}
+			idct(&b)
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					pix[(8*by+y)*stride+8*bx+x] = uint8(min(max(b[8*y+x]+128, 0), 255))
+				}
+			}
+		}
+	}
+	return pix, stride
+}
+
+func TestDecodeCoefficients(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.q50.420.jpeg",
+		"../testdata/video-001.q50.420.progressive.jpeg",
+	} {
+		c, data := decodeFileCoefficients(t, filename)
+		if c.Width != 150 || c.Height != 103 || c.Precision != 8 || c.Adobe {
+			t.Errorf("%s: got %dx%d, precision %d, Adobe %v", filename, c.Width, c.Height, c.Precision, c.Adobe)
+		}
+		if len(c.Components) != 3 {
+			t.Fatalf("%s: got %d components, want 3", filename, len(c.Components))
+		}
+		want := []struct {
+			id                     uint8
+			h, v                   int
+			blocksWide, blocksHigh int
+		}{
+			{1, 2, 2, 20, 14},
+			{2, 1, 1, 10, 7},
+			{3, 1, 1, 10, 7},
+		}
+		for i, w := range want {
+			cc := &c.Components[i]
+			if cc.ID != w.id || cc.H != w.h || cc.V != w.v || cc.BlocksWide != w.blocksWide || cc.BlocksHigh != w.blocksHigh {
+				t.Errorf("%s: component %d: got id %d, %dx%d sampling, %dx%d blocks", filename, i, cc.ID, cc.H, cc.V, cc.BlocksWide, cc.BlocksHigh)
+			}
+			if len(cc.Blocks) != cc.BlocksWide*cc.BlocksHigh {
+				t.Errorf("%s: component %d: got %d blocks", filename, i, len(cc.Blocks))
+			}
+		}
+		if c.Components[1].QuantTable != c.Components[2].QuantTable {
+			t.Errorf("%s: Cb and Cr don't share the quantization table", filename)
+		}
+
+		// The coefficients reconstruct the decoded image.
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range testPlanes(m) {
+			pix, stride := reconstructPlane(&c.Components[i])
+			for y := 0; y < p.h; y++ {
+				for x := 0; x < p.w; x++ {
+					if got, want := float64(pix[y*stride+x]), p.at(x, y); got != want {
+						t.Fatalf("%s: component %d: (%d, %d): got %v, want %v", filename, i, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// equalPlanes reports whether the images m0 and m1 have the same samples.
+// The samples outside the bounds aren't compared.
+func equalPlanes(m0, m1 image.Image) bool {
+	p0, p1 := testPlanes(m0), testPlanes(m1)
+	if len(p0) != len(p1) {
+		return false
+	}
+	for i := range p0 {
+		if p0[i].w != p1[i].w || p0[i].h != p1[i].h {
+			return false
+		}
+		for y := 0; y < p0[i].h; y++ {
+			for x := 0; x < p0[i].w; x++ {
+				if p0[i].at(x, y) != p1[i].at(x, y) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestEncodeCoefficients(t *testing.T) {
+	tests := []struct {
+		filename string
+		o        *Options
+	}{
+		{"../testdata/video-001.q50.420.jpeg", nil},
+		{"../testdata/video-001.q50.420.progressive.jpeg", &Options{OptimizeHuffman: true}},
+		{"../testdata/video-001.q50.422.jpeg", &Options{Progressive: true}},
+		{"../testdata/video-001.221212.jpeg", &Options{Progressive: true, OptimizeHuffman: true, RestartInterval: 3}},
+		{"../testdata/video-001.cmyk.jpeg", &Options{RestartRows: 1}},
+		{"../testdata/video-001.rgb.jpeg", nil},
+		{"../testdata/video-005.gray.q50.jpeg", &Options{Progressive: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			c, data := decodeFileCoefficients(t, tt.filename)
+			var buf bytes.Buffer
+			if err := EncodeCoefficients(&buf, c, tt.o); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.Bytes()
+
+			got, err := DecodeCoefficients(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c) {
+				t.Fatal("the coefficients differ")
+			}
+
+			// The images are the same too.
+			want, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalPlanes(m, want) {
+				t.Fatal("the images differ")
+			}
+		})
+	}
+}
+
+func TestEncodeCoefficients_Requantize(t *testing.T) {
+	c, _ := decodeFileCoefficients(t, "../testdata/video-005.gray.jpeg")
+	// Doubling the quantizers halves the resolution of the coefficients.
+	cc := &c.Components[0]
+	q := *cc.QuantTable
+	for i := range q {
+		q[i] *= 2
+	}
+	for i := range cc.Blocks {
+		for j, x := range cc.Blocks[i] {
+			cc.Blocks[i][j] = div(x, 2)
+		}
+	}
+	cc.QuantTable = &q
+
+	var buf bytes.Buffer
+	if err := EncodeCoefficients(&buf, c, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeCoefficients(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got.Components[0].QuantTable != q {
+		t.Errorf("got quantization table %v, want %v", *got.Components[0].QuantTable, q)
+	}
+	if !reflect.DeepEqual(got.Components[0].Blocks, cc.Blocks) {
+		t.Error("the coefficients differ")
+	}
+}
+
+func TestEncodeCoefficients_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Coefficients)
+		want   string
+	}{
+		{"size", func(c *Coefficients) { c.Width = 0 }, "jpeg: invalid image size"},
+		{"too large", func(c *Coefficients) { c.Height = 1 << 16 }, "jpeg: image is too large to encode"},
+		{"precision", func(c *Coefficients) { c.Precision = 12 }, "jpeg: unsupported precision"},
+		{"components", func(c *Coefficients) { c.Components = c.Components[:2] }, "jpeg: invalid number of components"},
+		{"nil table", func(c *Coefficients) { c.Components[1].QuantTable = nil }, "jpeg: invalid quantization table"},
+		{"zero quantizer", func(c *Coefficients) {
+			q := *c.Components[1].QuantTable
+			q[63] = 0
+			c.Components[1].QuantTable = &q
+		}, "jpeg: invalid quantization table"},
+		{"three tables", func(c *Coefficients) {
+			q := *c.Components[2].QuantTable
+			q[63]++
+			c.Components[2].QuantTable = &q
+		}, "jpeg: more than two quantization tables"},
+		{"sampling", func(c *Coefficients) { c.Components[1].H = 3 }, "jpeg: invalid sampling factors"},
+		{"not divisible", func(c *Coefficients) { c.Components[1].H = 4 }, "jpeg: invalid sampling factors"},
+		{"total sampling", func(c *Coefficients) {
+			c.Components[1].H, c.Components[1].V = 2, 2
+			c.Components[2].H, c.Components[2].V = 2, 2
+		}, "jpeg: invalid sampling factors"},
+		{"identifier", func(c *Coefficients) { c.Components[2].ID = c.Components[1].ID }, "jpeg: repeated component identifier"},
+		{"blocks", func(c *Coefficients) { c.Components[1].Blocks = c.Components[1].Blocks[1:] }, "jpeg: invalid number of blocks"},
+		{"blocks wide", func(c *Coefficients) { c.Components[2].BlocksWide++ }, "jpeg: invalid number of blocks"},
+		{"DC", func(c *Coefficients) { c.Components[0].Blocks[5][0] = 1024 }, "jpeg: DCT coefficient out of range"},
+		{"AC", func(c *Coefficients) { c.Components[2].Blocks[5][63] = -1024 }, "jpeg: DCT coefficient out of range"},
+		{"scan script", func(c *Coefficients) {}, "jpeg: empty scan script"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := decodeFileCoefficients(t, "../testdata/video-001.q50.420.jpeg")
+			tt.modify(c)
+			o := &Options{Progressive: tt.name == "scan script", ScanScript: []Scan{}}
+			err := EncodeCoefficients(new(bytes.Buffer), c, o)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCoefficients_Errors(t *testing.T) {
+	samples := [][]uint16{make([]uint16, 16*16)}
+	data := encodeLossless(samples, 16, 16, 8, 1, 0, 0, []byte{1})
+	_, err := DecodeCoefficients(bytes.NewReader(data))
+	if want := UnsupportedError("DCT coefficients of lossless image"); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	// The image ends before the first scan.
+	data, err = os.ReadFile("../testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte{0xff, sosMarker})
+	data = append(data[:i:i], 0xff, eoiMarker)
+	_, err = DecodeCoefficients(bytes.NewReader(data))
+	if want := FormatError("missing SOS marker"); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
@@ -4,6 +4,8 @@
 
 package jpeg
 
+import "math"
+
 // This is a Go translation of idct.c from
 //
 // http://standards.iso.org/ittf/PubliclyAvailableStandards/ISO_IEC_13818-4_2004_Conformance_Testing/Video/verifier/mpeg2decode_960109.tar.gz
@@ -39,7 +41,9 @@ package jpeg
 
 const blockSize = 64 // A DCT block is 8x8.
 
-type block [blockSize]int32
+// block is the DCT block used internally. It is the same type as Block, so
+// that the decoded coefficients are exposed without copying.
+type block = Block
 
 const (
 	w1 = 2841 // 2048*sqrt(2)*cos(1*pi/16)
@@ -192,3 +196,99 @@ func idct(src *block) {
 		s[8*7] = (y7 - y1) >> 14
 	}
 }
+
+// idctCos[x][u] is C(u)/2 * cos((2x+1)*u*pi/16), where C(0) is 1/sqrt(2) and
+// C(u) is 1 otherwise, as specified in section A.3.3.
+var idctCos [8][8]float64
+
+func init() {
+	for x := range idctCos {
+		for u := range idctCos[x] {
+			c := math.Cos(float64((2*x+1)*u) * math.Pi / 16)
+			if u == 0 {
+				c /= math.Sqrt2
+			}
+			idctCos[x][u] = c / 2
+		}
+	}
+}
+
+// idctFloat performs a 2-D Inverse Discrete Cosine Transformation in floating
+// point, rounding the results to the nearest integers. It is slower than idct,
+// but has no overflow for the coefficients of 12-bit samples.
+func idctFloat(src *block) {
+	var tmp [blockSize]float64
+	// Horizontal 1-D IDCT.
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			var sum float64
+			for u := 0; u < 8; u++ {
+				sum += idctCos[x][u] * float64(src[8*y+u])
+			}
+			tmp[8*y+x] = sum
+		}
+	}
+	// Vertical 1-D IDCT.
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			var sum float64
+			for v := 0; v < 8; v++ {
+				sum += idctCos[y][v] * tmp[8*v+x]
+			}
+			src[8*y+x] = int32(math.Round(sum))
+		}
+	}
+}
+
+// idctScaledCos[n][x][u] is C(u)/2 * cos((2x+1)*u*pi/(2n)), for the
+// reduced-size IDCTs of n = 2 and 4 points.
+var idctScaledCos [5][4][4]float64
+
+func init() {
+	for _, n := range []int{2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				c := math.Cos(float64((2*x+1)*u) * math.Pi / float64(2*n))
+				if u == 0 {
+					c /= math.Sqrt2
+				}
+				idctScaledCos[n][x][u] = c / 2
+			}
+		}
+	}
+}
+
+// idctScaled performs a reduced-size 2-D Inverse Discrete Cosine Transformation
+// that reconstructs n×n samples from the n×n lowest frequency coefficients,
+// where n is 4, 2 or 1. The samples are the full-size inverse DCT of those
+// coefficients at the centers of the (8/n)×(8/n) pixel areas, and they are
+// stored in the top-left n×n corner of src.
+func idctScaled(src *block, n int) {
+	if n == 1 {
+		// The DC coefficient is 8 times the average of the samples.
+		src[0] = (src[0] + 4) >> 3
+		return
+	}
+	cos := &idctScaledCos[n]
+	var tmp [4 * 4]float64
+	// Horizontal 1-D IDCT.
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var sum float64
+			for u := 0; u < n; u++ {
+				sum += cos[x][u] * float64(src[8*y+u])
+			}
+			tmp[4*y+x] = sum
+		}
+	}
+	// Vertical 1-D IDCT.
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			var sum float64
+			for v := 0; v < n; v++ {
+				sum += cos[y][v] * tmp[4*v+x]
+			}
+			src[8*y+x] = int32(math.Round(sum))
+		}
+	}
+}
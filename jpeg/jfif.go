@@ -0,0 +1,73 @@
+package jpeg
+
+import "strconv"
+
+// JFIF is the JFIF APP0 header of an image.
+type JFIF struct {
+	// MajorVersion and MinorVersion are the version of JFIF,
+	// such as 1 and 2 for the version 1.02.
+	MajorVersion, MinorVersion uint8
+
+	// Unit is the unit of XDensity and YDensity.
+	Unit DensityUnit
+
+	// XDensity and YDensity are the horizontal and vertical pixel densities.
+	// If Unit is DensityUnitNone, they specify only the pixel aspect ratio.
+	XDensity, YDensity uint16
+}
+
+// DensityUnit is the unit of the pixel densities of the JFIF header.
+type DensityUnit uint8
+
+const (
+	// DensityUnitNone means that the densities specify only the pixel aspect ratio.
+	DensityUnitNone DensityUnit = 0
+
+	// DensityUnitInch means that the densities are in dots per inch.
+	DensityUnitInch DensityUnit = 1
+
+	// DensityUnitCentimeter means that the densities are in dots per centimeter.
+	DensityUnitCentimeter DensityUnit = 2
+)
+
+func (u DensityUnit) String() string {
+	switch u {
+	case DensityUnitNone:
+		return "None"
+	case DensityUnitInch:
+		return "Inch"
+	case DensityUnitCentimeter:
+		return "Centimeter"
+	default:
+		return "Unknown DensityUnit: " + strconv.Itoa(int(u))
+	}
+}
+
+const jfifName = "JFIF\x00"
+
+// writeJFIF writes the JFIF APP0 segment without a thumbnail.
+// The densities are written as is, even if they are zero, so that the
+// headers DecodeWithMeta returns can be written back.
+func (e *encoder) writeJFIF(j *JFIF) {
+	if e.err != nil {
+		return
+	}
+
+	const segmentSize = 2 + len(jfifName) + 9
+	e.buf[0] = 0xff
+	e.buf[1] = app0Marker
+	e.buf[2] = 0
+	e.buf[3] = byte(segmentSize)
+	copy(e.buf[4:], jfifName)
+	b := e.buf[4+len(jfifName):]
+	b[0] = j.MajorVersion
+	b[1] = j.MinorVersion
+	b[2] = uint8(j.Unit)
+	b[3] = uint8(j.XDensity >> 8)
+	b[4] = uint8(j.XDensity)
+	b[5] = uint8(j.YDensity >> 8)
+	b[6] = uint8(j.YDensity)
+	b[7] = 0 // the width of the thumbnail
+	b[8] = 0 // the height of the thumbnail
+	e.write(e.buf[:2+segmentSize])
+}
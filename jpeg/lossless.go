@@ -0,0 +1,139 @@
+package jpeg
+
+// processLosslessSOS decodes the scan of a lossless image, as specified in
+// annex H. predictor is the selection value of the predictor, and pt is the
+// point transform.
+func (d *decoder) processLosslessSOS(scan []scanComponent, predictor, pt uint8) error {
+	if predictor < 1 || 7 < predictor {
+		// The predictor 0 is only for the hierarchical mode.
+		return FormatError("bad predictor")
+	}
+	if int(pt) >= d.precision {
+		return FormatError("bad point transform")
+	}
+
+	// mxx and myy are the number of MCUs in the image. An MCU has h*v samples
+	// of each component.
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	mxx := (d.width + h0 - 1) / h0
+	myy := (d.height + v0 - 1) / v0
+	if d.pix16[0] == nil {
+		d.makeImg(mxx, myy)
+	}
+	interleaved := len(scan) != 1
+	if !interleaved {
+		// A non-interleaved scan covers only the samples inside the component,
+		// and each sample is an MCU on its own.
+		c := d.comp[scan[0].compIndex]
+		mxx = (d.width*c.h + h0 - 1) / h0
+		myy = (d.height*c.v + v0 - 1) / v0
+	}
+	if d.ri > 0 && d.ri%mxx != 0 {
+		// The prediction is reset at each restart interval as if it were the
+		// start of the scan, which works only at the start of a row.
+		return UnsupportedError("restart interval in the middle of a row")
+	}
+
+	// initial is the prediction of the first sample of the scan and of each
+	// restart interval.
+	initial := int32(1) << (d.precision - int(pt) - 1)
+	d.bits = bits{}
+	mcu, expectedRST := 0, uint8(rst0Marker)
+	// firstRow is the first row of MCUs of the current restart interval.
+	firstRow := 0
+	var dc [maxComponents]int32
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			for _, s := range scan {
+				ci := s.compIndex
+				h, v := 1, 1
+				if interleaved {
+					h, v = d.comp[ci].h, d.comp[ci].v
+				}
+				pix, stride := d.pix16[ci], d.stride16[ci]
+				for j := 0; j < h*v; j++ {
+					x := h*mx + j%h
+					y := v*my + j/h
+					i := y*stride + x
+
+					// Predict the sample from its neighbors, as specified in section
+					// H.1.2.1. Ra is the left sample, Rb is the upper sample and Rc
+					// is the upper left sample.
+					var px int32
+					switch {
+					case y == v*firstRow && x == 0:
+						px = initial
+					case y == v*firstRow:
+						px = int32(pix[i-1])
+					case x == 0:
+						px = int32(pix[i-stride])
+					default:
+						px = predict(predictor, int32(pix[i-1]), int32(pix[i-stride]), int32(pix[i-stride-1]))
+					}
+
+					// Decode the difference, as specified in section H.1.2.2.
+					t, err := d.decodeHuffman(&d.huff[dcTable][s.td])
+					if err != nil {
+						return err
+					}
+					var diff int32
+					switch {
+					case t > 16:
+						return FormatError("bad difference category")
+					case t == 16:
+						// The difference 32768 has no additional bits.
+						diff = 32768
+					default:
+						diff, err = d.receiveExtend(t)
+						if err != nil {
+							return err
+						}
+					}
+					// The sum is computed modulo 2^16.
+					pix[i] = uint16(px + diff)
+				}
+			}
+
+			mcu++
+			if d.ri > 0 && mcu%d.ri == 0 && mcu < mxx*myy {
+				if err := d.processRST(&expectedRST, &dc); err != nil {
+					return err
+				}
+				firstRow = my + 1
+			}
+		}
+	}
+
+	// Undo the point transform.
+	if pt > 0 {
+		for _, s := range scan {
+			pix := d.pix16[s.compIndex]
+			for i := range pix {
+				pix[i] <<= pt
+			}
+		}
+	}
+	return nil
+}
+
+// predict returns the prediction of a sample from its neighbors, as specified
+// in table H.1. ra is the left sample, rb is the upper sample and rc is the
+// upper left sample.
+func predict(predictor uint8, ra, rb, rc int32) int32 {
+	switch predictor {
+	case 1:
+		return ra
+	case 2:
+		return rb
+	case 3:
+		return rc
+	case 4:
+		return ra + rb - rc
+	case 5:
+		return ra + (rb-rc)>>1
+	case 6:
+		return rb + (ra-rc)>>1
+	default:
+		return (ra + rb) >> 1
+	}
+}
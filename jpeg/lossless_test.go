@@ -0,0 +1,283 @@
+package jpeg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// fullHuffmanSpec returns a Huffman encoding specification that has codes
+// for all the values less than n.
+func fullHuffmanSpec(n int) huffmanSpec {
+	var freq [256]int
+	for i := 0; i < n; i++ {
+		freq[i] = 1
+	}
+	return optimalHuffmanSpec(&freq)
+}
+
+// writeTestSOF writes a Start Of Frame marker of the given precision, whose
+// components have no subsampling and use the quantization table 0.
+func writeTestSOF(e *encoder, marker uint8, precision, width, height int, ids []byte) {
+	e.writeMarkerHeader(marker, 8+3*len(ids))
+	e.write([]byte{uint8(precision), uint8(height >> 8), uint8(height), uint8(width >> 8), uint8(width), uint8(len(ids))})
+	for _, id := range ids {
+		e.write([]byte{id, 0x11, 0})
+	}
+}
+
+// encodeLossless encodes the samples in the lossless mode, with one
+// interleaved scan. samples[i] are the samples of the i'th component in
+// raster order.
+func encodeLossless(samples [][]uint16, width, height, precision int, predictor, pt uint8, ri int, ids []byte) []byte {
+	var buf bytes.Buffer
+	var e encoder
+	e.w = bufio.NewWriter(&buf)
+	e.write([]byte{0xff, soiMarker})
+	writeTestSOF(&e, sof3Marker, precision, width, height, ids)
+	// The differences have the categories from 0 to 16.
+	e.huffSpec[huffIndexLuminanceDC] = fullHuffmanSpec(17)
+	e.huffLUT[huffIndexLuminanceDC].init(e.huffSpec[huffIndexLuminanceDC])
+	e.writeDHT([]huffIndex{huffIndexLuminanceDC})
+	if ri > 0 {
+		e.ri = ri
+		e.writeDRI()
+	}
+	e.writeMarkerHeader(sosMarker, 6+2*len(ids))
+	e.writeByte(uint8(len(ids)))
+	for _, id := range ids {
+		e.write([]byte{id, 0x00})
+	}
+	e.write([]byte{predictor, 0, pt})
+
+	firstRow := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for _, s := range samples {
+				at := func(x, y int) int32 { return int32(s[y*width+x] >> pt) }
+				var px int32
+				switch {
+				case y == firstRow && x == 0:
+					px = 1 << (precision - int(pt) - 1)
+				case y == firstRow:
+					px = at(x-1, y)
+				case x == 0:
+					px = at(x, y-1)
+				default:
+					px = predict(predictor, at(x-1, y), at(x, y-1), at(x-1, y-1))
+				}
+				// The difference is coded modulo 2^16.
+				diff := int32(int16(uint16(at(x, y) - px)))
+				if diff == -32768 {
+					e.emitHuff(huffIndexLuminanceDC, 16)
+				} else {
+					e.emitHuffRLE(huffIndexLuminanceDC, 0, diff)
+				}
+			}
+			if mcu := y*width + x + 1; ri > 0 && mcu%ri == 0 && mcu < width*height {
+				e.restart(huffIndexLuminanceDC, mcu/ri-1)
+				firstRow = y + 1
+			}
+		}
+	}
+	e.padBits()
+	e.write([]byte{0xff, eoiMarker})
+	e.flush()
+	return buf.Bytes()
+}
+
+func TestDecodeLossless(t *testing.T) {
+	const width, height = 29, 13
+	rnd := rand.New(rand.NewSource(1))
+	random := func(precision int) []uint16 {
+		s := make([]uint16, width*height)
+		for i := range s {
+			s[i] = uint16(rnd.Intn(1 << precision))
+		}
+		return s
+	}
+	smooth := func(precision int) []uint16 {
+		s := make([]uint16, width*height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				s[y*width+x] = uint16((x*37 + y*101 + rnd.Intn(16)) % (1 << precision))
+			}
+		}
+		return s
+	}
+
+	for predictor := uint8(1); predictor <= 7; predictor++ {
+		for _, precision := range []int{8, 12, 16} {
+			// The random samples have the largest differences.
+			for _, samples := range [][]uint16{random(precision), smooth(precision)} {
+				data := encodeLossless([][]uint16{samples}, width, height, precision, predictor, 0, 0, []byte{1})
+				m, err := Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("predictor %d, precision %d: %v", predictor, precision, err)
+				}
+				gray, ok := m.(*image.Gray16)
+				if !ok {
+					t.Fatalf("got %T, want *image.Gray16", m)
+				}
+				if err := checkGray16(gray, samples, precision); err != nil {
+					t.Errorf("predictor %d, precision %d: %v", predictor, precision, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeLossless_KnownAnswer(t *testing.T) {
+	// The file is assembled by hand from annex H, independently of the
+	// decoder. It is a 4x3 8-bit image with the predictor 4 and the restart
+	// interval of two rows, so that the third row is predicted as the first
+	// row of the scan. The differences are
+	// -28, 2, -1, 4 / -2, 3, 2, -4 / RST0 / -8, -2, 1, 2.
+	m, err := decodeFile("../testdata/tiny.lossless.predictor4.restart.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := m.(*image.Gray16)
+	if !ok {
+		t.Fatalf("got %T, want *image.Gray16", m)
+	}
+	want := []uint16{
+		100, 102, 101, 105,
+		98, 103, 104, 104,
+		120, 118, 119, 121,
+	}
+	if err := checkGray16(gray, want, 8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeLossless_PointTransform(t *testing.T) {
+	const width, height = 17, 9
+	samples := make([]uint16, width*height)
+	for i := range samples {
+		// The point transform drops the 3 least significant bits.
+		samples[i] = uint16(i*53%4096) &^ 7
+	}
+	data := encodeLossless([][]uint16{samples}, width, height, 12, 6, 3, 0, []byte{1})
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGray16(m.(*image.Gray16), samples, 12); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeLossless_RestartInterval(t *testing.T) {
+	const width, height = 11, 7
+	samples := make([]uint16, width*height)
+	for i := range samples {
+		samples[i] = uint16(i * 7919 % 65536)
+	}
+	data := encodeLossless([][]uint16{samples}, width, height, 16, 4, 0, 2*width, []byte{1})
+	if !bytes.Contains(data, []byte{0xff, rst0Marker + 2}) {
+		t.Fatal("RST markers are not found")
+	}
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGray16(m.(*image.Gray16), samples, 16); err != nil {
+		t.Error(err)
+	}
+
+	// The restart intervals must start at the start of a row.
+	data = bytes.Replace(data, []byte{0xff, driMarker, 0x00, 0x04, 0x00, 2 * width}, []byte{0xff, driMarker, 0x00, 0x04, 0x00, 3}, 1)
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestDecodeLossless_Color(t *testing.T) {
+	const width, height = 19, 11
+	var samples [3][]uint16
+	for i := range samples {
+		samples[i] = make([]uint16, width*height)
+		for j := range samples[i] {
+			samples[i][j] = uint16((j*(i+3) + 50*i) % 256)
+		}
+	}
+
+	t.Run("RGB", func(t *testing.T) {
+		data := encodeLossless(samples[:], width, height, 8, 1, 0, 0, []byte{'R', 'G', 'B'})
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rgba, ok := m.(*image.RGBA64)
+		if !ok {
+			t.Fatalf("got %T, want *image.RGBA64", m)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				want := color.RGBA64{samples[0][i] * 0x101, samples[1][i] * 0x101, samples[2][i] * 0x101, 0xffff}
+				if got := rgba.RGBA64At(x, y); got != want {
+					t.Fatalf("(%d, %d): got %v, want %v", x, y, got, want)
+				}
+			}
+		}
+	})
+
+	t.Run("YCbCr", func(t *testing.T) {
+		data := encodeLossless(samples[:], width, height, 8, 7, 0, 0, []byte{1, 2, 3})
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rgba, ok := m.(*image.RGBA64)
+		if !ok {
+			t.Fatalf("got %T, want *image.RGBA64", m)
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				r0, g0, b0 := color.YCbCrToRGB(uint8(samples[0][i]), uint8(samples[1][i]), uint8(samples[2][i]))
+				c := rgba.RGBA64At(x, y)
+				if delta(uint32(r0)*0x101, uint32(c.R)) > 0x101 ||
+					delta(uint32(g0)*0x101, uint32(c.G)) > 0x101 ||
+					delta(uint32(b0)*0x101, uint32(c.B)) > 0x101 {
+					t.Fatalf("(%d, %d): got %v, want %v", x, y, c, color.RGBA{r0, g0, b0, 0xff})
+				}
+			}
+		}
+	})
+}
+
+func TestDecodeConfigLossless(t *testing.T) {
+	samples := make([]uint16, 4*3)
+	data := encodeLossless([][]uint16{samples}, 4, 3, 16, 1, 0, 0, []byte{1})
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ColorModel != color.Gray16Model || cfg.Width != 4 || cfg.Height != 3 {
+		t.Errorf("got %v, %dx%d, want Gray16Model, 4x3", cfg.ColorModel, cfg.Width, cfg.Height)
+	}
+}
+
+// checkGray16 checks that the gray image has the samples of the given
+// precision, scaled to 16 bits.
+func checkGray16(m *image.Gray16, samples []uint16, precision int) error {
+	b := m.Bounds()
+	maxVal := uint32(1)<<precision - 1
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s := uint32(samples[(y-b.Min.Y)*b.Dx()+(x-b.Min.X)])
+			want := uint16((s*0xffff + maxVal/2) / maxVal)
+			if got := m.Gray16At(x, y).Y; got != want {
+				return fmt.Errorf("(%d, %d): got %#04x, want %#04x", x, y, got, want)
+			}
+		}
+	}
+	return nil
+}
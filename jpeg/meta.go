@@ -1,7 +1,6 @@
 package jpeg
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"image"
@@ -11,10 +10,35 @@ import (
 	"github.com/shogo82148/go-imaging/icc"
 )
 
+// ImageWithMeta is an image with the metadata of the JPEG file.
 type ImageWithMeta struct {
 	image.Image
+
+	// ICCProfile is the ICC profile of the image.
+	// If ICCProfile is nil, the image has no ICC profile.
 	ICCProfile *icc.Profile
-	Exif       *exif.TIFF
+
+	// Exif is the Exif metadata of the image.
+	// If Exif is nil, the image has no Exif metadata.
+	Exif *exif.TIFF
+
+	// JFIF is the JFIF header of the image.
+	// If JFIF is nil, the image has no JFIF header.
+	JFIF *JFIF
+
+	// XMP is the XMP packet of the image.
+	// If XMP is nil, the image has no XMP packet.
+	XMP []byte
+
+	// ExtendedXMP is the extended XMP serialization, which holds the
+	// properties that don't fit in the XMP packet. The XMP packet refers to it
+	// by the xmpNote:HasExtendedXMP property, whose value is
+	// ExtendedXMPGUID(ExtendedXMP).
+	// If ExtendedXMP is nil, the image has no extended XMP.
+	ExtendedXMP []byte
+
+	// Comments are the texts of the COM segments.
+	Comments []string
 }
 
 func DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
@@ -23,21 +47,80 @@ func DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 }
 
 func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
+	if err := d.processSegments(r); err != nil {
+		return nil, err
+	}
+
+	if d.progressive {
+		if err := d.reconstructProgressiveImage(); err != nil {
+			return nil, err
+		}
+	}
+
+	var img image.Image
+	var err error
+	if d.pix16[0] != nil {
+		img, err = d.convertTo16()
+	} else if d.img1 != nil {
+		img = d.img1
+	} else if d.img3 != nil {
+		if d.blackPix != nil {
+			img, err = d.applyBlack()
+		} else if d.isRGB() {
+			img, err = d.convertToRGB()
+		} else {
+			img = d.img3
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, FormatError("missing SOS marker")
+	}
+
+	m, err := d.meta()
+	if err != nil {
+		return nil, err
+	}
+	m.Image = img
+	return m, nil
+}
+
+// meta returns the metadata read by processSegments, without the image.
+func (d *decoder) meta() (*ImageWithMeta, error) {
+	iccProfile, err := d.decodeICCProfile()
+	if err != nil {
+		return nil, err
+	}
+	return &ImageWithMeta{
+		ICCProfile:  iccProfile,
+		Exif:        d.exif,
+		JFIF:        d.jfifHeader,
+		XMP:         d.xmp,
+		ExtendedXMP: d.decodeExtendedXMP(),
+		Comments:    d.comments,
+	}, nil
+}
+
+// processSegments reads the segments of r up to the End Of Image marker,
+// including the metadata and the entropy-coded data.
+func (d *decoder) processSegments(r io.Reader) error {
 	d.r = r
 
 	// Check for the Start Of Image marker.
 	if err := d.readFull(d.tmp[:2]); err != nil {
-		return nil, err
+		return err
 	}
 	if d.tmp[0] != 0xff || d.tmp[1] != soiMarker {
-		return nil, FormatError("missing SOI marker")
+		return FormatError("missing SOI marker")
 	}
 
 	// Process the remaining segments until the End Of Image marker.
 	for {
 		err := d.readFull(d.tmp[:2])
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for d.tmp[0] != 0xff {
 			// Strictly speaking, this is a format error. However, libjpeg is
@@ -63,7 +146,7 @@ func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 			d.tmp[0] = d.tmp[1]
 			d.tmp[1], err = d.readByte()
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 		marker := d.tmp[1]
@@ -76,7 +159,7 @@ func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 			// number of fill bytes, which are bytes assigned code X'FF'".
 			marker, err = d.readByte()
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 		if marker == eoiMarker { // End Of Image.
@@ -95,22 +178,26 @@ func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 		// Read the 16-bit length of the segment. The value includes the 2 bytes for the
 		// length itself, so we subtract 2 to get the number of remaining bytes.
 		if err = d.readFull(d.tmp[:2]); err != nil {
-			return nil, err
+			return err
 		}
 		n := int(d.tmp[0])<<8 + int(d.tmp[1]) - 2
 		if n < 0 {
-			return nil, FormatError("short segment length")
+			return FormatError("short segment length")
 		}
 
 		switch marker {
-		case sof0Marker, sof1Marker, sof2Marker:
+		case sof0Marker, sof1Marker, sof2Marker, sof3Marker, sof9Marker, sof10Marker:
 			d.baseline = marker == sof0Marker
-			d.progressive = marker == sof2Marker
+			d.progressive = marker == sof2Marker || marker == sof10Marker
+			d.lossless = marker == sof3Marker
+			d.arithmetic = marker == sof9Marker || marker == sof10Marker
 			err = d.processSOF(n)
 		case dhtMarker:
 			err = d.processDHT(n)
 		case dqtMarker:
 			err = d.processDQT(n)
+		case dacMarker:
+			err = d.processDAC(n)
 		case sosMarker:
 			err = d.processSOS(n)
 		case driMarker:
@@ -123,8 +210,10 @@ func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 			err = d.processApp2Marker(n)
 		case app14Marker:
 			err = d.processApp14Marker(n)
+		case comMarker:
+			err = d.processCOM(n)
 		default:
-			if app0Marker <= marker && marker <= app15Marker || marker == comMarker {
+			if app0Marker <= marker && marker <= app15Marker {
 				err = d.ignore(n)
 			} else if marker < 0xc0 { // See Table B.1 "Marker code assignments".
 				err = FormatError("unknown marker")
@@ -133,74 +222,41 @@ func (d *decoder) decodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 			}
 		}
 		if err != nil {
-			return nil, err
-		}
-	}
-
-	if d.progressive {
-		if err := d.reconstructProgressiveImage(); err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	var img image.Image
-	var err error
-	if d.img1 != nil {
-		img = d.img1
-	} else if d.img3 != nil {
-		if d.blackPix != nil {
-			img, err = d.applyBlack()
-		} else if d.isRGB() {
-			img, err = d.convertToRGB()
-		} else {
-			img = d.img3
-		}
-	}
-	if err != nil {
-		return nil, err
-	}
-	if img == nil {
-		return nil, FormatError("missing SOS marker")
-	}
-
-	var iccProfile *icc.Profile
-	if d.iccProfileLen > 0 {
-		r := &multiBlockReader{blocks: d.iccProfile[:]}
-		iccProfile, err = icc.Decode(r)
-		if err != nil {
-			return nil, err
-		}
+// decodeICCProfile decodes the ICC profile split into the APP2 segments,
+// or returns nil if there are none.
+func (d *decoder) decodeICCProfile() (*icc.Profile, error) {
+	if d.iccProfileLen == 0 {
+		return nil, nil
 	}
-	return &ImageWithMeta{
-		Image:      img,
-		ICCProfile: iccProfile,
-		Exif:       d.exif,
-	}, nil
+	return icc.Decode(&multiBlockReader{blocks: d.iccProfile[:]})
 }
 
 const exifName = "Exif\x00\x00"
 const iccProfileName = "ICC_PROFILE\x00"
 
 func (d *decoder) processApp1Marker(n int) error {
-	l := len(exifName)
-	if n < l {
-		return d.ignore(n)
-	}
-	if err := d.readFull(d.tmp[:l]); err != nil {
-		return err
-	}
-	if string(d.tmp[:l]) != exifName {
-		return d.ignore(n - l)
-	}
-	buf := make([]byte, n-l)
+	buf := make([]byte, n)
 	if err := d.readFull(buf); err != nil {
 		return err
 	}
-	t, err := exif.Decode(bytes.NewReader(buf))
-	if err != nil {
-		return err
+	switch {
+	case bytes.HasPrefix(buf, []byte(exifName)):
+		t, err := exif.Decode(bytes.NewReader(buf[len(exifName):]))
+		if err != nil {
+			return err
+		}
+		d.exif = t
+	case bytes.HasPrefix(buf, []byte(xmpName)):
+		d.xmp = buf[len(xmpName):]
+	case bytes.HasPrefix(buf, []byte(extendedXMPName)):
+		d.processExtendedXMP(buf[len(extendedXMPName):])
 	}
-	d.exif = t
 	return nil
 }
 
@@ -226,6 +282,15 @@ func (d *decoder) processApp2Marker(n int) error {
 	return nil
 }
 
+func (d *decoder) processCOM(n int) error {
+	buf := make([]byte, n)
+	if err := d.readFull(buf); err != nil {
+		return err
+	}
+	d.comments = append(d.comments, string(buf))
+	return nil
+}
+
 type multiBlockReader struct {
 	blocks [][]byte
 	idx    int // current block index
@@ -245,84 +310,47 @@ func (r *multiBlockReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// EncodeWithMeta writes the image m to w in JPEG format with the given
+// options, and with the metadata of m. Default parameters are used if a nil
+// *Options is passed.
 func EncodeWithMeta(w io.Writer, m *ImageWithMeta, o *Options) error {
-	b := m.Bounds()
-	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
-		return errors.New("jpeg: image is too large to encode")
-	}
 	var e encoder
-	if ww, ok := w.(writer); ok {
-		e.w = ww
-	} else {
-		e.w = bufio.NewWriter(w)
-	}
-	// Clip quality to [1, 100].
-	quality := DefaultQuality
-	if o != nil {
-		quality = o.Quality
-		if quality < 1 {
-			quality = 1
-		} else if quality > 100 {
-			quality = 100
-		}
-	}
-	// Convert from a quality rating to a scaling factor.
-	var scale int
-	if quality < 50 {
-		scale = 5000 / quality
-	} else {
-		scale = 200 - quality*2
-	}
-	// Initialize the quantization tables.
-	for i := range e.quant {
-		for j := range e.quant[i] {
-			x := int(unscaledQuant[i][j])
-			x = (x*scale + 50) / 100
-			if x < 1 {
-				x = 1
-			} else if x > 255 {
-				x = 255
-			}
-			e.quant[i][j] = uint8(x)
-		}
-	}
-	// Compute number of components based on input image type.
-	nComponent := 3
-	switch m.Image.(type) {
-	// TODO(wathiede): switch on m.ColorModel() instead of type.
-	case *image.Gray:
-		nComponent = 1
+	if err := e.init(w, m.Image, o); err != nil {
+		return err
 	}
 	// Write the Start Of Image marker.
 	e.buf[0] = 0xff
 	e.buf[1] = 0xd8
 	e.write(e.buf[:2])
+	// Write the metadata.
+	e.writeMeta(m)
+	// Write the image.
+	e.writeImage(m.Image)
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
 
-	// Write the metadata
-	// Exif
+// writeMeta writes the metadata of m, except for the image.
+func (e *encoder) writeMeta(m *ImageWithMeta) {
+	if m.JFIF != nil {
+		e.writeJFIF(m.JFIF)
+	}
 	if m.Exif != nil {
 		e.writeExif(m.Exif)
 	}
-
-	// Write the ICC profile.
+	if m.XMP != nil || m.ExtendedXMP != nil {
+		e.writeXMP(m.XMP, m.ExtendedXMP)
+	}
 	if m.ICCProfile != nil {
 		e.writeICCProfile(m.ICCProfile)
 	}
-
-	// Write the quantization tables.
-	e.writeDQT()
-	// Write the image dimensions.
-	e.writeSOF0(b.Size(), nComponent)
-	// Write the Huffman tables.
-	e.writeDHT(nComponent)
-	// Write the image data.
-	e.writeSOS(m.Image)
-	// Write the End Of Image marker.
-	e.buf[0] = 0xff
-	e.buf[1] = 0xd9
-	e.write(e.buf[:2])
-	e.flush()
-	return e.err
+	for _, c := range m.Comments {
+		e.writeComment(c)
+	}
 }
 
 func (e *encoder) writeExif(tiff *exif.TIFF) {
@@ -380,3 +408,21 @@ func (e *encoder) writeICCProfile(profile *icc.Profile) {
 		e.write(data[off : off+blockSize])
 	}
 }
+
+func (e *encoder) writeComment(c string) {
+	if e.err != nil {
+		return
+	}
+	if len(c) > 0xffff-2 {
+		e.err = errors.New("jpeg: comment is too long")
+		return
+	}
+
+	segmentSize := len(c) + 2
+	e.buf[0] = 0xff
+	e.buf[1] = comMarker
+	e.buf[2] = byte(segmentSize >> 8)
+	e.buf[3] = byte(segmentSize)
+	e.write(e.buf[:4])
+	e.write([]byte(c))
+}
@@ -2,7 +2,10 @@ package jpeg
 
 import (
 	"bytes"
+	"image"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -62,3 +65,226 @@ func TestEncodeWithMeta(t *testing.T) {
 		t.Fatalf("ProfileID is %#v, want %#v", img.ICCProfile.ProfileID, profileID)
 	}
 }
+
+func TestDecodeWithMeta_JFIF(t *testing.T) {
+	img, err := decodeFileWithMeta("../testdata/senkakuwan.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &JFIF{MajorVersion: 1, MinorVersion: 1, Unit: DensityUnitNone, XDensity: 72, YDensity: 72}
+	if !reflect.DeepEqual(img.JFIF, want) {
+		t.Errorf("JFIF is %#v, want %#v", img.JFIF, want)
+	}
+	if !bytes.HasPrefix(img.XMP, []byte("<?xpacket begin=")) {
+		t.Errorf("XMP is %q", img.XMP)
+	}
+	if img.ExtendedXMP != nil {
+		t.Errorf("ExtendedXMP is %q, want nil", img.ExtendedXMP)
+	}
+	if img.Comments != nil {
+		t.Errorf("Comments are %q, want nil", img.Comments)
+	}
+}
+
+// testExtendedXMP returns an extended XMP serialization of n bytes, and the
+// XMP packet that refers to it.
+func testExtendedXMP(n int) (xmp, extended []byte) {
+	extended = make([]byte, n)
+	for i := range extended {
+		extended[i] = byte('a' + i%26)
+	}
+	xmp = []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:xmpNote="http://ns.adobe.com/xmp/note/" xmpNote:HasExtendedXMP="` +
+		ExtendedXMPGUID(extended) + `"/></rdf:RDF></x:xmpmeta>`)
+	return xmp, extended
+}
+
+func TestEncodeWithMeta_RoundTrip(t *testing.T) {
+	// The extended XMP is split into three chunks.
+	xmp, extended := testExtendedXMP(2*maxExtendedXMPChunkSize + 100)
+	m := &ImageWithMeta{
+		Image:       image.NewGray(image.Rect(0, 0, 16, 16)),
+		JFIF:        &JFIF{MajorVersion: 1, MinorVersion: 2, Unit: DensityUnitCentimeter, XDensity: 118, YDensity: 236},
+		XMP:         xmp,
+		ExtendedXMP: extended,
+		Comments:    []string{"first comment", "", strings.Repeat("x", 0xffff-2)},
+	}
+	buf := new(bytes.Buffer)
+	if err := EncodeWithMeta(buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte(extendedXMPName)); n != 3 {
+		t.Errorf("got %d extended XMP segments, want 3", n)
+	}
+
+	got, err := DecodeWithMeta(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.JFIF, m.JFIF) {
+		t.Errorf("JFIF is %#v, want %#v", got.JFIF, m.JFIF)
+	}
+	if !bytes.Equal(got.XMP, m.XMP) {
+		t.Errorf("XMP is %q, want %q", got.XMP, m.XMP)
+	}
+	if !bytes.Equal(got.ExtendedXMP, m.ExtendedXMP) {
+		t.Error("ExtendedXMP differs")
+	}
+	if !reflect.DeepEqual(got.Comments, m.Comments) {
+		t.Error("Comments differ")
+	}
+}
+
+func TestEncodeWithMeta_ZeroDensity(t *testing.T) {
+	// Some files have the JFIF header with zero densities.
+	// They should be written back as is.
+	m := &ImageWithMeta{
+		Image: image.NewGray(image.Rect(0, 0, 16, 16)),
+		JFIF:  &JFIF{MajorVersion: 1, MinorVersion: 1, Unit: DensityUnitNone},
+	}
+	buf := new(bytes.Buffer)
+	if err := EncodeWithMeta(buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeWithMeta(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.JFIF, m.JFIF) {
+		t.Errorf("JFIF is %#v, want %#v", got.JFIF, m.JFIF)
+	}
+
+	// Encode the decoded image again.
+	if err := EncodeWithMeta(new(bytes.Buffer), got, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transform keeps the header.
+	out := new(bytes.Buffer)
+	if err := Transform(out, bytes.NewReader(buf.Bytes()), &TransformOptions{Transformation: TransformRotate90}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = DecodeWithMeta(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.JFIF, m.JFIF) {
+		t.Errorf("JFIF is %#v, want %#v", got.JFIF, m.JFIF)
+	}
+}
+
+func TestDecodeWithMeta_ExtendedXMP(t *testing.T) {
+	xmp, extended := testExtendedXMP(1000)
+	guid := ExtendedXMPGUID(extended)
+	chunk := func(guid string, length, offset int, data []byte) []byte {
+		segmentSize := 2 + len(extendedXMPName) + extendedXMPHeaderSize + len(data)
+		b := []byte{0xff, app1Marker, byte(segmentSize >> 8), byte(segmentSize)}
+		b = append(b, extendedXMPName...)
+		b = append(b, guid...)
+		b = append(b, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		b = append(b, byte(offset>>24), byte(offset>>16), byte(offset>>8), byte(offset))
+		return append(b, data...)
+	}
+	n := len(extended)
+	half := n / 2
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   []byte
+	}{
+		{
+			"out of order",
+			[][]byte{
+				chunk(guid, n, half, extended[half:]),
+				chunk(guid, n, 0, extended[:half]),
+			},
+			extended,
+		},
+		{
+			"duplicated",
+			[][]byte{
+				chunk(guid, n, 0, extended[:half]),
+				chunk(guid, n, 0, extended[:half]),
+				chunk(guid, n, half, extended[half:]),
+			},
+			extended,
+		},
+		{
+			"other GUID",
+			[][]byte{
+				chunk(strings.Repeat("0", 32), 3, 0, []byte("foo")),
+				chunk(guid, n, 0, extended[:half]),
+				chunk(guid, n, half, extended[half:]),
+			},
+			extended,
+		},
+		{
+			"missing chunk",
+			[][]byte{chunk(guid, n, half, extended[half:])},
+			nil,
+		},
+		{
+			"wrong length",
+			[][]byte{chunk(guid, n+1, 0, extended[:half]), chunk(guid, n+1, half, extended[half:])},
+			nil,
+		},
+		{
+			"not referred",
+			[][]byte{chunk(strings.Repeat("0", 32), 3, 0, []byte("foo"))},
+			nil,
+		},
+	}
+
+	// Encode an image with the XMP packet, and insert the chunks after it.
+	buf := new(bytes.Buffer)
+	m := &ImageWithMeta{Image: image.NewGray(image.Rect(0, 0, 8, 8)), XMP: xmp}
+	if err := EncodeWithMeta(buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(buf.Bytes(), xmp) + len(xmp)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte{}, buf.Bytes()[:i]...)
+			for _, c := range tt.chunks {
+				data = append(data, c...)
+			}
+			data = append(data, buf.Bytes()[i:]...)
+			got, err := DecodeWithMeta(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.ExtendedXMP, tt.want) {
+				t.Errorf("got %d bytes of ExtendedXMP, want %d bytes", len(got.ExtendedXMP), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestEncodeWithMeta_Errors(t *testing.T) {
+	xmp, extended := testExtendedXMP(1000)
+	tests := []struct {
+		name string
+		m    *ImageWithMeta
+		want string
+	}{
+		{"XMP", &ImageWithMeta{XMP: make([]byte, maxXMPSize+1)}, "jpeg: XMP packet is too large"},
+		{"extended XMP", &ImageWithMeta{XMP: []byte("<x:xmpmeta/>"), ExtendedXMP: extended}, "jpeg: XMP packet doesn't refer to the extended XMP"},
+		{"no XMP", &ImageWithMeta{ExtendedXMP: extended}, "jpeg: XMP packet doesn't refer to the extended XMP"},
+		{"comment", &ImageWithMeta{Comments: []string{strings.Repeat("x", 0xffff-1)}}, "jpeg: comment is too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Image = image.NewGray(image.Rect(0, 0, 8, 8))
+			err := EncodeWithMeta(new(bytes.Buffer), tt.m, nil)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+
+	// The maximum size is accepted.
+	m := &ImageWithMeta{Image: image.NewGray(image.Rect(0, 0, 8, 8)), XMP: append(make([]byte, maxXMPSize-len(xmp)), xmp...), ExtendedXMP: extended}
+	if err := EncodeWithMeta(new(bytes.Buffer), m, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,381 @@
+package jpeg
+
+import (
+	"errors"
+	"image"
+)
+
+// Scan is a scan of a progressive JPEG image.
+// See section G.1.1.1 of the specification for the details.
+type Scan struct {
+	// Components are the indexes of the components coded in the scan,
+	// in ascending order. For YCbCr images, 0 is Y, 1 is Cb and 2 is Cr.
+	// For CMYK images, 0 is C, 1 is M, 2 is Y and 3 is K, and for YCCK
+	// images, 0 is Y, 1 is Cb, 2 is Cr and 3 is K.
+	// For grayscale images, the only component is 0.
+	// Only DC scans may have more than one component.
+	Components []int
+
+	// Ss and Se are the first and last DCT coefficients coded in the scan,
+	// in zig-zag order. A DC scan has Ss == Se == 0, and an AC scan has
+	// 1 <= Ss <= Se <= 63.
+	Ss, Se int
+
+	// Ah is the bit position of the previous scan of the coefficients,
+	// or 0 for the first scan of them.
+	// Al is the bit position of the scan. If Ah is not 0, Ah must be Al+1.
+	Ah, Al int
+}
+
+// maxAl is the maximum successive approximation bit position for 8-bit
+// samples.
+const maxAl = 10
+
+// defaultScanScript returns the standard scan script for an image with
+// nComp components. It is the same script as jpeg_simple_progression
+// in libjpeg.
+func defaultScanScript(nComp int) []Scan {
+	if nComp != 3 {
+		// The components of grayscale and CMYK images are treated alike.
+		all := []int{0, 1, 2, 3}[:nComp]
+		scans := []Scan{{Components: all, Ss: 0, Se: 0, Ah: 0, Al: 1}}
+		scans = appendACScans(scans, nComp, 1, 5, 0, 2)
+		scans = appendACScans(scans, nComp, 6, 63, 0, 2)
+		scans = appendACScans(scans, nComp, 1, 63, 2, 1)
+		scans = append(scans, Scan{Components: all, Ss: 0, Se: 0, Ah: 1, Al: 0})
+		scans = appendACScans(scans, nComp, 1, 63, 1, 0)
+		return scans
+	}
+	return []Scan{
+		// Initial DC scan for Y, Cb and Cr.
+		{Components: []int{0, 1, 2}, Ss: 0, Se: 0, Ah: 0, Al: 1},
+		// Initial AC scans: get some luma data out in a hurry.
+		{Components: []int{0}, Ss: 1, Se: 5, Ah: 0, Al: 2},
+		{Components: []int{2}, Ss: 1, Se: 63, Ah: 0, Al: 1},
+		{Components: []int{1}, Ss: 1, Se: 63, Ah: 0, Al: 1},
+		{Components: []int{0}, Ss: 6, Se: 63, Ah: 0, Al: 2},
+		// Refinement scans.
+		{Components: []int{0}, Ss: 1, Se: 63, Ah: 2, Al: 1},
+		{Components: []int{0, 1, 2}, Ss: 0, Se: 0, Ah: 1, Al: 0},
+		{Components: []int{2}, Ss: 1, Se: 63, Ah: 1, Al: 0},
+		{Components: []int{1}, Ss: 1, Se: 63, Ah: 1, Al: 0},
+		{Components: []int{0}, Ss: 1, Se: 63, Ah: 1, Al: 0},
+	}
+}
+
+// appendACScans appends an AC scan of the same parameters for each of the
+// nComp components to scans.
+func appendACScans(scans []Scan, nComp, ss, se, ah, al int) []Scan {
+	for ci := 0; ci < nComp; ci++ {
+		scans = append(scans, Scan{Components: []int{ci}, Ss: ss, Se: se, Ah: ah, Al: al})
+	}
+	return scans
+}
+
+// validateScanScript checks that scans is a valid scan script for an image
+// with nComp components, as specified in section G.1.1.1.
+func validateScanScript(scans []Scan, nComp int) error {
+	if len(scans) == 0 {
+		return errors.New("jpeg: empty scan script")
+	}
+
+	// last[ci][zig] is the Al value of the last scan of the coefficient,
+	// or -1 if it has not been coded yet.
+	var last [maxComponents][blockSize]int
+	for ci := range last {
+		for zig := range last[ci] {
+			last[ci][zig] = -1
+		}
+	}
+
+	for _, s := range scans {
+		if len(s.Components) == 0 || len(s.Components) > nComp {
+			return errors.New("jpeg: invalid number of components in scan")
+		}
+		if s.Ss < 0 || s.Ss > s.Se || s.Se >= blockSize || (s.Ss == 0 && s.Se != 0) {
+			return errors.New("jpeg: invalid spectral selection in scan")
+		}
+		if s.Ss != 0 && len(s.Components) != 1 {
+			return errors.New("jpeg: AC scan with more than one component")
+		}
+		if s.Al < 0 || s.Al > maxAl || (s.Ah != 0 && s.Ah != s.Al+1) {
+			return errors.New("jpeg: invalid successive approximation in scan")
+		}
+		for i, ci := range s.Components {
+			if ci < 0 || ci >= nComp || (i > 0 && ci <= s.Components[i-1]) {
+				return errors.New("jpeg: invalid component index in scan")
+			}
+			if s.Ss != 0 && last[ci][0] < 0 {
+				return errors.New("jpeg: AC scan before the DC scan")
+			}
+			for zig := s.Ss; zig <= s.Se; zig++ {
+				if s.Ah == 0 && last[ci][zig] >= 0 {
+					return errors.New("jpeg: coefficients coded twice in scan script")
+				}
+				if s.Ah != 0 && last[ci][zig] != s.Ah {
+					return errors.New("jpeg: invalid successive approximation in scan")
+				}
+				last[ci][zig] = s.Al
+			}
+		}
+	}
+
+	for ci := 0; ci < nComp; ci++ {
+		for zig := range last[ci] {
+			if last[ci][zig] < 0 {
+				return errors.New("jpeg: scan script doesn't code all coefficients")
+			}
+		}
+	}
+	return nil
+}
+
+// mcuSize returns the number of MCUs (Minimum Coded Units) in a row and in a
+// column of an image of the given size. The Y component has the largest
+// sampling factors.
+func (e *encoder) mcuSize(size image.Point) (mxx, myy int) {
+	h0, v0 := e.comp[0].h, e.comp[0].v
+	mxx = (size.X + 8*h0 - 1) / (8 * h0)
+	myy = (size.Y + 8*v0 - 1) / (8 * v0)
+	return
+}
+
+// saveCoeffs saves the quantized DCT coefficients of m for writing the scans
+// from them. The blocks of a component are stored in raster order, and a row
+// has mxx*h blocks, where h is the horizontal sampling factor of the
+// component.
+func (e *encoder) saveCoeffs(m image.Image) {
+	mxx, myy := e.mcuSize(e.size)
+	for i, c := range e.comp[:e.nComp] {
+		e.coeffs[i] = make([]block, mxx*myy*c.h*c.v)
+	}
+	e.forEachBlock(m, func(ci, bx, by int, b *block) {
+		e.coeffs[ci][by*mxx*e.comp[ci].h+bx] = *b
+	})
+}
+
+// writeScan writes the StartOfScan marker and the data of the scan s.
+func (e *encoder) writeScan(s *Scan) {
+	e.writeSOSHeader(s)
+	e.writeScanData(s)
+}
+
+// writeSOSHeader writes the StartOfScan marker of the scan s.
+// Each component uses the DC and AC Huffman tables whose destination
+// identifiers are the same as its quantization table.
+func (e *encoder) writeSOSHeader(s *Scan) {
+	nComp := len(s.Components)
+	e.writeMarkerHeader(sosMarker, 6+2*nComp)
+	e.writeByte(uint8(nComp))
+	for _, ci := range s.Components {
+		c := e.comp[ci]
+		e.buf[0] = c.c
+		e.buf[1] = c.tq<<4 | c.tq
+		e.write(e.buf[:2])
+	}
+	e.buf[0] = uint8(s.Ss)
+	e.buf[1] = uint8(s.Se)
+	e.buf[2] = uint8(s.Ah<<4 | s.Al)
+	e.write(e.buf[:3])
+}
+
+// writeScanData writes the entropy-coded data of the scan s from the saved
+// coefficients.
+func (e *encoder) writeScanData(s *Scan) {
+	nComp := len(s.Components)
+	mxx, myy := e.mcuSize(e.size)
+	// hAC is the Huffman table of the end-of-band runs.
+	hAC := huffIndex(2*e.comp[s.Components[0]].tq + 1)
+	if nComp > 1 {
+		// The interleaved scans are traversed one MCU at a time.
+		var prevDC [maxComponents]int32
+		for my := 0; my < myy; my++ {
+			for mx := 0; mx < mxx; mx++ {
+				for _, ci := range s.Components {
+					h, v := e.comp[ci].h, e.comp[ci].v
+					for j := 0; j < h*v; j++ {
+						bx := h*mx + j%h
+						by := v*my + j/h
+						b := &e.coeffs[ci][by*mxx*h+bx]
+						prevDC[ci] = e.writeScanBlock(b, ci, s, prevDC[ci])
+					}
+				}
+				if mcu := my*mxx + mx + 1; e.ri > 0 && mcu%e.ri == 0 && mcu < mxx*myy {
+					e.restart(hAC, mcu/e.ri-1)
+					prevDC = [maxComponents]int32{}
+				}
+			}
+		}
+	} else {
+		// The non-interleaved scans are traversed left to right, top to
+		// bottom, and cover only the blocks inside the component.
+		// Each block is an MCU on its own.
+		ci := s.Components[0]
+		h, v := e.comp[ci].h, e.comp[ci].v
+		h0, v0 := e.comp[0].h, e.comp[0].v
+		width := (e.size.X*h + h0 - 1) / h0
+		height := (e.size.Y*v + v0 - 1) / v0
+		bxx, byy := (width+7)/8, (height+7)/8
+		var prevDC int32
+		for by := 0; by < byy; by++ {
+			for bx := 0; bx < bxx; bx++ {
+				b := &e.coeffs[ci][by*mxx*h+bx]
+				prevDC = e.writeScanBlock(b, ci, s, prevDC)
+				if mcu := by*bxx + bx + 1; e.ri > 0 && mcu%e.ri == 0 && mcu < bxx*byy {
+					e.restart(hAC, mcu/e.ri-1)
+					prevDC = 0
+				}
+			}
+		}
+	}
+	e.emitEOBRun(hAC)
+	e.padBits()
+}
+
+// writeScanBlock writes the coefficients of the block b coded in the scan s,
+// returning the DC value of the block, shifted by Al in a progressive scan.
+// b is in natural (not zig-zag) order.
+func (e *encoder) writeScanBlock(b *block, ci int, s *Scan, prevDC int32) int32 {
+	q := e.comp[ci].tq
+	switch {
+	case !e.progressive:
+		return e.writeBlock(b, quantIndex(q), prevDC)
+	case s.Ss == 0 && s.Ah == 0:
+		// The first scan of the DC coefficient, as specified in section G.1.2.1.
+		dc := b[0] >> s.Al
+		e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
+		return dc
+	case s.Ss == 0:
+		// Refining a DC coefficient is trivial.
+		e.emit(uint32(b[0]>>s.Al)&1, 1)
+	case s.Ah == 0:
+		e.writeACFirst(b, huffIndex(2*q+1), s.Ss, s.Se, s.Al)
+	default:
+		e.writeACRefine(b, huffIndex(2*q+1), s.Ss, s.Se, s.Al)
+	}
+	return prevDC
+}
+
+// writeACFirst writes the first scan of the AC coefficients of the block b,
+// as specified in section G.1.2.2.
+func (e *encoder) writeACFirst(b *block, h huffIndex, ss, se, al int) {
+	runLength := int32(0)
+	for zig := ss; zig <= se; zig++ {
+		ac := b[unzig[zig]]
+		if ac < 0 {
+			ac = -(-ac >> al)
+		} else {
+			ac >>= al
+		}
+		if ac == 0 {
+			runLength++
+			continue
+		}
+		e.emitEOBRun(h)
+		for runLength > 15 {
+			e.emitHuff(h, 0xf0)
+			runLength -= 16
+		}
+		e.emitHuffRLE(h, runLength, ac)
+		runLength = 0
+	}
+	if runLength > 0 {
+		e.eobRun++
+		if e.eobRun == e.maxEOBRun {
+			e.emitEOBRun(h)
+		}
+	}
+}
+
+// writeACRefine writes a successive approximation refinement scan of the AC
+// coefficients of the block b, as specified in section G.1.2.3.
+func (e *encoder) writeACRefine(b *block, h huffIndex, ss, se, al int) {
+	// abs are the absolute values of the coefficients shifted by al.
+	// eob is the position of the last coefficient that becomes non-zero in
+	// this scan.
+	var abs [blockSize]int32
+	eob := 0
+	for zig := ss; zig <= se; zig++ {
+		ac := b[unzig[zig]]
+		if ac < 0 {
+			ac = -ac
+		}
+		abs[zig] = ac >> al
+		if abs[zig] == 1 {
+			eob = zig
+		}
+	}
+
+	// corr are the correction bits of the coefficients that were non-zero
+	// in the previous scans, which haven't been written yet.
+	var corr [blockSize]uint8
+	nCorr := 0
+	runLength := int32(0)
+	for zig := ss; zig <= se; zig++ {
+		ac := abs[zig]
+		if ac == 0 {
+			runLength++
+			continue
+		}
+		// The zero runs after the last new coefficient are folded into EOB.
+		for runLength > 15 && zig <= eob {
+			e.emitEOBRun(h)
+			e.emitHuff(h, 0xf0)
+			runLength -= 16
+			e.emitCorrectionBits(corr[:nCorr])
+			nCorr = 0
+		}
+		if ac > 1 {
+			corr[nCorr] = uint8(ac & 1)
+			nCorr++
+			continue
+		}
+		// The coefficient becomes non-zero in this scan.
+		e.emitEOBRun(h)
+		e.emitHuff(h, runLength<<4|1)
+		if b[unzig[zig]] < 0 {
+			e.emit(0, 1)
+		} else {
+			e.emit(1, 1)
+		}
+		e.emitCorrectionBits(corr[:nCorr])
+		nCorr = 0
+		runLength = 0
+	}
+	if runLength > 0 || nCorr > 0 {
+		e.eobRun++
+		e.corrBits = append(e.corrBits, corr[:nCorr]...)
+		if e.eobRun == e.maxEOBRun {
+			e.emitEOBRun(h)
+		}
+	}
+}
+
+// emitEOBRun emits the pending end-of-band run followed by its correction
+// bits.
+func (e *encoder) emitEOBRun(h huffIndex) {
+	if e.eobRun == 0 {
+		return
+	}
+	n := uint32(e.eobRun)
+	var nBits uint32
+	if n < 0x100 {
+		nBits = uint32(bitCount[n]) - 1
+	} else {
+		nBits = 8 + uint32(bitCount[n>>8]) - 1
+	}
+	e.emitHuff(h, int32(nBits<<4))
+	if nBits > 0 {
+		e.emit(n&(1<<nBits-1), nBits)
+	}
+	e.emitCorrectionBits(e.corrBits)
+	e.eobRun = 0
+	e.corrBits = e.corrBits[:0]
+}
+
+// emitCorrectionBits emits the correction bits of a refinement scan.
+func (e *encoder) emitCorrectionBits(corr []uint8) {
+	for _, bit := range corr {
+		e.emit(uint32(bit), 1)
+	}
+}
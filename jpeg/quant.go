@@ -0,0 +1,225 @@
+package jpeg
+
+import (
+	"io"
+	"strconv"
+)
+
+// QuantTable is a quantization table in natural (not zig-zag) order:
+// the element 8*v+u is the quantizer of the DCT coefficient whose horizontal
+// frequency is u and vertical frequency is v.
+type QuantTable [blockSize]uint16
+
+// QuantTableSet is a set of the base quantization tables that Encode scales
+// according to the quality.
+type QuantTableSet int
+
+const (
+	// QuantTableAnnexK is the tables in section K.1 of the specification.
+	// They are used by libjpeg and most encoders.
+	QuantTableAnnexK QuantTableSet = 0
+
+	// QuantTableFlat is the tables whose quantizers are all the same.
+	// It keeps high frequency details, at the cost of the file size.
+	QuantTableFlat QuantTableSet = 1
+
+	// QuantTableRobidoux is the perceptually tuned tables proposed by
+	// Nicolas Robidoux for ImageMagick. It is also the default of mozjpeg.
+	// The same table is used for luminance and chrominance.
+	QuantTableRobidoux QuantTableSet = 2
+)
+
+func (s QuantTableSet) String() string {
+	switch s {
+	case QuantTableAnnexK:
+		return "AnnexK"
+	case QuantTableFlat:
+		return "Flat"
+	case QuantTableRobidoux:
+		return "Robidoux"
+	default:
+		return "Unknown QuantTableSet: " + strconv.Itoa(int(s))
+	}
+}
+
+// robidouxQuant is the base table of QuantTableRobidoux, in natural order.
+var robidouxQuant = QuantTable{
+	16, 16, 16, 18, 25, 37, 56, 85,
+	16, 17, 20, 27, 34, 40, 53, 75,
+	16, 20, 24, 31, 43, 62, 91, 135,
+	18, 27, 31, 40, 53, 74, 106, 156,
+	25, 34, 43, 53, 69, 94, 131, 189,
+	37, 40, 62, 74, 94, 124, 169, 238,
+	56, 53, 91, 106, 131, 169, 226, 311,
+	85, 75, 135, 156, 189, 238, 311, 418,
+}
+
+// baseQuant returns the base tables of the set in zig-zag order, or nil if
+// the set is unknown.
+func (s QuantTableSet) baseQuant() *[nQuantIndex][blockSize]uint16 {
+	var base [nQuantIndex][blockSize]uint16
+	switch s {
+	case QuantTableAnnexK:
+		for i := range base {
+			for zig := range base[i] {
+				base[i][zig] = uint16(unscaledQuant[i][zig])
+			}
+		}
+	case QuantTableFlat:
+		for i := range base {
+			for zig := range base[i] {
+				base[i][zig] = 16
+			}
+		}
+	case QuantTableRobidoux:
+		for i := range base {
+			for zig := range base[i] {
+				base[i][zig] = robidouxQuant[unzig[zig]]
+			}
+		}
+	default:
+		return nil
+	}
+	return &base
+}
+
+// scaleQuant scales the base table in zig-zag order according to the quality,
+// in the same way as libjpeg does. The quantizers are clipped to [1, 255], so
+// that the table can be used in baseline images.
+func scaleQuant(dst, base *[blockSize]uint16, quality int) {
+	// Clip quality to [1, 100].
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	// Convert from a quality rating to a scaling factor.
+	var scale int
+	if quality < 50 {
+		scale = 5000 / quality
+	} else {
+		scale = 200 - quality*2
+	}
+	for i := range dst {
+		x := int(base[i])
+		x = (x*scale + 50) / 100
+		if x < 1 {
+			x = 1
+		} else if x > 255 {
+			x = 255
+		}
+		dst[i] = uint16(x)
+	}
+}
+
+// estimateQuality returns the quality whose scaled base table is the closest
+// to q. Both tables are in zig-zag order.
+func estimateQuality(q *block, base *[blockSize]uint16) int {
+	best, bestDiff := 0, -1
+	var scaled [blockSize]uint16
+	for quality := 100; quality >= 1; quality-- {
+		scaleQuant(&scaled, base, quality)
+		diff := 0
+		for i := range scaled {
+			d := int(q[i]) - int(scaled[i])
+			if d < 0 {
+				d = -d
+			}
+			diff += d
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = quality, diff
+		}
+	}
+	return best
+}
+
+// EstimateQuality reads the quantization tables of the JPEG image from r, and
+// estimates the qualities of the luminance and chrominance components that
+// they were generated with. The estimation assumes the tables of
+// QuantTableAnnexK, which is what Encode and libjpeg use by default.
+// chroma is 0 for grayscale, RGB, CMYK and YCCK images: luma is estimated
+// from the table of the first component. RGB images include the Adobe
+// images with the transform 0. If several qualities give the same table,
+// the highest one is returned.
+//
+// Only the headers before the first scan are read from r.
+func EstimateQuality(r io.Reader) (luma, chroma int, err error) {
+	var d decoder
+	d.r = r
+	if err := d.readQuantTables(); err != nil {
+		return 0, 0, err
+	}
+	base := QuantTableAnnexK.baseQuant()
+	luma = estimateQuality(&d.quant[d.comp[0].tq], &base[quantIndexLuminance])
+	if d.nComp == 3 && !d.isRGB() {
+		chroma = estimateQuality(&d.quant[d.comp[1].tq], &base[quantIndexChrominance])
+	}
+	return luma, chroma, nil
+}
+
+// readQuantTables reads the segments until the first SOS marker, and
+// processes the DQT, SOF, APP0 and APP14 markers in them.
+func (d *decoder) readQuantTables() error {
+	// Check for the Start Of Image marker.
+	if err := d.readFull(d.tmp[:2]); err != nil {
+		return err
+	}
+	if d.tmp[0] != 0xff || d.tmp[1] != soiMarker {
+		return FormatError("missing SOI marker")
+	}
+
+	for {
+		if err := d.readFull(d.tmp[:2]); err != nil {
+			return err
+		}
+		if d.tmp[0] != 0xff {
+			return FormatError("missing 0xff marker start")
+		}
+		marker := d.tmp[1]
+		for marker == 0xff {
+			// Section B.1.1.2 says, "Any marker may optionally be preceded by any
+			// number of fill bytes, which are bytes assigned code X'FF'".
+			var err error
+			marker, err = d.readByte()
+			if err != nil {
+				return err
+			}
+		}
+		if marker == eoiMarker || marker == sosMarker {
+			break
+		}
+
+		// Read the 16-bit length of the segment.
+		if err := d.readFull(d.tmp[:2]); err != nil {
+			return err
+		}
+		n := int(d.tmp[0])<<8 + int(d.tmp[1]) - 2
+		if n < 0 {
+			return FormatError("short segment length")
+		}
+
+		var err error
+		switch marker {
+		case sof0Marker, sof1Marker, sof2Marker, sof9Marker, sof10Marker:
+			d.baseline = marker == sof0Marker
+			d.progressive = marker == sof2Marker || marker == sof10Marker
+			err = d.processSOF(n)
+		case dqtMarker:
+			err = d.processDQT(n)
+		case app0Marker:
+			err = d.processApp0Marker(n)
+		case app14Marker:
+			err = d.processApp14Marker(n)
+		default:
+			err = d.ignore(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.nComp == 0 {
+		return FormatError("missing SOF marker")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+)
+
+func TestEstimateQuality(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for quality := 1; quality <= 100; quality++ {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, &Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		luma, chroma, err := EstimateQuality(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Some qualities give the same table, because the quantizers are clipped.
+		if !sameScaledQuant(quantIndexLuminance, luma, quality) || !sameScaledQuant(quantIndexChrominance, chroma, quality) {
+			t.Errorf("quality %d: got luma %d, chroma %d", quality, luma, chroma)
+		}
+	}
+}
+
+func sameScaledQuant(q quantIndex, quality1, quality2 int) bool {
+	base := QuantTableAnnexK.baseQuant()
+	var t1, t2 [blockSize]uint16
+	scaleQuant(&t1, &base[q], quality1)
+	scaleQuant(&t2, &base[q], quality2)
+	return t1 == t2
+}
+
+func TestEstimateQuality_ChromaQuality(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m0, &Options{Quality: 90, ChromaQuality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	luma, chroma, err := EstimateQuality(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if luma != 90 || chroma != 60 {
+		t.Errorf("got luma %d, chroma %d, want luma 90, chroma 60", luma, chroma)
+	}
+}
+
+func TestEstimateQuality_Gray(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), &Options{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	luma, chroma, err := EstimateQuality(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if luma != 80 || chroma != 0 {
+		t.Errorf("got luma %d, chroma %d, want luma 80, chroma 0", luma, chroma)
+	}
+}
+
+func TestEstimateQuality_NoChroma(t *testing.T) {
+	// The second tables of the CMYK and the Adobe RGB images are not chroma tables.
+	for _, filename := range []string{"video-001.cmyk.jpeg", "video-001.rgb.jpeg"} {
+		data, err := os.ReadFile("../testdata/" + filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		luma, chroma, err := EstimateQuality(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if luma == 0 || chroma != 0 {
+			t.Errorf("%s: got luma %d, chroma %d, want chroma 0", filename, luma, chroma)
+		}
+	}
+}
+
+func TestEncodeQuantTableSet(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []QuantTableSet{QuantTableAnnexK, QuantTableFlat, QuantTableRobidoux} {
+		t.Run(set.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m0, &Options{Quality: 90, QuantTableSet: set}); err != nil {
+				t.Fatal(err)
+			}
+			m1, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := averageDelta(m0, m1), int64(4<<8); got > want {
+				t.Errorf("average delta too high; got %d, want <= %d", got, want)
+			}
+		})
+	}
+
+	if err := Encode(&bytes.Buffer{}, m0, &Options{QuantTableSet: QuantTableSet(-1)}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestEncodeCustomQuantTable(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var luma, chroma QuantTable
+	for i := range luma {
+		luma[i] = 2
+		chroma[i] = 4
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m0, &Options{LumaQuantTable: &luma, ChromaQuantTable: &chroma}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte{0xff, sof0Marker}) {
+		t.Error("SOF0 marker is not found")
+	}
+
+	var d decoder
+	d.r = bytes.NewReader(buf.Bytes())
+	if err := d.readQuantTables(); err != nil {
+		t.Fatal(err)
+	}
+	for zig := 0; zig < blockSize; zig++ {
+		if d.quant[0][zig] != 2 || d.quant[1][zig] != 4 {
+			t.Fatalf("unexpected quantization tables: %v, %v", d.quant[0], d.quant[1])
+		}
+	}
+
+	m1, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := averageDelta(m0, m1), int64(3<<8); got > want {
+		t.Errorf("average delta too high; got %d, want <= %d", got, want)
+	}
+}
+
+func TestEncodeCustomQuantTable16(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var luma QuantTable
+	for i := range luma {
+		luma[i] = 300
+	}
+	luma[0] = 8
+	for _, progressive := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, &Options{LumaQuantTable: &luma, Progressive: progressive}); err != nil {
+			t.Fatal(err)
+		}
+		marker := byte(sof1Marker)
+		if progressive {
+			marker = sof2Marker
+		}
+		if !bytes.Contains(buf.Bytes(), []byte{0xff, marker}) {
+			t.Errorf("progressive=%t: SOF marker %#x is not found", progressive, marker)
+		}
+		if _, err := Decode(&buf); err != nil {
+			t.Errorf("progressive=%t: %v", progressive, err)
+		}
+	}
+}
+
+func TestEncodeCustomQuantTable_Zero(t *testing.T) {
+	var luma QuantTable
+	err := Encode(&bytes.Buffer{}, image.NewGray(image.Rect(0, 0, 8, 8)), &Options{LumaQuantTable: &luma})
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+}
@@ -8,6 +8,7 @@
 package jpeg
 
 import (
+	"errors"
 	"image"
 	"image/color"
 	"io"
@@ -47,18 +48,22 @@ const (
 )
 
 const (
-	sof0Marker = 0xc0 // Start Of Frame (Baseline Sequential).
-	sof1Marker = 0xc1 // Start Of Frame (Extended Sequential).
-	sof2Marker = 0xc2 // Start Of Frame (Progressive).
-	dhtMarker  = 0xc4 // Define Huffman Table.
-	rst0Marker = 0xd0 // ReSTart (0).
-	rst7Marker = 0xd7 // ReSTart (7).
-	soiMarker  = 0xd8 // Start Of Image.
-	eoiMarker  = 0xd9 // End Of Image.
-	sosMarker  = 0xda // Start Of Scan.
-	dqtMarker  = 0xdb // Define Quantization Table.
-	driMarker  = 0xdd // Define Restart Interval.
-	comMarker  = 0xfe // COMment.
+	sof0Marker  = 0xc0 // Start Of Frame (Baseline Sequential).
+	sof1Marker  = 0xc1 // Start Of Frame (Extended Sequential).
+	sof2Marker  = 0xc2 // Start Of Frame (Progressive).
+	sof3Marker  = 0xc3 // Start Of Frame (Lossless).
+	dhtMarker   = 0xc4 // Define Huffman Table.
+	sof9Marker  = 0xc9 // Start Of Frame (Extended Sequential, Arithmetic Coding).
+	sof10Marker = 0xca // Start Of Frame (Progressive, Arithmetic Coding).
+	dacMarker   = 0xcc // Define Arithmetic Coding conditioning.
+	rst0Marker  = 0xd0 // ReSTart (0).
+	rst7Marker  = 0xd7 // ReSTart (7).
+	soiMarker   = 0xd8 // Start Of Image.
+	eoiMarker   = 0xd9 // End Of Image.
+	sosMarker   = 0xda // Start Of Scan.
+	dqtMarker   = 0xdb // Define Quantization Table.
+	driMarker   = 0xdd // Define Restart Interval.
+	comMarker   = 0xfe // COMment.
 	// "APPlication specific" markers aren't part of the JPEG spec per se,
 	// but in practice, their use is described at
 	// https://www.sno.phy.queensu.ca/~phil/exiftool/TagNames/JPEG.html
@@ -128,16 +133,36 @@ type decoder struct {
 	blackPix    []byte
 	blackStride int
 
+	// pix16 and stride16 are the sample planes of each component, used
+	// instead of img1 and img3 for the images whose precision is not 8 bits
+	// and for the lossless images. The samples of a plane are in raster
+	// order, and they aren't scaled to 16 bits yet.
+	pix16    [maxComponents][]uint16
+	stride16 [maxComponents]int
+
 	ri    int // Restart Interval.
 	nComp int
 
 	// As per section 4.5, there are four modes of operation (selected by the
 	// SOF? markers): sequential DCT, progressive DCT, lossless and
 	// hierarchical, although this implementation does not support the latter
-	// two non-DCT modes. Sequential DCT is further split into baseline and
+	// non-DCT mode. Sequential DCT is further split into baseline and
 	// extended, as per section 4.11.
 	baseline    bool
 	progressive bool
+	lossless    bool
+	// arithmetic is whether the entropy coding is the arithmetic coding of
+	// annex D, instead of the Huffman coding.
+	arithmetic bool
+	// precision is the sample precision in bits: 8 or 12 for the DCT modes,
+	// and from 2 to 16 for the lossless mode.
+	precision int
+	// scaleShift is the base-2 logarithm of the scale denominator of the
+	// decoded image.
+	scaleShift uint
+	// coeffsOnly is whether the quantized DCT coefficients of every mode are
+	// kept in progCoeffs, instead of being reconstructed into the image.
+	coeffsOnly bool
 
 	jfif                bool
 	adobeTransformValid bool
@@ -150,10 +175,20 @@ type decoder struct {
 	quant      [maxTq + 1]block // Quantization tables, in zig-zag order.
 	tmp        [2 * blockSize]byte
 
+	arith arithDecoder
+	// arithCond are the conditioning tables of the arithmetic coding, defined
+	// by the DAC markers. arithCondDefined reports whether they are defined.
+	arithCond        [maxTc + 1][maxTh + 1]uint8
+	arithCondDefined [maxTc + 1][maxTh + 1]bool
+
 	// metadata
 	iccProfile    [256][]byte
 	iccProfileLen int // total length of iccProfile
 	exif          *exif.TIFF
+	jfifHeader    *JFIF
+	xmp           []byte
+	extendedXMP   map[string]*extendedXMP // keyed by GUID
+	comments      []string
 }
 
 // fill fills up the d.bytes.buf buffer from the underlying io.Reader. It
@@ -324,10 +359,22 @@ func (d *decoder) processSOF(n int) error {
 	if err := d.readFull(d.tmp[:n]); err != nil {
 		return err
 	}
-	// We only support 8-bit precision.
-	if d.tmp[0] != 8 {
+	// Section B.2.2 allows 8-bit precision for the baseline mode, 8 or 12-bit
+	// precision for the other DCT modes, and 2 to 16-bit precision for the
+	// lossless mode.
+	d.precision = int(d.tmp[0])
+	switch {
+	case d.lossless:
+		if d.precision < 2 || 16 < d.precision {
+			return FormatError("bad sample precision")
+		}
+	case d.precision == 12 && !d.baseline:
+	case d.precision != 8:
 		return UnsupportedError("precision")
 	}
+	if d.nComp == 4 && d.highPrecision() {
+		return UnsupportedError("4-component image of high precision")
+	}
 	d.height = int(d.tmp[1])<<8 + int(d.tmp[2])
 	d.width = int(d.tmp[3])<<8 + int(d.tmp[4])
 	if int(d.tmp[5]) != d.nComp {
@@ -498,6 +545,19 @@ func (d *decoder) processApp0Marker(n int) error {
 	n -= 5
 
 	d.jfif = d.tmp[0] == 'J' && d.tmp[1] == 'F' && d.tmp[2] == 'I' && d.tmp[3] == 'F' && d.tmp[4] == '\x00'
+	if d.jfif && n >= 9 {
+		if err := d.readFull(d.tmp[:9]); err != nil {
+			return err
+		}
+		n -= 9
+		d.jfifHeader = &JFIF{
+			MajorVersion: d.tmp[0],
+			MinorVersion: d.tmp[1],
+			Unit:         DensityUnit(d.tmp[2]),
+			XDensity:     uint16(d.tmp[3])<<8 | uint16(d.tmp[4]),
+			YDensity:     uint16(d.tmp[5])<<8 | uint16(d.tmp[6]),
+		}
+	}
 
 	if n > 0 {
 		return d.ignore(n)
@@ -607,9 +667,11 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 		}
 
 		switch marker {
-		case sof0Marker, sof1Marker, sof2Marker:
+		case sof0Marker, sof1Marker, sof2Marker, sof3Marker, sof9Marker, sof10Marker:
 			d.baseline = marker == sof0Marker
-			d.progressive = marker == sof2Marker
+			d.progressive = marker == sof2Marker || marker == sof10Marker
+			d.lossless = marker == sof3Marker
+			d.arithmetic = marker == sof9Marker || marker == sof10Marker
 			err = d.processSOF(n)
 			if configOnly && d.jfif {
 				return nil, err
@@ -626,6 +688,12 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			} else {
 				err = d.processDQT(n)
 			}
+		case dacMarker:
+			if configOnly {
+				err = d.ignore(n)
+			} else {
+				err = d.processDAC(n)
+			}
 		case sosMarker:
 			if configOnly {
 				return nil, nil
@@ -660,6 +728,9 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			return nil, err
 		}
 	}
+	if d.pix16[0] != nil {
+		return d.convertTo16()
+	}
 	if d.img1 != nil {
 		return d.img1, nil
 	}
@@ -776,12 +847,130 @@ func (d *decoder) convertToRGB() (image.Image, error) {
 	return img, nil
 }
 
+// bounds returns the bounds of the decoded image. The size of the image is
+// divided by the scale denominator, rounding up.
+func (d *decoder) bounds() image.Rectangle {
+	s := d.scaleShift
+	return image.Rect(0, 0, (d.width+1<<s-1)>>s, (d.height+1<<s-1)>>s)
+}
+
+// highPrecision reports whether the samples are decoded into the sample
+// planes instead of the 8-bit images.
+func (d *decoder) highPrecision() bool {
+	return d.precision != 8 || d.lossless
+}
+
+// convertTo16 combines the sample planes into an *image.Gray16 or an
+// *image.RGBA64. The samples are scaled to 16 bits, and the YCbCr samples are
+// converted to RGB unless the image is already RGB.
+func (d *decoder) convertTo16() (image.Image, error) {
+	maxVal := uint32(1)<<d.precision - 1
+	scale := func(v uint32) uint16 {
+		v = min(v, maxVal)
+		return uint16((v*0xffff + maxVal/2) / maxVal)
+	}
+	bounds := d.bounds()
+	if d.nComp == 1 {
+		img := image.NewGray16(bounds)
+		pix, stride := d.pix16[0], d.stride16[0]
+		for y := 0; y < bounds.Max.Y; y++ {
+			for x := 0; x < bounds.Max.X; x++ {
+				v := scale(uint32(pix[y*stride+x]))
+				i := img.PixOffset(x, y)
+				img.Pix[i+0] = uint8(v >> 8)
+				img.Pix[i+1] = uint8(v)
+			}
+		}
+		return img, nil
+	}
+
+	if d.nComp != 3 {
+		return nil, UnsupportedError("4-component image of high precision")
+	}
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	isRGB := d.isRGB()
+	img := image.NewRGBA64(bounds)
+	for y := 0; y < bounds.Max.Y; y++ {
+		for x := 0; x < bounds.Max.X; x++ {
+			// The chroma components may be subsampled.
+			var c [3]uint32
+			for i := range c {
+				sx := x * d.comp[i].h / h0
+				sy := y * d.comp[i].v / v0
+				c[i] = uint32(d.pix16[i][sy*d.stride16[i]+sx])
+			}
+			if !isRGB {
+				c[0], c[1], c[2] = yCbCrToRGB(c[0], c[1], c[2], d.precision)
+			}
+			i := img.PixOffset(x, y)
+			for j, v := range c {
+				v := scale(v)
+				img.Pix[i+2*j+0] = uint8(v >> 8)
+				img.Pix[i+2*j+1] = uint8(v)
+			}
+			img.Pix[i+6] = 0xff
+			img.Pix[i+7] = 0xff
+		}
+	}
+	return img, nil
+}
+
+// yCbCrToRGB converts the YCbCr samples of the given precision to RGB, with
+// the same coefficients as color.YCbCrToRGB.
+func yCbCrToRGB(y, cb, cr uint32, precision int) (r, g, b uint32) {
+	maxVal := int64(1)<<precision - 1
+	half := int64(1) << (precision - 1)
+	yy := int64(y)<<16 + 1<<15
+	cb1 := int64(cb) - half
+	cr1 := int64(cr) - half
+	clamp := func(v int64) uint32 {
+		return uint32(max(0, min(v>>16, maxVal)))
+	}
+	r = clamp(yy + 91881*cr1)
+	g = clamp(yy - 22554*cb1 - 46802*cr1)
+	b = clamp(yy + 116130*cb1)
+	return
+}
+
 // Decode reads a JPEG image from r and returns it as an image.Image.
+// The images of 12-bit precision and the lossless images are returned as an
+// *image.Gray16 or an *image.RGBA64.
 func Decode(r io.Reader) (image.Image, error) {
 	var d decoder
 	return d.decode(r, false)
 }
 
+// DecodeOptions are the decoding parameters.
+type DecodeOptions struct {
+	// ScaleDenom is the denominator of the scale of the decoded image: 1, 2,
+	// 4 or 8. The width and the height of the image are divided by it,
+	// rounding up. The image is reconstructed by the reduced-size inverse
+	// DCTs on the coefficients, or only from the DC coefficients for 8, which
+	// is much faster than decoding the full-size image and resizing it.
+	// Zero means 1. Lossless images can't be scaled.
+	ScaleDenom int
+}
+
+// DecodeWithOptions reads a JPEG image from r with the given options and
+// returns it as an image.Image. A nil o is the same as the zero options.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	var d decoder
+	if o != nil {
+		switch o.ScaleDenom {
+		case 0, 1:
+		case 2:
+			d.scaleShift = 1
+		case 4:
+			d.scaleShift = 2
+		case 8:
+			d.scaleShift = 3
+		default:
+			return nil, errors.New("jpeg: invalid scale denominator")
+		}
+	}
+	return d.decode(r, false)
+}
+
 // DecodeConfig returns the color model and dimensions of a JPEG image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
@@ -791,6 +980,13 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	}
 	switch d.nComp {
 	case 1:
+		if d.highPrecision() {
+			return image.Config{
+				ColorModel: color.Gray16Model,
+				Width:      d.width,
+				Height:     d.height,
+			}, nil
+		}
 		return image.Config{
 			ColorModel: color.GrayModel,
 			Width:      d.width,
@@ -798,7 +994,9 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		}, nil
 	case 3:
 		cm := color.YCbCrModel
-		if d.isRGB() {
+		if d.highPrecision() {
+			cm = color.RGBA64Model
+		} else if d.isRGB() {
 			cm = color.RGBAModel
 		}
 		return image.Config{
@@ -5,12 +5,14 @@
 package jpeg
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"runtime/debug"
@@ -504,7 +506,7 @@ func TestIssue56724(t *testing.T) {
 	}
 }
 
-func benchmarkDecode(b *testing.B, filename string) {
+func benchmarkDecode(b *testing.B, filename string, o *DecodeOptions) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		b.Fatal(err)
@@ -517,14 +519,352 @@ func benchmarkDecode(b *testing.B, filename string) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		Decode(bytes.NewReader(data))
+		DecodeWithOptions(bytes.NewReader(data), o)
 	}
 }
 
 func BenchmarkDecodeBaseline(b *testing.B) {
-	benchmarkDecode(b, "../testdata/video-001.jpeg")
+	benchmarkDecode(b, "../testdata/video-001.jpeg", nil)
 }
 
 func BenchmarkDecodeProgressive(b *testing.B) {
-	benchmarkDecode(b, "../testdata/video-001.progressive.jpeg")
+	benchmarkDecode(b, "../testdata/video-001.progressive.jpeg", nil)
+}
+
+func BenchmarkDecodeScaled(b *testing.B) {
+	for _, denom := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("1/%d", denom), func(b *testing.B) {
+			benchmarkDecode(b, "../testdata/video-001.jpeg", &DecodeOptions{ScaleDenom: denom})
+		})
+	}
+}
+
+// encode12 encodes the 12-bit samples in the extended sequential mode, or in
+// the progressive mode if progressive is true. samples[i] are the samples of
+// the i'th component in raster order. The quantizers are all 1.
+func encode12(samples [][]uint16, width, height int, progressive bool, ids []byte) []byte {
+	var buf bytes.Buffer
+	var e encoder
+	e.w = bufio.NewWriter(&buf)
+	e.write([]byte{0xff, soiMarker})
+	for i := range e.quant {
+		for zig := range e.quant[i] {
+			e.quant[i][zig] = 1
+		}
+	}
+	e.writeDQT()
+	marker := uint8(sof1Marker)
+	if progressive {
+		marker = sof2Marker
+	}
+	writeTestSOF(&e, marker, 12, width, height, ids)
+	// The DC differences of 12-bit samples have the categories up to 15, and
+	// the AC coefficients have the sizes up to 15.
+	e.huffSpec[huffIndexLuminanceDC] = fullHuffmanSpec(16)
+	e.huffSpec[huffIndexLuminanceAC] = fullHuffmanSpec(256)
+	for _, h := range []huffIndex{huffIndexLuminanceDC, huffIndexLuminanceAC} {
+		e.huffLUT[h].init(e.huffSpec[h])
+	}
+	e.writeDHT([]huffIndex{huffIndexLuminanceDC, huffIndexLuminanceAC})
+
+	e.nComp = len(ids)
+	e.size = image.Pt(width, height)
+	e.progressive = progressive
+	e.maxEOBRun = 0x7fff
+	for i := range ids {
+		e.comp[i] = component{h: 1, v: 1, c: ids[i], tq: 0}
+	}
+	mxx, myy := e.mcuSize(e.size)
+	for ci, s := range samples {
+		e.coeffs[ci] = make([]block, mxx*myy)
+		for by := 0; by < myy; by++ {
+			for bx := 0; bx < mxx; bx++ {
+				// Compute the DCT coefficients of the level shifted samples, as
+				// specified in section A.3.3.
+				var f [8][8]float64
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						sx := min(8*bx+x, width-1)
+						sy := min(8*by+y, height-1)
+						f[y][x] = float64(s[sy*width+sx]) - 2048
+					}
+				}
+				b := &e.coeffs[ci][by*mxx+bx]
+				for v := 0; v < 8; v++ {
+					for u := 0; u < 8; u++ {
+						var sum float64
+						for y := 0; y < 8; y++ {
+							for x := 0; x < 8; x++ {
+								sum += f[y][x] *
+									math.Cos(float64((2*x+1)*u)*math.Pi/16) *
+									math.Cos(float64((2*y+1)*v)*math.Pi/16)
+							}
+						}
+						cu, cv := 1.0, 1.0
+						if u == 0 {
+							cu = 1 / math.Sqrt2
+						}
+						if v == 0 {
+							cv = 1 / math.Sqrt2
+						}
+						b[8*v+u] = int32(math.Round(cu * cv * sum / 4))
+					}
+				}
+			}
+		}
+	}
+
+	scans := []Scan{{Components: []int{0, 1, 2}[:e.nComp], Ss: 0, Se: blockSize - 1}}
+	if progressive {
+		scans = defaultScanScript(e.nComp)
+	}
+	for i := range scans {
+		e.writeScan(&scans[i])
+	}
+	e.write([]byte{0xff, eoiMarker})
+	e.flush()
+	return buf.Bytes()
+}
+
+func TestDecode12Bit(t *testing.T) {
+	const width, height = 27, 18
+	rnd := rand.New(rand.NewSource(12))
+	var samples [3][]uint16
+	for i := range samples {
+		samples[i] = make([]uint16, width*height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := 2048 + 1500*math.Sin(float64(x+7*i)/5)*math.Cos(float64(y)/4) + float64(rnd.Intn(64))
+				samples[i][y*width+x] = uint16(v)
+			}
+		}
+	}
+
+	for _, progressive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gray/progressive=%t", progressive), func(t *testing.T) {
+			data := encode12(samples[:1], width, height, progressive, []byte{1})
+			m, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gray, ok := m.(*image.Gray16)
+			if !ok {
+				t.Fatalf("got %T, want *image.Gray16", m)
+			}
+			// The coefficients are rounded, so the samples may be off by one.
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					want := uint32(samples[0][y*width+x]) * 0xffff / 4095
+					if got := uint32(gray.Gray16At(x, y).Y); delta(got, want) > 2*0x10 {
+						t.Fatalf("(%d, %d): got %#04x, want %#04x", x, y, got, want)
+					}
+				}
+			}
+		})
+
+		t.Run(fmt.Sprintf("rgb/progressive=%t", progressive), func(t *testing.T) {
+			data := encode12(samples[:], width, height, progressive, []byte{'R', 'G', 'B'})
+			m, err := Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rgba, ok := m.(*image.RGBA64)
+			if !ok {
+				t.Fatalf("got %T, want *image.RGBA64", m)
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					c := rgba.RGBA64At(x, y)
+					for i, got := range []uint16{c.R, c.G, c.B} {
+						want := uint32(samples[i][y*width+x]) * 0xffff / 4095
+						if delta(uint32(got), want) > 2*0x10 {
+							t.Fatalf("(%d, %d): got %v, want %#04x in component %d", x, y, c, want, i)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecode12Bit_KnownAnswer(t *testing.T) {
+	// The file is assembled by hand from annex F, independently of the
+	// decoder. It is a 16x8 12-bit image with two blocks that have only the
+	// DC coefficients 100 and -300, and the DC quantizer is 4 in a 16-bit
+	// quantization table. The samples are 2048+100*4/8 and 2048-300*4/8.
+	m, err := decodeFile("../testdata/tiny.12bit.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := m.(*image.Gray16)
+	if !ok {
+		t.Fatalf("got %T, want *image.Gray16", m)
+	}
+	want := make([]uint16, 16*8)
+	for i := range want {
+		want[i] = 2098
+		if i%16 >= 8 {
+			want[i] = 1898
+		}
+	}
+	if err := checkGray16(gray, want, 12); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecode12Bit_Baseline(t *testing.T) {
+	data := encode12([][]uint16{make([]uint16, 8*8)}, 8, 8, false, []byte{1})
+	// The baseline mode supports only 8-bit precision.
+	data = bytes.Replace(data, []byte{0xff, sof1Marker}, []byte{0xff, sof0Marker}, 1)
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+// testPlane is a sample plane of an image, for comparing the scaled images.
+type testPlane struct {
+	w, h int
+	at   func(x, y int) float64
+}
+
+// testPlanes returns the sample planes of m in 8 bits. The planes of the
+// *image.Gray and *image.YCbCr images are the stored ones, which may be
+// subsampled, and the planes of the other images are R, G and B.
+func testPlanes(m image.Image) []testPlane {
+	b := m.Bounds()
+	switch m := m.(type) {
+	case *image.Gray:
+		return []testPlane{{b.Dx(), b.Dy(), func(x, y int) float64 {
+			return float64(m.Pix[m.PixOffset(x, y)])
+		}}}
+	case *image.YCbCr:
+		cw, ch := b.Dx(), b.Dy()
+		switch m.SubsampleRatio {
+		case image.YCbCrSubsampleRatio422:
+			cw = (cw + 1) / 2
+		case image.YCbCrSubsampleRatio420:
+			cw, ch = (cw+1)/2, (ch+1)/2
+		}
+		return []testPlane{
+			{b.Dx(), b.Dy(), func(x, y int) float64 { return float64(m.Y[y*m.YStride+x]) }},
+			{cw, ch, func(x, y int) float64 { return float64(m.Cb[y*m.CStride+x]) }},
+			{cw, ch, func(x, y int) float64 { return float64(m.Cr[y*m.CStride+x]) }},
+		}
+	}
+	var planes []testPlane
+	for i := 0; i < 3; i++ {
+		i := i
+		planes = append(planes, testPlane{b.Dx(), b.Dy(), func(x, y int) float64 {
+			r, g, b, _ := m.At(x, y).RGBA()
+			return float64([]uint32{r, g, b}[i]) / 0x101
+		}})
+	}
+	return planes
+}
+
+func TestDecodeScaled(t *testing.T) {
+	const width, height = 101, 67
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	gray := image.NewGray(rgba.Bounds())
+	cmyk := image.NewCMYK(rgba.Bounds())
+	samples := make([]uint16, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{uint8(128 + 100*math.Sin(float64(x)/9)), uint8(2 * y), uint8(x + y), 0xff}
+			rgba.SetRGBA(x, y, c)
+			gray.Set(x, y, c)
+			cmyk.Set(x, y, c)
+			samples[y*width+x] = uint16(2048 + 1500*math.Sin(float64(x)/7)*math.Cos(float64(y)/11))
+		}
+	}
+	encode := func(m image.Image, o *Options) []byte {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, o); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"gray", encode(gray, &Options{Quality: 90})},
+		{"ycbcr/420", encode(rgba, &Options{Quality: 90})},
+		{"ycbcr/444", encode(rgba, &Options{Quality: 95, Subsampling: Subsampling444})},
+		{"ycbcr/422/progressive", encode(rgba, &Options{Quality: 90, Subsampling: Subsampling422, Progressive: true})},
+		{"cmyk", encode(cmyk, &Options{Quality: 90})},
+		{"gray/12bit", encode12([][]uint16{samples}, width, height, false, []byte{1})},
+	}
+	for _, tt := range tests {
+		full, err := Decode(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, denom := range []int{1, 2, 4, 8} {
+			t.Run(fmt.Sprintf("%s/1:%d", tt.name, denom), func(t *testing.T) {
+				got, err := DecodeWithOptions(bytes.NewReader(tt.data), &DecodeOptions{ScaleDenom: denom})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := image.Rect(0, 0, (width+denom-1)/denom, (height+denom-1)/denom)
+				if got.Bounds() != want {
+					t.Fatalf("got bounds %v, want %v", got.Bounds(), want)
+				}
+				if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", full) {
+					t.Fatalf("got %T, want %T", got, full)
+				}
+
+				// Each sample of the scaled image is close to the average of the
+				// corresponding samples of the full-size image, though not equal
+				// since the reduced-size IDCTs sample the center of the area. The
+				// edge samples are skipped because the blocks there are padded.
+				fullPlanes, gotPlanes := testPlanes(full), testPlanes(got)
+				for i, p := range gotPlanes {
+					q := fullPlanes[i]
+					var sum float64
+					n := 0
+					for y := 0; y < p.h-1; y++ {
+						for x := 0; x < p.w-1; x++ {
+							var avg float64
+							for yy := y * denom; yy < (y+1)*denom; yy++ {
+								for xx := x * denom; xx < (x+1)*denom; xx++ {
+									avg += q.at(xx, yy)
+								}
+							}
+							avg /= float64(denom * denom)
+							d := math.Abs(p.at(x, y) - avg)
+							if denom == 1 && d != 0 {
+								t.Fatalf("plane %d (%d, %d): got %v, want %v", i, x, y, p.at(x, y), avg)
+							}
+							if d > 6 {
+								t.Fatalf("plane %d (%d, %d): got %v, want about %v", i, x, y, p.at(x, y), avg)
+							}
+							sum += d
+							n++
+						}
+					}
+					if mean := sum / float64(n); mean > 2.5 {
+						t.Errorf("plane %d: mean difference %.2f is too large", i, mean)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeScaled_Errors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), &DecodeOptions{ScaleDenom: 3}); err == nil {
+		t.Error("ScaleDenom 3: want error, got nil")
+	}
+
+	data := encodeLossless([][]uint16{make([]uint16, 8*8)}, 8, 8, 8, 1, 0, 0, []byte{1})
+	_, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{ScaleDenom: 2})
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Errorf("lossless: got %v, want UnsupportedError", err)
+	}
 }
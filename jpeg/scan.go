@@ -9,10 +9,25 @@ import (
 )
 
 // makeImg allocates and initializes the destination image.
+// mxx and myy are the number of MCUs in the image.
 func (d *decoder) makeImg(mxx, myy int) {
+	// size is the size of the reconstructed blocks.
+	size := 8 >> d.scaleShift
+	if d.highPrecision() {
+		// An MCU of a lossless image has h*v samples of each component,
+		// instead of h*v blocks.
+		if d.lossless {
+			size = 1
+		}
+		for i, c := range d.comp[:d.nComp] {
+			d.stride16[i] = size * c.h * mxx
+			d.pix16[i] = make([]uint16, d.stride16[i]*size*c.v*myy)
+		}
+		return
+	}
 	if d.nComp == 1 {
-		m := image.NewGray(image.Rect(0, 0, 8*mxx, 8*myy))
-		d.img1 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.Gray)
+		m := image.NewGray(image.Rect(0, 0, size*mxx, size*myy))
+		d.img1 = m.SubImage(d.bounds()).(*image.Gray)
 		return
 	}
 
@@ -37,16 +52,23 @@ func (d *decoder) makeImg(mxx, myy int) {
 	default:
 		panic("unreachable")
 	}
-	m := image.NewYCbCr(image.Rect(0, 0, 8*h0*mxx, 8*v0*myy), subsampleRatio)
-	d.img3 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.YCbCr)
+	m := image.NewYCbCr(image.Rect(0, 0, size*h0*mxx, size*v0*myy), subsampleRatio)
+	d.img3 = m.SubImage(d.bounds()).(*image.YCbCr)
 
 	if d.nComp == 4 {
 		h3, v3 := d.comp[3].h, d.comp[3].v
-		d.blackPix = make([]byte, 8*h3*mxx*8*v3*myy)
-		d.blackStride = 8 * h3 * mxx
+		d.blackPix = make([]byte, size*h3*mxx*size*v3*myy)
+		d.blackStride = size * h3 * mxx
 	}
 }
 
+// scanComponent is a component specification of a scan.
+type scanComponent struct {
+	compIndex uint8
+	td        uint8 // DC table selector.
+	ta        uint8 // AC table selector.
+}
+
 // Specified in section B.2.3.
 func (d *decoder) processSOS(n int) error {
 	if d.nComp == 0 {
@@ -62,11 +84,7 @@ func (d *decoder) processSOS(n int) error {
 	if n != 4+2*nComp {
 		return FormatError("SOS length inconsistent with number of components")
 	}
-	var scan [maxComponents]struct {
-		compIndex uint8
-		td        uint8 // DC table selector.
-		ta        uint8 // AC table selector.
-	}
+	var scan [maxComponents]scanComponent
 	totalHV := 0
 	for i := 0; i < nComp; i++ {
 		cs := d.tmp[1+2*i] // Component selector.
@@ -108,6 +126,19 @@ func (d *decoder) processSOS(n int) error {
 		return FormatError("total sampling factors too large")
 	}
 
+	if d.lossless {
+		if d.scaleShift != 0 {
+			// The lossless mode has no DCT coefficients to scale.
+			return UnsupportedError("scaled decoding of lossless image")
+		}
+		if d.coeffsOnly {
+			return UnsupportedError("DCT coefficients of lossless image")
+		}
+		// The lossless mode uses Ss and Al as the predictor and the point
+		// transform, as per section H.2.2.
+		return d.processLosslessSOS(scan[:nComp], d.tmp[1+2*nComp], d.tmp[3+2*nComp]&0x0f)
+	}
+
 	// zigStart and zigEnd are the spectral selection bounds.
 	// ah and al are the successive approximation high and low values.
 	// The spec calls these values Ss, Se, Ah and Al.
@@ -146,10 +177,10 @@ func (d *decoder) processSOS(n int) error {
 	h0, v0 := d.comp[0].h, d.comp[0].v // The h and v values from the Y components.
 	mxx := (d.width + 8*h0 - 1) / (8 * h0)
 	myy := (d.height + 8*v0 - 1) / (8 * v0)
-	if d.img1 == nil && d.img3 == nil {
+	if !d.coeffsOnly && d.img1 == nil && d.img3 == nil && d.pix16[0] == nil {
 		d.makeImg(mxx, myy)
 	}
-	if d.progressive {
+	if d.progressive || d.coeffsOnly {
 		for i := 0; i < nComp; i++ {
 			compIndex := scan[i].compIndex
 			if d.progCoeffs[compIndex] == nil {
@@ -159,6 +190,7 @@ func (d *decoder) processSOS(n int) error {
 	}
 
 	d.bits = bits{}
+	d.arith.reset()
 	mcu, expectedRST := 0, uint8(rst0Marker)
 	var (
 		// b is the decoded coefficients, in natural (not zig-zag) order.
@@ -212,6 +244,15 @@ func (d *decoder) processSOS(n int) error {
 						if bx*8 >= d.width || by*8 >= d.height {
 							continue
 						}
+						// In non-interleaved scans, each block is an MCU on its own, and
+						// restart intervals count the blocks inside the image, as per
+						// section A.2.2.
+						if d.ri > 0 && mcu > 0 && mcu%d.ri == 0 {
+							if err := d.processRST(&expectedRST, &dc); err != nil {
+								return err
+							}
+						}
+						mcu++
 					}
 
 					// Load the previous partially decoded coefficients, if applicable.
@@ -221,7 +262,11 @@ func (d *decoder) processSOS(n int) error {
 						b = block{}
 					}
 
-					if ah != 0 {
+					if d.arithmetic {
+						if err := d.decodeArithBlock(&b, scan[i], zigStart, zigEnd, ah, al, &dc); err != nil {
+							return err
+						}
+					} else if ah != 0 {
 						if err := d.refine(&b, &d.huff[acTable][scan[i].ta], zigStart, zigEnd, 1<<al); err != nil {
 							return err
 						}
@@ -286,7 +331,7 @@ func (d *decoder) processSOS(n int) error {
 						}
 					}
 
-					if d.progressive {
+					if d.progressive || d.coeffsOnly {
 						// Save the coefficients.
 						d.progCoeffs[compIndex][by*mxx*hi+bx] = b
 						// At this point, we could call reconstructBlock to dequantize and perform the
@@ -303,45 +348,13 @@ func (d *decoder) processSOS(n int) error {
 					}
 				} // for j
 			} // for i
-			mcu++
-			if d.ri > 0 && mcu%d.ri == 0 && mcu < mxx*myy {
-				// A more sophisticated decoder could use RST[0-7] markers to resynchronize from corrupt input,
-				// but this one assumes well-formed input, and hence the restart marker follows immediately.
-				if err := d.readFull(d.tmp[:2]); err != nil {
-					return err
-				}
-
-				// Section F.1.2.3 says that "Byte alignment of markers is
-				// achieved by padding incomplete bytes with 1-bits. If padding
-				// with 1-bits creates a X’FF’ value, a zero byte is stuffed
-				// before adding the marker."
-				//
-				// Seeing "\xff\x00" here is not spec compliant, as we are not
-				// expecting an *incomplete* byte (that needed padding). Still,
-				// some real world encoders (see golang.org/issue/28717) insert
-				// it, so we accept it and re-try the 2 byte read.
-				//
-				// libjpeg issues a warning (but not an error) for this:
-				// https://github.com/LuaDist/libjpeg/blob/6c0fcb8ddee365e7abc4d332662b06900612e923/jdmarker.c#L1041-L1046
-				if d.tmp[0] == 0xff && d.tmp[1] == 0x00 {
-					if err := d.readFull(d.tmp[:2]); err != nil {
+			if nComp != 1 {
+				mcu++
+				if d.ri > 0 && mcu%d.ri == 0 && mcu < mxx*myy {
+					if err := d.processRST(&expectedRST, &dc); err != nil {
 						return err
 					}
 				}
-
-				if d.tmp[0] != 0xff || d.tmp[1] != expectedRST {
-					return FormatError("bad RST marker")
-				}
-				expectedRST++
-				if expectedRST == rst7Marker+1 {
-					expectedRST = rst0Marker
-				}
-				// Reset the Huffman decoder.
-				d.bits = bits{}
-				// Reset the DC components, as per section F.2.1.3.1.
-				dc = [maxComponents]int32{}
-				// Reset the progressive decoder state, as per section G.1.2.2.
-				d.eobRun = 0
 			}
 		} // for mx
 	} // for my
@@ -349,6 +362,58 @@ func (d *decoder) processSOS(n int) error {
 	return nil
 }
 
+// processRST reads the expected RST marker at the end of a restart interval,
+// and resets the decoder state.
+func (d *decoder) processRST(expectedRST *uint8, dc *[maxComponents]int32) error {
+	// A more sophisticated decoder could use RST[0-7] markers to resynchronize from corrupt input,
+	// but this one assumes well-formed input, and hence the restart marker follows immediately.
+	// The arithmetic decoder may stop before the end of the data, though, since the encoder can
+	// write bytes that the decoder doesn't need.
+	if d.arithmetic {
+		if err := d.skipArithData(); err != nil {
+			return err
+		}
+	}
+	if err := d.readFull(d.tmp[:2]); err != nil {
+		return err
+	}
+
+	// Section F.1.2.3 says that "Byte alignment of markers is
+	// achieved by padding incomplete bytes with 1-bits. If padding
+	// with 1-bits creates a X’FF’ value, a zero byte is stuffed
+	// before adding the marker."
+	//
+	// Seeing "\xff\x00" here is not spec compliant, as we are not
+	// expecting an *incomplete* byte (that needed padding). Still,
+	// some real world encoders (see golang.org/issue/28717) insert
+	// it, so we accept it and re-try the 2 byte read.
+	//
+	// libjpeg issues a warning (but not an error) for this:
+	// https://github.com/LuaDist/libjpeg/blob/6c0fcb8ddee365e7abc4d332662b06900612e923/jdmarker.c#L1041-L1046
+	if d.tmp[0] == 0xff && d.tmp[1] == 0x00 {
+		if err := d.readFull(d.tmp[:2]); err != nil {
+			return err
+		}
+	}
+
+	if d.tmp[0] != 0xff || d.tmp[1] != *expectedRST {
+		return FormatError("bad RST marker")
+	}
+	*expectedRST++
+	if *expectedRST == rst7Marker+1 {
+		*expectedRST = rst0Marker
+	}
+	// Reset the Huffman decoder.
+	d.bits = bits{}
+	// Reset the DC components, as per section F.2.1.3.1.
+	*dc = [maxComponents]int32{}
+	// Reset the progressive decoder state, as per section G.1.2.2.
+	d.eobRun = 0
+	// Reset the arithmetic decoder and its statistics bins.
+	d.arith.reset()
+	return nil
+}
+
 // refine decodes a successive approximation refinement block, as specified in
 // section G.1.2.
 func (d *decoder) refine(b *block, h *huffman, zigStart, zigEnd, delta int32) error {
@@ -479,35 +544,45 @@ func (d *decoder) reconstructProgressiveImage() error {
 }
 
 // reconstructBlock dequantizes, performs the inverse DCT and stores the block
-// to the image.
+// to the image. The reconstructed block has n×n samples, where n is 8 scaled
+// by the decode options.
 func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
 	qt := &d.quant[d.comp[compIndex].tq]
 	for zig := 0; zig < blockSize; zig++ {
 		b[unzig[zig]] *= qt[zig]
 	}
-	idct(b)
+	n := 8 >> d.scaleShift
+	if d.highPrecision() {
+		d.reconstructBlock16(b, bx, by, compIndex, n)
+		return nil
+	}
+	if n == 8 {
+		idct(b)
+	} else {
+		idctScaled(b, n)
+	}
 	dst, stride := []byte(nil), 0
 	if d.nComp == 1 {
-		dst, stride = d.img1.Pix[8*(by*d.img1.Stride+bx):], d.img1.Stride
+		dst, stride = d.img1.Pix[n*(by*d.img1.Stride+bx):], d.img1.Stride
 	} else {
 		switch compIndex {
 		case 0:
-			dst, stride = d.img3.Y[8*(by*d.img3.YStride+bx):], d.img3.YStride
+			dst, stride = d.img3.Y[n*(by*d.img3.YStride+bx):], d.img3.YStride
 		case 1:
-			dst, stride = d.img3.Cb[8*(by*d.img3.CStride+bx):], d.img3.CStride
+			dst, stride = d.img3.Cb[n*(by*d.img3.CStride+bx):], d.img3.CStride
 		case 2:
-			dst, stride = d.img3.Cr[8*(by*d.img3.CStride+bx):], d.img3.CStride
+			dst, stride = d.img3.Cr[n*(by*d.img3.CStride+bx):], d.img3.CStride
 		case 3:
-			dst, stride = d.blackPix[8*(by*d.blackStride+bx):], d.blackStride
+			dst, stride = d.blackPix[n*(by*d.blackStride+bx):], d.blackStride
 		default:
 			return UnsupportedError("too many components")
 		}
 	}
 	// Level shift by +128, clip to [0, 255], and write to dst.
-	for y := 0; y < 8; y++ {
+	for y := 0; y < n; y++ {
 		y8 := y * 8
 		yStride := y * stride
-		for x := 0; x < 8; x++ {
+		for x := 0; x < n; x++ {
 			c := b[y8+x]
 			if c < -128 {
 				c = 0
@@ -521,3 +596,24 @@ func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
 	}
 	return nil
 }
+
+// reconstructBlock16 performs the inverse DCT on the dequantized block and
+// stores the n×n samples to the sample plane of the component.
+func (d *decoder) reconstructBlock16(b *block, bx, by, compIndex, n int) {
+	// The integer idct may overflow with the coefficients of 12-bit samples.
+	if n == 8 {
+		idctFloat(b)
+	} else {
+		idctScaled(b, n)
+	}
+	stride := d.stride16[compIndex]
+	dst := d.pix16[compIndex][n*(by*stride+bx):]
+	// Level shift by +2^(P-1), clip to [0, 2^P-1], and write to dst.
+	half := int32(1) << (d.precision - 1)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			c := b[8*y+x] + half
+			dst[y*stride+x] = uint16(max(0, min(c, 2*half-1)))
+		}
+	}
+}
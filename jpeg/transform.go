@@ -0,0 +1,359 @@
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"io"
+	"strconv"
+
+	"github.com/shogo82148/go-imaging/exif"
+)
+
+// Transformation is a lossless transformation of a JPEG image. It rearranges
+// the quantized DCT coefficients of the image, instead of decoding and
+// re-encoding the pixels, so that it doesn't lose any quality.
+type Transformation int
+
+const (
+	// TransformNone keeps the image as is.
+	TransformNone Transformation = 0
+
+	// TransformFlipHorizontal mirrors the image horizontally.
+	TransformFlipHorizontal Transformation = 1
+
+	// TransformFlipVertical mirrors the image vertically.
+	TransformFlipVertical Transformation = 2
+
+	// TransformTranspose mirrors the image across the diagonal from the
+	// top-left corner to the bottom-right corner.
+	TransformTranspose Transformation = 3
+
+	// TransformTransverse mirrors the image across the diagonal from the
+	// top-right corner to the bottom-left corner.
+	TransformTransverse Transformation = 4
+
+	// TransformRotate90 rotates the image by 90 degrees clockwise.
+	TransformRotate90 Transformation = 5
+
+	// TransformRotate180 rotates the image by 180 degrees.
+	TransformRotate180 Transformation = 6
+
+	// TransformRotate270 rotates the image by 270 degrees clockwise.
+	TransformRotate270 Transformation = 7
+)
+
+// transformAxes are the operations that make up a transformation. It
+// transposes the image if transpose is true, and then mirrors the result
+// horizontally if flipX is true, and vertically if flipY is true.
+type transformAxes struct {
+	transpose, flipX, flipY bool
+}
+
+// transformationAxes are the operations of each transformation.
+var transformationAxes = [...]transformAxes{
+	TransformNone:           {false, false, false},
+	TransformFlipHorizontal: {false, true, false},
+	TransformFlipVertical:   {false, false, true},
+	TransformTranspose:      {true, false, false},
+	TransformTransverse:     {true, true, true},
+	TransformRotate90:       {true, true, false},
+	TransformRotate180:      {false, true, true},
+	TransformRotate270:      {true, false, true},
+}
+
+// OrientationTransformation returns the transformation that makes an image
+// of the Exif orientation o upright.
+func OrientationTransformation(o exif.Orientation) Transformation {
+	switch o {
+	case exif.OrientationTopRight:
+		return TransformFlipHorizontal
+	case exif.OrientationBottomRight:
+		return TransformRotate180
+	case exif.OrientationBottomLeft:
+		return TransformFlipVertical
+	case exif.OrientationLeftTop:
+		return TransformTranspose
+	case exif.OrientationRightTop:
+		return TransformRotate90
+	case exif.OrientationRightBottom:
+		return TransformTransverse
+	case exif.OrientationLeftBottom:
+		return TransformRotate270
+	}
+	return TransformNone
+}
+
+// Then returns the transformation that applies t, and then u.
+func (t Transformation) Then(u Transformation) Transformation {
+	a, b := t.axes(), u.axes()
+	if b.transpose {
+		// Transposing swaps the directions of the preceding mirrors.
+		a.flipX, a.flipY = a.flipY, a.flipX
+	}
+	a.transpose = a.transpose != b.transpose
+	a.flipX = a.flipX != b.flipX
+	a.flipY = a.flipY != b.flipY
+	for i, x := range transformationAxes {
+		if x == a {
+			return Transformation(i)
+		}
+	}
+	panic("unreachable")
+}
+
+// axes returns the operations that make up t. An unknown transformation
+// keeps the image as is.
+func (t Transformation) axes() transformAxes {
+	if t < 0 || int(t) >= len(transformationAxes) {
+		return transformAxes{}
+	}
+	return transformationAxes[t]
+}
+
+func (t Transformation) String() string {
+	switch t {
+	case TransformNone:
+		return "None"
+	case TransformFlipHorizontal:
+		return "FlipHorizontal"
+	case TransformFlipVertical:
+		return "FlipVertical"
+	case TransformTranspose:
+		return "Transpose"
+	case TransformTransverse:
+		return "Transverse"
+	case TransformRotate90:
+		return "Rotate90"
+	case TransformRotate180:
+		return "Rotate180"
+	case TransformRotate270:
+		return "Rotate270"
+	default:
+		return "Unknown Transformation: " + strconv.Itoa(int(t))
+	}
+}
+
+// TransformOptions are the parameters of Transform.
+type TransformOptions struct {
+	// Transformation is the transformation applied to the image.
+	Transformation Transformation
+
+	// AutoOrient specifies whether the image is made upright according to
+	// its Exif orientation before Transformation is applied.
+	AutoOrient bool
+
+	// Crop is the region of the transformed image to keep. Its top-left
+	// corner is rounded down to the MCU (Minimum Coded Unit) boundary, and it
+	// is clipped to the image. The zero rectangle keeps the whole image.
+	Crop image.Rectangle
+
+	// Progressive specifies whether the image is written in the progressive
+	// format (SOF2) instead of the sequential format.
+	Progressive bool
+}
+
+// Transform reads a JPEG image from r, applies the lossless transformation
+// and the crop of o, and writes the result to w. A nil *TransformOptions
+// keeps the image as is.
+//
+// The DCT coefficients are moved in whole MCUs, so the partial MCUs at the
+// right and bottom edges can't be moved to the opposite edges. They are
+// trimmed if the transformation mirrors the direction they are on.
+// If the image is narrower or shorter than one MCU, it isn't trimmed and
+// isn't mirrored in that direction.
+//
+// The quantization tables, the sampling factors and the color space of the
+// image are kept, and the Huffman tables are optimized. The metadata that
+// DecodeWithMeta reads are kept too, but the Exif orientation is reset to
+// TopLeft: use AutoOrient to keep the appearance of the image. The JFIF
+// densities are swapped if the image is transposed.
+// Lossless and 12-bit images, and images with more than two quantization
+// tables aren't supported, as EncodeCoefficients doesn't support them.
+func Transform(w io.Writer, r io.Reader, o *TransformOptions) error {
+	var d decoder
+	d.coeffsOnly = true
+	if err := d.processSegments(r); err != nil {
+		return err
+	}
+	src, err := d.coefficients()
+	if err != nil {
+		return err
+	}
+	if src.Precision != 8 {
+		return UnsupportedError("transformation of 12-bit image")
+	}
+	meta, err := d.meta()
+	if err != nil {
+		return err
+	}
+
+	var opts TransformOptions
+	if o != nil {
+		opts = *o
+	}
+	t := opts.Transformation
+	if opts.AutoOrient && meta.Exif != nil {
+		t = OrientationTransformation(meta.Exif.Orientation).Then(t)
+	}
+	if meta.Exif != nil && meta.Exif.Orientation != exif.OrientationUnknown {
+		meta.Exif.Orientation = exif.OrientationTopLeft
+	}
+	if meta.JFIF != nil && t.axes().transpose {
+		meta.JFIF.XDensity, meta.JFIF.YDensity = meta.JFIF.YDensity, meta.JFIF.XDensity
+	}
+	c, err := transformCoefficients(src, t, opts.Crop)
+	if err != nil {
+		return err
+	}
+
+	var e encoder
+	eo := &Options{Progressive: opts.Progressive, OptimizeHuffman: true}
+	if err := e.initCoefficients(w, c, eo); err != nil {
+		return err
+	}
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	// Write the metadata.
+	e.writeMeta(meta)
+	// Write the image.
+	if c.Adobe {
+		e.writeAdobeTransform(c.AdobeTransform)
+	}
+	e.writeCoeffs()
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
+
+// transformCoefficients returns the coefficients src transformed by t and
+// cropped to crop.
+func transformCoefficients(src *Coefficients, t Transformation, crop image.Rectangle) (*Coefficients, error) {
+	a := t.axes()
+	dst := *src
+	dst.Components = make([]ComponentCoefficients, len(src.Components))
+	// The transposed tables are shared like the source ones.
+	quant := map[*QuantTable]*QuantTable{}
+	for i, sc := range src.Components {
+		dc := &dst.Components[i]
+		*dc = sc
+		if a.transpose {
+			dc.H, dc.V = sc.V, sc.H
+			q, ok := quant[sc.QuantTable]
+			if !ok {
+				q = new(QuantTable)
+				for v := 0; v < 8; v++ {
+					for u := 0; u < 8; u++ {
+						q[u*8+v] = sc.QuantTable[v*8+u]
+					}
+				}
+				quant[sc.QuantTable] = q
+			}
+			dc.QuantTable = q
+		}
+	}
+	c0 := &dst.Components[0]
+	if c0.V == 4 {
+		// The subsampling ratio is valid, but Decode doesn't support it.
+		return nil, UnsupportedError("transposed luma/chroma subsampling ratio")
+	}
+
+	// Compute the size of the transformed image. The partial MCUs are
+	// trimmed if they would be moved to the left or top edge.
+	mw, mh := 8*c0.H, 8*c0.V
+	width, height := src.Width, src.Height
+	if a.transpose {
+		width, height = height, width
+	}
+	if a.flipX {
+		if width < mw {
+			// There is no whole MCU to move. Keep the image as jpegtran does.
+			a.flipX = false
+		} else {
+			width -= width % mw
+		}
+	}
+	if a.flipY {
+		if height < mh {
+			a.flipY = false
+		} else {
+			height -= height % mh
+		}
+	}
+	rect := image.Rect(0, 0, width, height)
+	if !crop.Empty() {
+		rect = crop.Intersect(rect)
+	}
+	if rect.Empty() {
+		return nil, errors.New("jpeg: empty transformed image")
+	}
+	rect.Min.X -= rect.Min.X % mw
+	rect.Min.Y -= rect.Min.Y % mh
+	dst.Width, dst.Height = rect.Dx(), rect.Dy()
+
+	// Move the blocks. (tbx, tby) is the location of the block in the
+	// transformed image, before mirroring it, and (sbx, sby) is the location
+	// in the source image.
+	mxx := (dst.Width + mw - 1) / mw
+	myy := (dst.Height + mh - 1) / mh
+	for i := range dst.Components {
+		sc, dc := &src.Components[i], &dst.Components[i]
+		dc.BlocksWide, dc.BlocksHigh = mxx*dc.H, myy*dc.V
+		dc.Blocks = make([]Block, dc.BlocksWide*dc.BlocksHigh)
+		// (ox, oy) is the location of the top-left block of the crop, and
+		// bxx and byy are the numbers of blocks of the trimmed image.
+		ox, oy := rect.Min.X/mw*dc.H, rect.Min.Y/mh*dc.V
+		bxx, byy := width/mw*dc.H, height/mh*dc.V
+		for by := 0; by < dc.BlocksHigh; by++ {
+			for bx := 0; bx < dc.BlocksWide; bx++ {
+				tbx, tby := ox+bx, oy+by
+				if a.flipX {
+					tbx = bxx - 1 - tbx
+				}
+				if a.flipY {
+					tby = byy - 1 - tby
+				}
+				sbx, sby := tbx, tby
+				if a.transpose {
+					sbx, sby = tby, tbx
+				}
+				if sbx < 0 || sbx >= sc.BlocksWide || sby < 0 || sby >= sc.BlocksHigh {
+					continue
+				}
+				b := &dc.Blocks[by*dc.BlocksWide+bx]
+				*b = sc.Blocks[sby*sc.BlocksWide+sbx]
+				transformBlock(b, a)
+			}
+		}
+	}
+	return &dst, nil
+}
+
+// transformBlock transposes and mirrors the coefficients of the block b.
+// Mirroring a block negates the coefficients of the odd frequencies in the
+// direction.
+func transformBlock(b *Block, a transformAxes) {
+	if a.transpose {
+		for v := 0; v < 8; v++ {
+			for u := v + 1; u < 8; u++ {
+				b[v*8+u], b[u*8+v] = b[u*8+v], b[v*8+u]
+			}
+		}
+	}
+	if a.flipX {
+		for i := 1; i < blockSize; i += 2 {
+			b[i] = -b[i]
+		}
+	}
+	if a.flipY {
+		for i := 8; i < blockSize; i += 16 {
+			for j := i; j < i+8; j++ {
+				b[j] = -b[j]
+			}
+		}
+	}
+}
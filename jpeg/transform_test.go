@@ -0,0 +1,410 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/shogo82148/go-imaging/exif"
+	"github.com/shogo82148/go-imaging/fp16"
+)
+
+var allTransformations = []Transformation{
+	TransformNone,
+	TransformFlipHorizontal,
+	TransformFlipVertical,
+	TransformTranspose,
+	TransformTransverse,
+	TransformRotate90,
+	TransformRotate180,
+	TransformRotate270,
+}
+
+// inverseTransformation returns the transformation that undoes t.
+func inverseTransformation(t Transformation) Transformation {
+	switch t {
+	case TransformRotate90:
+		return TransformRotate270
+	case TransformRotate270:
+		return TransformRotate90
+	}
+	return t
+}
+
+// transformedSize returns the size of the image of the given size transformed
+// by t, with the partial MCUs of the size mcu trimmed.
+func transformedSize(t Transformation, size, mcu image.Point) image.Point {
+	a := t.axes()
+	if a.transpose {
+		size.X, size.Y = size.Y, size.X
+		mcu.X, mcu.Y = mcu.Y, mcu.X
+	}
+	if a.flipX {
+		size.X -= size.X % mcu.X
+	}
+	if a.flipY {
+		size.Y -= size.Y % mcu.Y
+	}
+	return size
+}
+
+// sourcePoint returns the location of the pixel p of the image transformed by
+// t in the source image. size is the size of the transformed image before
+// cropping, and p is in the coordinates before cropping.
+func sourcePoint(t Transformation, size, p image.Point) image.Point {
+	a := t.axes()
+	if a.flipX {
+		p.X = size.X - 1 - p.X
+	}
+	if a.flipY {
+		p.Y = size.Y - 1 - p.Y
+	}
+	if a.transpose {
+		p.X, p.Y = p.Y, p.X
+	}
+	return p
+}
+
+// checkTransformed checks that got is the region r of want transformed by t,
+// where size is the size of the transformed image before cropping. The
+// samples may differ by tolerance because of the rounding of the IDCT.
+func checkTransformed(got, want image.Image, t Transformation, size image.Point, r image.Rectangle, tolerance int64) error {
+	if got.Bounds() != image.Rect(0, 0, r.Dx(), r.Dy()) {
+		return fmt.Errorf("got bounds %v, want %v", got.Bounds(), image.Rect(0, 0, r.Dx(), r.Dy()))
+	}
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			p := sourcePoint(t, size, image.Pt(x+r.Min.X, y+r.Min.Y))
+			r0, g0, b0, a0 := got.At(x, y).RGBA()
+			r1, g1, b1, a1 := want.At(p.X, p.Y).RGBA()
+			if delta(r0, r1) > tolerance || delta(g0, g1) > tolerance || delta(b0, b1) > tolerance || delta(a0, a1) > tolerance {
+				return fmt.Errorf("(%d, %d): got %v, want %v at %v", x, y, got.At(x, y), want.At(p.X, p.Y), p)
+			}
+		}
+	}
+	return nil
+}
+
+func transform(t *testing.T, data []byte, o *TransformOptions) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Transform(&buf, bytes.NewReader(data), o); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		filename string
+		mcu      image.Point
+	}{
+		{"video-001.q50.420.jpeg", image.Pt(16, 16)},
+		{"video-001.q50.422.jpeg", image.Pt(16, 8)},
+		{"video-001.q50.440.jpeg", image.Pt(8, 16)},
+		{"video-001.q50.444.jpeg", image.Pt(8, 8)},
+		{"video-001.221212.jpeg", image.Pt(16, 16)},
+		{"video-001.progressive.jpeg", image.Pt(8, 8)},
+		{"video-001.cmyk.jpeg", image.Pt(8, 8)},
+		{"video-001.rgb.jpeg", image.Pt(16, 16)},
+		{"video-005.gray.q50.2x2.progressive.jpeg", image.Pt(8, 8)},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile("../testdata/" + tt.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tr := range allTransformations {
+			for _, progressive := range []bool{false, true} {
+				name := fmt.Sprintf("%s/%v", tt.filename, tr)
+				if progressive {
+					name += "/progressive"
+				}
+				t.Run(name, func(t *testing.T) {
+					out := transform(t, data, &TransformOptions{Transformation: tr, Progressive: progressive})
+					got, err := Decode(bytes.NewReader(out))
+					if err != nil {
+						t.Fatal(err)
+					}
+					size := transformedSize(tr, src.Bounds().Size(), tt.mcu)
+					r := image.Rectangle{Max: size}
+					if err := checkTransformed(got, src, tr, size, r, 0x300); err != nil {
+						t.Fatal(err)
+					}
+
+					// Undoing the transformation restores the coefficients exactly.
+					out = transform(t, out, &TransformOptions{Transformation: inverseTransformation(tr)})
+					got, err = Decode(bytes.NewReader(out))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if tr.axes().transpose {
+						size.X, size.Y = size.Y, size.X
+					}
+					r = image.Rectangle{Max: size}
+					if err := checkTransformed(got, src, TransformNone, size, r, 0); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestTransform_Arithmetic(t *testing.T) {
+	m := arithTestImage(48, 32)
+	data := encodeArith(t, m, &Options{Quality: 90, Progressive: true}, nil)
+	want, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := transform(t, data, &TransformOptions{Transformation: TransformRotate90})
+	got, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := image.Pt(32, 48)
+	if err := checkTransformed(got, want, TransformRotate90, size, image.Rectangle{Max: size}, 0x300); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransform_SmallerThanMCU(t *testing.T) {
+	// 4:2:0 image smaller than one MCU.
+	m := image.NewYCbCr(image.Rect(0, 0, 15, 15), image.YCbCrSubsampleRatio420)
+	for i := range m.Y {
+		m.Y[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	src, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range allTransformations {
+		t.Run(tr.String(), func(t *testing.T) {
+			out := transform(t, data, &TransformOptions{Transformation: tr})
+			got, err := Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The image is only transposed, and isn't mirrored.
+			want := TransformNone
+			if tr.axes().transpose {
+				want = TransformTranspose
+			}
+			size := image.Pt(15, 15)
+			if err := checkTransformed(got, src, want, size, image.Rectangle{Max: size}, 0x300); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTransform_Crop(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tr   Transformation
+		crop image.Rectangle
+		want image.Rectangle
+	}{
+		// The top-left corner is rounded down to the MCU boundary.
+		{TransformNone, image.Rect(20, 10, 90, 70), image.Rect(16, 0, 90, 70)},
+		{TransformNone, image.Rect(32, 48, 33, 49), image.Rect(32, 48, 33, 49)},
+		// The crop is clipped to the image.
+		{TransformNone, image.Rect(100, 90, 200, 200), image.Rect(96, 80, 150, 103)},
+		{TransformRotate180, image.Rect(20, 10, 90, 70), image.Rect(16, 0, 90, 70)},
+		{TransformRotate90, image.Rect(-10, 30, 50, 1000), image.Rect(0, 16, 50, 150)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v/%v", tt.tr, tt.crop), func(t *testing.T) {
+			out := transform(t, data, &TransformOptions{Transformation: tt.tr, Crop: tt.crop})
+			got, err := Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := transformedSize(tt.tr, src.Bounds().Size(), image.Pt(16, 16))
+			if err := checkTransformed(got, src, tt.tr, size, tt.want, 0x300); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTransform_Meta(t *testing.T) {
+	m, err := decodeFileWithMeta("../testdata/senkakuwan.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Exif.Orientation = exif.OrientationRightTop
+	m.JFIF.XDensity, m.JFIF.YDensity = 72, 96
+	m.Comments = []string{"comment"}
+	var buf bytes.Buffer
+	if err := EncodeWithMeta(&buf, m, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	src, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := transform(t, data, &TransformOptions{AutoOrient: true})
+	got, err := DecodeWithMeta(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ICCProfile == nil {
+		t.Fatal("ICCProfile is nil")
+	}
+	if got.ICCProfile.ProfileID != m.ICCProfile.ProfileID {
+		t.Errorf("ProfileID is %#v, want %#v", got.ICCProfile.ProfileID, m.ICCProfile.ProfileID)
+	}
+	if got.Exif == nil {
+		t.Fatal("Exif is nil")
+	}
+	if got.Exif.Orientation != exif.OrientationTopLeft {
+		t.Errorf("Orientation is %v, want %v", got.Exif.Orientation, exif.OrientationTopLeft)
+	}
+	if *got.Exif.Model != *m.Exif.Model {
+		t.Errorf("Model is %q, want %q", *got.Exif.Model, *m.Exif.Model)
+	}
+	if got.JFIF == nil {
+		t.Fatal("JFIF is nil")
+	}
+	if got.JFIF.XDensity != 96 || got.JFIF.YDensity != 72 {
+		t.Errorf("density is %dx%d, want 96x72", got.JFIF.XDensity, got.JFIF.YDensity)
+	}
+	if !bytes.Equal(got.XMP, m.XMP) {
+		t.Error("XMP differs")
+	}
+	if !reflect.DeepEqual(got.Comments, m.Comments) {
+		t.Errorf("Comments are %q, want %q", got.Comments, m.Comments)
+	}
+	size := image.Pt(480, 640)
+	if err := checkTransformed(got.Image, src, TransformRotate90, size, image.Rectangle{Max: size}, 0x300); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transformation is applied after the orientation.
+	out = transform(t, data, &TransformOptions{AutoOrient: true, Transformation: TransformRotate270})
+	got, err = DecodeWithMeta(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size = image.Pt(640, 480)
+	if err := checkTransformed(got.Image, src, TransformNone, size, image.Rectangle{Max: size}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransform_Errors(t *testing.T) {
+	samples := [][]uint16{make([]uint16, 16*16)}
+	ycbcr411, err := os.ReadFile("../testdata/video-001.q50.411.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert the third quantization table, and use it for the Cr component.
+	i := bytes.Index(ycbcr411, []byte{0xff, sof0Marker})
+	dqt := append([]byte{0xff, dqtMarker, 0, 2 + 1 + blockSize, 2}, bytes.Repeat([]byte{1}, blockSize)...)
+	threeTables := append(append(append([]byte{}, ycbcr411[:i]...), dqt...), ycbcr411[i:]...)
+	threeTables[i+len(dqt)+10+3*2+2] = 2
+
+	tests := []struct {
+		name string
+		data []byte
+		o    *TransformOptions
+		want error
+	}{
+		{"lossless", encodeLossless(samples, 16, 16, 8, 1, 0, 0, []byte{1}), nil, UnsupportedError("DCT coefficients of lossless image")},
+		{"12-bit", encode12(samples, 16, 16, false, []byte{1}), nil, UnsupportedError("transformation of 12-bit image")},
+		{"4:1:1 transposed", ycbcr411, &TransformOptions{Transformation: TransformTranspose}, UnsupportedError("transposed luma/chroma subsampling ratio")},
+		{"crop outside", ycbcr411, &TransformOptions{Crop: image.Rect(200, 0, 300, 10)}, errors.New("jpeg: empty transformed image")},
+		{"three tables", threeTables, nil, errors.New("jpeg: more than two quantization tables")},
+		{"truncated", ycbcr411[:len(ycbcr411)/2], nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Transform(new(bytes.Buffer), bytes.NewReader(tt.data), tt.o)
+			if err == nil {
+				t.Fatal("want error")
+			}
+			if tt.want != nil && err.Error() != tt.want.Error() {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// The 4:1:1 images can be mirrored.
+	transform(t, ycbcr411, &TransformOptions{Transformation: TransformRotate180})
+}
+
+// transformGray returns m transformed by t, by moving the pixels.
+func transformGray(t Transformation, m *image.Gray) *image.Gray {
+	size := transformedSize(t, m.Bounds().Size(), image.Pt(1, 1))
+	dst := image.NewGray(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := sourcePoint(t, size, image.Pt(x, y))
+			dst.SetGray(x, y, m.GrayAt(p.X, p.Y))
+		}
+	}
+	return dst
+}
+
+func TestTransformationThen(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	for _, t1 := range allTransformations {
+		for _, t2 := range allTransformations {
+			got := transformGray(t1.Then(t2), m)
+			want := transformGray(t2, transformGray(t1, m))
+			if !bytes.Equal(got.Pix, want.Pix) || got.Rect != want.Rect {
+				t.Errorf("%v.Then(%v) = %v", t1, t2, t1.Then(t2))
+			}
+		}
+	}
+}
+
+func TestOrientationTransformation(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	src := fp16.NewNRGBAh(m.Rect)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+		src.Pix[i*8] = uint8(i)
+	}
+	for o := exif.OrientationTopLeft; o <= exif.OrientationLeftBottom; o++ {
+		want := exif.AutoOrientation(o, src)
+		got := transformGray(OrientationTransformation(o), m)
+		if got.Rect != want.Rect {
+			t.Errorf("%v: got bounds %v, want %v", o, got.Rect, want.Rect)
+			continue
+		}
+		for i := range got.Pix {
+			if got.Pix[i] != want.Pix[i*8] {
+				t.Errorf("%v: got %v, want %v", o, got.Pix, want.Pix)
+				break
+			}
+		}
+	}
+}
@@ -10,6 +10,11 @@ import (
 	"image"
 	"image/color"
 	"io"
+	"strconv"
+
+	"github.com/shogo82148/go-imaging/graymap"
+	huffcode "github.com/shogo82148/go-imaging/internal/huffman"
+	"github.com/shogo82148/go-imaging/pixmap"
 )
 
 // div returns a/b rounded to the nearest integer, instead of rounded to zero.
@@ -199,6 +204,39 @@ func init() {
 	}
 }
 
+// optimalHuffmanSpec returns the Huffman encoding specification that gives
+// the shortest code for the symbol frequencies freq, as described in section
+// K.2. No code is longer than 16 bits, and no code consists of all 1-bits.
+func optimalHuffmanSpec(freq *[256]int) huffmanSpec {
+	// The symbol 256 is a dummy symbol that reserves the all 1-bits code.
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1
+	lengths := huffcode.Lengths(f[:], 16)
+
+	// The dummy symbol has the least frequency, but it may be tied with
+	// other symbols. Swapping the lengths of tied symbols doesn't change
+	// the total code length, so it can take one of the longest codes.
+	for v := 0; v < 256; v++ {
+		if lengths[v] > lengths[256] {
+			lengths[v], lengths[256] = lengths[256], lengths[v]
+		}
+	}
+
+	// The codes are assigned in the order of their lengths and values, and
+	// the dummy symbol, whose value is the largest, takes the last code.
+	var s huffmanSpec
+	for n := uint8(1); n <= 16; n++ {
+		for v := 0; v < 256; v++ {
+			if lengths[v] == n {
+				s.count[n-1]++
+				s.value = append(s.value, uint8(v))
+			}
+		}
+	}
+	return s
+}
+
 // writer is a buffered writer.
 type writer interface {
 	Flush() error
@@ -212,12 +250,45 @@ type encoder struct {
 	// writing. All attempted writes after the first error become no-ops.
 	w   writer
 	err error
-	// buf is a scratch buffer.
-	buf [16]byte
+	// buf is a scratch buffer, large enough for the frame header.
+	buf [6 + 3*maxComponents]byte
 	// bits and nBits are accumulated bits to write to w.
 	bits, nBits uint32
+	// huffSpec are the Huffman tables, and huffLUT are their compiled
+	// representations.
+	huffSpec [nHuffIndex]huffmanSpec
+	huffLUT  [nHuffIndex]huffmanLUT
+	// stats are the symbol frequencies of the Huffman tables counted in the
+	// statistics pass of the optimization, or nil when writing the data.
+	stats *[nHuffIndex][256]int
 	// quant is the scaled quantization tables, in zig-zag order.
-	quant [nQuantIndex][blockSize]byte
+	quant [nQuantIndex][blockSize]uint16
+	// nComp is the number of components, and comp are the components of
+	// the frame.
+	nComp int
+	comp  [maxComponents]component
+	// size is the size of the image.
+	size image.Point
+	// ycck is whether a CMYK image is written in the YCCK color space.
+	ycck bool
+
+	// progressive is whether the image is progressive, and scans is its
+	// scan script. A baseline image has only one scan.
+	progressive bool
+	scans       []Scan
+	// optimize is whether the Huffman tables are optimized for each scan.
+	optimize bool
+	// ri is the restart interval in MCUs, or 0 if restart markers are not
+	// used.
+	ri int
+	// coeffs are the quantized DCT coefficients of each component, saved for
+	// the progressive scans and the statistics pass. The blocks are in natural (not zig-zag) order.
+	coeffs [maxComponents][]block
+	// eobRun is the length of the pending end-of-band run, and corrBits are
+	// the correction bits that follow it in a refinement scan. maxEOBRun is
+	// the maximum run length that the Huffman tables can encode.
+	eobRun, maxEOBRun int
+	corrBits          []uint8
 }
 
 func (e *encoder) flush() {
@@ -244,6 +315,9 @@ func (e *encoder) writeByte(b byte) {
 // emit emits the least significant nBits bits of bits to the bit-stream.
 // The precondition is bits < 1<<nBits && nBits <= 16.
 func (e *encoder) emit(bits, nBits uint32) {
+	if e.stats != nil {
+		return
+	}
 	nBits += e.nBits
 	bits <<= 32 - nBits
 	bits |= e.bits
@@ -261,7 +335,11 @@ func (e *encoder) emit(bits, nBits uint32) {
 
 // emitHuff emits the given value with the given Huffman encoder.
 func (e *encoder) emitHuff(h huffIndex, value int32) {
-	x := theHuffmanLUT[h][value]
+	if e.stats != nil {
+		e.stats[h][value]++
+		return
+	}
+	x := e.huffLUT[h][value]
 	e.emit(x&(1<<24-1), x>>24)
 }
 
@@ -295,71 +373,120 @@ func (e *encoder) writeMarkerHeader(marker uint8, markerlen int) {
 
 // writeDQT writes the Define Quantization Table marker.
 func (e *encoder) writeDQT() {
-	const markerlen = 2 + int(nQuantIndex)*(1+blockSize)
+	markerlen := 2
+	for i := range e.quant {
+		markerlen += 1 + blockSize
+		if e.quant16(quantIndex(i)) {
+			markerlen += blockSize
+		}
+	}
 	e.writeMarkerHeader(dqtMarker, markerlen)
 	for i := range e.quant {
-		e.writeByte(uint8(i))
-		e.write(e.quant[i][:])
+		if !e.quant16(quantIndex(i)) {
+			e.writeByte(uint8(i))
+			for _, x := range e.quant[i] {
+				e.writeByte(uint8(x))
+			}
+			continue
+		}
+		// The table has 16-bit precision.
+		e.writeByte(0x10 | uint8(i))
+		for _, x := range e.quant[i] {
+			e.writeByte(uint8(x >> 8))
+			e.writeByte(uint8(x))
+		}
 	}
 }
 
-// writeSOF0 writes the Start Of Frame (Baseline Sequential) marker.
-func (e *encoder) writeSOF0(size image.Point, nComponent int) {
-	markerlen := 8 + 3*nComponent
-	e.writeMarkerHeader(sof0Marker, markerlen)
+// quant16 reports whether the quantization table needs 16-bit precision.
+func (e *encoder) quant16(q quantIndex) bool {
+	for _, x := range e.quant[q] {
+		if x > 255 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSOF writes the Start Of Frame marker. The marker is either sof0Marker
+// (Baseline Sequential), sof1Marker (Extended Sequential) or sof2Marker
+// (Progressive).
+func (e *encoder) writeSOF(marker uint8, size image.Point) {
+	markerlen := 8 + 3*e.nComp
+	e.writeMarkerHeader(marker, markerlen)
 	e.buf[0] = 8 // 8-bit color.
 	e.buf[1] = uint8(size.Y >> 8)
 	e.buf[2] = uint8(size.Y & 0xff)
 	e.buf[3] = uint8(size.X >> 8)
 	e.buf[4] = uint8(size.X & 0xff)
-	e.buf[5] = uint8(nComponent)
-	if nComponent == 1 {
-		e.buf[6] = 1
-		// No subsampling for grayscale image.
-		e.buf[7] = 0x11
-		e.buf[8] = 0x00
-	} else {
-		for i := 0; i < nComponent; i++ {
-			e.buf[3*i+6] = uint8(i + 1)
-			// We use 4:2:0 chroma subsampling.
-			e.buf[3*i+7] = "\x22\x11\x11"[i]
-			e.buf[3*i+8] = "\x00\x01\x01"[i]
-		}
+	e.buf[5] = uint8(e.nComp)
+	for i, c := range e.comp[:e.nComp] {
+		e.buf[3*i+6] = c.c
+		e.buf[3*i+7] = uint8(c.h<<4 | c.v)
+		e.buf[3*i+8] = c.tq
 	}
-	e.write(e.buf[:3*(nComponent-1)+9])
+	e.write(e.buf[:3*e.nComp+6])
 }
 
-// writeDHT writes the Define Huffman Table marker.
-func (e *encoder) writeDHT(nComponent int) {
+// writeDHT writes the Define Huffman Table marker for the given tables.
+func (e *encoder) writeDHT(tables []huffIndex) {
 	markerlen := 2
-	specs := theHuffmanSpec[:]
-	if nComponent == 1 {
-		// Drop the Chrominance tables.
-		specs = specs[:2]
-	}
-	for _, s := range specs {
-		markerlen += 1 + 16 + len(s.value)
+	for _, h := range tables {
+		markerlen += 1 + 16 + len(e.huffSpec[h].value)
 	}
 	e.writeMarkerHeader(dhtMarker, markerlen)
-	for i, s := range specs {
-		e.writeByte("\x00\x10\x01\x11"[i])
+	for _, h := range tables {
+		s := &e.huffSpec[h]
+		// The table class is 0 for DC and 1 for AC, and the destination
+		// identifier is the same as the quantization table.
+		e.writeByte(uint8(h&1)<<4 | uint8(h>>1))
 		e.write(s.count[:])
 		e.write(s.value)
 	}
 }
 
-// writeBlock writes a block of pixel data using the given quantization table,
-// returning the post-quantized DC value of the DCT-transformed block. b is in
-// natural (not zig-zag) order.
-func (e *encoder) writeBlock(b *block, q quantIndex, prevDC int32) int32 {
+// writeStandardDHT writes the Define Huffman Table marker for the standard
+// tables.
+func (e *encoder) writeStandardDHT() {
+	tables := []huffIndex{
+		huffIndexLuminanceDC,
+		huffIndexLuminanceAC,
+		huffIndexChrominanceDC,
+		huffIndexChrominanceAC,
+	}
+	chroma := false
+	for _, c := range e.comp[:e.nComp] {
+		if quantIndex(c.tq) == quantIndexChrominance {
+			chroma = true
+		}
+	}
+	if !chroma {
+		// Drop the Chrominance tables, which no component uses.
+		tables = tables[:2]
+	}
+	e.writeDHT(tables)
+}
+
+// quantize performs the forward DCT on the block b and quantizes it using the
+// given quantization table. b is in natural (not zig-zag) order.
+func (e *encoder) quantize(b *block, q quantIndex) {
 	fdct(b)
+	for zig := 0; zig < blockSize; zig++ {
+		b[unzig[zig]] = div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+	}
+}
+
+// writeBlock writes a block of quantized DCT coefficients using the Huffman
+// tables of the given quantization table, returning the DC value of the
+// block. b is in natural (not zig-zag) order.
+func (e *encoder) writeBlock(b *block, q quantIndex, prevDC int32) int32 {
 	// Emit the DC delta.
-	dc := div(b[0], 8*int32(e.quant[q][0]))
+	dc := b[0]
 	e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
 	// Emit the AC components.
 	h, runLength := huffIndex(2*q+1), int32(0)
 	for zig := 1; zig < blockSize; zig++ {
-		ac := div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+		ac := b[unzig[zig]]
 		if ac == 0 {
 			runLength++
 		} else {
@@ -457,100 +584,337 @@ func yCbCrToYCbCr(m *image.YCbCr, p image.Point, yBlock, cbBlock, crBlock *block
 	}
 }
 
-// scale scales the 16x16 region represented by the 4 src blocks to the 8x8
-// dst block.
-func scale(dst *block, src *[4]block) {
-	for i := 0; i < 4; i++ {
-		dstOff := (i&2)<<4 | (i&1)<<2
-		for y := 0; y < 4; y++ {
-			for x := 0; x < 4; x++ {
-				j := 16*y + 2*x
-				sum := src[i][j] + src[i][j+1] + src[i][j+8] + src[i][j+9]
-				dst[8*y+x+dstOff] = (sum + 2) >> 2
+// toY converts the 8x8 region of m whose top-left corner is p to its gray
+// values.
+func toY(m image.Image, p image.Point, yBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			c := color.GrayModel.Convert(m.At(min(p.X+i, xmax), min(p.Y+j, ymax))).(color.Gray)
+			yBlock[8*j+i] = int32(c.Y)
+		}
+	}
+}
+
+// gray16ToY is a specialized version of toY for image.Gray16 images.
+func gray16ToY(m *image.Gray16, p image.Point, yBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	pix := m.Pix
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			idx := m.PixOffset(min(p.X+i, xmax), min(p.Y+j, ymax))
+			// The most significant byte comes first.
+			yBlock[8*j+i] = int32(pix[idx])
+		}
+	}
+}
+
+// grayMapToY is a specialized version of toY for graymap.Image images.
+func grayMapToY(m *graymap.Image, p image.Point, yBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			y, _, _, _ := m.GrayAt(min(p.X+i, xmax), min(p.Y+j, ymax)).RGBA()
+			yBlock[8*j+i] = int32(y >> 8)
+		}
+	}
+}
+
+// nrgbaToYCbCr is a specialized version of toYCbCr for image.NRGBA images.
+// The colors are premultiplied by the alpha, as toYCbCr does.
+func nrgbaToYCbCr(m *image.NRGBA, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			idx := m.PixOffset(min(p.X+i, xmax), min(p.Y+j, ymax))
+			pix := m.Pix[idx : idx+4 : idx+4]
+			r, g, b := pix[0], pix[1], pix[2]
+			if a := pix[3]; a != 0xff {
+				rr, gg, bb, _ := color.NRGBA{r, g, b, a}.RGBA()
+				r, g, b = uint8(rr>>8), uint8(gg>>8), uint8(bb>>8)
 			}
+			yy, cb, cr := color.RGBToYCbCr(r, g, b)
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
 		}
 	}
 }
 
-// sosHeaderY is the SOS marker "\xff\xda" followed by 8 bytes:
-//   - the marker length "\x00\x08",
-//   - the number of components "\x01",
-//   - component 1 uses DC table 0 and AC table 0 "\x01\x00",
-//   - the bytes "\x00\x3f\x00". Section B.2.3 of the spec says that for
-//     sequential DCTs, those bytes (8-bit Ss, 8-bit Se, 4-bit Ah, 4-bit Al)
-//     should be 0x00, 0x3f, 0x00<<4 | 0x00.
-var sosHeaderY = []byte{
-	0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x3f, 0x00,
+// rgba64ToYCbCr is a specialized version of toYCbCr for image.RGBA64 images.
+func rgba64ToYCbCr(m *image.RGBA64, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			idx := m.PixOffset(min(p.X+i, xmax), min(p.Y+j, ymax))
+			pix := m.Pix[idx : idx+8 : idx+8]
+			// The most significant byte of each 16-bit channel comes first.
+			yy, cb, cr := color.RGBToYCbCr(pix[0], pix[2], pix[4])
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
 }
 
-// sosHeaderYCbCr is the SOS marker "\xff\xda" followed by 12 bytes:
-//   - the marker length "\x00\x0c",
-//   - the number of components "\x03",
-//   - component 1 uses DC table 0 and AC table 0 "\x01\x00",
-//   - component 2 uses DC table 1 and AC table 1 "\x02\x11",
-//   - component 3 uses DC table 1 and AC table 1 "\x03\x11",
-//   - the bytes "\x00\x3f\x00". Section B.2.3 of the spec says that for
-//     sequential DCTs, those bytes (8-bit Ss, 8-bit Se, 4-bit Ah, 4-bit Al)
-//     should be 0x00, 0x3f, 0x00<<4 | 0x00.
-var sosHeaderYCbCr = []byte{
-	0xff, 0xda, 0x00, 0x0c, 0x03, 0x01, 0x00, 0x02,
-	0x11, 0x03, 0x11, 0x00, 0x3f, 0x00,
+// pixMapToYCbCr is a specialized version of toYCbCr for pixmap.Image images.
+func pixMapToYCbCr(m *pixmap.Image, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			r, g, b, _ := m.PixAt(min(p.X+i, xmax), min(p.Y+j, ymax)).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
 }
 
-// writeSOS writes the StartOfScan marker.
-func (e *encoder) writeSOS(m image.Image) {
-	switch m.(type) {
-	case *image.Gray:
-		e.write(sosHeaderY)
+// toCMYK converts the 8x8 region of m whose top-left corner is p to its CMYK
+// values. The values are inverted, where 255 means no ink instead of full
+// ink, as in Adobe CMYK JPEG images.
+func toCMYK(m image.Image, p image.Point, cBlock, mBlock, yBlock, kBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			c := color.CMYKModel.Convert(m.At(min(p.X+i, xmax), min(p.Y+j, ymax))).(color.CMYK)
+			cBlock[8*j+i] = 255 - int32(c.C)
+			mBlock[8*j+i] = 255 - int32(c.M)
+			yBlock[8*j+i] = 255 - int32(c.Y)
+			kBlock[8*j+i] = 255 - int32(c.K)
+		}
+	}
+}
+
+// cmykToCMYK is a specialized version of toCMYK for image.CMYK images.
+func cmykToCMYK(m *image.CMYK, p image.Point, cBlock, mBlock, yBlock, kBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			idx := m.PixOffset(min(p.X+i, xmax), min(p.Y+j, ymax))
+			pix := m.Pix[idx : idx+4 : idx+4]
+			cBlock[8*j+i] = 255 - int32(pix[0])
+			mBlock[8*j+i] = 255 - int32(pix[1])
+			yBlock[8*j+i] = 255 - int32(pix[2])
+			kBlock[8*j+i] = 255 - int32(pix[3])
+		}
+	}
+}
+
+// invertedCMYToYCbCr converts the inverted CMY values to the YCbCr values of
+// YCCK images, in place. Inverting the inverted CMY values gives the
+// CMY values, which are converted as if they were RGB values, in the same
+// way as libjpeg does.
+// The K values of YCCK images stay inverted.
+func invertedCMYToYCbCr(cBlock, mBlock, yBlock *block) {
+	for i := range cBlock {
+		yy, cb, cr := color.RGBToYCbCr(uint8(255-cBlock[i]), uint8(255-mBlock[i]), uint8(255-yBlock[i]))
+		cBlock[i] = int32(yy)
+		mBlock[i] = int32(cb)
+		yBlock[i] = int32(cr)
+	}
+}
+
+// scale scales the (8*h)x(8*v) region represented by the h*v src blocks to
+// the 8x8 dst block. The src blocks are in raster order.
+func scale(dst *block, src *[4]block, h, v int) {
+	switch h<<4 | v {
+	case 0x11:
+		*dst = src[0]
+	case 0x21:
+		for i := 0; i < 2; i++ {
+			dstOff := i << 2
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 4; x++ {
+					j := 8*y + 2*x
+					sum := src[i][j] + src[i][j+1]
+					dst[8*y+x+dstOff] = (sum + 1) >> 1
+				}
+			}
+		}
+	case 0x12:
+		for i := 0; i < 2; i++ {
+			dstOff := i << 5
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 8; x++ {
+					j := 16*y + x
+					sum := src[i][j] + src[i][j+8]
+					dst[8*y+x+dstOff] = (sum + 1) >> 1
+				}
+			}
+		}
+	case 0x22:
+		for i := 0; i < 4; i++ {
+			dstOff := (i&2)<<4 | (i&1)<<2
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 4; x++ {
+					j := 16*y + 2*x
+					sum := src[i][j] + src[i][j+1] + src[i][j+8] + src[i][j+9]
+					dst[8*y+x+dstOff] = (sum + 2) >> 2
+				}
+			}
+		}
 	default:
-		e.write(sosHeaderYCbCr)
+		panic("unreachable")
 	}
+}
+
+// forEachBlock calls f with the quantized DCT coefficients of each block of
+// m, in natural (not zig-zag) order. ci is the component index of the block,
+// and bx and by are its location in the component, in units of 8x8 blocks.
+// The blocks are visited in the order of an interleaved scan: one MCU at a
+// time, and component by component in each MCU.
+func (e *encoder) forEachBlock(m image.Image, f func(ci, bx, by int, b *block)) {
 	var (
-		// Scratch buffers to hold the YCbCr values.
-		// The blocks are in natural (not zig-zag) order.
-		b      block
-		cb, cr [4]block
-		// DC components are delta-encoded.
-		prevDCY, prevDCCb, prevDCCr int32
+		// Scratch buffers to hold the color values of an MCU.
+		// px[ci][i] is the i'th 8x8 region of the MCU in the component ci,
+		// in natural (not zig-zag) order.
+		b  block
+		px [maxComponents][4]block
 	)
+	convert := e.converter(m, &px)
 	bounds := m.Bounds()
-	switch m := m.(type) {
-	// TODO(wathiede): switch on m.ColorModel() instead of type.
-	case *image.Gray:
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
-				p := image.Pt(x, y)
-				grayToY(m, p, &b)
-				prevDCY = e.writeBlock(&b, 0, prevDCY)
+	// h0 and v0 are the sampling factors of the Y component. An MCU has
+	// h0*v0 regions. The components with the same sampling factors have a
+	// block for each region, and the others have one block scaled from them.
+	h0, v0 := e.comp[0].h, e.comp[0].v
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 * v0 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 8 * h0 {
+			mx, my := (x-bounds.Min.X)/(8*h0), (y-bounds.Min.Y)/(8*v0)
+			for i := 0; i < h0*v0; i++ {
+				xOff := (i % h0) * 8
+				yOff := (i / h0) * 8
+				convert(image.Pt(x+xOff, y+yOff), i)
 			}
-		}
-	default:
-		rgba, _ := m.(*image.RGBA)
-		ycbcr, _ := m.(*image.YCbCr)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 16 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 16 {
-				for i := 0; i < 4; i++ {
-					xOff := (i & 1) * 8
-					yOff := (i & 2) * 4
-					p := image.Pt(x+xOff, y+yOff)
-					if rgba != nil {
-						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
-					} else if ycbcr != nil {
-						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
-					} else {
-						toYCbCr(m, p, &b, &cb[i], &cr[i])
-					}
-					prevDCY = e.writeBlock(&b, 0, prevDCY)
+			for ci, c := range e.comp[:e.nComp] {
+				q := quantIndex(c.tq)
+				if c.h != h0 || c.v != v0 {
+					scale(&b, &px[ci], h0, v0)
+					e.quantize(&b, q)
+					f(ci, mx, my, &b)
+					continue
+				}
+				for i := 0; i < h0*v0; i++ {
+					b = px[ci][i]
+					e.quantize(&b, q)
+					f(ci, h0*mx+i%h0, v0*my+i/h0, &b)
 				}
-				scale(&b, &cb)
-				prevDCCb = e.writeBlock(&b, 1, prevDCCb)
-				scale(&b, &cr)
-				prevDCCr = e.writeBlock(&b, 1, prevDCCr)
 			}
 		}
 	}
-	// Pad the last byte with 1's.
+}
+
+// converter returns the function that stores the color values of the 8x8
+// region of m whose top-left corner is p in px[ci][i] for each component ci.
+// The image type of m is checked in advance, so that the fast paths are
+// chosen once per image instead of once per block.
+func (e *encoder) converter(m image.Image, px *[maxComponents][4]block) func(p image.Point, i int) {
+	switch e.nComp {
+	case 1:
+		switch m := m.(type) {
+		case *image.Gray:
+			return func(p image.Point, i int) { grayToY(m, p, &px[0][i]) }
+		case *image.Gray16:
+			return func(p image.Point, i int) { gray16ToY(m, p, &px[0][i]) }
+		case *graymap.Image:
+			return func(p image.Point, i int) { grayMapToY(m, p, &px[0][i]) }
+		}
+		return func(p image.Point, i int) { toY(m, p, &px[0][i]) }
+	case 4:
+		cmyk, _ := m.(*image.CMYK)
+		return func(p image.Point, i int) {
+			if cmyk != nil {
+				cmykToCMYK(cmyk, p, &px[0][i], &px[1][i], &px[2][i], &px[3][i])
+			} else {
+				toCMYK(m, p, &px[0][i], &px[1][i], &px[2][i], &px[3][i])
+			}
+			if e.ycck {
+				invertedCMYToYCbCr(&px[0][i], &px[1][i], &px[2][i])
+			}
+		}
+	}
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(p image.Point, i int) { rgbaToYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+	case *image.NRGBA:
+		return func(p image.Point, i int) { nrgbaToYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+	case *image.RGBA64:
+		return func(p image.Point, i int) { rgba64ToYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+	case *image.YCbCr:
+		return func(p image.Point, i int) { yCbCrToYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+	case *pixmap.Image:
+		return func(p image.Point, i int) { pixMapToYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+	}
+	return func(p image.Point, i int) { toYCbCr(m, p, &px[0][i], &px[1][i], &px[2][i]) }
+}
+
+// padBits pads the last byte of the entropy-coded data with 1's.
+func (e *encoder) padBits() {
 	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// writeSOS writes the StartOfScan marker.
+func (e *encoder) writeSOS(m image.Image) {
+	e.writeSOSHeader(&e.scans[0])
+	// DC components are delta-encoded.
+	var prevDC [maxComponents]int32
+	mxx, myy := e.mcuSize(e.size)
+	mcu := 0
+	e.forEachBlock(m, func(ci, bx, by int, b *block) {
+		prevDC[ci] = e.writeBlock(b, quantIndex(e.comp[ci].tq), prevDC[ci])
+		// The MCU ends with the last block of the last component.
+		c := e.comp[ci]
+		if ci != e.nComp-1 || (bx+1)%c.h != 0 || (by+1)%c.v != 0 {
+			return
+		}
+		mcu++
+		if e.ri > 0 && mcu%e.ri == 0 && mcu < mxx*myy {
+			e.restart(huffIndexLuminanceAC, mcu/e.ri-1)
+			prevDC = [maxComponents]int32{}
+		}
+	})
+	e.padBits()
+}
+
+// restart ends the n'th restart interval: it emits the pending end-of-band
+// run in the Huffman table h, pads the last byte, and writes a RST marker.
+// The caller resets the DC predictions.
+func (e *encoder) restart(h huffIndex, n int) {
+	e.emitEOBRun(h)
+	e.padBits()
+	if e.stats != nil {
+		// This is the statistics pass, which doesn't write anything.
+		return
+	}
+	e.buf[0] = 0xff
+	e.buf[1] = rst0Marker + uint8(n%8)
+	e.write(e.buf[:2])
+}
+
+// writeDRI writes the Define Restart Interval marker.
+func (e *encoder) writeDRI() {
+	e.writeMarkerHeader(driMarker, 4)
+	e.buf[0] = uint8(e.ri >> 8)
+	e.buf[1] = uint8(e.ri & 0xff)
+	e.write(e.buf[:2])
 }
 
 // DefaultQuality is the default quality encoding parameter.
@@ -560,74 +924,383 @@ const DefaultQuality = 75
 // Quality ranges from 1 to 100 inclusive, higher is better.
 type Options struct {
 	Quality int
+
+	// ChromaQuality is the quality of the chrominance components, ranging
+	// from 1 to 100 inclusive. If it is 0, Quality is used for them too.
+	ChromaQuality int
+
+	// QuantTableSet is the set of the base quantization tables that are
+	// scaled according to Quality and ChromaQuality.
+	QuantTableSet QuantTableSet
+
+	// LumaQuantTable and ChromaQuantTable are custom quantization tables of
+	// the luminance and chrominance components. If they are not nil, they are
+	// used as is, instead of the scaled base tables.
+	// The quantizers must not be zero. If any of them is greater than 255,
+	// the image is written in the extended sequential format (SOF1) instead of
+	// the baseline format.
+	LumaQuantTable, ChromaQuantTable *QuantTable
+
+	// Progressive specifies whether the image is encoded in the progressive
+	// format (SOF2) instead of the baseline format (SOF0).
+	// Progressive images are usually smaller only with OptimizeHuffman,
+	// because the standard Huffman tables can't encode end-of-band runs.
+	Progressive bool
+
+	// ScanScript is the sequence of scans of a progressive image.
+	// If it is nil, the standard script is used: the DC coefficients first,
+	// followed by the AC coefficients split by spectral selection and
+	// successive approximation.
+	// It is ignored unless Progressive is true.
+	ScanScript []Scan
+
+	// OptimizeHuffman specifies whether the Huffman tables are optimized for
+	// the image instead of using the standard tables. It makes the image
+	// smaller without any quality loss, at the cost of encoding speed.
+	OptimizeHuffman bool
+
+	// RestartInterval is the number of MCUs (Minimum Coded Units) in a
+	// restart interval. The entropy-coded data is split into the intervals
+	// by RST markers, so that a decoder can recover from corrupted data, or
+	// decode the intervals in parallel. It ranges from 0 to 65535, and 0
+	// means no restart markers.
+	RestartInterval int
+
+	// RestartRows is the restart interval in rows of MCUs.
+	// It is used only if RestartInterval is 0.
+	RestartRows int
+
+	// Subsampling is the chroma subsampling of YCbCr images.
+	// The default is 4:2:0. It is ignored for grayscale and CMYK images.
+	// YCCK images support only 4:2:0 and 4:4:4.
+	Subsampling Subsampling
+
+	// YCCK specifies whether the images of the CMYK color model are written
+	// in the YCCK color space instead of the CMYK color space. YCCK images
+	// are usually smaller, because their chrominance can be subsampled.
+	// It is ignored for the images of the other color models.
+	YCCK bool
+}
+
+// Subsampling is a chroma subsampling ratio of the encoded image.
+type Subsampling int
+
+const (
+	// Subsampling420 halves the horizontal and vertical resolution of Cb and Cr.
+	Subsampling420 Subsampling = 0
+
+	// Subsampling444 keeps the full resolution of Cb and Cr.
+	Subsampling444 Subsampling = 1
+
+	// Subsampling422 halves the horizontal resolution of Cb and Cr.
+	Subsampling422 Subsampling = 2
+
+	// Subsampling440 halves the vertical resolution of Cb and Cr.
+	Subsampling440 Subsampling = 3
+)
+
+// samplingFactors returns the horizontal and vertical sampling factors of the
+// Y component, or zeros if s is unknown.
+// The sampling factors of the Cb and Cr components are always 1.
+func (s Subsampling) samplingFactors() (h, v int) {
+	switch s {
+	case Subsampling420:
+		return 2, 2
+	case Subsampling444:
+		return 1, 1
+	case Subsampling422:
+		return 2, 1
+	case Subsampling440:
+		return 1, 2
+	}
+	return 0, 0
+}
+
+func (s Subsampling) String() string {
+	switch s {
+	case Subsampling420:
+		return "4:2:0"
+	case Subsampling444:
+		return "4:4:4"
+	case Subsampling422:
+		return "4:2:2"
+	case Subsampling440:
+		return "4:4:0"
+	default:
+		return "Unknown Subsampling: " + strconv.Itoa(int(s))
+	}
 }
 
-// Encode writes the Image m to w in JPEG 4:2:0 baseline format with the given
-// options. Default parameters are used if a nil *Options is passed.
+// Encode writes the Image m to w in JPEG baseline or progressive format with
+// the given options. Default parameters are used if a nil *Options is passed.
 func Encode(w io.Writer, m image.Image, o *Options) error {
+	var e encoder
+	if err := e.init(w, m, o); err != nil {
+		return err
+	}
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	// Write the image.
+	e.writeImage(m)
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
+
+// init initializes the encoder to write m to w with the given options.
+func (e *encoder) init(w io.Writer, m image.Image, o *Options) error {
 	b := m.Bounds()
 	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
 		return errors.New("jpeg: image is too large to encode")
 	}
-	var e encoder
 	if ww, ok := w.(writer); ok {
 		e.w = ww
 	} else {
 		e.w = bufio.NewWriter(w)
 	}
-	// Clip quality to [1, 100].
-	quality := DefaultQuality
+	e.size = b.Size()
+	// Initialize the quantization tables.
+	quality, chromaQuality := DefaultQuality, 0
+	set := QuantTableAnnexK
+	var custom [nQuantIndex]*QuantTable
+	if o != nil {
+		quality, chromaQuality = o.Quality, o.ChromaQuality
+		set = o.QuantTableSet
+		custom = [nQuantIndex]*QuantTable{o.LumaQuantTable, o.ChromaQuantTable}
+	}
+	if chromaQuality == 0 {
+		chromaQuality = quality
+	}
+	base := set.baseQuant()
+	if base == nil {
+		return errors.New("jpeg: unknown quantization table set")
+	}
+	scaleQuant(&e.quant[quantIndexLuminance], &base[quantIndexLuminance], quality)
+	scaleQuant(&e.quant[quantIndexChrominance], &base[quantIndexChrominance], chromaQuality)
+	for i, t := range custom {
+		if t == nil {
+			continue
+		}
+		for zig := range e.quant[i] {
+			x := t[unzig[zig]]
+			if x == 0 {
+				return errors.New("jpeg: invalid quantization table")
+			}
+			e.quant[i][zig] = x
+		}
+	}
+	// Compute the components based on the color model of the input image.
+	var subsampling Subsampling
 	if o != nil {
-		quality = o.Quality
-		if quality < 1 {
-			quality = 1
-		} else if quality > 100 {
-			quality = 100
+		subsampling = o.Subsampling
+	}
+	h, v := subsampling.samplingFactors()
+	switch model := m.ColorModel(); {
+	case isGrayModel(model):
+		// No subsampling for grayscale image.
+		e.nComp = 1
+		e.comp[0] = component{h: 1, v: 1, c: 1, tq: 0}
+	case model == color.CMYKModel && o != nil && o.YCCK:
+		// Only the Cb and Cr components are subsampled, and the decoders
+		// expect the same sampling factors of 1 or 2 for Y and K.
+		if h == 0 {
+			return errors.New("jpeg: unknown chroma subsampling")
+		}
+		if h != v {
+			return errors.New("jpeg: unsupported chroma subsampling for YCCK images")
 		}
+		e.nComp = 4
+		e.ycck = true
+		e.comp[0] = component{h: h, v: v, c: 1, tq: 0}
+		e.comp[1] = component{h: 1, v: 1, c: 2, tq: 1}
+		e.comp[2] = component{h: 1, v: 1, c: 3, tq: 1}
+		e.comp[3] = component{h: h, v: v, c: 4, tq: 0}
+	case model == color.CMYKModel:
+		// The components are identified by their initial letters, and they
+		// share the luminance table, as libjpeg does.
+		e.nComp = 4
+		e.comp[0] = component{h: 1, v: 1, c: 'C', tq: 0}
+		e.comp[1] = component{h: 1, v: 1, c: 'M', tq: 0}
+		e.comp[2] = component{h: 1, v: 1, c: 'Y', tq: 0}
+		e.comp[3] = component{h: 1, v: 1, c: 'K', tq: 0}
+	default:
+		if h == 0 {
+			return errors.New("jpeg: unknown chroma subsampling")
+		}
+		e.nComp = 3
+		e.comp[0] = component{h: h, v: v, c: 1, tq: 0}
+		e.comp[1] = component{h: 1, v: 1, c: 2, tq: 1}
+		e.comp[2] = component{h: 1, v: 1, c: 3, tq: 1}
 	}
-	// Convert from a quality rating to a scaling factor.
-	var scale int
-	if quality < 50 {
-		scale = 5000 / quality
+	return e.initCoding(o)
+}
+
+// initCoding initializes the scan script, the restart interval and the
+// Huffman tables with the given options. The components and the size of the
+// image must be initialized in advance.
+func (e *encoder) initCoding(o *Options) error {
+	// Prepare the scan script.
+	if o != nil && o.Progressive {
+		e.progressive = true
+		e.scans = o.ScanScript
+		if e.scans == nil {
+			e.scans = defaultScanScript(e.nComp)
+		}
+		if err := validateScanScript(e.scans, e.nComp); err != nil {
+			return err
+		}
 	} else {
-		scale = 200 - quality*2
+		components := []int{0, 1, 2, 3}
+		e.scans = []Scan{{Components: components[:e.nComp], Ss: 0, Se: blockSize - 1}}
 	}
-	// Initialize the quantization tables.
-	for i := range e.quant {
-		for j := range e.quant[i] {
-			x := int(unscaledQuant[i][j])
-			x = (x*scale + 50) / 100
-			if x < 1 {
-				x = 1
-			} else if x > 255 {
-				x = 255
-			}
-			e.quant[i][j] = uint8(x)
+	// Compute the restart interval.
+	if o != nil {
+		switch {
+		case o.RestartInterval < 0 || o.RestartInterval > 0xffff || o.RestartRows < 0:
+			return errors.New("jpeg: invalid restart interval")
+		case o.RestartInterval > 0:
+			e.ri = o.RestartInterval
+		case o.RestartRows > 0:
+			mxx, _ := e.mcuSize(e.size)
+			e.ri = min(o.RestartRows*mxx, 0xffff)
 		}
 	}
-	// Compute number of components based on input image type.
-	nComponent := 3
-	switch m.(type) {
-	// TODO(wathiede): switch on m.ColorModel() instead of type.
-	case *image.Gray:
-		nComponent = 1
+	// Prepare the Huffman tables.
+	e.huffSpec = theHuffmanSpec
+	e.huffLUT = theHuffmanLUT
+	if o != nil && o.OptimizeHuffman {
+		e.optimize = true
+		e.maxEOBRun = 0x7fff
+	} else {
+		// The standard Huffman tables have no codes for the end-of-band runs
+		// longer than one block.
+		e.maxEOBRun = 1
+	}
+	return nil
+}
+
+// writeImage writes the quantization tables, the frame header, the Huffman
+// tables and the scans of m. CMYK images are preceded by the Adobe APP14
+// marker that tells their color space.
+func (e *encoder) writeImage(m image.Image) {
+	if e.nComp == 4 {
+		e.writeAdobe()
+	}
+	if e.progressive || e.optimize {
+		// The scans are written from the saved coefficients.
+		e.saveCoeffs(m)
+		e.writeCoeffs()
+		return
 	}
-	// Write the Start Of Image marker.
-	e.buf[0] = 0xff
-	e.buf[1] = 0xd8
-	e.write(e.buf[:2])
 	// Write the quantization tables.
 	e.writeDQT()
 	// Write the image dimensions.
-	e.writeSOF0(b.Size(), nComponent)
+	e.writeSOF(e.sequentialMarker(), e.size)
 	// Write the Huffman tables.
-	e.writeDHT(nComponent)
+	e.writeStandardDHT()
+	// Write the restart interval.
+	if e.ri > 0 {
+		e.writeDRI()
+	}
 	// Write the image data.
 	e.writeSOS(m)
-	// Write the End Of Image marker.
-	e.buf[0] = 0xff
-	e.buf[1] = 0xd9
-	e.write(e.buf[:2])
-	e.flush()
-	return e.err
+}
+
+// writeCoeffs writes the quantization tables, the frame header, the Huffman
+// tables and the scans of the saved coefficients.
+func (e *encoder) writeCoeffs() {
+	e.writeDQT()
+	if e.progressive {
+		e.writeSOF(sof2Marker, e.size)
+	} else {
+		e.writeSOF(e.sequentialMarker(), e.size)
+	}
+	if !e.optimize {
+		e.writeStandardDHT()
+	}
+	if e.ri > 0 {
+		e.writeDRI()
+	}
+	for i := range e.scans {
+		s := &e.scans[i]
+		if e.optimize {
+			e.optimizeHuffman(s)
+		}
+		e.writeScan(s)
+	}
+}
+
+// isGrayModel reports whether the color model c has only the gray channel.
+func isGrayModel(c color.Model) bool {
+	if _, ok := c.(graymap.Model); ok {
+		return true
+	}
+	return c == color.GrayModel || c == color.Gray16Model
+}
+
+// writeAdobe writes the Adobe APP14 marker. Its transform flag is 2 for YCCK
+// images, and 0 for CMYK images.
+func (e *encoder) writeAdobe() {
+	if e.ycck {
+		e.writeAdobeTransform(adobeTransformYCbCrK)
+	} else {
+		e.writeAdobeTransform(adobeTransformUnknown)
+	}
+}
+
+// writeAdobeTransform writes the Adobe APP14 marker with the given transform
+// flag.
+func (e *encoder) writeAdobeTransform(transform uint8) {
+	e.writeMarkerHeader(app14Marker, 14)
+	copy(e.buf[:], "Adobe")
+	// The version is 100, and no flags are set.
+	e.buf[5], e.buf[6] = 0, 100
+	e.buf[7], e.buf[8], e.buf[9], e.buf[10] = 0, 0, 0, 0
+	e.buf[11] = transform
+	e.write(e.buf[:12])
+}
+
+// sequentialMarker returns the Start Of Frame marker of a sequential image.
+// Baseline images can't have 16-bit quantization tables.
+func (e *encoder) sequentialMarker() uint8 {
+	for i := range e.quant {
+		if e.quant16(quantIndex(i)) {
+			return sof1Marker
+		}
+	}
+	return sof0Marker
+}
+
+// optimizeHuffman counts the symbols of the scan s, and writes the optimal
+// Huffman tables for them.
+func (e *encoder) optimizeHuffman(s *Scan) {
+	var stats [nHuffIndex][256]int
+	e.stats = &stats
+	e.writeScanData(s)
+	e.stats = nil
+
+	var tables []huffIndex
+	for h := range stats {
+		used := false
+		for _, n := range stats[h] {
+			if n > 0 {
+				used = true
+				break
+			}
+		}
+		if !used {
+			continue
+		}
+		e.huffSpec[h] = optimalHuffmanSpec(&stats[h])
+		e.huffLUT[h].init(e.huffSpec[h])
+		tables = append(tables, huffIndex(h))
+	}
+	if len(tables) > 0 {
+		e.writeDHT(tables)
+	}
 }
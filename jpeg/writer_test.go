@@ -9,12 +9,16 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"io"
 	"math/rand"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/shogo82148/go-imaging/graymap"
+	"github.com/shogo82148/go-imaging/pixmap"
 )
 
 // zigzag maps from the natural ordering to the zig-zag ordering. For example,
@@ -287,3 +291,648 @@ func BenchmarkEncodeYCbCr(b *testing.B) {
 		Encode(io.Discard, img, options)
 	}
 }
+
+func TestEncodeProgressive(t *testing.T) {
+	rnd := rand.New(rand.NewSource(123))
+	gray := image.NewGray(image.Rect(0, 0, 37, 29))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(rnd.Intn(256))
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 53, 41))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(rnd.Intn(256))
+	}
+	video, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		opts *Options
+	}{
+		{"gray", gray, &Options{Quality: 90, Progressive: true}},
+		{"rgba", rgba, &Options{Quality: 90, Progressive: true}},
+		{"rgba 4:4:4", rgba, &Options{Quality: 90, Progressive: true, Subsampling: Subsampling444}},
+		{"rgba 4:2:2", rgba, &Options{Quality: 90, Progressive: true, Subsampling: Subsampling422}},
+		{"rgba 4:4:0", rgba, &Options{Quality: 90, Progressive: true, Subsampling: Subsampling440}},
+		{"video", video, &Options{Quality: 75, Progressive: true}},
+		{"video, quality 100", video, &Options{Quality: 100, Progressive: true}},
+		{
+			"custom scan script",
+			video,
+			&Options{
+				Quality:     75,
+				Progressive: true,
+				ScanScript: []Scan{
+					{Components: []int{0}, Ss: 0, Se: 0, Ah: 0, Al: 0},
+					{Components: []int{1, 2}, Ss: 0, Se: 0, Ah: 0, Al: 0},
+					{Components: []int{0}, Ss: 1, Se: 63, Ah: 0, Al: 3},
+					{Components: []int{1}, Ss: 1, Se: 63, Ah: 0, Al: 0},
+					{Components: []int{2}, Ss: 1, Se: 63, Ah: 0, Al: 0},
+					{Components: []int{0}, Ss: 1, Se: 63, Ah: 3, Al: 2},
+					{Components: []int{0}, Ss: 1, Se: 63, Ah: 2, Al: 1},
+					{Components: []int{0}, Ss: 1, Se: 63, Ah: 1, Al: 0},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var progressive, baseline bytes.Buffer
+			if err := Encode(&progressive, tt.img, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := Encode(&baseline, tt.img, &Options{Quality: tt.opts.Quality, Subsampling: tt.opts.Subsampling}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(progressive.Bytes(), []byte{0xff, sof2Marker}) {
+				t.Error("SOF2 marker is not found")
+			}
+
+			// The progressive image has the same coefficients as the baseline image.
+			m0, err := Decode(&baseline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m1, err := Decode(&progressive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m0.Bounds() != m1.Bounds() {
+				t.Fatalf("bounds differ: %v and %v", m0.Bounds(), m1.Bounds())
+			}
+			if got := averageDelta(m0, m1); got != 0 {
+				t.Errorf("average delta is %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestEncodeProgressive_InvalidScanScript(t *testing.T) {
+	tests := []struct {
+		name  string
+		scans []Scan
+	}{
+		{
+			name:  "empty",
+			scans: []Scan{},
+		},
+		{
+			name: "missing coefficients",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 0, Se: 0},
+				{Components: []int{0}, Ss: 1, Se: 62},
+			},
+		},
+		{
+			name: "AC scan before DC scan",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 1, Se: 63},
+				{Components: []int{0}, Ss: 0, Se: 0},
+			},
+		},
+		{
+			name: "AC scan with DC coefficient",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 0, Se: 63},
+			},
+		},
+		{
+			name: "interleaved AC scan",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 0, Se: 0},
+				{Components: []int{0, 0}, Ss: 1, Se: 63},
+			},
+		},
+		{
+			name: "unknown component",
+			scans: []Scan{
+				{Components: []int{1}, Ss: 0, Se: 0},
+			},
+		},
+		{
+			name: "coded twice",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 0, Se: 0},
+				{Components: []int{0}, Ss: 1, Se: 63},
+				{Components: []int{0}, Ss: 1, Se: 63},
+			},
+		},
+		{
+			name: "bad successive approximation",
+			scans: []Scan{
+				{Components: []int{0}, Ss: 0, Se: 0, Al: 2},
+				{Components: []int{0}, Ss: 1, Se: 63},
+				{Components: []int{0}, Ss: 0, Se: 0, Ah: 1, Al: 0},
+			},
+		},
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Encode(io.Discard, img, &Options{Progressive: true, ScanScript: tt.scans})
+			if err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeProgressive(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	bo := img.Bounds()
+	rnd := rand.New(rand.NewSource(123))
+	for y := bo.Min.Y; y < bo.Max.Y; y++ {
+		for x := bo.Min.X; x < bo.Max.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				uint8(rnd.Intn(256)),
+				uint8(rnd.Intn(256)),
+				uint8(rnd.Intn(256)),
+				255,
+			})
+		}
+	}
+	b.SetBytes(640 * 480 * 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	options := &Options{Quality: 90, Progressive: true}
+	for i := 0; i < b.N; i++ {
+		Encode(io.Discard, img, options)
+	}
+}
+
+func TestEncodeSubsampling(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		subsampling Subsampling
+		want        image.YCbCrSubsampleRatio
+	}{
+		{Subsampling420, image.YCbCrSubsampleRatio420},
+		{Subsampling444, image.YCbCrSubsampleRatio444},
+		{Subsampling422, image.YCbCrSubsampleRatio422},
+		{Subsampling440, image.YCbCrSubsampleRatio440},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subsampling.String(), func(t *testing.T) {
+			for _, progressive := range []bool{false, true} {
+				var buf bytes.Buffer
+				opts := &Options{Quality: 90, Subsampling: tt.subsampling, Progressive: progressive}
+				if err := Encode(&buf, m0, opts); err != nil {
+					t.Fatal(err)
+				}
+				m1, err := Decode(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ycbcr, ok := m1.(*image.YCbCr)
+				if !ok {
+					t.Fatalf("got %T, want *image.YCbCr", m1)
+				}
+				if ycbcr.SubsampleRatio != tt.want {
+					t.Errorf("progressive=%t: got %v, want %v", progressive, ycbcr.SubsampleRatio, tt.want)
+				}
+				if m0.Bounds() != m1.Bounds() {
+					t.Fatalf("bounds differ: %v and %v", m0.Bounds(), m1.Bounds())
+				}
+				if got, want := averageDelta(m0, m1), int64(4<<8); got > want {
+					t.Errorf("progressive=%t: average delta too high; got %d, want <= %d", progressive, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeSubsampling444 tests that 4:4:4 chroma subsampling keeps sharp
+// color edges better than 4:2:0.
+func TestEncodeSubsampling444(t *testing.T) {
+	m0 := image.NewRGBA(image.Rect(0, 0, 33, 33))
+	for y := 0; y < 33; y++ {
+		for x := 0; x < 33; x++ {
+			if x%2 == 0 {
+				m0.SetRGBA(x, y, color.RGBA{0xff, 0x00, 0x00, 0xff})
+			} else {
+				m0.SetRGBA(x, y, color.RGBA{0x00, 0x00, 0xff, 0xff})
+			}
+		}
+	}
+
+	encodeDelta := func(subsampling Subsampling) int64 {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, &Options{Quality: 100, Subsampling: subsampling}); err != nil {
+			t.Fatal(err)
+		}
+		m1, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return averageDelta(m0, m1)
+	}
+	d444 := encodeDelta(Subsampling444)
+	d420 := encodeDelta(Subsampling420)
+	if d444 >= d420 {
+		t.Errorf("4:4:4 average delta %d is not smaller than 4:2:0 average delta %d", d444, d420)
+	}
+}
+
+func TestEncodeSubsampling_Unknown(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	if err := Encode(io.Discard, img, &Options{Subsampling: Subsampling(-1)}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestEncodeOptimizeHuffman(t *testing.T) {
+	video, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := image.NewGray(video.Bounds())
+	draw.Draw(gray, gray.Bounds(), video, video.Bounds().Min, draw.Src)
+
+	tests := []struct {
+		name string
+		img  image.Image
+		opts Options
+	}{
+		{"baseline", video, Options{Quality: 75}},
+		{"baseline, quality 100", video, Options{Quality: 100}},
+		{"baseline, gray", gray, Options{Quality: 75}},
+		{"progressive", video, Options{Quality: 75, Progressive: true}},
+		{"progressive, gray", gray, Options{Quality: 75, Progressive: true}},
+		{"progressive, 4:4:4", video, Options{Quality: 90, Progressive: true, Subsampling: Subsampling444}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var standard, optimized bytes.Buffer
+			opts := tt.opts
+			if err := Encode(&standard, tt.img, &opts); err != nil {
+				t.Fatal(err)
+			}
+			opts.OptimizeHuffman = true
+			if err := Encode(&optimized, tt.img, &opts); err != nil {
+				t.Fatal(err)
+			}
+			if optimized.Len() >= standard.Len() {
+				t.Errorf("optimized size %d is not smaller than standard size %d", optimized.Len(), standard.Len())
+			}
+
+			// The optimization is lossless.
+			m0, err := Decode(&standard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m1, err := Decode(&optimized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m0.Bounds() != m1.Bounds() {
+				t.Fatalf("bounds differ: %v and %v", m0.Bounds(), m1.Bounds())
+			}
+			if got := averageDelta(m0, m1); got != 0 {
+				t.Errorf("average delta is %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestOptimalHuffmanSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		freq func(freq *[256]int)
+	}{
+		{
+			name: "one symbol",
+			freq: func(freq *[256]int) {
+				freq[0x12] = 100
+			},
+		},
+		{
+			name: "uniform",
+			freq: func(freq *[256]int) {
+				for i := range freq {
+					freq[i] = 1
+				}
+			},
+		},
+		{
+			// The Fibonacci sequence makes the unlimited Huffman codes longer than 16 bits.
+			name: "fibonacci",
+			freq: func(freq *[256]int) {
+				a, b := 1, 1
+				for i := 0; i < 30; i++ {
+					freq[i] = a
+					a, b = b, a+b
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var freq [256]int
+			tt.freq(&freq)
+			s := optimalHuffmanSpec(&freq)
+
+			// All symbols have codes.
+			var lut huffmanLUT
+			lut.init(s)
+			for v, n := range freq {
+				if n == 0 {
+					continue
+				}
+				if v >= len(lut) || lut[v] == 0 {
+					t.Fatalf("symbol %#x has no code", v)
+				}
+			}
+
+			// No code consists of all 1-bits.
+			for _, x := range lut {
+				nBits := x >> 24
+				code := x & (1<<24 - 1)
+				if nBits > 0 && code == 1<<nBits-1 {
+					t.Errorf("code %b consists of all 1-bits", code)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeRestartInterval(t *testing.T) {
+	rnd := rand.New(rand.NewSource(123))
+	rgba := image.NewRGBA(image.Rect(0, 0, 53, 41))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(rnd.Intn(256))
+	}
+	gray := image.NewGray(image.Rect(0, 0, 37, 29))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(rnd.Intn(256))
+	}
+	cmyk := image.NewCMYK(image.Rect(0, 0, 53, 41))
+	for i := range cmyk.Pix {
+		cmyk.Pix[i] = uint8(rnd.Intn(256))
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		opts Options
+		// rst is the number of RST markers.
+		rst int
+	}{
+		{
+			// 4x3 MCUs
+			name: "baseline",
+			img:  rgba,
+			opts: Options{Quality: 90, RestartInterval: 5},
+			rst:  2,
+		},
+		{
+			name: "baseline, rows",
+			img:  rgba,
+			opts: Options{Quality: 90, RestartRows: 1},
+			rst:  2,
+		},
+		{
+			// 5x4 MCUs
+			name: "gray",
+			img:  gray,
+			opts: Options{Quality: 90, RestartInterval: 3},
+			rst:  6,
+		},
+		{
+			name: "optimized",
+			img:  rgba,
+			opts: Options{Quality: 90, RestartInterval: 1, OptimizeHuffman: true},
+			rst:  11,
+		},
+		{
+			// 4x3 MCUs, each of which has 4 Y and 4 K blocks.
+			name: "ycck",
+			img:  cmyk,
+			opts: Options{Quality: 90, RestartInterval: 5, YCCK: true},
+			rst:  2,
+		},
+		{
+			// 2 interleaved DC scans with 12 MCUs, and 8 non-interleaved AC scans:
+			// 4 Y scans with 7x6 blocks, and 4 Cb and Cr scans with 4x3 blocks.
+			name: "progressive",
+			img:  rgba,
+			opts: Options{Quality: 90, RestartInterval: 4, Progressive: true},
+			rst:  2*2 + 4*10 + 4*2,
+		},
+		{
+			name: "progressive, optimized",
+			img:  rgba,
+			opts: Options{Quality: 90, RestartInterval: 4, Progressive: true, OptimizeHuffman: true},
+			rst:  2*2 + 4*10 + 4*2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var restart, plain bytes.Buffer
+			opts := tt.opts
+			if err := Encode(&restart, tt.img, &opts); err != nil {
+				t.Fatal(err)
+			}
+			opts.RestartInterval, opts.RestartRows = 0, 0
+			if err := Encode(&plain, tt.img, &opts); err != nil {
+				t.Fatal(err)
+			}
+
+			data := restart.Bytes()
+			if !bytes.Contains(data, []byte{0xff, driMarker, 0x00, 0x04}) {
+				t.Error("DRI marker is not found")
+			}
+			rst := 0
+			for i := 0; i+1 < len(data); i++ {
+				if data[i] == 0xff && rst0Marker <= data[i+1] && data[i+1] <= rst7Marker {
+					rst++
+				}
+			}
+			if rst != tt.rst {
+				t.Errorf("got %d RST markers, want %d", rst, tt.rst)
+			}
+
+			// The restart markers don't change the image.
+			m0, err := Decode(&plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m1, err := Decode(&restart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := averageDelta(m0, m1); got != 0 {
+				t.Errorf("average delta is %d, want 0", got)
+			}
+		})
+	}
+}
+
+// TestEncodeFastPaths tests that the specialized conversions of the image
+// types give the same result as the generic one.
+func TestEncodeFastPaths(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	r := image.Rect(3, 5, 44, 31)
+	nrgba := image.NewNRGBA(r)
+	rgba64 := image.NewRGBA64(r)
+	gray16 := image.NewGray16(r)
+	cmyk := image.NewCMYK(r)
+	gray8 := graymap.New(r, 200)
+	gray16Map := graymap.New(r, 1000)
+	pix8 := pixmap.New(r, 255)
+	pix16 := pixmap.New(r, 4095)
+	for _, pix := range [][]uint8{nrgba.Pix, rgba64.Pix, gray16.Pix, cmyk.Pix} {
+		for i := range pix {
+			pix[i] = uint8(rnd.Intn(256))
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			gray8.SetGray(x, y, graymap.Color{Y: uint16(rnd.Intn(201)), Max: 200})
+			gray16Map.SetGray(x, y, graymap.Color{Y: uint16(rnd.Intn(1001)), Max: 1000})
+			pix8.SetPix(x, y, pixmap.Color{R: uint16(rnd.Intn(256)), G: uint16(rnd.Intn(256)), B: uint16(rnd.Intn(256)), Max: 255})
+			pix16.SetPix(x, y, pixmap.Color{R: uint16(rnd.Intn(4096)), G: uint16(rnd.Intn(4096)), B: uint16(rnd.Intn(4096)), Max: 4095})
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		opts *Options
+	}{
+		{"NRGBA", nrgba, nil},
+		{"RGBA64", rgba64, nil},
+		{"Gray16", gray16, nil},
+		{"CMYK", cmyk, nil},
+		{"YCCK", cmyk, &Options{YCCK: true}},
+		{"graymap 8-bit", gray8, nil},
+		{"graymap 16-bit", gray16Map, nil},
+		{"pixmap 8-bit", pix8, nil},
+		{"pixmap 16-bit", pix16, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fast, generic bytes.Buffer
+			if err := Encode(&fast, tt.img, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			// Embedding hides the concrete type, but not the color model.
+			if err := Encode(&generic, struct{ image.Image }{tt.img}, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fast.Bytes(), generic.Bytes()) {
+				t.Error("the specialized conversion differs from the generic one")
+			}
+		})
+	}
+}
+
+// TestEncodeColorModel tests that the number of the components is chosen by
+// the color model of the image.
+func TestEncodeColorModel(t *testing.T) {
+	r := image.Rect(0, 0, 16, 16)
+	tests := []struct {
+		img  image.Image
+		want color.Model
+	}{
+		{image.NewGray(r), color.GrayModel},
+		{image.NewGray16(r), color.GrayModel},
+		{graymap.New(r, 1000), color.GrayModel},
+		{image.NewNRGBA(r), color.YCbCrModel},
+		{pixmap.New(r, 255), color.YCbCrModel},
+		{image.NewCMYK(r), color.CMYKModel},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%T", tt.img), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, tt.img, nil); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := DecodeConfig(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ColorModel != tt.want {
+				t.Errorf("got %v, want %v", cfg.ColorModel, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeCMYK(t *testing.T) {
+	// A smooth image compresses well enough to compare the colors.
+	m0 := image.NewCMYK(image.Rect(0, 0, 45, 37))
+	for y := 0; y < 37; y++ {
+		for x := 0; x < 45; x++ {
+			m0.SetCMYK(x, y, color.CMYK{
+				C: uint8(5 * x),
+				M: uint8(6 * y),
+				Y: uint8(3 * (x + y)),
+				K: uint8(255 - 4*x),
+			})
+		}
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		transform uint8
+	}{
+		{"CMYK", Options{Quality: 95}, adobeTransformUnknown},
+		{"CMYK, progressive", Options{Quality: 95, Progressive: true}, adobeTransformUnknown},
+		{"CMYK, optimized", Options{Quality: 95, OptimizeHuffman: true, RestartInterval: 7}, adobeTransformUnknown},
+		{"YCCK", Options{Quality: 95, YCCK: true}, adobeTransformYCbCrK},
+		{"YCCK 4:4:4", Options{Quality: 95, YCCK: true, Subsampling: Subsampling444}, adobeTransformYCbCrK},
+		{"YCCK, progressive", Options{Quality: 95, YCCK: true, Progressive: true}, adobeTransformYCbCrK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m0, &tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			adobe := []byte{0xff, app14Marker, 0x00, 0x0e, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0, 0, 0, 0, tt.transform}
+			if !bytes.Contains(buf.Bytes(), adobe) {
+				t.Error("Adobe APP14 marker is not found")
+			}
+			m1, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmyk, ok := m1.(*image.CMYK)
+			if !ok {
+				t.Fatalf("got %T, want *image.CMYK", m1)
+			}
+			if m0.Bounds() != cmyk.Bounds() {
+				t.Fatalf("bounds differ: %v and %v", m0.Bounds(), cmyk.Bounds())
+			}
+			var sum int64
+			for i := range m0.Pix {
+				sum += delta(uint32(m0.Pix[i]), uint32(cmyk.Pix[i]))
+			}
+			if got, want := sum/int64(len(m0.Pix)), int64(2); got > want {
+				t.Errorf("average delta too high; got %d, want <= %d", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeYCCK_UnsupportedSubsampling(t *testing.T) {
+	img := image.NewCMYK(image.Rect(0, 0, 8, 8))
+	for _, s := range []Subsampling{Subsampling422, Subsampling440, Subsampling(-1)} {
+		if err := Encode(io.Discard, img, &Options{YCCK: true, Subsampling: s}); err == nil {
+			t.Errorf("%v: want error, got nil", s)
+		}
+	}
+}
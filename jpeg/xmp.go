@@ -0,0 +1,172 @@
+package jpeg
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The XMP packet is stored in an APP1 segment, and the extended XMP
+// serialization that doesn't fit in it is split into the following APP1
+// segments, as per the XMP Specification Part 3, section 1.1.3.1.
+const xmpName = "http://ns.adobe.com/xap/1.0/\x00"
+const extendedXMPName = "http://ns.adobe.com/xmp/extension/\x00"
+
+// extendedXMPHeaderSize is the size of the GUID, the full length and the
+// offset that follow extendedXMPName.
+const extendedXMPHeaderSize = 32 + 4 + 4
+
+// maxXMPSize is the maximum size of the XMP packet.
+const maxXMPSize = 0xffff - 2 - len(xmpName)
+
+// maxExtendedXMPChunkSize is the maximum size of a chunk of the extended XMP.
+const maxExtendedXMPChunkSize = 0xffff - 2 - len(extendedXMPName) - extendedXMPHeaderSize
+
+// ExtendedXMPGUID returns the GUID of the extended XMP serialization b,
+// which is the MD5 digest of b in uppercase hexadecimal.
+// The XMP packet refers to the extended XMP by the xmpNote:HasExtendedXMP
+// property with this value.
+func ExtendedXMPGUID(b []byte) string {
+	sum := md5.Sum(b)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// extendedXMP is the extended XMP serialization being read.
+type extendedXMP struct {
+	length uint32
+	chunks []extendedXMPChunk
+}
+
+type extendedXMPChunk struct {
+	offset uint32
+	data   []byte
+}
+
+// processExtendedXMP saves a chunk of the extended XMP. buf is the payload of
+// the APP1 segment after extendedXMPName.
+func (d *decoder) processExtendedXMP(buf []byte) {
+	if len(buf) < extendedXMPHeaderSize {
+		// Ignore the malformed chunk.
+		return
+	}
+	guid := string(buf[:32])
+	length := uint32(buf[32])<<24 | uint32(buf[33])<<16 | uint32(buf[34])<<8 | uint32(buf[35])
+	offset := uint32(buf[36])<<24 | uint32(buf[37])<<16 | uint32(buf[38])<<8 | uint32(buf[39])
+
+	if d.extendedXMP == nil {
+		d.extendedXMP = map[string]*extendedXMP{}
+	}
+	x, ok := d.extendedXMP[guid]
+	if !ok {
+		x = &extendedXMP{length: length}
+		d.extendedXMP[guid] = x
+	}
+	x.chunks = append(x.chunks, extendedXMPChunk{offset: offset, data: buf[extendedXMPHeaderSize:]})
+}
+
+// decodeExtendedXMP reassembles the extended XMP which the XMP packet refers
+// to. It returns nil if there is no such extended XMP, or if its chunks are
+// inconsistent or missing.
+func (d *decoder) decodeExtendedXMP() []byte {
+	var x *extendedXMP
+	for guid, xx := range d.extendedXMP {
+		if bytes.Contains(d.xmp, []byte(guid)) {
+			x = xx
+			break
+		}
+	}
+	if x == nil {
+		return nil
+	}
+
+	// The chunks must cover the whole serialization without gaps.
+	// The duplicated chunks are ignored.
+	sort.SliceStable(x.chunks, func(i, j int) bool {
+		return x.chunks[i].offset < x.chunks[j].offset
+	})
+	var size uint64
+	for i, c := range x.chunks {
+		if i > 0 && c.offset == x.chunks[i-1].offset {
+			continue
+		}
+		if uint64(c.offset) != size {
+			return nil
+		}
+		size += uint64(len(c.data))
+	}
+	if size != uint64(x.length) {
+		return nil
+	}
+	buf := make([]byte, 0, size)
+	for i, c := range x.chunks {
+		if i > 0 && c.offset == x.chunks[i-1].offset {
+			continue
+		}
+		buf = append(buf, c.data...)
+	}
+	return buf
+}
+
+// writeXMP writes the XMP packet xmp in an APP1 segment, and the extended XMP
+// in the following APP1 segments if it isn't nil.
+func (e *encoder) writeXMP(xmp, extended []byte) {
+	if e.err != nil {
+		return
+	}
+	if len(xmp) > maxXMPSize {
+		e.err = errors.New("jpeg: XMP packet is too large")
+		return
+	}
+	if uint64(len(extended)) > math.MaxUint32 {
+		e.err = errors.New("jpeg: extended XMP is too large")
+		return
+	}
+	var guid string
+	if extended != nil {
+		// Readers ignore the extended XMP that the XMP packet doesn't refer to.
+		guid = ExtendedXMPGUID(extended)
+		if !bytes.Contains(xmp, []byte(guid)) {
+			e.err = errors.New("jpeg: XMP packet doesn't refer to the extended XMP")
+			return
+		}
+	}
+
+	segmentSize := 2 + len(xmpName) + len(xmp)
+	e.buf[0] = 0xff
+	e.buf[1] = app1Marker
+	e.buf[2] = byte(segmentSize >> 8)
+	e.buf[3] = byte(segmentSize)
+	e.write(e.buf[:4])
+	e.write([]byte(xmpName))
+	e.write(xmp)
+
+	if extended == nil {
+		return
+	}
+	length := len(extended)
+	for off := 0; off < len(extended); off += maxExtendedXMPChunkSize {
+		chunk := extended[off:min(off+maxExtendedXMPChunkSize, len(extended))]
+		segmentSize := 2 + len(extendedXMPName) + extendedXMPHeaderSize + len(chunk)
+		e.buf[0] = 0xff
+		e.buf[1] = app1Marker
+		e.buf[2] = byte(segmentSize >> 8)
+		e.buf[3] = byte(segmentSize)
+		e.write(e.buf[:4])
+		e.write([]byte(extendedXMPName))
+		e.write([]byte(guid))
+		e.buf[0] = byte(length >> 24)
+		e.buf[1] = byte(length >> 16)
+		e.buf[2] = byte(length >> 8)
+		e.buf[3] = byte(length)
+		e.buf[4] = byte(off >> 24)
+		e.buf[5] = byte(off >> 16)
+		e.buf[6] = byte(off >> 8)
+		e.buf[7] = byte(off)
+		e.write(e.buf[:8])
+		e.write(chunk)
+	}
+}
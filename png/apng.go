@@ -0,0 +1,559 @@
+package png
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strconv"
+	"time"
+)
+
+// DisposeOp specifies how the output buffer should be changed
+// at the end of the delay (before rendering the next frame).
+type DisposeOp int
+
+const (
+	// DisposeOpNone means that no disposal is done on this frame before rendering the next;
+	// the contents of the output buffer are left as is.
+	DisposeOpNone DisposeOp = 0
+
+	// DisposeOpBackground means that the frame's region of the output buffer is
+	// to be cleared to fully transparent black before rendering the next frame.
+	DisposeOpBackground DisposeOp = 1
+
+	// DisposeOpPrevious means that the frame's region of the output buffer is
+	// to be reverted to the previous contents before rendering the next frame.
+	DisposeOpPrevious DisposeOp = 2
+)
+
+func (op DisposeOp) String() string {
+	switch op {
+	case DisposeOpNone:
+		return "None"
+	case DisposeOpBackground:
+		return "Background"
+	case DisposeOpPrevious:
+		return "Previous"
+	default:
+		return "Unknown DisposeOp: " + strconv.Itoa(int(op))
+	}
+}
+
+// BlendOp specifies whether the frame is to be alpha blended
+// into the current output buffer content, or whether it should completely
+// replace its region in the output buffer.
+type BlendOp int
+
+const (
+	// BlendOpSource means that all color components of the frame,
+	// including alpha, overwrite the current contents of the frame's output buffer region.
+	BlendOpSource BlendOp = 0
+
+	// BlendOpOver means that the frame should be composited onto the output buffer
+	// based on its alpha.
+	BlendOpOver BlendOp = 1
+)
+
+func (op BlendOp) String() string {
+	switch op {
+	case BlendOpSource:
+		return "Source"
+	case BlendOpOver:
+		return "Over"
+	default:
+		return "Unknown BlendOp: " + strconv.Itoa(int(op))
+	}
+}
+
+// Frame is a frame of an animated PNG.
+type Frame struct {
+	// Image is the image of the frame.
+	// Its size is the size of the frame region.
+	image.Image
+
+	// XOffset and YOffset are the position of the frame region on the canvas.
+	XOffset, YOffset int
+
+	// DelayNum and DelayDen are the frame delay fraction in seconds.
+	// If DelayDen is 0, the denominator is treated as 100.
+	DelayNum, DelayDen uint16
+
+	// DisposeOp is the type of frame area disposal to be done after rendering this frame.
+	DisposeOp DisposeOp
+
+	// BlendOp is the type of frame area rendering for this frame.
+	BlendOp BlendOp
+}
+
+// Delay returns the frame delay.
+func (f *Frame) Delay() time.Duration {
+	den := time.Duration(f.DelayDen)
+	if den == 0 {
+		den = 100
+	}
+	return time.Duration(f.DelayNum) * time.Second / den
+}
+
+// APNG is an animated PNG image.
+type APNG struct {
+	// Width and Height are the size of the canvas.
+	Width, Height int
+
+	// DefaultImage is the default image that is shown by decoders that don't support APNG.
+	// If DefaultImage is nil, the first frame is the default image.
+	DefaultImage image.Image
+
+	// Frames are the frames of the animation.
+	Frames []Frame
+
+	// LoopCount is the number of times to loop the animation.
+	// 0 means infinite looping.
+	LoopCount int
+}
+
+// Render composites the frames onto the full canvas,
+// and returns the images that are shown in each frame.
+func (a *APNG) Render() []*image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, a.Width, a.Height))
+	ret := make([]*image.RGBA, 0, len(a.Frames))
+	var prev *image.RGBA
+	for i, f := range a.Frames {
+		size := f.Bounds().Size()
+		r := image.Rectangle{
+			Min: image.Pt(f.XOffset, f.YOffset),
+			Max: image.Pt(f.XOffset+size.X, f.YOffset+size.Y),
+		}
+
+		dispose := f.DisposeOp
+		if dispose == DisposeOpPrevious && i == 0 {
+			// If the first frame is DisposeOpPrevious, it should be treated as DisposeOpBackground.
+			dispose = DisposeOpBackground
+		}
+		if dispose == DisposeOpPrevious {
+			if prev == nil {
+				prev = image.NewRGBA(r)
+			} else {
+				prev.Rect = r
+				prev.Stride = 4 * r.Dx()
+				if cap(prev.Pix) < 4*r.Dx()*r.Dy() {
+					prev.Pix = make([]uint8, 4*r.Dx()*r.Dy())
+				}
+				prev.Pix = prev.Pix[:4*r.Dx()*r.Dy()]
+			}
+			draw.Draw(prev, r, canvas, r.Min, draw.Src)
+		}
+
+		op := draw.Src
+		if f.BlendOp == BlendOpOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, r, f.Image, f.Bounds().Min, op)
+
+		out := image.NewRGBA(canvas.Rect)
+		copy(out.Pix, canvas.Pix)
+		ret = append(ret, out)
+
+		switch dispose {
+		case DisposeOpBackground:
+			draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+		case DisposeOpPrevious:
+			draw.Draw(canvas, r, prev, r.Min, draw.Src)
+		}
+	}
+	return ret
+}
+
+// DecodeAll reads an animated PNG image from r and returns the sequential frames.
+// If the image is not animated, the image is returned as a single frame.
+func DecodeAll(r io.Reader) (*APNG, error) {
+	var dec Decoder
+	return dec.DecodeAll(r)
+}
+
+// DecodeAll reads an animated PNG image from r and returns the sequential frames.
+// If the image is not animated, the image is returned as a single frame.
+// DecodeAll doesn't return partially decoded images even if the decoder is lenient.
+func (dec *Decoder) DecodeAll(r io.Reader) (*APNG, error) {
+	d := dec.newDecoder(r)
+	d.decodeAnimation = true
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	for d.stage != dsSeenIEND {
+		if err := d.parseChunk(false); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	if !d.animated {
+		// It is not an animated PNG.
+		return &APNG{
+			Width:  d.width,
+			Height: d.height,
+			Frames: []Frame{{Image: d.img}},
+		}, nil
+	}
+	if d.frameControl != nil {
+		return nil, FormatError("missing fdAT chunk")
+	}
+	if len(d.frames) != int(d.numFrames) {
+		return nil, FormatError("bad number of APNG frames")
+	}
+	a := &APNG{
+		Width:     d.width,
+		Height:    d.height,
+		Frames:    d.frames,
+		LoopCount: int(d.numPlays),
+	}
+	if !d.defaultIsFrame {
+		a.DefaultImage = d.img
+	}
+	return a, nil
+}
+
+func (d *decoder) parseACTL(length uint32) error {
+	if length != 8 {
+		return FormatError("bad acTL length")
+	}
+	if d.animated {
+		return FormatError("multiple acTL chunks")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:8])
+	d.numFrames = binary.BigEndian.Uint32(d.tmp[0:4])
+	d.numPlays = binary.BigEndian.Uint32(d.tmp[4:8])
+	if d.numFrames == 0 {
+		return FormatError("bad number of APNG frames")
+	}
+	d.animated = true
+	return d.verifyChecksum()
+}
+
+// checkSequenceNumber checks the sequence number of fcTL and fdAT chunks.
+func (d *decoder) checkSequenceNumber(seq uint32) error {
+	if seq != d.seq {
+		return FormatError("bad APNG sequence number")
+	}
+	d.seq++
+	return nil
+}
+
+func (d *decoder) parseFCTL(length uint32) error {
+	if length != 26 {
+		return FormatError("bad fcTL length")
+	}
+	if !d.animated {
+		return chunkOrderError
+	}
+	if d.frameControl != nil {
+		return FormatError("missing fdAT chunk")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:26]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:26])
+	if err := d.checkSequenceNumber(binary.BigEndian.Uint32(d.tmp[0:4])); err != nil {
+		return err
+	}
+
+	w := binary.BigEndian.Uint32(d.tmp[4:8])
+	h := binary.BigEndian.Uint32(d.tmp[8:12])
+	x := binary.BigEndian.Uint32(d.tmp[12:16])
+	y := binary.BigEndian.Uint32(d.tmp[16:20])
+	if w == 0 || h == 0 || uint64(x)+uint64(w) > uint64(d.width) || uint64(y)+uint64(h) > uint64(d.height) {
+		return FormatError("bad fcTL frame region")
+	}
+	if d.stage < dsSeenIDAT && (x != 0 || y != 0 || int(w) != d.width || int(h) != d.height) {
+		// The default image is the first frame, so it must cover the whole canvas.
+		return FormatError("bad fcTL frame region")
+	}
+	f := &Frame{
+		XOffset:   int(x),
+		YOffset:   int(y),
+		DelayNum:  binary.BigEndian.Uint16(d.tmp[20:22]),
+		DelayDen:  binary.BigEndian.Uint16(d.tmp[22:24]),
+		DisposeOp: DisposeOp(d.tmp[24]),
+		BlendOp:   BlendOp(d.tmp[25]),
+	}
+	if f.DisposeOp > DisposeOpPrevious {
+		return FormatError("bad fcTL dispose op")
+	}
+	if f.BlendOp > BlendOpOver {
+		return FormatError("bad fcTL blend op")
+	}
+	d.frameControl = f
+	d.frameWidth, d.frameHeight = int(w), int(h)
+	if d.stage < dsSeenIDAT {
+		d.defaultIsFrame = true
+	}
+	return d.verifyChecksum()
+}
+
+// readFDATSequenceNumber reads the sequence number at the beginning of fdAT chunks.
+func (d *decoder) readFDATSequenceNumber() error {
+	if d.idatLength < 4 {
+		return FormatError("bad fdAT length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:4])
+	d.idatLength -= 4
+	return d.checkSequenceNumber(binary.BigEndian.Uint32(d.tmp[:4]))
+}
+
+func (d *decoder) parseFDAT(length uint32) error {
+	if d.frameControl == nil {
+		return FormatError("missing fcTL chunk")
+	}
+
+	// decode the frame with the size of the frame region.
+	width, height := d.width, d.height
+	d.width, d.height = d.frameWidth, d.frameHeight
+	defer func() {
+		d.width, d.height = width, height
+	}()
+
+	d.fdat = true
+	defer func() {
+		d.fdat = false
+	}()
+	d.idatLength = length
+	if err := d.readFDATSequenceNumber(); err != nil {
+		return err
+	}
+	img, err := d.decode()
+	if err != nil {
+		return err
+	}
+	d.appendFrame(img)
+	return d.verifyChecksum()
+}
+
+func (d *decoder) appendFrame(img image.Image) {
+	f := d.frameControl
+	f.Image = img
+	d.frames = append(d.frames, *f)
+	d.frameControl = nil
+}
+
+// EncodeAll writes the animated PNG a to w.
+func EncodeAll(w io.Writer, a *APNG) error {
+	var e Encoder
+	return e.EncodeAll(w, a)
+}
+
+// EncodeAll writes the animated PNG a to w.
+func (enc *Encoder) EncodeAll(w io.Writer, a *APNG) error {
+	if a.Width <= 0 || a.Height <= 0 || int64(a.Width) >= 1<<32 || int64(a.Height) >= 1<<32 {
+		return FormatError("invalid image size: " + strconv.Itoa(a.Width) + "x" + strconv.Itoa(a.Height))
+	}
+	if len(a.Frames) == 0 {
+		return FormatError("no frames")
+	}
+	canvas := image.Rect(0, 0, a.Width, a.Height)
+	images := make([]image.Image, 0, len(a.Frames)+1)
+	if a.DefaultImage != nil {
+		if a.DefaultImage.Bounds().Size() != canvas.Size() {
+			return FormatError("the default image must cover the whole canvas")
+		}
+		images = append(images, a.DefaultImage)
+	} else {
+		f := a.Frames[0]
+		if f.XOffset != 0 || f.YOffset != 0 || f.Bounds().Size() != canvas.Size() {
+			return FormatError("the first frame must cover the whole canvas")
+		}
+	}
+	for i, f := range a.Frames {
+		size := f.Bounds().Size()
+		r := image.Rectangle{
+			Min: image.Pt(f.XOffset, f.YOffset),
+			Max: image.Pt(f.XOffset+size.X, f.YOffset+size.Y),
+		}
+		if r.Empty() || !r.In(canvas) {
+			return FormatError("invalid frame region of frame " + strconv.Itoa(i))
+		}
+		images = append(images, f.Image)
+	}
+
+	var e *encoder
+	if enc.BufferPool != nil {
+		buffer := enc.BufferPool.Get()
+		e = (*encoder)(buffer)
+
+	}
+	if e == nil {
+		e = &encoder{}
+	}
+	if enc.BufferPool != nil {
+		defer enc.BufferPool.Put((*EncoderBuffer)(e))
+	}
+
+	e.enc = enc
+	e.w = w
+	e.m = images[0]
+	e.seq = 0
+
+	var pal color.Palette
+	e.cb, pal = cbForImages(images)
+
+	_, e.err = io.WriteString(w, pngHeader)
+	e.writeIHDR()
+	e.writeACTL(len(a.Frames), a.LoopCount)
+	if pal != nil {
+		e.writePLTEAndTRNS(pal)
+	}
+	if a.DefaultImage != nil {
+		e.writeIDATs()
+	}
+	for i, f := range a.Frames {
+		e.writeFCTL(f)
+		if i == 0 && a.DefaultImage == nil {
+			e.m = f.Image
+			e.writeIDATs()
+		} else {
+			e.writeFDATs(f.Image)
+		}
+	}
+	e.writeIEND()
+	return e.err
+}
+
+// cbForImages returns the combination of color type and bit depth
+// that can represent all the images.
+func cbForImages(images []image.Image) (int, color.Palette) {
+	// cbP8 encoding needs PalettedImage's ColorIndexAt method,
+	// and all the images must share the same palette.
+	var pal color.Palette
+	for i, m := range images {
+		if _, ok := m.(image.PalettedImage); !ok {
+			pal = nil
+			break
+		}
+		p, _ := m.ColorModel().(color.Palette)
+		if p == nil || (i > 0 && !samePalette(pal, p)) {
+			pal = nil
+			break
+		}
+		pal = p
+	}
+	if pal != nil {
+		if len(pal) <= 2 {
+			return cbP1, pal
+		} else if len(pal) <= 4 {
+			return cbP2, pal
+		} else if len(pal) <= 16 {
+			return cbP4, pal
+		}
+		return cbP8, pal
+	}
+
+	gray, gray16, rgba, isOpaque := true, true, true, true
+	for _, m := range images {
+		switch m.ColorModel() {
+		case color.GrayModel:
+			gray16 = false
+		case color.Gray16Model:
+			gray = false
+		case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+			gray, gray16 = false, false
+		default:
+			gray, gray16, rgba = false, false, false
+		}
+		if isOpaque && !opaque(m) {
+			isOpaque = false
+		}
+	}
+	switch {
+	case gray:
+		return cbG8, nil
+	case gray16:
+		return cbG16, nil
+	case rgba && isOpaque:
+		return cbTC8, nil
+	case rgba:
+		return cbTCA8, nil
+	case isOpaque:
+		return cbTC16, nil
+	default:
+		return cbTCA16, nil
+	}
+}
+
+func samePalette(p, q color.Palette) bool {
+	if len(p) != len(q) {
+		return false
+	}
+	for i := range p {
+		r0, g0, b0, a0 := p[i].RGBA()
+		r1, g1, b1, a1 := q[i].RGBA()
+		if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *encoder) writeACTL(numFrames, numPlays int) {
+	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(numFrames))
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(numPlays))
+	e.writeChunk(e.tmp[:8], "acTL")
+}
+
+func (e *encoder) writeFCTL(f Frame) {
+	size := f.Bounds().Size()
+	binary.BigEndian.PutUint32(e.tmp[0:4], e.seq)
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(size.X))
+	binary.BigEndian.PutUint32(e.tmp[8:12], uint32(size.Y))
+	binary.BigEndian.PutUint32(e.tmp[12:16], uint32(f.XOffset))
+	binary.BigEndian.PutUint32(e.tmp[16:20], uint32(f.YOffset))
+	binary.BigEndian.PutUint16(e.tmp[20:22], f.DelayNum)
+	binary.BigEndian.PutUint16(e.tmp[22:24], f.DelayDen)
+	e.tmp[24] = byte(f.DisposeOp)
+	e.tmp[25] = byte(f.BlendOp)
+	e.writeChunk(e.tmp[:26], "fcTL")
+	e.seq++
+}
+
+// fdatWriter is an io.Writer that satisfies writes by writing APNG fdAT chunks.
+type fdatWriter encoder
+
+func (w *fdatWriter) Write(b []byte) (int, error) {
+	e := (*encoder)(w)
+	e.fdat = binary.BigEndian.AppendUint32(e.fdat[:0], e.seq)
+	e.fdat = append(e.fdat, b...)
+	e.writeChunk(e.fdat, "fdAT")
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.seq++
+	return len(b), nil
+}
+
+// Write the frame image data to one or more fdAT chunks.
+func (e *encoder) writeFDATs(m image.Image) {
+	if e.err != nil {
+		return
+	}
+	if e.bw == nil {
+		e.bw = bufio.NewWriterSize((*fdatWriter)(e), 1<<15)
+	} else {
+		e.bw.Reset((*fdatWriter)(e))
+	}
+	e.err = e.writeImageData(e.bw, m)
+	if e.err != nil {
+		return
+	}
+	e.err = e.bw.Flush()
+}
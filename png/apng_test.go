@@ -0,0 +1,299 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"testing"
+	"time"
+)
+
+func newUniform(r image.Rectangle, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(r)
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+var (
+	red   = color.NRGBA{0xff, 0x00, 0x00, 0xff}
+	green = color.NRGBA{0x00, 0xff, 0x00, 0xff}
+	blue  = color.NRGBA{0x00, 0x00, 0xff, 0x80}
+)
+
+func testAPNG() *APNG {
+	return &APNG{
+		Width:  16,
+		Height: 16,
+		Frames: []Frame{
+			{
+				Image:    newUniform(image.Rect(0, 0, 16, 16), red),
+				DelayNum: 1,
+				DelayDen: 10,
+			},
+			{
+				Image:     newUniform(image.Rect(0, 0, 8, 8), green),
+				XOffset:   4,
+				YOffset:   4,
+				DelayNum:  20,
+				DisposeOp: DisposeOpPrevious,
+			},
+			{
+				Image:     newUniform(image.Rect(0, 0, 4, 4), blue),
+				XOffset:   12,
+				YOffset:   12,
+				DelayNum:  1,
+				DelayDen:  2,
+				DisposeOp: DisposeOpBackground,
+				BlendOp:   BlendOpOver,
+			},
+		},
+		LoopCount: 3,
+	}
+}
+
+func encodeDecodeAll(a *APNG) (*APNG, error) {
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, a); err != nil {
+		return nil, err
+	}
+	return DecodeAll(&buf)
+}
+
+func TestEncodeAll(t *testing.T) {
+	a := testAPNG()
+	decoded, err := encodeDecodeAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Width != a.Width || decoded.Height != a.Height {
+		t.Errorf("unexpected size: %dx%d, want %dx%d", decoded.Width, decoded.Height, a.Width, a.Height)
+	}
+	if decoded.LoopCount != a.LoopCount {
+		t.Errorf("unexpected loop count: %d, want %d", decoded.LoopCount, a.LoopCount)
+	}
+	if decoded.DefaultImage != nil {
+		t.Error("want nil default image")
+	}
+	if len(decoded.Frames) != len(a.Frames) {
+		t.Fatalf("unexpected number of frames: %d, want %d", len(decoded.Frames), len(a.Frames))
+	}
+	for i := range a.Frames {
+		want, got := a.Frames[i], decoded.Frames[i]
+		if got.XOffset != want.XOffset || got.YOffset != want.YOffset {
+			t.Errorf("frame %d: unexpected offset: (%d, %d), want (%d, %d)", i, got.XOffset, got.YOffset, want.XOffset, want.YOffset)
+		}
+		if got.Delay() != want.Delay() {
+			t.Errorf("frame %d: unexpected delay: %s, want %s", i, got.Delay(), want.Delay())
+		}
+		if got.DisposeOp != want.DisposeOp {
+			t.Errorf("frame %d: unexpected dispose op: %s, want %s", i, got.DisposeOp, want.DisposeOp)
+		}
+		if got.BlendOp != want.BlendOp {
+			t.Errorf("frame %d: unexpected blend op: %s, want %s", i, got.BlendOp, want.BlendOp)
+		}
+		if err := diff(want.Image, got.Image); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestEncodeAll_DefaultImage(t *testing.T) {
+	a := testAPNG()
+	a.DefaultImage = newUniform(image.Rect(0, 0, 16, 16), green)
+
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode returns the default image.
+	img, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(a.DefaultImage, img); err != nil {
+		t.Error(err)
+	}
+
+	decoded, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.DefaultImage == nil {
+		t.Fatal("unexpected nil default image")
+	}
+	if err := diff(a.DefaultImage, decoded.DefaultImage); err != nil {
+		t.Error(err)
+	}
+	if len(decoded.Frames) != len(a.Frames) {
+		t.Fatalf("unexpected number of frames: %d, want %d", len(decoded.Frames), len(a.Frames))
+	}
+}
+
+func TestEncodeAll_Paletted(t *testing.T) {
+	pal := color.Palette{red, green, blue}
+	frame0 := image.NewPaletted(image.Rect(0, 0, 8, 8), pal)
+	frame1 := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+	for i := range frame1.Pix {
+		frame1.Pix[i] = uint8(i % len(pal))
+	}
+	a := &APNG{
+		Width:  8,
+		Height: 8,
+		Frames: []Frame{
+			{Image: frame0},
+			{Image: frame1, XOffset: 2, YOffset: 2},
+		},
+	}
+	decoded, err := encodeDecodeAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range a.Frames {
+		if _, ok := decoded.Frames[i].Image.(*image.Paletted); !ok {
+			t.Errorf("frame %d: unexpected type %T, want *image.Paletted", i, decoded.Frames[i].Image)
+		}
+		if err := diff(a.Frames[i].Image, decoded.Frames[i].Image); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestEncodeAll_Interlace(t *testing.T) {
+	a := testAPNG()
+	enc := &Encoder{Interlace: true}
+	var buf bytes.Buffer
+	if err := enc.EncodeAll(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Frames) != len(a.Frames) {
+		t.Fatalf("unexpected number of frames: %d, want %d", len(decoded.Frames), len(a.Frames))
+	}
+	for i := range a.Frames {
+		if err := diff(a.Frames[i].Image, decoded.Frames[i].Image); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestEncodeAll_InvalidFrame(t *testing.T) {
+	a := testAPNG()
+	a.Frames[1].XOffset = 10
+	if err := EncodeAll(new(bytes.Buffer), a); err == nil {
+		t.Error("want error, got nil")
+	}
+
+	a = testAPNG()
+	a.Frames[0].XOffset = 1
+	if err := EncodeAll(new(bytes.Buffer), a); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestDecodeAll_NotAnimated(t *testing.T) {
+	f, err := os.Open("testdata/gamma.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 1 {
+		t.Fatalf("unexpected number of frames: %d, want 1", len(a.Frames))
+	}
+	if got, want := a.Frames[0].Bounds(), image.Rect(0, 0, a.Width, a.Height); got != want {
+		t.Errorf("unexpected bounds: %v, want %v", got, want)
+	}
+}
+
+func TestDecodeAll_BadSequenceNumber(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, testAPNG()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the sequence number of the second fcTL chunk.
+	b := buf.Bytes()
+	var out []byte
+	out = append(out, b[:len(pngHeader)]...)
+	fctl := 0
+	for b = b[len(pngHeader):]; len(b) > 0; {
+		length := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		name := string(b[4:8])
+		data := append([]byte(nil), b[8:8+length]...)
+		if name == "fcTL" {
+			fctl++
+			if fctl == 2 {
+				data[3]++
+			}
+		}
+		out = appendChunk(out, name, data)
+		b = b[12+length:]
+	}
+
+	_, err := DecodeAll(bytes.NewReader(out))
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	// Decode ignores animation chunks.
+	if _, err := Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFrame_Delay(t *testing.T) {
+	tests := []struct {
+		num, den uint16
+		want     time.Duration
+	}{
+		{1, 10, 100 * time.Millisecond},
+		{1, 0, 10 * time.Millisecond},
+		{0, 0, 0},
+		{3, 2, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		f := &Frame{DelayNum: tt.num, DelayDen: tt.den}
+		if got := f.Delay(); got != tt.want {
+			t.Errorf("Delay(%d/%d) = %s, want %s", tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestAPNG_Render(t *testing.T) {
+	frames := testAPNG().Render()
+	if len(frames) != 3 {
+		t.Fatalf("unexpected number of frames: %d, want 3", len(frames))
+	}
+
+	tests := []struct {
+		frame int
+		x, y  int
+		want  color.Color
+	}{
+		{0, 0, 0, red},
+		{0, 8, 8, red},
+		{1, 0, 0, red},
+		{1, 8, 8, green},
+		// The second frame is disposed to the previous content.
+		{2, 8, 8, red},
+		// The third frame is blended over the red background.
+		{2, 13, 13, color.NRGBA{0x7f, 0x00, 0x80, 0xff}},
+	}
+	for _, tt := range tests {
+		got := color.NRGBAModel.Convert(frames[tt.frame].At(tt.x, tt.y))
+		want := color.NRGBAModel.Convert(tt.want)
+		if got != want {
+			t.Errorf("frame %d (%d, %d): got %v, want %v", tt.frame, tt.x, tt.y, got, want)
+		}
+	}
+}
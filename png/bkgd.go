@@ -0,0 +1,97 @@
+package png
+
+import (
+	"encoding/binary"
+	"image/color"
+	"io"
+)
+
+func (d *decoder) parseBKGD(length uint32) error {
+	var n int
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8, cbG16, cbGA8, cbGA16:
+		n = 2
+	case cbTC8, cbTC16, cbTCA8, cbTCA16:
+		n = 6
+	case cbP1, cbP2, cbP4, cbP8:
+		n = 1
+	}
+	if length != uint32(n) {
+		return FormatError("bad bKGD length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:n]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:n])
+
+	if cbPaletted(d.cb) {
+		if int(d.tmp[0]) >= len(d.palette) {
+			return FormatError("bad bKGD palette index")
+		}
+	} else {
+		limit := uint16(1<<d.depth - 1)
+		for i := 0; i < n; i += 2 {
+			if binary.BigEndian.Uint16(d.tmp[i:]) > limit {
+				return FormatError("bad bKGD value")
+			}
+		}
+	}
+	d.bkgd = append([]byte(nil), d.tmp[:n]...)
+	return d.verifyChecksum()
+}
+
+// background returns the background color from the bKGD chunk.
+// It is resolved after all chunks are read, because the tRNS chunk may
+// follow the bKGD chunk and change the palette.
+func (d *decoder) background() color.Color {
+	switch len(d.bkgd) {
+	case 1:
+		return d.palette[d.bkgd[0]]
+	case 2:
+		y := binary.BigEndian.Uint16(d.bkgd[0:2])
+		return color.Gray16{Y: scaleTo16(y, d.depth)}
+	case 6:
+		r := binary.BigEndian.Uint16(d.bkgd[0:2])
+		g := binary.BigEndian.Uint16(d.bkgd[2:4])
+		b := binary.BigEndian.Uint16(d.bkgd[4:6])
+		return color.RGBA64{
+			R: scaleTo16(r, d.depth),
+			G: scaleTo16(g, d.depth),
+			B: scaleTo16(b, d.depth),
+			A: 0xffff,
+		}
+	}
+	return nil
+}
+
+// scaleTo16 scales the sample v of the bit depth to 16 bits.
+func scaleTo16(v uint16, depth int) uint16 {
+	return uint16(uint32(v) * 0xffff / (1<<depth - 1))
+}
+
+func (e *encoder) writeBKGD(c color.Color, pal color.Palette) {
+	switch e.cb {
+	case cbG8:
+		e.tmp[0] = 0
+		e.tmp[1] = color.GrayModel.Convert(c).(color.Gray).Y
+		e.writeChunk(e.tmp[:2], "bKGD")
+	case cbG16:
+		binary.BigEndian.PutUint16(e.tmp[0:2], color.Gray16Model.Convert(c).(color.Gray16).Y)
+		e.writeChunk(e.tmp[:2], "bKGD")
+	case cbTC8, cbTCA8:
+		c1 := color.NRGBAModel.Convert(c).(color.NRGBA)
+		binary.BigEndian.PutUint16(e.tmp[0:2], uint16(c1.R))
+		binary.BigEndian.PutUint16(e.tmp[2:4], uint16(c1.G))
+		binary.BigEndian.PutUint16(e.tmp[4:6], uint16(c1.B))
+		e.writeChunk(e.tmp[:6], "bKGD")
+	case cbTC16, cbTCA16:
+		c1 := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		binary.BigEndian.PutUint16(e.tmp[0:2], c1.R)
+		binary.BigEndian.PutUint16(e.tmp[2:4], c1.G)
+		binary.BigEndian.PutUint16(e.tmp[4:6], c1.B)
+		e.writeChunk(e.tmp[:6], "bKGD")
+	case cbP1, cbP2, cbP4, cbP8:
+		e.tmp[0] = byte(pal.Index(c))
+		e.writeChunk(e.tmp[:1], "bKGD")
+	}
+}
@@ -0,0 +1,150 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestDecodeWithMeta_Background(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     color.Color
+	}{
+		{
+			// paletted image, the background is the palette entry 245.
+			filename: "ftbyn3p08",
+			want:     color.RGBA{0xff, 0xff, 0x00, 0xff},
+		},
+		{
+			filename: "ftbwn0g16",
+			want:     color.Gray16{0xffff},
+		},
+		{
+			filename: "ftbrn2c08",
+			want:     color.RGBA64{0xffff, 0x0000, 0x0000, 0xffff},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			f, err := os.Open("testdata/pngsuite/" + tt.filename + ".png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			img, err := DecodeWithMeta(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Background != tt.want {
+				t.Errorf("unexpected background: got %v, want %v", img.Background, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeWithMeta_Background(t *testing.T) {
+	palette := color.Palette{
+		color.NRGBA{0xff, 0x00, 0x00, 0x00},
+		color.RGBA{0x00, 0xff, 0x00, 0xff},
+		color.RGBA{0x00, 0x00, 0xff, 0xff},
+	}
+	tests := []struct {
+		name  string
+		img   image.Image
+		color color.Color
+		want  color.Color
+	}{
+		{
+			name:  "gray",
+			img:   image.NewGray(image.Rect(0, 0, 1, 1)),
+			color: color.Gray{0x80},
+			want:  color.Gray16{0x8080},
+		},
+		{
+			name:  "gray16",
+			img:   image.NewGray16(image.Rect(0, 0, 1, 1)),
+			color: color.Gray16{0x1234},
+			want:  color.Gray16{0x1234},
+		},
+		{
+			name:  "truecolor",
+			img:   image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			color: color.RGBA{0x12, 0x34, 0x56, 0xff},
+			want:  color.RGBA64{0x1212, 0x3434, 0x5656, 0xffff},
+		},
+		{
+			name:  "truecolor16",
+			img:   image.NewNRGBA64(image.Rect(0, 0, 1, 1)),
+			color: color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff},
+			want:  color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff},
+		},
+		{
+			name:  "paletted",
+			img:   image.NewPaletted(image.Rect(0, 0, 1, 1), palette),
+			color: color.RGBA{0x00, 0x00, 0xff, 0xff},
+			want:  color.RGBA{0x00, 0x00, 0xff, 0xff},
+		},
+		{
+			name:  "paletted, not in the palette",
+			img:   image.NewPaletted(image.Rect(0, 0, 1, 1), palette),
+			color: color.RGBA{0x00, 0xf0, 0x00, 0xff},
+			want:  color.RGBA{0x00, 0xff, 0x00, 0xff},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+				Image:      tt.img,
+				Background: tt.color,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Background != tt.want {
+				t.Errorf("unexpected background: got %v, want %v", decoded.Background, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeWithMeta_BackgroundBeforePLTE(t *testing.T) {
+	data, err := os.ReadFile("testdata/pngsuite/ftbbn3p08.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewChunkReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the bKGD chunk before the PLTE chunk.
+	out := []byte(pngHeader)
+	for {
+		c, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch c.Type {
+		case "PLTE":
+			out = appendChunk(out, "bKGD", []byte{0})
+			out = appendChunk(out, c.Type, c.Data)
+		case "bKGD":
+		default:
+			out = appendChunk(out, c.Type, c.Data)
+		}
+	}
+
+	if _, err := DecodeWithMeta(bytes.NewReader(out)); err != chunkOrderError {
+		t.Errorf("want chunkOrderError, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"unicode/utf16"
+
+	"github.com/shogo82148/go-imaging/icc"
+)
+
+// Chromaticity is a CIE 1931 xy chromaticity coordinate.
+type Chromaticity struct {
+	X, Y float64
+}
+
+// Chromaticities is the chromaticities of the primaries and the white point of the image.
+type Chromaticities struct {
+	WhitePoint Chromaticity
+	Red        Chromaticity
+	Green      Chromaticity
+	Blue       Chromaticity
+}
+
+func (d *decoder) parseCHRM(length uint32) error {
+	if length != 32 {
+		return FormatError("bad cHRM length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:32]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:32])
+
+	var v [8]float64
+	for i := range v {
+		v[i] = float64(binary.BigEndian.Uint32(d.tmp[4*i:])) / 100000
+	}
+	d.chrm = &Chromaticities{
+		WhitePoint: Chromaticity{v[0], v[1]},
+		Red:        Chromaticity{v[2], v[3]},
+		Green:      Chromaticity{v[4], v[5]},
+		Blue:       Chromaticity{v[6], v[7]},
+	}
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeCHRM(c *Chromaticities) {
+	v := [8]float64{
+		c.WhitePoint.X, c.WhitePoint.Y,
+		c.Red.X, c.Red.Y,
+		c.Green.X, c.Green.Y,
+		c.Blue.X, c.Blue.Y,
+	}
+	for i, f := range v {
+		// PNG four-byte unsigned integers are limited to 2^31-1.
+		x, ok := fixedPoint(f, 100000, math.MaxInt32)
+		if !ok {
+			e.err = FormatError("invalid chromaticity")
+			return
+		}
+		binary.BigEndian.PutUint32(e.tmp[4*i:], x)
+	}
+	e.writeChunk(e.tmp[:32], "cHRM")
+}
+
+// fixedPoint converts f to the fixed-point value in the unit.
+// It reports false if f is NaN, negative, or larger than max in the unit.
+func fixedPoint(f, unit float64, max uint32) (uint32, bool) {
+	v := math.RoundToEven(f * unit)
+	if !(v >= 0 && v <= float64(max)) {
+		return 0, false
+	}
+	return uint32(v), true
+}
+
+// matrix3 is a 3x3 matrix.
+type matrix3 [3][3]float64
+
+func (m matrix3) mul(n matrix3) matrix3 {
+	var ret matrix3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			ret[i][j] = m[i][0]*n[0][j] + m[i][1]*n[1][j] + m[i][2]*n[2][j]
+		}
+	}
+	return ret
+}
+
+func (m matrix3) apply(v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func (m matrix3) inverse() (matrix3, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return matrix3{}, false
+	}
+	return matrix3{
+		{
+			(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det,
+			(m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det,
+			(m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det,
+		},
+		{
+			(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det,
+			(m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det,
+			(m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det,
+		},
+		{
+			(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det,
+			(m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det,
+			(m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det,
+		},
+	}, true
+}
+
+// xyz converts the chromaticity to the CIE XYZ color whose luminance is 1.
+func (c Chromaticity) xyz() [3]float64 {
+	return [3]float64{c.X / c.Y, 1, (1 - c.X - c.Y) / c.Y}
+}
+
+// d50 is the PCS illuminant of ICC profiles.
+var d50 = [3]float64{0.9642, 1.0, 0.8249}
+
+// bradford is the Bradford chromatic adaptation matrix.
+var bradford = matrix3{
+	{0.8951, 0.2664, -0.1614},
+	{-0.7502, 1.7135, 0.0367},
+	{0.0389, -0.0685, 1.0296},
+}
+
+// ICCProfile returns a matrix/TRC ICC profile that is equivalent to
+// the chromaticities and gamma.
+// gamma is the value of the gAMA chunk, for example, 0.45455.
+func (c *Chromaticities) ICCProfile(gamma float64) (*icc.Profile, error) {
+	if gamma <= 0 || math.IsNaN(gamma) || math.IsInf(gamma, 0) {
+		return nil, errors.New("png: invalid gamma")
+	}
+	for _, p := range []Chromaticity{c.WhitePoint, c.Red, c.Green, c.Blue} {
+		if p.Y <= 0 || p.X < 0 || math.IsNaN(p.X) || math.IsNaN(p.Y) {
+			return nil, errors.New("png: invalid chromaticities")
+		}
+	}
+
+	// compute the RGB to XYZ matrix.
+	r, g, b := c.Red.xyz(), c.Green.xyz(), c.Blue.xyz()
+	primaries := matrix3{
+		{r[0], g[0], b[0]},
+		{r[1], g[1], b[1]},
+		{r[2], g[2], b[2]},
+	}
+	inv, ok := primaries.inverse()
+	if !ok {
+		return nil, errors.New("png: invalid chromaticities")
+	}
+	white := c.WhitePoint.xyz()
+	s := inv.apply(white)
+	rgbToXYZ := primaries.mul(matrix3{
+		{s[0], 0, 0},
+		{0, s[1], 0},
+		{0, 0, s[2]},
+	})
+
+	// adapt the white point to D50.
+	bradfordInv, _ := bradford.inverse()
+	src := bradford.apply(white)
+	dst := bradford.apply(d50)
+	chad := bradfordInv.mul(matrix3{
+		{dst[0] / src[0], 0, 0},
+		{0, dst[1] / src[1], 0},
+		{0, 0, dst[2] / src[2]},
+	}).mul(bradford)
+	adapted := chad.mul(rgbToXYZ)
+
+	trc := &icc.TagContentParametricCurve{
+		FunctionType: 0x0000,
+	}
+	trc.Params[0] = icc.S15Fixed16NumberFromFloat64(1 / gamma)
+
+	return &icc.Profile{
+		ProfileHeader: icc.ProfileHeader{
+			Version:                0x04300000,
+			Class:                  icc.ClassDisplay,
+			ColorSpace:             icc.ColorSpaceRGB,
+			ProfileConnectionSpace: icc.ColorSpaceXYZ,
+			XYZ:                    xyzNumber(d50),
+		},
+		Tags: []icc.TagEntry{
+			{Tag: icc.TagProfileDescription, TagContent: mlucTag("PNG cHRM/gAMA")},
+			{Tag: icc.TagMediaWhitePoint, TagContent: xyzTag(d50)},
+			{Tag: icc.TagChromaticAdaptation, TagContent: sf32Tag(chad)},
+			{Tag: icc.TagRedMatrixColumn, TagContent: xyzTag([3]float64{adapted[0][0], adapted[1][0], adapted[2][0]})},
+			{Tag: icc.TagGreenMatrixColumn, TagContent: xyzTag([3]float64{adapted[0][1], adapted[1][1], adapted[2][1]})},
+			{Tag: icc.TagBlueMatrixColumn, TagContent: xyzTag([3]float64{adapted[0][2], adapted[1][2], adapted[2][2]})},
+			{Tag: icc.TagRedTRC, TagContent: trc},
+			{Tag: icc.TagGreenTRC, TagContent: trc},
+			{Tag: icc.TagBlueTRC, TagContent: trc},
+		},
+	}, nil
+}
+
+func xyzNumber(v [3]float64) icc.XYZNumber {
+	return icc.XYZNumber{
+		X: icc.S15Fixed16NumberFromFloat64(v[0]),
+		Y: icc.S15Fixed16NumberFromFloat64(v[1]),
+		Z: icc.S15Fixed16NumberFromFloat64(v[2]),
+	}
+}
+
+// xyzTag returns a XYZType tag.
+func xyzTag(v [3]float64) icc.TagContent {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, icc.TagTypeXYZ)
+	binary.Write(buf, binary.BigEndian, uint32(0)) // reserved
+	binary.Write(buf, binary.BigEndian, xyzNumber(v))
+	return &icc.TagContentRaw{Data: buf.Bytes()}
+}
+
+// sf32Tag returns a s15Fixed16ArrayType tag.
+func sf32Tag(m matrix3) icc.TagContent {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, icc.TagTypeS15Fixed16Array)
+	binary.Write(buf, binary.BigEndian, uint32(0)) // reserved
+	for _, row := range m {
+		for _, v := range row {
+			binary.Write(buf, binary.BigEndian, icc.S15Fixed16NumberFromFloat64(v))
+		}
+	}
+	return &icc.TagContentRaw{Data: buf.Bytes()}
+}
+
+// mlucTag returns a multiLocalizedUnicodeType tag that has only an English text.
+func mlucTag(s string) icc.TagContent {
+	text := utf16.Encode([]rune(s))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, icc.TagTypeMultiLocalizedUnicode)
+	binary.Write(buf, binary.BigEndian, uint32(0))  // reserved
+	binary.Write(buf, binary.BigEndian, uint32(1))  // number of records
+	binary.Write(buf, binary.BigEndian, uint32(12)) // record size
+	buf.WriteString("enUS")                         // language code and country code
+	binary.Write(buf, binary.BigEndian, uint32(len(text)*2))
+	binary.Write(buf, binary.BigEndian, uint32(28)) // offset
+	binary.Write(buf, binary.BigEndian, text)
+	return &icc.TagContentRaw{Data: buf.Bytes()}
+}
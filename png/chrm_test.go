@@ -0,0 +1,113 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/shogo82148/go-imaging/icc"
+)
+
+// srgbChromaticities is the chromaticities of sRGB.
+var srgbChromaticities = &Chromaticities{
+	WhitePoint: Chromaticity{0.3127, 0.3290},
+	Red:        Chromaticity{0.64, 0.33},
+	Green:      Chromaticity{0.30, 0.60},
+	Blue:       Chromaticity{0.15, 0.06},
+}
+
+func TestEncodeWithMeta_Chromaticities(t *testing.T) {
+	m := &ImageWithMeta{
+		Image:          image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Gamma:          0.45455,
+		Chromaticities: srgbChromaticities,
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(m.Chromaticities, decoded.Chromaticities); diff != "" {
+		t.Errorf("unexpected chromaticities (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeWithMeta_InvalidChromaticities(t *testing.T) {
+	for _, v := range []float64{-0.1, math.NaN(), math.Inf(1), 30000} {
+		c := *srgbChromaticities
+		c.Red.X = v
+		m := &ImageWithMeta{
+			Image:          image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+			Chromaticities: &c,
+		}
+		if _, err := encodeDecodeWithMeta(m); err != FormatError("invalid chromaticity") {
+			t.Errorf("%v: want invalid chromaticity error, got %v", v, err)
+		}
+	}
+}
+
+func TestChromaticities_ICCProfile(t *testing.T) {
+	profile, err := srgbChromaticities.ICCProfile(0.45455)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip
+	var buf bytes.Buffer
+	if err := profile.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	profile, err = icc.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the primaries of sRGB adapted to D50.
+	tests := []struct {
+		tag  icc.Tag
+		want [3]float64
+	}{
+		{icc.TagRedMatrixColumn, [3]float64{0.4361, 0.2225, 0.0139}},
+		{icc.TagGreenMatrixColumn, [3]float64{0.3851, 0.7169, 0.0971}},
+		{icc.TagBlueMatrixColumn, [3]float64{0.1431, 0.0606, 0.7141}},
+		{icc.TagMediaWhitePoint, [3]float64{0.9642, 1.0, 0.8249}},
+	}
+	for _, tt := range tests {
+		data, err := profile.Get(tt.tag).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var xyz icc.XYZNumber
+		if err := binary.Read(bytes.NewReader(data[8:]), binary.BigEndian, &xyz); err != nil {
+			t.Fatal(err)
+		}
+		got := [3]float64{xyz.X.Float64(), xyz.Y.Float64(), xyz.Z.Float64()}
+		for i := range got {
+			if math.Abs(got[i]-tt.want[i]) > 1e-3 {
+				t.Errorf("%08x: unexpected XYZ: %v, want %v", uint32(tt.tag), got, tt.want)
+				break
+			}
+		}
+	}
+
+	curve := profile.Get(icc.TagRedTRC).(icc.Curve)
+	if got := curve.DecodeTone(0.5); math.Abs(got-math.Pow(0.5, 2.2)) > 1e-3 {
+		t.Errorf("unexpected tone: %f, want %f", got, math.Pow(0.5, 2.2))
+	}
+}
+
+func TestChromaticities_ICCProfileInvalid(t *testing.T) {
+	c := &Chromaticities{
+		WhitePoint: Chromaticity{0.3127, 0.3290},
+		Red:        Chromaticity{0.64, 0.33},
+		Green:      Chromaticity{0.64, 0.33},
+		Blue:       Chromaticity{0.64, 0.33},
+	}
+	if _, err := c.ICCProfile(0.45455); err == nil {
+		t.Error("want error, got nil")
+	}
+}
@@ -0,0 +1,205 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Chunk is a raw PNG chunk.
+type Chunk struct {
+	// Type is the four-letter chunk type, e.g. "IHDR", "tEXt".
+	Type string
+
+	// Data is the chunk data, without the length, the type and the CRC.
+	Data []byte
+}
+
+// IsCritical reports whether the chunk is critical.
+// Decoders must understand critical chunks to display the image.
+func (c Chunk) IsCritical() bool {
+	return len(c.Type) == 4 && c.Type[0]&0x20 == 0
+}
+
+// IsPublic reports whether the chunk is a public chunk,
+// defined by the PNG specification or registered.
+func (c Chunk) IsPublic() bool {
+	return len(c.Type) == 4 && c.Type[1]&0x20 == 0
+}
+
+// IsSafeToCopy reports whether the chunk may be copied to a modified PNG
+// even if the editor doesn't recognize it.
+func (c Chunk) IsSafeToCopy() bool {
+	return len(c.Type) == 4 && c.Type[3]&0x20 != 0
+}
+
+// validChunkType reports whether typ consists of four ASCII letters.
+func validChunkType(typ string) bool {
+	if len(typ) != 4 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		c := typ[i] | 0x20
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ChunkReader reads the raw chunks of a PNG stream, without decoding them.
+// It verifies the CRC of each chunk and the chunk ordering
+// with the same rules as Decode.
+type ChunkReader struct {
+	r     io.Reader
+	order chunkOrder
+	tmp   [8]byte
+	err   error
+}
+
+// NewChunkReader reads the PNG signature from r, and returns a ChunkReader
+// that reads the chunks following it.
+func NewChunkReader(r io.Reader) (*ChunkReader, error) {
+	var header [len(pngHeader)]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if string(header[:]) != pngHeader {
+		return nil, FormatError("not a PNG file")
+	}
+	return &ChunkReader{r: r}, nil
+}
+
+// Next reads the next chunk.
+// It returns io.EOF after the IEND chunk.
+func (cr *ChunkReader) Next() (Chunk, error) {
+	if cr.err != nil {
+		return Chunk{}, cr.err
+	}
+	c, err := cr.next()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		cr.err = err
+		return Chunk{}, err
+	}
+	if cr.order.stage == dsSeenIEND {
+		cr.err = io.EOF
+	}
+	return c, nil
+}
+
+func (cr *ChunkReader) next() (Chunk, error) {
+	if _, err := io.ReadFull(cr.r, cr.tmp[:8]); err != nil {
+		return Chunk{}, err
+	}
+	length := binary.BigEndian.Uint32(cr.tmp[:4])
+	if length > 0x7fffffff {
+		return Chunk{}, FormatError(fmt.Sprintf("Bad chunk length: %d", length))
+	}
+	typ := string(cr.tmp[4:8])
+	if !validChunkType(typ) {
+		return Chunk{}, FormatError(fmt.Sprintf("invalid chunk type: %q", typ))
+	}
+
+	// Don't trust the length to allocate the buffer,
+	// the buffer grows as the data arrives.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, cr.r, int64(length)); err != nil {
+		return Chunk{}, err
+	}
+	data := buf.Bytes()
+	if _, err := io.ReadFull(cr.r, cr.tmp[:4]); err != nil {
+		return Chunk{}, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	if binary.BigEndian.Uint32(cr.tmp[:4]) != crc.Sum32() {
+		return Chunk{}, FormatError("invalid checksum")
+	}
+
+	c := Chunk{Type: typ, Data: data}
+	if err := cr.order.check(c); err != nil {
+		return Chunk{}, err
+	}
+	return c, nil
+}
+
+// chunkOrder tracks the ordering of chunks.
+type chunkOrder struct {
+	stage int
+	cb    int
+	// idatEnded reports whether a chunk other than IDAT follows the IDAT chunks.
+	idatEnded bool
+}
+
+// check checks the ordering of c, and updates the decoding stage.
+func (o *chunkOrder) check(c Chunk) error {
+	next, err := nextStage(o.stage, o.cb, c.Type)
+	if err != nil {
+		return err
+	}
+	if c.Type == "IHDR" {
+		if len(c.Data) != 13 {
+			return FormatError("bad IHDR length")
+		}
+		o.cb = colorBits(c.Data[8], c.Data[9])
+		if o.cb == cbInvalid {
+			return UnsupportedError(fmt.Sprintf("bit depth %d, color type %d", c.Data[8], c.Data[9]))
+		}
+	}
+	if o.stage == dsSeenIDAT {
+		// The IDAT chunks must be consecutive.
+		if c.Type == "IDAT" && o.idatEnded {
+			return chunkOrderError
+		}
+		if c.Type != "IDAT" {
+			o.idatEnded = true
+		}
+	}
+	o.stage = next
+	return nil
+}
+
+// ChunkWriter writes raw chunks to a PNG stream.
+// It computes the CRC of each chunk, and verifies the chunk ordering
+// with the same rules as Decode.
+type ChunkWriter struct {
+	e     encoder
+	order chunkOrder
+}
+
+// NewChunkWriter writes the PNG signature to w, and returns a ChunkWriter
+// that writes chunks following it.
+func NewChunkWriter(w io.Writer) (*ChunkWriter, error) {
+	if _, err := io.WriteString(w, pngHeader); err != nil {
+		return nil, err
+	}
+	return &ChunkWriter{e: encoder{w: w}}, nil
+}
+
+// WriteChunk writes the chunk c.
+// The caller must write the IEND chunk at the end of the stream.
+func (cw *ChunkWriter) WriteChunk(c Chunk) error {
+	if cw.e.err != nil {
+		return cw.e.err
+	}
+	if !validChunkType(c.Type) {
+		return FormatError(fmt.Sprintf("invalid chunk type: %q", c.Type))
+	}
+	if len(c.Data) > 0x7fffffff {
+		return UnsupportedError(c.Type + " chunk is too large")
+	}
+	if err := cw.order.check(c); err != nil {
+		return err
+	}
+	cw.e.writeChunk(c.Data, c.Type)
+	return cw.e.err
+}
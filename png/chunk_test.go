@@ -0,0 +1,225 @@
+package png
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// copyChunks copies the chunks from r to w, except for the chunks that keep returns false.
+func copyChunks(w io.Writer, r io.Reader, keep func(c Chunk) bool) error {
+	cr, err := NewChunkReader(r)
+	if err != nil {
+		return err
+	}
+	cw, err := NewChunkWriter(w)
+	if err != nil {
+		return err
+	}
+	for {
+		c, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !keep(c) {
+			continue
+		}
+		if err := cw.WriteChunk(c); err != nil {
+			return err
+		}
+	}
+}
+
+func TestChunkReader_Copy(t *testing.T) {
+	for _, fn := range filenames {
+		data, err := os.ReadFile("testdata/pngsuite/" + fn + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := copyChunks(&buf, bytes.NewReader(data), func(Chunk) bool { return true }); err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: the copy is different from the original", fn)
+		}
+	}
+}
+
+func TestChunkReader_Strip(t *testing.T) {
+	var buf bytes.Buffer
+	m := &ImageWithMeta{
+		Image: gradient(),
+		Texts: []TextEntry{{Keyword: "Comment", Text: "hello"}},
+		Gamma: 0.45455,
+	}
+	if err := EncodeWithMeta(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	var stripped bytes.Buffer
+	err := copyChunks(&stripped, &buf, func(c Chunk) bool {
+		return c.Type != "tEXt" && c.Type != "zTXt" && c.Type != "iTXt"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeWithMeta(&stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Texts) != 0 {
+		t.Errorf("unexpected texts: %v", got.Texts)
+	}
+	if got.Gamma != m.Gamma {
+		t.Errorf("unexpected gamma: %f", got.Gamma)
+	}
+	if err := diff(m.Image, got.Image); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChunkReader_InvalidChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// corrupt the CRC of the IHDR chunk.
+	data[len(pngHeader)+8+13] ^= 0xff
+
+	cr, err := NewChunkReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.Next(); err != FormatError("invalid checksum") {
+		t.Errorf("want invalid checksum error, got %v", err)
+	}
+}
+
+func TestChunkReader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// cut the IEND chunk.
+	cr, err := NewChunkReader(bytes.NewReader(data[:len(data)-12]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := cr.Next()
+		if err == nil {
+			continue
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("want io.ErrUnexpectedEOF, got %v", err)
+		}
+		break
+	}
+}
+
+func TestChunkWriter_Order(t *testing.T) {
+	ihdr := func(colorType uint8) Chunk {
+		return Chunk{Type: "IHDR", Data: []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, colorType, 0, 0, 0}}
+	}
+	tests := []struct {
+		name   string
+		chunks []Chunk
+		err    error
+	}{
+		{
+			name:   "valid",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "tEXt"}, {Type: "IDAT"}, {Type: "IDAT"}, {Type: "tEXt"}, {Type: "IEND"}},
+		},
+		{
+			name:   "IDAT before IHDR",
+			chunks: []Chunk{{Type: "IDAT"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "paletted image without PLTE",
+			chunks: []Chunk{ihdr(ctPaletted), {Type: "IDAT"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "tRNS after PLTE in a grayscale image",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "PLTE", Data: make([]byte, 3)}, {Type: "tRNS"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "eXIf after IDAT",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "IDAT"}, {Type: "eXIf"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "non-consecutive IDAT",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "IDAT"}, {Type: "tEXt"}, {Type: "IDAT"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "chunk after IEND",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "IDAT"}, {Type: "IEND"}, {Type: "tEXt"}},
+			err:    chunkOrderError,
+		},
+		{
+			name:   "invalid chunk type",
+			chunks: []Chunk{ihdr(ctGrayscale), {Type: "a1b2"}},
+			err:    FormatError(`invalid chunk type: "a1b2"`),
+		},
+		{
+			name:   "invalid color type",
+			chunks: []Chunk{ihdr(1)},
+			err:    UnsupportedError("bit depth 8, color type 1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw, err := NewChunkWriter(io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tt.chunks {
+				err = cw.WriteChunk(c)
+				if err != nil {
+					break
+				}
+			}
+			if err != tt.err {
+				t.Errorf("want %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestChunk_Properties(t *testing.T) {
+	tests := []struct {
+		typ                        string
+		critical, public, safeCopy bool
+	}{
+		{"IHDR", true, true, false},
+		{"tEXt", false, true, true},
+		{"gAMA", false, true, false},
+		{"prVt", false, false, true},
+	}
+	for _, tt := range tests {
+		c := Chunk{Type: tt.typ}
+		if c.IsCritical() != tt.critical {
+			t.Errorf("%s: IsCritical() = %v", tt.typ, c.IsCritical())
+		}
+		if c.IsPublic() != tt.public {
+			t.Errorf("%s: IsPublic() = %v", tt.typ, c.IsPublic())
+		}
+		if c.IsSafeToCopy() != tt.safeCopy {
+			t.Errorf("%s: IsSafeToCopy() = %v", tt.typ, c.IsSafeToCopy())
+		}
+	}
+}
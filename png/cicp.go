@@ -0,0 +1,302 @@
+package png
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+)
+
+// CICP is the coding-independent code points for video signal type identification,
+// defined in ITU-T H.273.
+type CICP struct {
+	// ColorPrimaries is the chromaticity coordinates of the color primaries.
+	ColorPrimaries ColorPrimaries
+
+	// TransferFunction is the opto-electronic transfer characteristic.
+	TransferFunction TransferFunction
+
+	// MatrixCoefficients is the matrix coefficients for deriving luma and chroma signals.
+	// PNG supports only RGB, so it must be 0.
+	MatrixCoefficients uint8
+
+	// VideoFullRange reports whether the image uses the full range of the values.
+	// If false, the image uses the narrow range (e.g. 16-235 for 8 bit images).
+	VideoFullRange bool
+}
+
+// ColorPrimaries is the color primaries of CICP.
+type ColorPrimaries uint8
+
+const (
+	// ColorPrimariesBT709 is the color primaries of ITU-R BT.709 and sRGB.
+	ColorPrimariesBT709 ColorPrimaries = 1
+
+	// ColorPrimariesBT2020 is the color primaries of ITU-R BT.2020 and BT.2100.
+	ColorPrimariesBT2020 ColorPrimaries = 9
+
+	// ColorPrimariesDCIP3 is the color primaries of SMPTE RP 431-2 (DCI-P3).
+	ColorPrimariesDCIP3 ColorPrimaries = 11
+
+	// ColorPrimariesDisplayP3 is the color primaries of SMPTE EG 432-1 (Display P3).
+	ColorPrimariesDisplayP3 ColorPrimaries = 12
+)
+
+func (p ColorPrimaries) String() string {
+	switch p {
+	case ColorPrimariesBT709:
+		return "BT.709"
+	case ColorPrimariesBT2020:
+		return "BT.2020"
+	case ColorPrimariesDCIP3:
+		return "DCI-P3"
+	case ColorPrimariesDisplayP3:
+		return "Display P3"
+	default:
+		return "Unknown ColorPrimaries: " + strconv.Itoa(int(p))
+	}
+}
+
+// TransferFunction is the transfer characteristics of CICP.
+type TransferFunction uint8
+
+const (
+	// TransferFunctionBT709 is the transfer function of ITU-R BT.709.
+	TransferFunctionBT709 TransferFunction = 1
+
+	// TransferFunctionLinear is the linear transfer function.
+	TransferFunctionLinear TransferFunction = 8
+
+	// TransferFunctionSRGB is the transfer function of IEC 61966-2-1 (sRGB).
+	TransferFunctionSRGB TransferFunction = 13
+
+	// TransferFunctionPQ is the perceptual quantization (PQ) transfer function
+	// of SMPTE ST 2084 and ITU-R BT.2100.
+	TransferFunctionPQ TransferFunction = 16
+
+	// TransferFunctionHLG is the hybrid log-gamma (HLG) transfer function
+	// of ARIB STD-B67 and ITU-R BT.2100.
+	TransferFunctionHLG TransferFunction = 18
+)
+
+func (f TransferFunction) String() string {
+	switch f {
+	case TransferFunctionBT709:
+		return "BT.709"
+	case TransferFunctionLinear:
+		return "Linear"
+	case TransferFunctionSRGB:
+		return "sRGB"
+	case TransferFunctionPQ:
+		return "PQ"
+	case TransferFunctionHLG:
+		return "HLG"
+	default:
+		return "Unknown TransferFunction: " + strconv.Itoa(int(f))
+	}
+}
+
+// MasteringDisplayColorVolume is the color volume of the display
+// that was used to master the content, defined in SMPTE ST 2086.
+type MasteringDisplayColorVolume struct {
+	// Red, Green and Blue are the chromaticities of the display primaries.
+	// The coordinates of the chromaticities must be in the range [0, 1.3107].
+	Red, Green, Blue Chromaticity
+
+	// WhitePoint is the chromaticity of the white point of the display.
+	WhitePoint Chromaticity
+
+	// MaxLuminance is the maximum luminance of the display in cd/m².
+	MaxLuminance float64
+
+	// MinLuminance is the minimum luminance of the display in cd/m².
+	MinLuminance float64
+}
+
+// ContentLightLevel is the content light level information, defined in CTA-861.3.
+type ContentLightLevel struct {
+	// MaxCLL is the maximum content light level in cd/m².
+	MaxCLL float64
+
+	// MaxFALL is the maximum frame-average light level in cd/m².
+	MaxFALL float64
+}
+
+// ColorSpaceSource is the chunk that defines the color space of the image.
+type ColorSpaceSource int
+
+const (
+	// ColorSpaceSourceNone means that the image has no color space information.
+	ColorSpaceSourceNone ColorSpaceSource = iota
+
+	// ColorSpaceSourceCICP means that the color space is defined by the cICP chunk.
+	ColorSpaceSourceCICP
+
+	// ColorSpaceSourceICCP means that the color space is defined by the iCCP chunk.
+	ColorSpaceSourceICCP
+
+	// ColorSpaceSourceSRGB means that the color space is defined by the sRGB chunk.
+	ColorSpaceSourceSRGB
+
+	// ColorSpaceSourceGAMA means that the color space is defined by the gAMA and/or cHRM chunks.
+	ColorSpaceSourceGAMA
+)
+
+func (s ColorSpaceSource) String() string {
+	switch s {
+	case ColorSpaceSourceNone:
+		return "None"
+	case ColorSpaceSourceCICP:
+		return "cICP"
+	case ColorSpaceSourceICCP:
+		return "iCCP"
+	case ColorSpaceSourceSRGB:
+		return "sRGB"
+	case ColorSpaceSourceGAMA:
+		return "gAMA/cHRM"
+	default:
+		return "Unknown ColorSpaceSource: " + strconv.Itoa(int(s))
+	}
+}
+
+// ColorSpaceSource returns the chunk that defines the effective color space of the image.
+// If the image has multiple color space chunks, the precedence is
+// cICP > iCCP > sRGB > gAMA/cHRM.
+func (m *ImageWithMeta) ColorSpaceSource() ColorSpaceSource {
+	switch {
+	case m.CICP != nil:
+		return ColorSpaceSourceCICP
+	case m.ICCProfile != nil:
+		return ColorSpaceSourceICCP
+	case m.SRGB != nil:
+		return ColorSpaceSourceSRGB
+	case m.Gamma != 0 || m.Chromaticities != nil:
+		return ColorSpaceSourceGAMA
+	default:
+		return ColorSpaceSourceNone
+	}
+}
+
+func (d *decoder) parseCICP(length uint32) error {
+	if length != 4 {
+		return FormatError("bad cICP length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:4])
+	if d.tmp[2] != 0 {
+		return FormatError("bad cICP matrix coefficients")
+	}
+	if d.tmp[3] > 1 {
+		return FormatError("bad cICP video full range flag")
+	}
+	d.cicp = &CICP{
+		ColorPrimaries:     ColorPrimaries(d.tmp[0]),
+		TransferFunction:   TransferFunction(d.tmp[1]),
+		MatrixCoefficients: d.tmp[2],
+		VideoFullRange:     d.tmp[3] != 0,
+	}
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeCICP(c *CICP) {
+	if e.err != nil {
+		return
+	}
+	if c.MatrixCoefficients != 0 {
+		e.err = FormatError("invalid cICP matrix coefficients: " + strconv.Itoa(int(c.MatrixCoefficients)))
+		return
+	}
+	e.tmp[0] = byte(c.ColorPrimaries)
+	e.tmp[1] = byte(c.TransferFunction)
+	e.tmp[2] = c.MatrixCoefficients
+	e.tmp[3] = 0
+	if c.VideoFullRange {
+		e.tmp[3] = 1
+	}
+	e.writeChunk(e.tmp[:4], "cICP")
+}
+
+// The chromaticities in mDCv chunks are in units of 0.00002.
+const mdcvChromaticityUnit = 50000
+
+// The luminances in mDCv and cLLi chunks are in units of 0.0001 cd/m².
+const luminanceUnit = 10000
+
+func (d *decoder) parseMDCV(length uint32) error {
+	if length != 24 {
+		return FormatError("bad mDCv length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:24]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:24])
+
+	var v [8]float64
+	for i := range v {
+		v[i] = float64(binary.BigEndian.Uint16(d.tmp[2*i:])) / mdcvChromaticityUnit
+	}
+	d.mdcv = &MasteringDisplayColorVolume{
+		Red:          Chromaticity{v[0], v[1]},
+		Green:        Chromaticity{v[2], v[3]},
+		Blue:         Chromaticity{v[4], v[5]},
+		WhitePoint:   Chromaticity{v[6], v[7]},
+		MaxLuminance: float64(binary.BigEndian.Uint32(d.tmp[16:20])) / luminanceUnit,
+		MinLuminance: float64(binary.BigEndian.Uint32(d.tmp[20:24])) / luminanceUnit,
+	}
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeMDCV(m *MasteringDisplayColorVolume) {
+	v := [8]float64{
+		m.Red.X, m.Red.Y,
+		m.Green.X, m.Green.Y,
+		m.Blue.X, m.Blue.Y,
+		m.WhitePoint.X, m.WhitePoint.Y,
+	}
+	for i, f := range v {
+		x, ok := fixedPoint(f, mdcvChromaticityUnit, math.MaxUint16)
+		if !ok {
+			e.err = FormatError("invalid mDCv chromaticity")
+			return
+		}
+		binary.BigEndian.PutUint16(e.tmp[2*i:], uint16(x))
+	}
+	maxLum, ok1 := fixedPoint(m.MaxLuminance, luminanceUnit, math.MaxUint32)
+	minLum, ok2 := fixedPoint(m.MinLuminance, luminanceUnit, math.MaxUint32)
+	if !ok1 || !ok2 {
+		e.err = FormatError("invalid mDCv luminance")
+		return
+	}
+	binary.BigEndian.PutUint32(e.tmp[16:20], maxLum)
+	binary.BigEndian.PutUint32(e.tmp[20:24], minLum)
+	e.writeChunk(e.tmp[:24], "mDCv")
+}
+
+func (d *decoder) parseCLLI(length uint32) error {
+	if length != 8 {
+		return FormatError("bad cLLi length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:8])
+	d.clli = &ContentLightLevel{
+		MaxCLL:  float64(binary.BigEndian.Uint32(d.tmp[0:4])) / luminanceUnit,
+		MaxFALL: float64(binary.BigEndian.Uint32(d.tmp[4:8])) / luminanceUnit,
+	}
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeCLLI(c *ContentLightLevel) {
+	maxCLL, ok1 := fixedPoint(c.MaxCLL, luminanceUnit, math.MaxUint32)
+	maxFALL, ok2 := fixedPoint(c.MaxFALL, luminanceUnit, math.MaxUint32)
+	if !ok1 || !ok2 {
+		e.err = FormatError("invalid cLLi luminance")
+		return
+	}
+	binary.BigEndian.PutUint32(e.tmp[0:4], maxCLL)
+	binary.BigEndian.PutUint32(e.tmp[4:8], maxFALL)
+	e.writeChunk(e.tmp[:8], "cLLi")
+}
@@ -0,0 +1,190 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeWithMeta_HDR(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA64(image.Rect(0, 0, 16, 16)),
+		CICP: &CICP{
+			ColorPrimaries:   ColorPrimariesBT2020,
+			TransferFunction: TransferFunctionPQ,
+			VideoFullRange:   true,
+		},
+		MasteringDisplayColorVolume: &MasteringDisplayColorVolume{
+			Red:          Chromaticity{0.708, 0.292},
+			Green:        Chromaticity{0.170, 0.797},
+			Blue:         Chromaticity{0.131, 0.046},
+			WhitePoint:   Chromaticity{0.3127, 0.3290},
+			MaxLuminance: 1000,
+			MinLuminance: 0.0001,
+		},
+		ContentLightLevel: &ContentLightLevel{
+			MaxCLL:  1000,
+			MaxFALL: 400,
+		},
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(m.CICP, decoded.CICP); diff != "" {
+		t.Errorf("unexpected cICP (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(m.MasteringDisplayColorVolume, decoded.MasteringDisplayColorVolume); diff != "" {
+		t.Errorf("unexpected mDCv (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(m.ContentLightLevel, decoded.ContentLightLevel); diff != "" {
+		t.Errorf("unexpected cLLi (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeWithMeta_InvalidCICP(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 16, 16)),
+		CICP: &CICP{
+			ColorPrimaries:     ColorPrimariesBT709,
+			TransferFunction:   TransferFunctionSRGB,
+			MatrixCoefficients: 1,
+		},
+	}
+	if err := EncodeWithMeta(new(bytes.Buffer), m); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestEncodeWithMeta_InvalidHDRMetadata(t *testing.T) {
+	mdcv := func(f func(m *MasteringDisplayColorVolume)) *MasteringDisplayColorVolume {
+		m := &MasteringDisplayColorVolume{
+			Red:          Chromaticity{0.708, 0.292},
+			Green:        Chromaticity{0.170, 0.797},
+			Blue:         Chromaticity{0.131, 0.046},
+			WhitePoint:   Chromaticity{0.3127, 0.3290},
+			MaxLuminance: 1000,
+			MinLuminance: 0.0001,
+		}
+		f(m)
+		return m
+	}
+	tests := []struct {
+		name string
+		m    *ImageWithMeta
+		want error
+	}{
+		{"negative chromaticity", &ImageWithMeta{MasteringDisplayColorVolume: mdcv(func(m *MasteringDisplayColorVolume) { m.Red.X = -0.1 })}, FormatError("invalid mDCv chromaticity")},
+		{"too large chromaticity", &ImageWithMeta{MasteringDisplayColorVolume: mdcv(func(m *MasteringDisplayColorVolume) { m.Blue.Y = 1.32 })}, FormatError("invalid mDCv chromaticity")},
+		{"NaN luminance", &ImageWithMeta{MasteringDisplayColorVolume: mdcv(func(m *MasteringDisplayColorVolume) { m.MaxLuminance = math.NaN() })}, FormatError("invalid mDCv luminance")},
+		{"too large luminance", &ImageWithMeta{MasteringDisplayColorVolume: mdcv(func(m *MasteringDisplayColorVolume) { m.MaxLuminance = 1e6 })}, FormatError("invalid mDCv luminance")},
+		{"negative MaxCLL", &ImageWithMeta{ContentLightLevel: &ContentLightLevel{MaxCLL: -1, MaxFALL: 400}}, FormatError("invalid cLLi luminance")},
+		{"infinite MaxFALL", &ImageWithMeta{ContentLightLevel: &ContentLightLevel{MaxCLL: 1000, MaxFALL: math.Inf(1)}}, FormatError("invalid cLLi luminance")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Image = image.NewNRGBA64(image.Rect(0, 0, 16, 16))
+			if err := EncodeWithMeta(new(bytes.Buffer), tt.m); err != tt.want {
+				t.Errorf("want %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// The largest chromaticity is accepted.
+	m := &ImageWithMeta{
+		Image:                       image.NewNRGBA64(image.Rect(0, 0, 16, 16)),
+		MasteringDisplayColorVolume: mdcv(func(m *MasteringDisplayColorVolume) { m.Red.X = 1.3107 }),
+	}
+	if err := EncodeWithMeta(new(bytes.Buffer), m); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeWithMeta_CICPAfterPLTE(t *testing.T) {
+	var buf bytes.Buffer
+	m := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White})
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert a cICP chunk after the PLTE chunk.
+	b := buf.Bytes()
+	var out []byte
+	out = append(out, b[:len(pngHeader)]...)
+	for b = b[len(pngHeader):]; len(b) > 0; {
+		length := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		name := string(b[4:8])
+		out = appendChunk(out, name, b[8:8+length])
+		if name == "PLTE" {
+			out = appendChunk(out, "cICP", []byte{1, 13, 0, 1})
+		}
+		b = b[12+length:]
+	}
+
+	if _, err := DecodeWithMeta(bytes.NewReader(out)); err != chunkOrderError {
+		t.Errorf("want chunkOrderError, got %v", err)
+	}
+}
+
+func TestImageWithMeta_ColorSpaceSource(t *testing.T) {
+	profile, err := srgbChromaticities.ICCProfile(0.45455)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		m    *ImageWithMeta
+		want ColorSpaceSource
+	}{
+		{
+			m:    &ImageWithMeta{},
+			want: ColorSpaceSourceNone,
+		},
+		{
+			m:    &ImageWithMeta{Gamma: 0.45455},
+			want: ColorSpaceSourceGAMA,
+		},
+		{
+			m:    &ImageWithMeta{Chromaticities: srgbChromaticities},
+			want: ColorSpaceSourceGAMA,
+		},
+		{
+			m: &ImageWithMeta{
+				Gamma: 0.45455,
+				SRGB:  &SRGB{},
+			},
+			want: ColorSpaceSourceSRGB,
+		},
+		{
+			m: &ImageWithMeta{
+				Gamma:      0.45455,
+				SRGB:       &SRGB{},
+				ICCProfile: profile,
+			},
+			want: ColorSpaceSourceICCP,
+		},
+		{
+			m: &ImageWithMeta{
+				Gamma:      0.45455,
+				SRGB:       &SRGB{},
+				ICCProfile: profile,
+				CICP: &CICP{
+					ColorPrimaries:   ColorPrimariesBT709,
+					TransferFunction: TransferFunctionSRGB,
+					VideoFullRange:   true,
+				},
+			},
+			want: ColorSpaceSourceCICP,
+		},
+	}
+	for i, tt := range tests {
+		if got := tt.m.ColorSpaceSource(); got != tt.want {
+			t.Errorf("%d: got %s, want %s", i, got, tt.want)
+		}
+	}
+}
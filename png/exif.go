@@ -0,0 +1,45 @@
+package png
+
+import (
+	"bytes"
+
+	"github.com/shogo82148/go-imaging/exif"
+)
+
+// exifHeader is the header that exif.Encode writes.
+// The eXIf chunk starts with the TIFF header directly, so it is removed.
+const exifHeader = "Exif\x00\x00"
+
+func (d *decoder) parseEXIF(length uint32) error {
+	if d.exif != nil {
+		return FormatError("multiple eXIf chunks")
+	}
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	// The eXIf chunk must begin with "MM\x00\x2a" or "II\x2a\x00".
+	if len(data) < 4 || (string(data[:4]) != "MM\x00\x2a" && string(data[:4]) != "II\x2a\x00") {
+		return FormatError("bad eXIf header")
+	}
+	t, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return FormatError("bad eXIf: " + err.Error())
+	}
+	d.exif = t
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeEXIF(t *exif.TIFF) {
+	if e.err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	e.err = exif.Encode(buf, t)
+	if e.err != nil {
+		return
+	}
+	data := bytes.TrimPrefix(buf.Bytes(), []byte(exifHeader))
+	e.writeChunk(data, "eXIf")
+}
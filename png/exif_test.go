@@ -0,0 +1,91 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/shogo82148/go-imaging/exif"
+	"github.com/shogo82148/pointer"
+)
+
+// appendChunk appends a PNG chunk to b.
+func appendChunk(b []byte, name string, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, name...)
+	b = append(b, data...)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(name))
+	crc.Write(data)
+	return binary.BigEndian.AppendUint32(b, crc.Sum32())
+}
+
+func TestDecodeWithMeta_Exif(t *testing.T) {
+	f, err := os.Open("testdata/icc-profile.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := DecodeWithMeta(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Exif == nil {
+		t.Fatal("unexpected nil Exif")
+	}
+	if img.Exif.ResolutionUnit != exif.ResolutionUnitInch {
+		t.Errorf("unexpected resolution unit: %v, want %v", img.Exif.ResolutionUnit, exif.ResolutionUnitInch)
+	}
+	if img.Exif.XResolution == nil || *img.Exif.XResolution != (exif.Rational{Numerator: 144, Denominator: 1}) {
+		t.Errorf("unexpected x resolution: %v", img.Exif.XResolution)
+	}
+}
+
+func TestEncodeWithMeta_Exif(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Exif: &exif.TIFF{
+			Orientation: exif.OrientationRightTop,
+			Make:        pointer.String("Gopher"),
+			Model:       pointer.String("Gopher Camera"),
+		},
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(m.Exif, decoded.Exif); diff != "" {
+		t.Errorf("unexpected Exif (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecodeWithMeta_ExifOrder(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	var tiff bytes.Buffer
+	if err := exif.Encode(&tiff, &exif.TIFF{Orientation: exif.OrientationTopLeft}); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.TrimPrefix(tiff.Bytes(), []byte(exifHeader))
+
+	// move the eXIf chunk after the IDAT chunk.
+	b := buf.Bytes()
+	iend := b[len(b)-12:]
+	b = appendChunk(b[:len(b)-12:len(b)-12], "eXIf", data)
+	b = append(b, iend...)
+
+	if _, err := DecodeWithMeta(bytes.NewReader(b)); err != chunkOrderError {
+		t.Errorf("unexpected error: %v, want %v", err, chunkOrderError)
+	}
+}
@@ -7,10 +7,13 @@ package png
 import (
 	"bytes"
 	"image"
+	"image/color"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func FuzzDecode(f *testing.F) {
@@ -127,5 +130,49 @@ func FuzzDecodeWithMeta(f *testing.F) {
 		if (img0.ICCProfile != nil) != (img1.ICCProfile != nil) {
 			t.Errorf("ICC profile mismatch")
 		}
+		if diff := cmp.Diff(img0.Chromaticities, img1.Chromaticities); diff != "" {
+			t.Errorf("chromaticities mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(img0.CICP, img1.CICP); diff != "" {
+			t.Errorf("cICP mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(img0.MasteringDisplayColorVolume, img1.MasteringDisplayColorVolume); diff != "" {
+			t.Errorf("mastering display color volume mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(img0.ContentLightLevel, img1.ContentLightLevel); diff != "" {
+			t.Errorf("content light level mismatch (-want +got):\n%s", diff)
+		}
+		if !sameColor(img0.Background, img1.Background) {
+			t.Errorf("background mismatch: got %v, want %v", img1.Background, img0.Background)
+		}
+		if diff := cmp.Diff(img0.Histogram, img1.Histogram); diff != "" {
+			t.Errorf("histogram mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(img0.SuggestedPalettes, img1.SuggestedPalettes); diff != "" {
+			t.Errorf("suggested palettes mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(img0.PhysicalDimensions, img1.PhysicalDimensions); diff != "" {
+			t.Errorf("physical dimensions mismatch (-want +got):\n%s", diff)
+		}
+		if !img0.LastModified.Equal(img1.LastModified) {
+			t.Errorf("last modification time mismatch: got %s, want %s", img1.LastModified, img0.LastModified)
+		}
+		if (img0.Exif != nil) != (img1.Exif != nil) {
+			t.Errorf("Exif mismatch")
+		}
+		if diff := cmp.Diff(img0.Texts, img1.Texts); diff != "" {
+			t.Errorf("texts mismatch (-want +got):\n%s", diff)
+		}
 	})
 }
+
+// sameColor reports whether c0 and c1 are the same color.
+// The color types may differ, because the image may be encoded in a different color type.
+func sameColor(c0, c1 color.Color) bool {
+	if c0 == nil || c1 == nil {
+		return c0 == nil && c1 == nil
+	}
+	r0, g0, b0, a0 := c0.RGBA()
+	r1, g1, b1, a1 := c1.RGBA()
+	return r0 == r1 && g0 == g1 && b0 == b1 && a0 == a1
+}
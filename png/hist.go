@@ -0,0 +1,37 @@
+package png
+
+import (
+	"encoding/binary"
+)
+
+func (d *decoder) parseHIST(length uint32) error {
+	if length%2 != 0 || length < 2 || length > 2*256 {
+		return FormatError("bad hIST length")
+	}
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	if !cbPaletted(d.cb) {
+		// The PLTE chunk of truecolor images is ignored, and so is the hIST chunk.
+		return d.verifyChecksum()
+	}
+	if len(data) != 2*len(d.palette) {
+		return FormatError("bad hIST length")
+	}
+
+	hist := make([]uint16, len(data)/2)
+	for i := range hist {
+		hist[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	d.hist = hist
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeHIST(hist []uint16) {
+	buf := make([]byte, 2*len(hist))
+	for i, v := range hist {
+		binary.BigEndian.PutUint16(buf[2*i:], v)
+	}
+	e.writeChunk(buf, "hIST")
+}
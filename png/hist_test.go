@@ -0,0 +1,53 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeWithMeta_Histogram(t *testing.T) {
+	palette := color.Palette{color.Black, color.White, color.Transparent}
+	hist := []uint16{10, 20, 0}
+
+	t.Run("paletted", func(t *testing.T) {
+		decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+			Image:     image.NewPaletted(image.Rect(0, 0, 1, 1), palette),
+			Histogram: hist,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(hist, decoded.Histogram); diff != "" {
+			t.Errorf("unexpected histogram (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("palette length mismatch", func(t *testing.T) {
+		decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+			Image:     image.NewPaletted(image.Rect(0, 0, 1, 1), palette[:2]),
+			Histogram: hist,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Histogram != nil {
+			t.Errorf("want no histogram, got %v", decoded.Histogram)
+		}
+	})
+
+	t.Run("truecolor", func(t *testing.T) {
+		decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+			Image:     image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			Histogram: hist,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Histogram != nil {
+			t.Errorf("want no histogram, got %v", decoded.Histogram)
+		}
+	})
+}
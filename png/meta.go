@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
-	"hash/crc32"
 	"image"
 	"image/color"
 	"io"
 	"math"
 	"strconv"
+	"time"
 
+	"github.com/shogo82148/go-imaging/exif"
 	"github.com/shogo82148/go-imaging/icc"
 )
 
@@ -32,6 +33,56 @@ type ImageWithMeta struct {
 	// ICCProfile is the ICC profile of the image.
 	// If ICCProfile is nil, the image has no ICC profile.
 	ICCProfile *icc.Profile
+
+	// Chromaticities is the chromaticities of the primaries and the white point of the image.
+	// If Chromaticities is nil, the image has no chromaticity information.
+	Chromaticities *Chromaticities
+
+	// CICP is the coding-independent code points of the image.
+	// If CICP is not nil, it takes precedence over ICCProfile, SRGB, Gamma and Chromaticities.
+	CICP *CICP
+
+	// MasteringDisplayColorVolume is the color volume of the mastering display.
+	// If MasteringDisplayColorVolume is nil, the image has no mastering display information.
+	MasteringDisplayColorVolume *MasteringDisplayColorVolume
+
+	// ContentLightLevel is the content light level of the image.
+	// If ContentLightLevel is nil, the image has no content light level information.
+	ContentLightLevel *ContentLightLevel
+
+	// SignificantBits is the number of significant bits in the original image data.
+	// If SignificantBits is nil, the image has no significant bits information.
+	SignificantBits *SignificantBits
+
+	// Background is the default background color to present the image against.
+	// If Background is nil, the image has no background color.
+	// In paletted images, the background color is one of the palette entries;
+	// otherwise it is color.Gray16 or color.RGBA64.
+	Background color.Color
+
+	// Histogram is the approximate usage frequency of each palette entry.
+	// It is available only in paletted images, and
+	// it is written only if the encoded palette has the same number of entries.
+	Histogram []uint16
+
+	// SuggestedPalettes are the palettes suggested for displaying the image
+	// on devices with limited colors.
+	SuggestedPalettes []SuggestedPalette
+
+	// PhysicalDimensions is the intended pixel size or aspect ratio of the image.
+	// If PhysicalDimensions is nil, the image has no physical dimensions.
+	PhysicalDimensions *PhysicalDimensions
+
+	// LastModified is the time of the last image modification.
+	// If LastModified is zero, the image has no modification time.
+	LastModified time.Time
+
+	// Exif is the Exif information of the image.
+	// If Exif is nil, the image has no Exif information.
+	Exif *exif.TIFF
+
+	// Texts are the textual information of the image.
+	Texts []TextEntry
 }
 
 type SRGB struct {
@@ -76,10 +127,14 @@ func (ri RenderingIntent) String() string {
 // DecodeWithMeta reads a PNG image from r and returns it as an image.Image.
 // The type of Image returned depends on the PNG contents.
 func DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
-	d := &decoder{
-		r:   r,
-		crc: crc32.NewIEEE(),
-	}
+	var dec Decoder
+	return dec.DecodeWithMeta(r)
+}
+
+// DecodeWithMeta reads a PNG image from r and returns it as an image.Image.
+// The type of Image returned depends on the PNG contents.
+func (dec *Decoder) DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
+	d := dec.newDecoder(r)
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -91,10 +146,17 @@ func DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
+			if d.partialImage(err) != nil {
+				return d.imageWithMeta(), err
+			}
 			return nil, err
 		}
 	}
+	return d.imageWithMeta(), nil
+}
 
+// imageWithMeta returns the decoded image with the metadata.
+func (d *decoder) imageWithMeta() *ImageWithMeta {
 	img := &ImageWithMeta{
 		Image: d.img,
 	}
@@ -106,7 +168,19 @@ func DecodeWithMeta(r io.Reader) (*ImageWithMeta, error) {
 		img.ICCProfileName = d.profileName
 		img.ICCProfile = d.icc
 	}
-	return img, nil
+	img.Chromaticities = d.chrm
+	img.CICP = d.cicp
+	img.MasteringDisplayColorVolume = d.mdcv
+	img.ContentLightLevel = d.clli
+	img.SignificantBits = d.sbit
+	img.Background = d.background()
+	img.Histogram = d.hist
+	img.SuggestedPalettes = d.splt
+	img.PhysicalDimensions = d.phys
+	img.LastModified = d.modTime
+	img.Exif = d.exif
+	img.Texts = d.texts
+	return img
 }
 
 // EncodeWithMeta writes the Image m to w in PNG format. Any Image may be
@@ -139,9 +213,15 @@ func (enc *Encoder) EncodeWithMeta(w io.Writer, m *ImageWithMeta) error {
 		defer enc.BufferPool.Put((*EncoderBuffer)(e))
 	}
 
+	if p := enc.quantize(m.Image); p != nil {
+		quantized := *m
+		quantized.Image = p
+		m = &quantized
+	}
+
 	e.enc = enc
 	e.w = w
-	e.m = m
+	e.m = m.Image
 
 	var pal color.Palette
 	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
@@ -181,18 +261,50 @@ func (enc *Encoder) EncodeWithMeta(w io.Writer, m *ImageWithMeta) error {
 
 	_, e.err = io.WriteString(w, pngHeader)
 	e.writeIHDR()
+	if m.CICP != nil {
+		e.writeCICP(m.CICP)
+	}
+	if m.MasteringDisplayColorVolume != nil {
+		e.writeMDCV(m.MasteringDisplayColorVolume)
+	}
+	if m.ContentLightLevel != nil {
+		e.writeCLLI(m.ContentLightLevel)
+	}
 	if m.Gamma != 0 {
 		e.writeGAMA(m.Gamma)
 	}
 	if m.SRGB != nil {
 		e.writeSRGB(m.SRGB)
 	}
+	if m.Chromaticities != nil {
+		e.writeCHRM(m.Chromaticities)
+	}
 	if m.ICCProfile != nil {
 		e.writeICCP(m.ICCProfileName, m.ICCProfile)
 	}
+	if m.SignificantBits != nil {
+		e.writeSBIT(m.SignificantBits)
+	}
 	if pal != nil {
 		e.writePLTEAndTRNS(pal)
 	}
+	if m.Background != nil {
+		e.writeBKGD(m.Background, pal)
+	}
+	if m.Histogram != nil && len(m.Histogram) == len(pal) {
+		e.writeHIST(m.Histogram)
+	}
+	e.writeSPLTs(m.SuggestedPalettes)
+	if m.PhysicalDimensions != nil {
+		e.writePHYS(m.PhysicalDimensions)
+	}
+	if !m.LastModified.IsZero() {
+		e.writeTIME(m.LastModified)
+	}
+	if m.Exif != nil {
+		e.writeEXIF(m.Exif)
+	}
+	e.writeTexts(m.Texts)
 	e.writeIDATs()
 	e.writeIEND()
 	return e.err
@@ -7,7 +7,9 @@ import (
 	"math"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/shogo82148/go-imaging/icc"
 )
 
@@ -212,3 +214,58 @@ func TestEncodeWithMeta_ICCProfile(t *testing.T) {
 		}
 	})
 }
+
+func TestDecodeWithMeta_PhysicalDimensions(t *testing.T) {
+	f, err := os.Open("testdata/gamma.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := DecodeWithMeta(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &PhysicalDimensions{
+		XPixelsPerUnit: 5669,
+		YPixelsPerUnit: 5669,
+		Unit:           PhysicalUnitMeter,
+	}
+	if diff := cmp.Diff(want, img.PhysicalDimensions); diff != "" {
+		t.Errorf("unexpected physical dimensions (-want +got):\n%s", diff)
+	}
+
+	x, y, ok := img.PhysicalDimensions.DPI()
+	if !ok {
+		t.Fatal("want ok")
+	}
+	if math.Abs(x-144) > 0.01 || math.Abs(y-144) > 0.01 {
+		t.Errorf("unexpected DPI: %f, %f, want 144, 144", x, y)
+	}
+
+	wantTime := time.Date(2023, time.September, 23, 20, 51, 3, 0, time.UTC)
+	if !img.LastModified.Equal(wantTime) {
+		t.Errorf("unexpected last modification time: %s, want %s", img.LastModified, wantTime)
+	}
+}
+
+func TestEncodeWithMeta_PhysicalDimensions(t *testing.T) {
+	m := &ImageWithMeta{
+		Image:              image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		PhysicalDimensions: PhysicalDimensionsFromDPI(300, 300),
+		LastModified:       time.Date(2024, time.January, 2, 3, 4, 5, 0, time.FixedZone("Asia/Tokyo", 9*60*60)),
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(m.PhysicalDimensions, decoded.PhysicalDimensions); diff != "" {
+		t.Errorf("unexpected physical dimensions (-want +got):\n%s", diff)
+	}
+	if !decoded.LastModified.Equal(m.LastModified) {
+		t.Errorf("unexpected last modification time: %s, want %s", decoded.LastModified, m.LastModified)
+	}
+}
@@ -0,0 +1,89 @@
+package png
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+)
+
+// PhysicalDimensions is the intended pixel size or aspect ratio of the image.
+type PhysicalDimensions struct {
+	// XPixelsPerUnit is the number of pixels per unit in the X axis.
+	XPixelsPerUnit uint32
+
+	// YPixelsPerUnit is the number of pixels per unit in the Y axis.
+	YPixelsPerUnit uint32
+
+	// Unit is the unit of XPixelsPerUnit and YPixelsPerUnit.
+	Unit PhysicalUnit
+}
+
+// PhysicalUnit is the unit of PhysicalDimensions.
+type PhysicalUnit int
+
+const (
+	// PhysicalUnitUnknown means that PhysicalDimensions defines the pixel aspect ratio only.
+	PhysicalUnitUnknown PhysicalUnit = 0
+
+	// PhysicalUnitMeter means that the unit of PhysicalDimensions is the meter.
+	PhysicalUnitMeter PhysicalUnit = 1
+)
+
+func (u PhysicalUnit) String() string {
+	switch u {
+	case PhysicalUnitUnknown:
+		return "Unknown"
+	case PhysicalUnitMeter:
+		return "Meter"
+	default:
+		return "Unknown PhysicalUnit: " + strconv.Itoa(int(u))
+	}
+}
+
+// metersPerInch is the number of meters in an inch.
+const metersPerInch = 0.0254
+
+// PhysicalDimensionsFromDPI returns the PhysicalDimensions
+// whose resolution is x and y dots per inch.
+func PhysicalDimensionsFromDPI(x, y float64) *PhysicalDimensions {
+	return &PhysicalDimensions{
+		XPixelsPerUnit: uint32(math.RoundToEven(x / metersPerInch)),
+		YPixelsPerUnit: uint32(math.RoundToEven(y / metersPerInch)),
+		Unit:           PhysicalUnitMeter,
+	}
+}
+
+// DPI returns the resolution in dots per inch.
+// If the unit is not the meter, ok is false.
+func (p *PhysicalDimensions) DPI() (x, y float64, ok bool) {
+	if p.Unit != PhysicalUnitMeter {
+		return 0, 0, false
+	}
+	x = float64(p.XPixelsPerUnit) * metersPerInch
+	y = float64(p.YPixelsPerUnit) * metersPerInch
+	return x, y, true
+}
+
+func (d *decoder) parsePHYS(length uint32) error {
+	if length != 9 {
+		return FormatError("bad pHYs length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:9]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:9])
+	d.phys = &PhysicalDimensions{
+		XPixelsPerUnit: binary.BigEndian.Uint32(d.tmp[0:4]),
+		YPixelsPerUnit: binary.BigEndian.Uint32(d.tmp[4:8]),
+		Unit:           PhysicalUnit(d.tmp[8]),
+	}
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writePHYS(p *PhysicalDimensions) {
+	binary.BigEndian.PutUint32(e.tmp[0:4], p.XPixelsPerUnit)
+	binary.BigEndian.PutUint32(e.tmp[4:8], p.YPixelsPerUnit)
+	e.tmp[8] = byte(p.Unit)
+	e.writeChunk(e.tmp[:9], "pHYs")
+}
@@ -0,0 +1,263 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// quantize converts the truecolor image m to a paletted image if enc.Quantize is true.
+// It returns nil if m should not be converted.
+func (enc *Encoder) quantize(m image.Image) *image.Paletted {
+	if !enc.Quantize {
+		return nil
+	}
+	if _, ok := m.(image.PalettedImage); ok {
+		return nil
+	}
+	switch m.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return nil
+	}
+
+	numColors := enc.NumColors
+	if numColors <= 0 || numColors > 256 {
+		numColors = 256
+	}
+
+	if p := losslessPaletted(m, numColors); p != nil {
+		return p
+	}
+
+	quantizer := enc.Quantizer
+	if quantizer == nil {
+		quantizer = medianCutQuantizer{}
+	}
+	drawer := enc.Drawer
+	if drawer == nil {
+		drawer = draw.FloydSteinberg
+	}
+	b := m.Bounds()
+	pal := quantizer.Quantize(make(color.Palette, 0, numColors), m)
+	if len(pal) == 0 || len(pal) > numColors {
+		return nil
+	}
+	p := image.NewPaletted(b, pal)
+	drawer.Draw(p, b, m, b.Min)
+	return p
+}
+
+// losslessPaletted converts m to a paletted image without any loss,
+// if m has at most numColors distinct colors.
+// Otherwise, it returns nil.
+func losslessPaletted(m image.Image, numColors int) *image.Paletted {
+	// The images of 8-bit color models are encoded in 8 bits even if they are not paletted.
+	// The others are encoded in 16 bits, so their colors must be represented in 8 bits.
+	var eightBit bool
+	switch m.ColorModel() {
+	case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+		eightBit = true
+	}
+
+	b := m.Bounds()
+	index := make(map[color.NRGBA]int, numColors)
+	var pal color.Palette
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c, ok := paletteColor(m.At(x, y), eightBit)
+			if !ok {
+				return nil
+			}
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(pal) == numColors {
+				return nil
+			}
+			index[c] = len(pal)
+			pal = append(pal, c)
+		}
+	}
+
+	// The tRNS chunk can omit the trailing opaque entries,
+	// so place the transparent colors first.
+	sort.SliceStable(pal, func(i, j int) bool {
+		return pal[i].(color.NRGBA).A < pal[j].(color.NRGBA).A
+	})
+	for i, c := range pal {
+		index[c.(color.NRGBA)] = i
+	}
+
+	p := image.NewPaletted(b, pal)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c, _ := paletteColor(m.At(x, y), eightBit)
+			p.SetColorIndex(x, y, uint8(index[c]))
+		}
+	}
+	return p
+}
+
+// paletteColor converts c to the color of a palette entry.
+// If eightBit is false, it reports whether c can be represented in 8 bits.
+// All fully transparent colors are converted to the same color.
+func paletteColor(c color.Color, eightBit bool) (color.NRGBA, bool) {
+	if eightBit {
+		ret := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if ret.A == 0 {
+			return color.NRGBA{}, true
+		}
+		return ret, true
+	}
+
+	c64 := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	if c64.A == 0 {
+		return color.NRGBA{}, true
+	}
+	ret := color.NRGBA{uint8(c64.R >> 8), uint8(c64.G >> 8), uint8(c64.B >> 8), uint8(c64.A >> 8)}
+	ok := uint16(ret.R)*0x101 == c64.R && uint16(ret.G)*0x101 == c64.G &&
+		uint16(ret.B)*0x101 == c64.B && uint16(ret.A)*0x101 == c64.A
+	return ret, ok
+}
+
+// medianCutQuantizer is a draw.Quantizer that uses the median cut algorithm.
+type medianCutQuantizer struct{}
+
+// colorCount is a color and the number of pixels that have the color.
+type colorCount struct {
+	c     [4]uint8 // non-alpha-premultiplied R, G, B and A.
+	count int
+}
+
+// colorBox is a box in the color space, that contains the colors.
+type colorBox struct {
+	colors []colorCount
+	count  int
+}
+
+// widest returns the channel that has the widest range, and the range.
+func (box *colorBox) widest() (channel int, width int) {
+	var lo, hi [4]uint8
+	lo = box.colors[0].c
+	hi = box.colors[0].c
+	for _, cc := range box.colors[1:] {
+		for i := 0; i < 4; i++ {
+			lo[i] = min(lo[i], cc.c[i])
+			hi[i] = max(hi[i], cc.c[i])
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if w := int(hi[i]) - int(lo[i]); w > width {
+			channel, width = i, w
+		}
+	}
+	return
+}
+
+// split splits the box at the median of the widest channel.
+func (box *colorBox) split() (*colorBox, *colorBox) {
+	channel, _ := box.widest()
+	sort.SliceStable(box.colors, func(i, j int) bool {
+		return box.colors[i].c[channel] < box.colors[j].c[channel]
+	})
+
+	// find the weighted median.
+	half := box.count / 2
+	sum := 0
+	i := 0
+	for ; i < len(box.colors)-1; i++ {
+		sum += box.colors[i].count
+		if sum >= half {
+			break
+		}
+	}
+	i = min(i+1, len(box.colors)-1)
+	a := &colorBox{colors: box.colors[:i]}
+	b := &colorBox{colors: box.colors[i:]}
+	for _, cc := range a.colors {
+		a.count += cc.count
+	}
+	b.count = box.count - a.count
+	return a, b
+}
+
+// average returns the average color of the box weighted by the number of pixels.
+func (box *colorBox) average() color.NRGBA {
+	var sum [4]int
+	for _, cc := range box.colors {
+		for i := 0; i < 4; i++ {
+			sum[i] += int(cc.c[i]) * cc.count
+		}
+	}
+	var c [4]uint8
+	for i := 0; i < 4; i++ {
+		c[i] = uint8((sum[i] + box.count/2) / box.count)
+	}
+	return color.NRGBA{c[0], c[1], c[2], c[3]}
+}
+
+// Quantize implements draw.Quantizer.
+func (medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p
+	}
+
+	// build the histogram.
+	hist := make(map[[4]uint8]int)
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			hist[[4]uint8{c.R, c.G, c.B, c.A}]++
+		}
+	}
+	if len(hist) == 0 {
+		return p
+	}
+	colors := make([]colorCount, 0, len(hist))
+	for c, count := range hist {
+		colors = append(colors, colorCount{c: c, count: count})
+	}
+	// sort the colors to make the result deterministic.
+	sort.Slice(colors, func(i, j int) bool {
+		ci, cj := colors[i].c, colors[j].c
+		for k := 0; k < 4; k++ {
+			if ci[k] != cj[k] {
+				return ci[k] < cj[k]
+			}
+		}
+		return false
+	})
+
+	root := &colorBox{colors: colors, count: b.Dx() * b.Dy()}
+	boxes := []*colorBox{root}
+	for len(boxes) < n {
+		// split the box that has the largest range weighted by the number of pixels.
+		best, bestScore := -1, 0
+		for i, box := range boxes {
+			if len(box.colors) < 2 {
+				continue
+			}
+			_, width := box.widest()
+			if score := width * box.count; best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	for _, box := range boxes {
+		p = append(p, box.average())
+	}
+	return p
+}
@@ -0,0 +1,193 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// bitDepthAndColorType returns the bit depth and the color type in the IHDR chunk.
+func bitDepthAndColorType(b []byte) (uint8, uint8) {
+	ihdr := b[len(pngHeader)+8:]
+	return ihdr[8], ihdr[9]
+}
+
+func TestEncoder_QuantizeLossless(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	colors := []color.NRGBA{
+		{0xff, 0x00, 0x00, 0xff},
+		{0x00, 0xff, 0x00, 0xff},
+		{0x00, 0x00, 0xff, 0x80},
+	}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			m.SetNRGBA(x, y, colors[(x+y)%len(colors)])
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := &Encoder{Quantize: true}
+	if err := enc.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	depth, ct := bitDepthAndColorType(buf.Bytes())
+	if depth != 2 || ct != ctPaletted {
+		t.Errorf("unexpected bit depth and color type: %d, %d", depth, ct)
+	}
+
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := decoded.(*image.Paletted)
+	if !ok {
+		t.Fatalf("unexpected type: %T", decoded)
+	}
+	if len(p.Palette) != 3 {
+		t.Errorf("unexpected palette length: %d", len(p.Palette))
+	}
+	// the transparent color comes first, to make the tRNS chunk short.
+	if _, _, _, a := p.Palette[0].RGBA(); a == 0xffff {
+		t.Errorf("unexpected opaque color in the first palette entry")
+	}
+	if err := diff(m, decoded); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncoder_QuantizeLossless16(t *testing.T) {
+	// The 16-bit colors that can be represented in 8 bits are converted losslessly.
+	m := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	m.SetNRGBA64(1, 1, color.NRGBA64{0x1212, 0x3434, 0x5656, 0xffff})
+
+	var buf bytes.Buffer
+	enc := &Encoder{Quantize: true}
+	if err := enc.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if depth, ct := bitDepthAndColorType(buf.Bytes()); depth != 1 || ct != ctPaletted {
+		t.Errorf("unexpected bit depth and color type: %d, %d", depth, ct)
+	}
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(m, decoded); err != nil {
+		t.Error(err)
+	}
+}
+
+func gradient() *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8((x + y) * 2), 0xff})
+		}
+	}
+	return m
+}
+
+func TestEncoder_QuantizeLossy(t *testing.T) {
+	tests := []struct {
+		name      string
+		enc       *Encoder
+		depth     uint8
+		maxColors int
+	}{
+		{
+			name:      "default",
+			enc:       &Encoder{Quantize: true},
+			depth:     8,
+			maxColors: 256,
+		},
+		{
+			name:      "16 colors without dithering",
+			enc:       &Encoder{Quantize: true, NumColors: 16, Drawer: draw.Src},
+			depth:     4,
+			maxColors: 16,
+		},
+	}
+
+	m := gradient()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.enc.Encode(&buf, m); err != nil {
+				t.Fatal(err)
+			}
+			if depth, ct := bitDepthAndColorType(buf.Bytes()); depth != tt.depth || ct != ctPaletted {
+				t.Errorf("unexpected bit depth and color type: %d, %d", depth, ct)
+			}
+			decoded, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := decoded.(*image.Paletted)
+			if len(p.Palette) > tt.maxColors {
+				t.Errorf("too many colors: %d", len(p.Palette))
+			}
+
+			// the average error should be small.
+			var sum int
+			b := m.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					c0 := m.NRGBAAt(x, y)
+					c1 := color.NRGBAModel.Convert(p.At(x, y)).(color.NRGBA)
+					sum += absDiff(c0.R, c1.R) + absDiff(c0.G, c1.G) + absDiff(c0.B, c1.B)
+				}
+			}
+			if avg := sum / (b.Dx() * b.Dy()); avg > 48 {
+				t.Errorf("the error is too large: %d", avg)
+			}
+		})
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func TestEncoder_QuantizeGray(t *testing.T) {
+	// grayscale images are not converted.
+	m := image.NewGray(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	enc := &Encoder{Quantize: true}
+	if err := enc.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ct := bitDepthAndColorType(buf.Bytes()); ct != ctGrayscale {
+		t.Errorf("unexpected color type: %d", ct)
+	}
+}
+
+func TestEncodeWithMeta_Quantize(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: gradient(),
+		Gamma: 0.45455,
+	}
+	var buf bytes.Buffer
+	enc := &Encoder{Quantize: true}
+	if err := enc.EncodeWithMeta(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeWithMeta(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.Image.(*image.Paletted); !ok {
+		t.Errorf("unexpected type: %T", decoded.Image)
+	}
+	if decoded.Gamma != m.Gamma {
+		t.Errorf("unexpected gamma: %f", decoded.Gamma)
+	}
+	// the original image is not modified.
+	if _, ok := m.Image.(*image.NRGBA); !ok {
+		t.Errorf("unexpected type: %T", m.Image)
+	}
+}
@@ -11,13 +11,16 @@ import (
 	"bufio"
 	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
 	"image"
 	"image/color"
 	"io"
+	"time"
 
+	"github.com/shogo82148/go-imaging/exif"
 	"github.com/shogo82148/go-imaging/icc"
 )
 
@@ -109,6 +112,7 @@ const (
 const pngHeader = "\x89PNG\r\n\x1a\n"
 
 type decoder struct {
+	dec           *Decoder
 	r             io.Reader
 	img           image.Image
 	crc           hash.Hash32
@@ -121,6 +125,17 @@ type decoder struct {
 	tmp           [3 * 256]byte
 	interlace     int
 
+	// chunk is the type of the current chunk.
+	chunk string
+	// ancillary reports whether the current chunk is an ancillary chunk.
+	ancillary bool
+	// ancillarySize is the total size of ancillary chunks, including decompressed data.
+	ancillarySize int64
+	// allocated is the total size of the allocated image buffers.
+	allocated int64
+	// truncatedInput reports whether the input ends in the image data.
+	truncatedInput bool
+
 	// useTransparent and transparent are used for grayscale and truecolor
 	// transparency, as opposed to palette transparency.
 	useTransparent bool
@@ -131,6 +146,29 @@ type decoder struct {
 	srgb        *SRGB
 	profileName string
 	icc         *icc.Profile
+	texts       []TextEntry
+	exif        *exif.TIFF
+	phys        *PhysicalDimensions
+	modTime     time.Time
+	chrm        *Chromaticities
+	cicp        *CICP
+	mdcv        *MasteringDisplayColorVolume
+	clli        *ContentLightLevel
+	sbit        *SignificantBits
+	bkgd        []byte
+	hist        []uint16
+	splt        []SuggestedPalette
+
+	// animation
+	decodeAnimation         bool
+	animated                bool
+	fdat                    bool
+	numFrames, numPlays     uint32
+	seq                     uint32
+	frameControl            *Frame
+	frameWidth, frameHeight int
+	defaultIsFrame          bool
+	frames                  []Frame
 }
 
 // A FormatError reports that the input is not a valid PNG.
@@ -145,6 +183,11 @@ type UnsupportedError string
 
 func (e UnsupportedError) Error() string { return "png: unsupported feature: " + string(e) }
 
+// A LimitError reports that the input exceeds a limit of the Decoder.
+type LimitError string
+
+func (e LimitError) Error() string { return "png: limit exceeded: " + string(e) }
+
 func (d *decoder) parseIHDR(length uint32) error {
 	if length != 13 {
 		return FormatError("bad IHDR length")
@@ -179,60 +222,66 @@ func (d *decoder) parseIHDR(length uint32) error {
 		return UnsupportedError("dimension overflow")
 	}
 
-	d.cb = cbInvalid
 	d.depth = int(d.tmp[8])
-	switch d.depth {
+	d.cb = colorBits(d.tmp[8], d.tmp[9])
+	if d.cb == cbInvalid {
+		return UnsupportedError(fmt.Sprintf("bit depth %d, color type %d", d.tmp[8], d.tmp[9]))
+	}
+	d.width, d.height = int(w), int(h)
+	return d.verifyChecksum()
+}
+
+// colorBits returns the cb value for the bit depth and the color type in the IHDR chunk.
+// It returns cbInvalid if the combination is not valid.
+func colorBits(depth, colorType uint8) int {
+	switch depth {
 	case 1:
-		switch d.tmp[9] {
+		switch colorType {
 		case ctGrayscale:
-			d.cb = cbG1
+			return cbG1
 		case ctPaletted:
-			d.cb = cbP1
+			return cbP1
 		}
 	case 2:
-		switch d.tmp[9] {
+		switch colorType {
 		case ctGrayscale:
-			d.cb = cbG2
+			return cbG2
 		case ctPaletted:
-			d.cb = cbP2
+			return cbP2
 		}
 	case 4:
-		switch d.tmp[9] {
+		switch colorType {
 		case ctGrayscale:
-			d.cb = cbG4
+			return cbG4
 		case ctPaletted:
-			d.cb = cbP4
+			return cbP4
 		}
 	case 8:
-		switch d.tmp[9] {
+		switch colorType {
 		case ctGrayscale:
-			d.cb = cbG8
+			return cbG8
 		case ctTrueColor:
-			d.cb = cbTC8
+			return cbTC8
 		case ctPaletted:
-			d.cb = cbP8
+			return cbP8
 		case ctGrayscaleAlpha:
-			d.cb = cbGA8
+			return cbGA8
 		case ctTrueColorAlpha:
-			d.cb = cbTCA8
+			return cbTCA8
 		}
 	case 16:
-		switch d.tmp[9] {
+		switch colorType {
 		case ctGrayscale:
-			d.cb = cbG16
+			return cbG16
 		case ctTrueColor:
-			d.cb = cbTC16
+			return cbTC16
 		case ctGrayscaleAlpha:
-			d.cb = cbGA16
+			return cbGA16
 		case ctTrueColorAlpha:
-			d.cb = cbTCA16
+			return cbTCA16
 		}
 	}
-	if d.cb == cbInvalid {
-		return UnsupportedError(fmt.Sprintf("bit depth %d, color type %d", d.tmp[8], d.tmp[9]))
-	}
-	d.width, d.height = int(w), int(h)
-	return d.verifyChecksum()
+	return cbInvalid
 }
 
 func (d *decoder) parsePLTE(length uint32) error {
@@ -345,24 +394,36 @@ func (d *decoder) Read(p []byte) (int, error) {
 	for d.idatLength == 0 {
 		// We have exhausted an IDAT chunk. Verify the checksum of that chunk.
 		if err := d.verifyChecksum(); err != nil {
+			d.checkTruncated(err)
 			return 0, err
 		}
 		// Read the length and chunk type of the next chunk, and check that
 		// it is an IDAT chunk.
 		if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+			d.checkTruncated(err)
 			return 0, err
 		}
 		d.idatLength = binary.BigEndian.Uint32(d.tmp[:4])
-		if string(d.tmp[4:8]) != "IDAT" {
+		chunkType := "IDAT"
+		if d.fdat {
+			chunkType = "fdAT"
+		}
+		if string(d.tmp[4:8]) != chunkType {
 			return 0, FormatError("not enough pixel data")
 		}
 		d.crc.Reset()
 		d.crc.Write(d.tmp[4:8])
+		if d.fdat {
+			if err := d.readFDATSequenceNumber(); err != nil {
+				return 0, err
+			}
+		}
 	}
 	if int(d.idatLength) < 0 {
 		return 0, UnsupportedError("IDAT chunk length overflow")
 	}
 	n, err := d.r.Read(p[:min(len(p), int(d.idatLength))])
+	d.checkTruncated(err)
 	d.crc.Write(p[:n])
 	d.idatLength -= uint32(n)
 	return n, err
@@ -379,7 +440,7 @@ func (d *decoder) decode() (image.Image, error) {
 	if d.interlace == itNone {
 		img, err = d.readImagePass(r, 0, false)
 		if err != nil {
-			return nil, err
+			return d.truncated(img, err)
 		}
 	} else if d.interlace == itAdam7 {
 		// Allocate a blank image of the full size.
@@ -389,47 +450,60 @@ func (d *decoder) decode() (image.Image, error) {
 		}
 		for pass := 0; pass < 7; pass++ {
 			imagePass, err := d.readImagePass(r, pass, false)
-			if err != nil {
-				return nil, err
-			}
 			if imagePass != nil {
 				d.mergePassInto(img, imagePass, pass)
 			}
+			if err != nil {
+				return d.truncated(img, err)
+			}
 		}
 	}
 
-	// Check for EOF, to verify the zlib checksum.
+	if err := d.checkEOF(r); err != nil {
+		return d.truncated(img, err)
+	}
+	return img, nil
+}
+
+// checkTruncated records whether the input ends in the image data.
+func (d *decoder) checkTruncated(err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.truncatedInput = true
+	}
+}
+
+// truncated handles the error err while reading the image data.
+// If the decoder is lenient and the input ends in the image data,
+// it returns the partially decoded image img with io.ErrUnexpectedEOF.
+func (d *decoder) truncated(img image.Image, err error) (image.Image, error) {
+	if d.dec.Lenient && d.truncatedInput {
+		return img, io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// checkEOF checks that the zlib stream r of the image data has no extra data,
+// and verifies the zlib checksum.
+func (d *decoder) checkEOF(r io.Reader) error {
 	n := 0
+	var err error
 	for i := 0; n == 0 && err == nil; i++ {
 		if i == 100 {
-			return nil, io.ErrNoProgress
+			return io.ErrNoProgress
 		}
 		n, err = r.Read(d.tmp[:1])
 	}
 	if err != nil && err != io.EOF {
-		return nil, FormatError(err.Error())
+		return FormatError(err.Error())
 	}
 	if n != 0 || d.idatLength != 0 {
-		return nil, FormatError("too much pixel data")
+		return FormatError("too much pixel data")
 	}
-
-	return img, nil
+	return nil
 }
 
 // readImagePass reads a single image pass, sized according to the pass number.
 func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image.Image, error) {
-	bitsPerPixel := 0
-	pixOffset := 0
-	var (
-		gray     *image.Gray
-		rgba     *image.RGBA
-		paletted *image.Paletted
-		nrgba    *image.NRGBA
-		gray16   *image.Gray16
-		rgba64   *image.RGBA64
-		nrgba64  *image.NRGBA64
-		img      image.Image
-	)
 	width, height := d.width, d.height
 	if d.interlace == itAdam7 && !allocateOnly {
 		p := interlacing[pass]
@@ -443,354 +517,426 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 			return nil, nil
 		}
 	}
+	if err := d.checkAlloc(width, height); err != nil {
+		return nil, err
+	}
+	img := d.newImage(image.Rect(0, 0, width, height))
+	if allocateOnly {
+		return img, nil
+	}
+
+	sr, err := newScanlineReader(d.bitsPerPixel(), width)
+	if err != nil {
+		return nil, err
+	}
+	for y := 0; y < height; y++ {
+		cdat, err := sr.readRow(r)
+		if err != nil {
+			// Return the rows decoded so far, for the lenient mode.
+			return img, err
+		}
+		d.convertRow(img, y, cdat)
+	}
+	return img, nil
+}
+
+// bitsPerPixel returns the number of bits per pixel of the PNG image.
+func (d *decoder) bitsPerPixel() int {
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8, cbP1, cbP2, cbP4, cbP8:
+		return d.depth
+	case cbGA8, cbG16:
+		return 16
+	case cbTC8:
+		return 24
+	case cbTCA8, cbGA16:
+		return 32
+	case cbTC16:
+		return 48
+	case cbTCA16:
+		return 64
+	}
+	return 0
+}
+
+// checkPixels checks the number of pixels of an image of the size against the limit of the Decoder.
+func (d *decoder) checkPixels(width, height int) error {
+	if d.dec.MaxPixels > 0 && int64(width)*int64(height) > d.dec.MaxPixels {
+		return LimitError(fmt.Sprintf("too many pixels: %dx%d", width, height))
+	}
+	return nil
+}
+
+// checkAlloc checks the limits of the Decoder before allocating an image of the size.
+func (d *decoder) checkAlloc(width, height int) error {
+	if err := d.checkPixels(width, height); err != nil {
+		return err
+	}
+	n := int64(width) * int64(height)
+	d.allocated += n * int64(d.imageBytesPerPixel())
+	if d.dec.MaxMemory > 0 && d.allocated > d.dec.MaxMemory {
+		return LimitError(fmt.Sprintf("too much memory: %d bytes", d.allocated))
+	}
+	return nil
+}
+
+// imageBytesPerPixel returns the number of bytes per pixel of the image that newImage allocates.
+func (d *decoder) imageBytesPerPixel() int {
+	switch d.newImage(image.Rectangle{}).(type) {
+	case *image.Gray, *image.Paletted:
+		return 1
+	case *image.Gray16:
+		return 2
+	case *image.RGBA, *image.NRGBA:
+		return 4
+	}
+	return 8
+}
+
+// newImage allocates an image for the color type and bit depth of the PNG image.
+func (d *decoder) newImage(r image.Rectangle) image.Image {
 	switch d.cb {
 	case cbG1, cbG2, cbG4, cbG8:
-		bitsPerPixel = d.depth
 		if d.useTransparent {
-			nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
-			img = nrgba
-		} else {
-			gray = image.NewGray(image.Rect(0, 0, width, height))
-			img = gray
+			return image.NewNRGBA(r)
 		}
+		return image.NewGray(r)
 	case cbGA8:
-		bitsPerPixel = 16
-		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
-		img = nrgba
+		return image.NewNRGBA(r)
 	case cbTC8:
-		bitsPerPixel = 24
 		if d.useTransparent {
-			nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
-			img = nrgba
-		} else {
-			rgba = image.NewRGBA(image.Rect(0, 0, width, height))
-			img = rgba
+			return image.NewNRGBA(r)
 		}
+		return image.NewRGBA(r)
 	case cbP1, cbP2, cbP4, cbP8:
-		bitsPerPixel = d.depth
-		paletted = image.NewPaletted(image.Rect(0, 0, width, height), d.palette)
-		img = paletted
+		return image.NewPaletted(r, d.palette)
 	case cbTCA8:
-		bitsPerPixel = 32
-		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
-		img = nrgba
+		return image.NewNRGBA(r)
 	case cbG16:
-		bitsPerPixel = 16
 		if d.useTransparent {
-			nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
-			img = nrgba64
-		} else {
-			gray16 = image.NewGray16(image.Rect(0, 0, width, height))
-			img = gray16
+			return image.NewNRGBA64(r)
 		}
+		return image.NewGray16(r)
 	case cbGA16:
-		bitsPerPixel = 32
-		nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
-		img = nrgba64
+		return image.NewNRGBA64(r)
 	case cbTC16:
-		bitsPerPixel = 48
 		if d.useTransparent {
-			nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
-			img = nrgba64
-		} else {
-			rgba64 = image.NewRGBA64(image.Rect(0, 0, width, height))
-			img = rgba64
+			return image.NewNRGBA64(r)
 		}
+		return image.NewRGBA64(r)
 	case cbTCA16:
-		bitsPerPixel = 64
-		nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
-		img = nrgba64
+		return image.NewNRGBA64(r)
 	}
-	if allocateOnly {
-		return img, nil
-	}
-	bytesPerPixel := (bitsPerPixel + 7) / 8
+	return nil
+}
 
+// scanlineReader reads the scanlines of an image pass and reverses the filters.
+type scanlineReader struct {
+	bytesPerPixel int
+	// cr and pr are the bytes for the current and previous row.
 	// The +1 is for the per-row filter type, which is at cr[0].
+	cr, pr []uint8
+}
+
+func newScanlineReader(bitsPerPixel, width int) (*scanlineReader, error) {
 	rowSize := 1 + (int64(bitsPerPixel)*int64(width)+7)/8
 	if rowSize != int64(int(rowSize)) {
 		return nil, UnsupportedError("dimension overflow")
 	}
-	// cr and pr are the bytes for the current and previous row.
-	cr := make([]uint8, rowSize)
-	pr := make([]uint8, rowSize)
+	return &scanlineReader{
+		bytesPerPixel: (bitsPerPixel + 7) / 8,
+		cr:            make([]uint8, rowSize),
+		pr:            make([]uint8, rowSize),
+	}, nil
+}
 
-	for y := 0; y < height; y++ {
-		// Read the decompressed bytes.
-		_, err := io.ReadFull(r, cr)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return nil, FormatError("not enough pixel data")
-			}
-			return nil, err
+// readRow reads the next row from r, and returns the unfiltered bytes.
+// The returned slice is valid until the next call of readRow.
+func (s *scanlineReader) readRow(r io.Reader) ([]uint8, error) {
+	cr, pr := s.cr, s.pr
+	bytesPerPixel := s.bytesPerPixel
+
+	// Read the decompressed bytes.
+	_, err := io.ReadFull(r, cr)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, FormatError("not enough pixel data")
 		}
+		return nil, err
+	}
 
-		// Apply the filter.
-		cdat := cr[1:]
-		pdat := pr[1:]
-		switch cr[0] {
-		case ftNone:
-			// No-op.
-		case ftSub:
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += cdat[i-bytesPerPixel]
-			}
-		case ftUp:
-			for i, p := range pdat {
-				cdat[i] += p
-			}
-		case ftAverage:
-			// The first column has no column to the left of it, so it is a
-			// special case. We know that the first column exists because we
-			// check above that width != 0, and so len(cdat) != 0.
-			for i := 0; i < bytesPerPixel; i++ {
-				cdat[i] += pdat[i] / 2
-			}
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
-			}
-		case ftPaeth:
-			filterPaeth(cdat, pdat, bytesPerPixel)
-		default:
-			return nil, FormatError("bad filter type")
+	// Apply the filter.
+	cdat := cr[1:]
+	pdat := pr[1:]
+	switch cr[0] {
+	case ftNone:
+		// No-op.
+	case ftSub:
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bytesPerPixel]
+		}
+	case ftUp:
+		for i, p := range pdat {
+			cdat[i] += p
+		}
+	case ftAverage:
+		// The first column has no column to the left of it, so it is a
+		// special case. We know that the first column exists because the
+		// rows of zero width are never read, and so len(cdat) != 0.
+		for i := 0; i < bytesPerPixel; i++ {
+			cdat[i] += pdat[i] / 2
 		}
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
+		}
+	case ftPaeth:
+		filterPaeth(cdat, pdat, bytesPerPixel)
+	default:
+		return nil, FormatError("bad filter type")
+	}
 
-		// Convert from bytes to colors.
-		switch d.cb {
-		case cbG1:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x += 8 {
-					b := cdat[x/8]
-					for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-						ycol := (b >> 7) * 0xff
-						acol := uint8(0xff)
-						if ycol == ty {
-							acol = 0x00
-						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 1
-					}
-				}
-			} else {
-				for x := 0; x < width; x += 8 {
-					b := cdat[x/8]
-					for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 7) * 0xff})
-						b <<= 1
-					}
-				}
-			}
-		case cbG2:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x += 4 {
-					b := cdat[x/4]
-					for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-						ycol := (b >> 6) * 0x55
-						acol := uint8(0xff)
-						if ycol == ty {
-							acol = 0x00
-						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 2
-					}
-				}
-			} else {
-				for x := 0; x < width; x += 4 {
-					b := cdat[x/4]
-					for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 6) * 0x55})
-						b <<= 2
-					}
-				}
-			}
-		case cbG4:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x += 2 {
-					b := cdat[x/2]
-					for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-						ycol := (b >> 4) * 0x11
-						acol := uint8(0xff)
-						if ycol == ty {
-							acol = 0x00
-						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 4
-					}
-				}
-			} else {
-				for x := 0; x < width; x += 2 {
-					b := cdat[x/2]
-					for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 4) * 0x11})
-						b <<= 4
-					}
-				}
-			}
-		case cbG8:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x++ {
-					ycol := cdat[x]
+	// The current row for y is the previous row for y+1.
+	s.pr, s.cr = cr, pr
+	return cdat, nil
+}
+
+// convertRow converts the unfiltered bytes of the row y to the colors of img.
+// img must be allocated by newImage, and its Min.X must be 0.
+func (d *decoder) convertRow(img image.Image, y int, cdat []uint8) {
+	gray, _ := img.(*image.Gray)
+	rgba, _ := img.(*image.RGBA)
+	paletted, _ := img.(*image.Paletted)
+	nrgba, _ := img.(*image.NRGBA)
+	gray16, _ := img.(*image.Gray16)
+	rgba64, _ := img.(*image.RGBA64)
+	nrgba64, _ := img.(*image.NRGBA64)
+	width := img.Bounds().Dx()
+
+	// Convert from bytes to colors.
+	switch d.cb {
+	case cbG1:
+		if d.useTransparent {
+			ty := d.transparent[1]
+			for x := 0; x < width; x += 8 {
+				b := cdat[x/8]
+				for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
+					ycol := (b >> 7) * 0xff
 					acol := uint8(0xff)
 					if ycol == ty {
 						acol = 0x00
 					}
-					nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, acol})
-				}
-			} else {
-				copy(gray.Pix[pixOffset:], cdat)
-				pixOffset += gray.Stride
-			}
-		case cbGA8:
-			for x := 0; x < width; x++ {
-				ycol := cdat[2*x+0]
-				nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, cdat[2*x+1]})
-			}
-		case cbTC8:
-			if d.useTransparent {
-				pix, i, j := nrgba.Pix, pixOffset, 0
-				tr, tg, tb := d.transparent[1], d.transparent[3], d.transparent[5]
-				for x := 0; x < width; x++ {
-					r := cdat[j+0]
-					g := cdat[j+1]
-					b := cdat[j+2]
-					a := uint8(0xff)
-					if r == tr && g == tg && b == tb {
-						a = 0x00
-					}
-					pix[i+0] = r
-					pix[i+1] = g
-					pix[i+2] = b
-					pix[i+3] = a
-					i += 4
-					j += 3
-				}
-				pixOffset += nrgba.Stride
-			} else {
-				pix, i, j := rgba.Pix, pixOffset, 0
-				for x := 0; x < width; x++ {
-					pix[i+0] = cdat[j+0]
-					pix[i+1] = cdat[j+1]
-					pix[i+2] = cdat[j+2]
-					pix[i+3] = 0xff
-					i += 4
-					j += 3
+					nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
+					b <<= 1
 				}
-				pixOffset += rgba.Stride
 			}
-		case cbP1:
+		} else {
 			for x := 0; x < width; x += 8 {
 				b := cdat[x/8]
 				for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-					idx := b >> 7
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
-					}
-					paletted.SetColorIndex(x+x2, y, idx)
+					gray.SetGray(x+x2, y, color.Gray{(b >> 7) * 0xff})
 					b <<= 1
 				}
 			}
-		case cbP2:
+		}
+	case cbG2:
+		if d.useTransparent {
+			ty := d.transparent[1]
 			for x := 0; x < width; x += 4 {
 				b := cdat[x/4]
 				for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-					idx := b >> 6
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
+					ycol := (b >> 6) * 0x55
+					acol := uint8(0xff)
+					if ycol == ty {
+						acol = 0x00
 					}
-					paletted.SetColorIndex(x+x2, y, idx)
+					nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
 					b <<= 2
 				}
 			}
-		case cbP4:
+		} else {
+			for x := 0; x < width; x += 4 {
+				b := cdat[x/4]
+				for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
+					gray.SetGray(x+x2, y, color.Gray{(b >> 6) * 0x55})
+					b <<= 2
+				}
+			}
+		}
+	case cbG4:
+		if d.useTransparent {
+			ty := d.transparent[1]
 			for x := 0; x < width; x += 2 {
 				b := cdat[x/2]
 				for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-					idx := b >> 4
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
+					ycol := (b >> 4) * 0x11
+					acol := uint8(0xff)
+					if ycol == ty {
+						acol = 0x00
 					}
-					paletted.SetColorIndex(x+x2, y, idx)
+					nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
 					b <<= 4
 				}
 			}
-		case cbP8:
-			if len(paletted.Palette) != 256 {
-				for x := 0; x < width; x++ {
-					if len(paletted.Palette) <= int(cdat[x]) {
-						paletted.Palette = paletted.Palette[:int(cdat[x])+1]
-					}
+		} else {
+			for x := 0; x < width; x += 2 {
+				b := cdat[x/2]
+				for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
+					gray.SetGray(x+x2, y, color.Gray{(b >> 4) * 0x11})
+					b <<= 4
 				}
 			}
-			copy(paletted.Pix[pixOffset:], cdat)
-			pixOffset += paletted.Stride
-		case cbTCA8:
-			copy(nrgba.Pix[pixOffset:], cdat)
-			pixOffset += nrgba.Stride
-		case cbG16:
-			if d.useTransparent {
-				ty := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
-				for x := 0; x < width; x++ {
-					ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
-					acol := uint16(0xffff)
-					if ycol == ty {
-						acol = 0x0000
-					}
-					nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+		}
+	case cbG8:
+		if d.useTransparent {
+			ty := d.transparent[1]
+			for x := 0; x < width; x++ {
+				ycol := cdat[x]
+				acol := uint8(0xff)
+				if ycol == ty {
+					acol = 0x00
 				}
-			} else {
-				for x := 0; x < width; x++ {
-					ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
-					gray16.SetGray16(x, y, color.Gray16{ycol})
+				nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, acol})
+			}
+		} else {
+			copy(gray.Pix[gray.PixOffset(0, y):], cdat)
+		}
+	case cbGA8:
+		for x := 0; x < width; x++ {
+			ycol := cdat[2*x+0]
+			nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, cdat[2*x+1]})
+		}
+	case cbTC8:
+		if d.useTransparent {
+			pix, i, j := nrgba.Pix, nrgba.PixOffset(0, y), 0
+			tr, tg, tb := d.transparent[1], d.transparent[3], d.transparent[5]
+			for x := 0; x < width; x++ {
+				r := cdat[j+0]
+				g := cdat[j+1]
+				b := cdat[j+2]
+				a := uint8(0xff)
+				if r == tr && g == tg && b == tb {
+					a = 0x00
 				}
+				pix[i+0] = r
+				pix[i+1] = g
+				pix[i+2] = b
+				pix[i+3] = a
+				i += 4
+				j += 3
 			}
-		case cbGA16:
+		} else {
+			pix, i, j := rgba.Pix, rgba.PixOffset(0, y), 0
 			for x := 0; x < width; x++ {
-				ycol := uint16(cdat[4*x+0])<<8 | uint16(cdat[4*x+1])
-				acol := uint16(cdat[4*x+2])<<8 | uint16(cdat[4*x+3])
-				nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+				pix[i+0] = cdat[j+0]
+				pix[i+1] = cdat[j+1]
+				pix[i+2] = cdat[j+2]
+				pix[i+3] = 0xff
+				i += 4
+				j += 3
 			}
-		case cbTC16:
-			if d.useTransparent {
-				tr := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
-				tg := uint16(d.transparent[2])<<8 | uint16(d.transparent[3])
-				tb := uint16(d.transparent[4])<<8 | uint16(d.transparent[5])
-				for x := 0; x < width; x++ {
-					rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
-					gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
-					bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
-					acol := uint16(0xffff)
-					if rcol == tr && gcol == tg && bcol == tb {
-						acol = 0x0000
-					}
-					nrgba64.SetNRGBA64(x, y, color.NRGBA64{rcol, gcol, bcol, acol})
+		}
+	case cbP1:
+		for x := 0; x < width; x += 8 {
+			b := cdat[x/8]
+			for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
+				idx := b >> 7
+				if len(paletted.Palette) <= int(idx) {
+					paletted.Palette = paletted.Palette[:int(idx)+1]
+				}
+				paletted.SetColorIndex(x+x2, y, idx)
+				b <<= 1
+			}
+		}
+	case cbP2:
+		for x := 0; x < width; x += 4 {
+			b := cdat[x/4]
+			for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
+				idx := b >> 6
+				if len(paletted.Palette) <= int(idx) {
+					paletted.Palette = paletted.Palette[:int(idx)+1]
+				}
+				paletted.SetColorIndex(x+x2, y, idx)
+				b <<= 2
+			}
+		}
+	case cbP4:
+		for x := 0; x < width; x += 2 {
+			b := cdat[x/2]
+			for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
+				idx := b >> 4
+				if len(paletted.Palette) <= int(idx) {
+					paletted.Palette = paletted.Palette[:int(idx)+1]
 				}
-			} else {
-				for x := 0; x < width; x++ {
-					rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
-					gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
-					bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
-					rgba64.SetRGBA64(x, y, color.RGBA64{rcol, gcol, bcol, 0xffff})
+				paletted.SetColorIndex(x+x2, y, idx)
+				b <<= 4
+			}
+		}
+	case cbP8:
+		if len(paletted.Palette) != 256 {
+			for x := 0; x < width; x++ {
+				if len(paletted.Palette) <= int(cdat[x]) {
+					paletted.Palette = paletted.Palette[:int(cdat[x])+1]
 				}
 			}
-		case cbTCA16:
+		}
+		copy(paletted.Pix[paletted.PixOffset(0, y):], cdat)
+	case cbTCA8:
+		copy(nrgba.Pix[nrgba.PixOffset(0, y):], cdat)
+	case cbG16:
+		if d.useTransparent {
+			ty := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
 			for x := 0; x < width; x++ {
-				rcol := uint16(cdat[8*x+0])<<8 | uint16(cdat[8*x+1])
-				gcol := uint16(cdat[8*x+2])<<8 | uint16(cdat[8*x+3])
-				bcol := uint16(cdat[8*x+4])<<8 | uint16(cdat[8*x+5])
-				acol := uint16(cdat[8*x+6])<<8 | uint16(cdat[8*x+7])
+				ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
+				acol := uint16(0xffff)
+				if ycol == ty {
+					acol = 0x0000
+				}
+				nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+			}
+		} else {
+			for x := 0; x < width; x++ {
+				ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
+				gray16.SetGray16(x, y, color.Gray16{ycol})
+			}
+		}
+	case cbGA16:
+		for x := 0; x < width; x++ {
+			ycol := uint16(cdat[4*x+0])<<8 | uint16(cdat[4*x+1])
+			acol := uint16(cdat[4*x+2])<<8 | uint16(cdat[4*x+3])
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+		}
+	case cbTC16:
+		if d.useTransparent {
+			tr := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
+			tg := uint16(d.transparent[2])<<8 | uint16(d.transparent[3])
+			tb := uint16(d.transparent[4])<<8 | uint16(d.transparent[5])
+			for x := 0; x < width; x++ {
+				rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
+				gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
+				bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
+				acol := uint16(0xffff)
+				if rcol == tr && gcol == tg && bcol == tb {
+					acol = 0x0000
+				}
 				nrgba64.SetNRGBA64(x, y, color.NRGBA64{rcol, gcol, bcol, acol})
 			}
+		} else {
+			for x := 0; x < width; x++ {
+				rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
+				gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
+				bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
+				rgba64.SetRGBA64(x, y, color.RGBA64{rcol, gcol, bcol, 0xffff})
+			}
+		}
+	case cbTCA16:
+		for x := 0; x < width; x++ {
+			rcol := uint16(cdat[8*x+0])<<8 | uint16(cdat[8*x+1])
+			gcol := uint16(cdat[8*x+2])<<8 | uint16(cdat[8*x+3])
+			bcol := uint16(cdat[8*x+4])<<8 | uint16(cdat[8*x+5])
+			acol := uint16(cdat[8*x+6])<<8 | uint16(cdat[8*x+7])
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{rcol, gcol, bcol, acol})
 		}
-
-		// The current row for y is the previous row for y+1.
-		pr, cr = cr, pr
 	}
-
-	return img, nil
 }
 
 // mergePassInto merges a single pass into a full sized image.
@@ -936,9 +1082,9 @@ func (d *decoder) parseICCP(length uint32) error {
 	if err != nil {
 		return FormatError("bad iCCP: " + err.Error())
 	}
-	p, err := icc.Decode(zr)
+	p, err := icc.Decode(&ancillaryReader{d: d, r: zr})
 	if err != nil {
-		return FormatError("bad iCCP: " + err.Error())
+		return decompressError("iCCP", err)
 	}
 	d.icc = p
 	if err := zr.Close(); err != nil {
@@ -952,6 +1098,87 @@ func (d *decoder) parseICCP(length uint32) error {
 	return d.verifyChecksum()
 }
 
+// nextStage returns the decoding stage after a chunk named name, or
+// chunkOrderError if the chunk may not appear at the given stage.
+// cb is the color type and bit depth from the IHDR chunk.
+// Unknown chunks are allowed anywhere between IHDR and IEND.
+func nextStage(stage, cb int, name string) (int, error) {
+	if stage == dsSeenIEND {
+		return stage, chunkOrderError
+	}
+	switch name {
+	case "IHDR":
+		if stage != dsStart {
+			return stage, chunkOrderError
+		}
+		return dsSeenIHDR, nil
+	case "PLTE":
+		if stage != dsSeenIHDR {
+			return stage, chunkOrderError
+		}
+		return dsSeenPLTE, nil
+	case "tRNS":
+		if cbPaletted(cb) {
+			if stage != dsSeenPLTE {
+				return stage, chunkOrderError
+			}
+		} else if cbTrueColor(cb) {
+			if stage != dsSeenIHDR && stage != dsSeenPLTE {
+				return stage, chunkOrderError
+			}
+		} else if stage != dsSeenIHDR {
+			return stage, chunkOrderError
+		}
+		return dsSeentRNS, nil
+	case "IDAT":
+		if stage < dsSeenIHDR || stage > dsSeenIDAT || (stage == dsSeenIHDR && cbPaletted(cb)) {
+			return stage, chunkOrderError
+		}
+		return dsSeenIDAT, nil
+	case "IEND":
+		if stage != dsSeenIDAT {
+			return stage, chunkOrderError
+		}
+		return dsSeenIEND, nil
+
+	// Ancillary chunks.
+	case "gAMA", "sRGB", "iCCP", "cHRM", "pHYs":
+		if stage < dsSeenIHDR || stage > dsSeenIDAT {
+			return stage, chunkOrderError
+		}
+	case "acTL", "mDCv", "cLLi", "eXIf", "sPLT":
+		if stage < dsSeenIHDR || stage >= dsSeenIDAT {
+			return stage, chunkOrderError
+		}
+	case "sBIT":
+		if stage < dsSeenIHDR || stage >= dsSeenIDAT || (stage >= dsSeenPLTE && cbPaletted(cb)) {
+			return stage, chunkOrderError
+		}
+	case "bKGD":
+		if stage < dsSeenIHDR || stage >= dsSeenIDAT || (stage < dsSeenPLTE && cbPaletted(cb)) {
+			return stage, chunkOrderError
+		}
+	case "hIST":
+		if stage < dsSeenPLTE || stage >= dsSeenIDAT {
+			return stage, chunkOrderError
+		}
+	case "fdAT":
+		if stage != dsSeenIDAT {
+			return stage, chunkOrderError
+		}
+	case "cICP":
+		if stage != dsSeenIHDR {
+			return stage, chunkOrderError
+		}
+	default:
+		// fcTL, tIME, tEXt, zTXt, iTXt and unknown chunks.
+		if stage < dsSeenIHDR {
+			return stage, chunkOrderError
+		}
+	}
+	return stage, nil
+}
+
 func (d *decoder) parseChunk(configOnly bool) error {
 	// Read the length and chunk type.
 	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
@@ -962,73 +1189,106 @@ func (d *decoder) parseChunk(configOnly bool) error {
 	d.crc.Write(d.tmp[4:8])
 
 	// Read the chunk data.
-	switch string(d.tmp[4:8]) {
-	case "IHDR":
-		if d.stage != dsStart {
-			return chunkOrderError
+	name := string(d.tmp[4:8])
+	d.chunk = name
+	d.ancillary = d.tmp[4]&0x20 != 0
+	switch name {
+	case "acTL", "fcTL", "fdAT":
+		if !d.decodeAnimation {
+			return d.skipChunk(length)
+		}
+	}
+	stage, err := nextStage(d.stage, d.cb, name)
+	if err != nil {
+		return err
+	}
+	if name == "IDAT" && d.stage == dsSeenIDAT {
+		// Ignore trailing zero-length or garbage IDAT chunks.
+		//
+		// This does not affect valid PNG images that contain multiple IDAT
+		// chunks, since the first call to parseIDAT below will consume all
+		// consecutive IDAT chunks required for decoding the image.
+		return d.skipChunk(length)
+	}
+	d.stage = stage
+	if d.ancillary && name != "fdAT" {
+		// fdAT chunks are image data, not metadata.
+		if err := d.countAncillary(int64(length)); err != nil {
+			return err
 		}
-		d.stage = dsSeenIHDR
+	}
+
+	switch name {
+	case "IHDR":
 		return d.parseIHDR(length)
 	case "PLTE":
-		if d.stage != dsSeenIHDR {
-			return chunkOrderError
-		}
-		d.stage = dsSeenPLTE
 		return d.parsePLTE(length)
 	case "tRNS":
-		if cbPaletted(d.cb) {
-			if d.stage != dsSeenPLTE {
-				return chunkOrderError
-			}
-		} else if cbTrueColor(d.cb) {
-			if d.stage != dsSeenIHDR && d.stage != dsSeenPLTE {
-				return chunkOrderError
-			}
-		} else if d.stage != dsSeenIHDR {
-			return chunkOrderError
-		}
-		d.stage = dsSeentRNS
 		return d.parsetRNS(length)
 	case "IDAT":
-		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
-			return chunkOrderError
-		} else if d.stage == dsSeenIDAT {
-			// Ignore trailing zero-length or garbage IDAT chunks.
-			//
-			// This does not affect valid PNG images that contain multiple IDAT
-			// chunks, since the first call to parseIDAT below will consume all
-			// consecutive IDAT chunks required for decoding the image.
-			break
-		}
-		d.stage = dsSeenIDAT
 		if configOnly {
+			// Leave the image data unread; RowReader reads it later.
+			d.idatLength = length
 			return nil
 		}
-		return d.parseIDAT(length)
-	case "IEND":
-		if d.stage != dsSeenIDAT {
-			return chunkOrderError
+		if err := d.parseIDAT(length); err != nil {
+			return err
 		}
-		d.stage = dsSeenIEND
+		if d.frameControl != nil {
+			// The default image is the first frame of the animation.
+			d.appendFrame(d.img)
+		}
+		return nil
+	case "IEND":
 		return d.parseIEND(length)
 
 	// Ancillary chunks.
 	case "gAMA":
-		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT {
-			return chunkOrderError
-		}
 		return d.parseGAMA(length)
 	case "sRGB":
-		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT {
-			return chunkOrderError
-		}
 		return d.parseSRGB(length)
 	case "iCCP":
-		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT {
-			return chunkOrderError
-		}
 		return d.parseICCP(length)
+	case "acTL":
+		return d.parseACTL(length)
+	case "fcTL":
+		return d.parseFCTL(length)
+	case "fdAT":
+		return d.parseFDAT(length)
+	case "cHRM":
+		return d.parseCHRM(length)
+	case "cICP":
+		return d.parseCICP(length)
+	case "mDCv":
+		return d.parseMDCV(length)
+	case "cLLi":
+		return d.parseCLLI(length)
+	case "sBIT":
+		return d.parseSBIT(length)
+	case "bKGD":
+		return d.parseBKGD(length)
+	case "hIST":
+		return d.parseHIST(length)
+	case "sPLT":
+		return d.parseSPLT(length)
+	case "pHYs":
+		return d.parsePHYS(length)
+	case "tIME":
+		return d.parseTIME(length)
+	case "eXIf":
+		return d.parseEXIF(length)
+	case "tEXt":
+		return d.parseTEXT(length)
+	case "zTXt":
+		return d.parseZTXT(length)
+	case "iTXt":
+		return d.parseITXT(length)
 	}
+	return d.skipChunk(length)
+}
+
+// skipChunk ignores the chunk data of the given length, and verifies the checksum.
+func (d *decoder) skipChunk(length uint32) error {
 	if length > 0x7fffffff {
 		return FormatError(fmt.Sprintf("Bad chunk length: %d", length))
 	}
@@ -1050,11 +1310,52 @@ func (d *decoder) verifyChecksum() error {
 		return err
 	}
 	if binary.BigEndian.Uint32(d.tmp[:4]) != d.crc.Sum32() {
+		if d.dec.Lenient && d.ancillary && d.chunk != "fdAT" && d.chunk != "fcTL" && d.chunk != "acTL" {
+			// Ancillary chunks are not necessary to display the image,
+			// except for the APNG chunks that make up the frames.
+			return nil
+		}
 		return FormatError("invalid checksum")
 	}
 	return nil
 }
 
+// countAncillary adds n bytes to the total size of ancillary chunks,
+// and checks the limit of the Decoder.
+func (d *decoder) countAncillary(n int64) error {
+	d.ancillarySize += n
+	if d.dec.MaxAncillarySize > 0 && d.ancillarySize > d.dec.MaxAncillarySize {
+		return LimitError(fmt.Sprintf("too large ancillary chunks: %d bytes", d.ancillarySize))
+	}
+	return nil
+}
+
+// ancillaryReader counts the decompressed data of ancillary chunks,
+// such as iCCP and zTXt, for the limit of the Decoder.
+type ancillaryReader struct {
+	d *decoder
+	r io.Reader
+}
+
+func (r *ancillaryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err := r.d.countAncillary(int64(n)); err != nil {
+		// Drop the data, or io.ReadFull might ignore the error.
+		return 0, err
+	}
+	return n, err
+}
+
+// decompressError converts the error in decompressing the chunk into FormatError.
+// LimitError is returned as is.
+func decompressError(chunk string, err error) error {
+	var lerr LimitError
+	if errors.As(err, &lerr) {
+		return lerr
+	}
+	return FormatError("bad " + chunk + ": " + err.Error())
+}
+
 func (d *decoder) checkHeader() error {
 	_, err := io.ReadFull(d.r, d.tmp[:len(pngHeader)])
 	if err != nil {
@@ -1066,13 +1367,62 @@ func (d *decoder) checkHeader() error {
 	return nil
 }
 
-// Decode reads a PNG image from r and returns it as an image.Image.
-// The type of Image returned depends on the PNG contents.
-func Decode(r io.Reader) (image.Image, error) {
-	d := &decoder{
+// Decoder configures decoding PNG images.
+// The zero value has no limits and is strict, the same as Decode.
+type Decoder struct {
+	// MaxPixels is the maximum number of pixels of an image.
+	// It is checked before allocating the image, and by DecodeConfig and NewRowReader.
+	// If MaxPixels is 0, the number of pixels is not limited.
+	MaxPixels int64
+
+	// MaxMemory is the maximum total size in bytes of the allocated image buffers.
+	// It includes the buffers for the passes of interlaced images and all frames of animated images.
+	// For a RowReader, it limits the size of each strip that ReadRows returns.
+	// If MaxMemory is 0, the memory is not limited.
+	MaxMemory int64
+
+	// MaxAncillarySize is the maximum total size in bytes of the ancillary chunks,
+	// including decompressed data of iCCP, zTXt and iTXt chunks.
+	// If MaxAncillarySize is 0, the size is not limited.
+	MaxAncillarySize int64
+
+	// Lenient makes the decoder recover from corrupted input.
+	// It ignores CRC errors in ancillary chunks, except for the APNG
+	// acTL, fcTL and fdAT chunks, and
+	// Decode and DecodeWithMeta return the partially decoded image with io.ErrUnexpectedEOF
+	// if the input is truncated after the image data begins.
+	// The rows that are not decoded are left zero.
+	Lenient bool
+}
+
+func (dec *Decoder) newDecoder(r io.Reader) *decoder {
+	return &decoder{
+		dec: dec,
 		r:   r,
 		crc: crc32.NewIEEE(),
 	}
+}
+
+// partialImage returns the partially decoded image if the decoder is lenient
+// and the input is truncated. Otherwise it returns nil.
+func (d *decoder) partialImage(err error) image.Image {
+	if d.dec.Lenient && err == io.ErrUnexpectedEOF {
+		return d.img
+	}
+	return nil
+}
+
+// Decode reads a PNG image from r and returns it as an image.Image.
+// The type of Image returned depends on the PNG contents.
+func Decode(r io.Reader) (image.Image, error) {
+	var dec Decoder
+	return dec.Decode(r)
+}
+
+// Decode reads a PNG image from r and returns it as an image.Image.
+// The type of Image returned depends on the PNG contents.
+func (dec *Decoder) Decode(r io.Reader) (image.Image, error) {
+	d := dec.newDecoder(r)
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -1084,7 +1434,7 @@ func Decode(r io.Reader) (image.Image, error) {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
-			return nil, err
+			return d.partialImage(err), err
 		}
 	}
 	return d.img, nil
@@ -1093,10 +1443,14 @@ func Decode(r io.Reader) (image.Image, error) {
 // DecodeConfig returns the color model and dimensions of a PNG image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
-	d := &decoder{
-		r:   r,
-		crc: crc32.NewIEEE(),
-	}
+	var dec Decoder
+	return dec.DecodeConfig(r)
+}
+
+// DecodeConfig returns the color model and dimensions of a PNG image without
+// decoding the entire image.
+func (dec *Decoder) DecodeConfig(r io.Reader) (image.Config, error) {
+	d := dec.newDecoder(r)
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -1122,7 +1476,15 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 			}
 		}
 	}
+	if err := d.checkPixels(d.width, d.height); err != nil {
+		return image.Config{}, err
+	}
 
+	return d.config(), nil
+}
+
+// config returns the color model and dimensions of the image.
+func (d *decoder) config() image.Config {
 	var cm color.Model
 	switch d.cb {
 	case cbG1, cbG2, cbG4, cbG8:
@@ -1148,7 +1510,7 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		ColorModel: cm,
 		Width:      d.width,
 		Height:     d.height,
-	}, nil
+	}
 }
 
 func init() {
@@ -876,3 +876,245 @@ func BenchmarkDecodeRGB(b *testing.B) {
 func BenchmarkDecodeInterlacing(b *testing.B) {
 	benchmarkDecode(b, "testdata/benchRGB-interlace.png", 4)
 }
+
+func TestDecoder_MaxPixels(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	dec := &Decoder{MaxPixels: 64*64 - 1}
+	img, err := dec.Decode(bytes.NewReader(data))
+	if _, ok := err.(LimitError); !ok {
+		t.Errorf("want LimitError, got %v", err)
+	}
+	if img != nil {
+		t.Errorf("unexpected image")
+	}
+
+	// DecodeConfig checks the size without allocating the image.
+	if _, err := dec.DecodeConfig(bytes.NewReader(data)); err != LimitError("too many pixels: 64x64") {
+		t.Errorf("want LimitError, got %v", err)
+	}
+
+	dec = &Decoder{MaxPixels: 64 * 64}
+	if _, err := dec.Decode(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+	if _, err := dec.DecodeConfig(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecoder_MaxMemory(t *testing.T) {
+	// The decoded image is *image.RGBA, 4 bytes per pixel.
+	const size = 64 * 64 * 4
+	for _, interlace := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := &Encoder{Interlace: interlace}
+		if err := enc.Encode(&buf, gradient()); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		dec := &Decoder{MaxMemory: size}
+		_, err := dec.Decode(bytes.NewReader(data))
+		if interlace {
+			// The passes of interlaced images need extra buffers.
+			if _, ok := err.(LimitError); !ok {
+				t.Errorf("interlaced: want LimitError, got %v", err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+
+		dec = &Decoder{MaxMemory: size - 1}
+		if _, err := dec.Decode(bytes.NewReader(data)); err == nil {
+			t.Errorf("interlace %v: want LimitError, got nil", interlace)
+		}
+	}
+}
+
+func TestDecoder_MaxAncillarySize(t *testing.T) {
+	profile, err := srgbChromaticities.ICCProfile(0.45455)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		m    *ImageWithMeta
+	}{
+		{
+			name: "zTXt",
+			m: &ImageWithMeta{
+				Texts: []TextEntry{{Keyword: "Comment", Text: strings.Repeat("a", 10000), Compressed: true}},
+			},
+		},
+		{
+			name: "iTXt",
+			m: &ImageWithMeta{
+				Texts: []TextEntry{{Keyword: "Comment", Text: strings.Repeat("あ", 10000), Compressed: true}},
+			},
+		},
+		{
+			name: "iCCP",
+			m: &ImageWithMeta{
+				ICCProfile: profile,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Image = image.NewGray(image.Rect(0, 0, 1, 1))
+			var buf bytes.Buffer
+			if err := EncodeWithMeta(&buf, tt.m); err != nil {
+				t.Fatal(err)
+			}
+			data := buf.Bytes()
+
+			// The limit allows the compressed chunks, but not the decompressed data.
+			var size int64
+			cr, err := NewChunkReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				c, err := cr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !c.IsCritical() {
+					size += int64(len(c.Data))
+				}
+			}
+			dec := &Decoder{MaxAncillarySize: size}
+			_, err = dec.DecodeWithMeta(bytes.NewReader(data))
+			if _, ok := err.(LimitError); !ok {
+				t.Errorf("want LimitError, got %v", err)
+			}
+
+			dec = &Decoder{MaxAncillarySize: 1 << 20}
+			if _, err := dec.DecodeWithMeta(bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDecoder_LenientChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	m := &ImageWithMeta{
+		Image: gradient(),
+		Texts: []TextEntry{{Keyword: "Comment", Text: "hello"}},
+	}
+	if err := EncodeWithMeta(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// corrupt the CRC of the tEXt chunk.
+	i := bytes.Index(data, []byte("tEXt"))
+	text := data[:i+4+len("Comment\x00hello")+4]
+	text[len(text)-1] ^= 0xff
+
+	if _, err := Decode(bytes.NewReader(data)); err != FormatError("invalid checksum") {
+		t.Errorf("want invalid checksum error, got %v", err)
+	}
+
+	dec := &Decoder{Lenient: true}
+	got, err := dec.DecodeWithMeta(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(m.Image, got.Image); err != nil {
+		t.Error(err)
+	}
+	if len(got.Texts) != 1 {
+		t.Errorf("unexpected texts: %v", got.Texts)
+	}
+
+	// CRC errors in critical chunks are not ignored.
+	i = bytes.Index(data, []byte("IDAT"))
+	length := int(data[i-4])<<24 | int(data[i-3])<<16 | int(data[i-2])<<8 | int(data[i-1])
+	data[i+4+length] ^= 0xff
+	if _, err := dec.Decode(bytes.NewReader(data)); err != FormatError("invalid checksum") {
+		t.Errorf("want invalid checksum error, got %v", err)
+	}
+}
+
+func TestDecoder_LenientChecksumAPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, testAPNG()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// corrupt the CRC of the first fdAT chunk.
+	i := bytes.Index(data, []byte("fdAT"))
+	length := int(data[i-4])<<24 | int(data[i-3])<<16 | int(data[i-2])<<8 | int(data[i-1])
+	data[i+4+length] ^= 0xff
+
+	// fdAT chunks are image data, so CRC errors are not ignored.
+	dec := &Decoder{Lenient: true}
+	if _, err := dec.DecodeAll(bytes.NewReader(data)); err != FormatError("invalid checksum") {
+		t.Errorf("want invalid checksum error, got %v", err)
+	}
+}
+
+func TestDecoder_LenientTruncated(t *testing.T) {
+	m := gradient()
+	for _, interlace := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := &Encoder{Interlace: interlace, CompressionLevel: NoCompression}
+		if err := enc.Encode(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		// cut the image data in half.
+		data = data[:len(data)/2]
+
+		if img, err := Decode(bytes.NewReader(data)); img != nil || err == nil {
+			t.Errorf("interlace %v: want no image and an error, got %v", interlace, err)
+		}
+
+		dec := &Decoder{Lenient: true}
+		img, err := dec.Decode(bytes.NewReader(data))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("interlace %v: want io.ErrUnexpectedEOF, got %v", interlace, err)
+		}
+		if img == nil {
+			t.Fatalf("interlace %v: want partially decoded image", interlace)
+		}
+		if !img.Bounds().Eq(m.Bounds()) {
+			t.Errorf("interlace %v: unexpected bounds: %v", interlace, img.Bounds())
+		}
+		// the first row is decoded.
+		if c := color.NRGBAModel.Convert(img.At(63, 0)); c != m.At(63, 0) {
+			t.Errorf("interlace %v: unexpected color: %v", interlace, c)
+		}
+
+		meta, err := dec.DecodeWithMeta(bytes.NewReader(data))
+		if err != io.ErrUnexpectedEOF || meta == nil || meta.Image == nil {
+			t.Errorf("interlace %v: want partially decoded image with io.ErrUnexpectedEOF, got %v", interlace, err)
+		}
+	}
+}
+
+func TestDecoder_LenientTruncatedBeforeImageData(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()[:len(pngHeader)+20]
+
+	dec := &Decoder{Lenient: true}
+	img, err := dec.Decode(bytes.NewReader(data))
+	if img != nil || err != io.ErrUnexpectedEOF {
+		t.Errorf("want no image and io.ErrUnexpectedEOF, got %v, %v", img, err)
+	}
+}
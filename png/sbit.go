@@ -0,0 +1,102 @@
+package png
+
+import (
+	"io"
+)
+
+// SignificantBits is the number of significant bits in each channel of the original image data.
+// For example, an image from a 5-bit source stored with 8-bit samples has 5 significant bits.
+type SignificantBits struct {
+	// Red, Green and Blue are the significant bits of the color channels.
+	// In grayscale images, they have the same value, the significant bits of the gray channel.
+	Red, Green, Blue uint8
+
+	// Alpha is the significant bits of the alpha channel.
+	// It is 0 if the image has no alpha channel.
+	Alpha uint8
+}
+
+func (d *decoder) parseSBIT(length uint32) error {
+	var n int
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8, cbG16:
+		n = 1
+	case cbGA8, cbGA16:
+		n = 2
+	case cbTC8, cbTC16, cbP1, cbP2, cbP4, cbP8:
+		n = 3
+	case cbTCA8, cbTCA16:
+		n = 4
+	}
+	if length != uint32(n) {
+		return FormatError("bad sBIT length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:n]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:n])
+
+	// The sample depth of paletted images is always 8.
+	depth := d.depth
+	if cbPaletted(d.cb) {
+		depth = 8
+	}
+	for _, v := range d.tmp[:n] {
+		if v == 0 || int(v) > depth {
+			return FormatError("bad sBIT value")
+		}
+	}
+
+	switch n {
+	case 1:
+		d.sbit = &SignificantBits{Red: d.tmp[0], Green: d.tmp[0], Blue: d.tmp[0]}
+	case 2:
+		d.sbit = &SignificantBits{Red: d.tmp[0], Green: d.tmp[0], Blue: d.tmp[0], Alpha: d.tmp[1]}
+	case 3:
+		d.sbit = &SignificantBits{Red: d.tmp[0], Green: d.tmp[1], Blue: d.tmp[2]}
+	case 4:
+		d.sbit = &SignificantBits{Red: d.tmp[0], Green: d.tmp[1], Blue: d.tmp[2], Alpha: d.tmp[3]}
+	}
+	return d.verifyChecksum()
+}
+
+// sampleDepth returns the sample depth of the encoded image.
+// The sample depth of paletted images is 8.
+func (e *encoder) sampleDepth() int {
+	switch e.cb {
+	case cbG16, cbTC16, cbTCA16:
+		return 16
+	}
+	return 8
+}
+
+func (e *encoder) writeSBIT(s *SignificantBits) {
+	depth := e.sampleDepth()
+
+	// sig clamps v to the sample depth of the encoded image.
+	// The image may be encoded in a different color type or bit depth from the original,
+	// e.g. a grayscale image with alpha is encoded as a truecolor image.
+	sig := func(v uint8) byte {
+		if v == 0 || int(v) > depth {
+			return byte(depth)
+		}
+		return v
+	}
+
+	switch e.cb {
+	case cbG8, cbG16:
+		e.tmp[0] = sig(max(s.Red, s.Green, s.Blue))
+		e.writeChunk(e.tmp[:1], "sBIT")
+	case cbTC8, cbTC16, cbP1, cbP2, cbP4, cbP8:
+		e.tmp[0] = sig(s.Red)
+		e.tmp[1] = sig(s.Green)
+		e.tmp[2] = sig(s.Blue)
+		e.writeChunk(e.tmp[:3], "sBIT")
+	case cbTCA8, cbTCA16:
+		e.tmp[0] = sig(s.Red)
+		e.tmp[1] = sig(s.Green)
+		e.tmp[2] = sig(s.Blue)
+		e.tmp[3] = sig(s.Alpha)
+		e.writeChunk(e.tmp[:4], "sBIT")
+	}
+}
@@ -0,0 +1,79 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeWithMeta_SignificantBits(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	opaque.SetNRGBA(0, 0, color.NRGBA{0x00, 0x00, 0x00, 0xff})
+
+	tests := []struct {
+		name string
+		img  image.Image
+		sbit *SignificantBits
+		want *SignificantBits
+	}{
+		{
+			name: "gray",
+			img:  image.NewGray(image.Rect(0, 0, 1, 1)),
+			sbit: &SignificantBits{Red: 5, Green: 5, Blue: 5},
+			want: &SignificantBits{Red: 5, Green: 5, Blue: 5},
+		},
+		{
+			name: "truecolor",
+			img:  opaque,
+			sbit: &SignificantBits{Red: 5, Green: 6, Blue: 5},
+			want: &SignificantBits{Red: 5, Green: 6, Blue: 5},
+		},
+		{
+			name: "truecolor with alpha",
+			img:  image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			sbit: &SignificantBits{Red: 5, Green: 6, Blue: 5, Alpha: 1},
+			want: &SignificantBits{Red: 5, Green: 6, Blue: 5, Alpha: 1},
+		},
+		{
+			name: "the alpha channel is missing",
+			img:  image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+			sbit: &SignificantBits{Red: 5, Green: 6, Blue: 5},
+			want: &SignificantBits{Red: 5, Green: 6, Blue: 5, Alpha: 8},
+		},
+		{
+			name: "clamped to the sample depth",
+			img:  image.NewGray(image.Rect(0, 0, 1, 1)),
+			sbit: &SignificantBits{Red: 12, Green: 12, Blue: 12},
+			want: &SignificantBits{Red: 8, Green: 8, Blue: 8},
+		},
+		{
+			name: "16-bit",
+			img:  image.NewGray16(image.Rect(0, 0, 1, 1)),
+			sbit: &SignificantBits{Red: 12, Green: 12, Blue: 12},
+			want: &SignificantBits{Red: 12, Green: 12, Blue: 12},
+		},
+		{
+			name: "paletted",
+			img:  image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}),
+			sbit: &SignificantBits{Red: 5, Green: 6, Blue: 5},
+			want: &SignificantBits{Red: 5, Green: 6, Blue: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+				Image:           tt.img,
+				SignificantBits: tt.sbit,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, decoded.SignificantBits); diff != "" {
+				t.Errorf("unexpected significant bits (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"strconv"
+)
+
+// SuggestedPalette is a palette suggested for displaying the image
+// on devices that can't display the full range of colors.
+type SuggestedPalette struct {
+	// Name is the name of the palette.
+	// It must be 1-79 characters long and consist of printable Latin-1 characters,
+	// without leading, trailing or consecutive spaces, and must be unique in the image.
+	Name string
+
+	// SampleDepth is the sample depth of the palette in the chunk, 8 or 16.
+	SampleDepth int
+
+	// Entries are the colors of the palette.
+	Entries []SuggestedPaletteEntry
+}
+
+// SuggestedPaletteEntry is an entry of SuggestedPalette.
+type SuggestedPaletteEntry struct {
+	// Color is the color of the entry.
+	// If SampleDepth is 8, only the upper 8 bits of each channel are stored.
+	Color color.NRGBA64
+
+	// Frequency is proportional to the fraction of the pixels in the image
+	// that are closest to the entry.
+	Frequency uint16
+}
+
+func (d *decoder) parseSPLT(length uint32) error {
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	name, rest, ok := cutKeyword(data)
+	if !ok {
+		return FormatError("bad sPLT palette name")
+	}
+	if len(rest) == 0 {
+		return FormatError("bad sPLT")
+	}
+	depth := int(rest[0])
+	rest = rest[1:]
+
+	var entries []SuggestedPaletteEntry
+	switch depth {
+	case 8:
+		if len(rest)%6 != 0 {
+			return FormatError("bad sPLT length")
+		}
+		entries = make([]SuggestedPaletteEntry, len(rest)/6)
+		for i := range entries {
+			b := rest[6*i:]
+			entries[i] = SuggestedPaletteEntry{
+				Color: color.NRGBA64{
+					R: uint16(b[0]) * 0x101,
+					G: uint16(b[1]) * 0x101,
+					B: uint16(b[2]) * 0x101,
+					A: uint16(b[3]) * 0x101,
+				},
+				Frequency: binary.BigEndian.Uint16(b[4:6]),
+			}
+		}
+	case 16:
+		if len(rest)%10 != 0 {
+			return FormatError("bad sPLT length")
+		}
+		entries = make([]SuggestedPaletteEntry, len(rest)/10)
+		for i := range entries {
+			b := rest[10*i:]
+			entries[i] = SuggestedPaletteEntry{
+				Color: color.NRGBA64{
+					R: binary.BigEndian.Uint16(b[0:2]),
+					G: binary.BigEndian.Uint16(b[2:4]),
+					B: binary.BigEndian.Uint16(b[4:6]),
+					A: binary.BigEndian.Uint16(b[6:8]),
+				},
+				Frequency: binary.BigEndian.Uint16(b[8:10]),
+			}
+		}
+	default:
+		return FormatError("bad sPLT sample depth")
+	}
+
+	for _, p := range d.splt {
+		if p.Name == name {
+			return FormatError("duplicated sPLT palette name")
+		}
+	}
+	d.splt = append(d.splt, SuggestedPalette{
+		Name:        name,
+		SampleDepth: depth,
+		Entries:     entries,
+	})
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeSPLTs(palettes []SuggestedPalette) {
+	names := make(map[string]bool, len(palettes))
+	for _, p := range palettes {
+		if e.err != nil {
+			return
+		}
+		name, ok := textKeywordToLatin1(p.Name)
+		if !ok {
+			e.err = FormatError("invalid suggested palette name: " + p.Name)
+			return
+		}
+		if names[name] {
+			e.err = FormatError("duplicated suggested palette name: " + p.Name)
+			return
+		}
+		names[name] = true
+		e.writeSPLT(name, p)
+	}
+}
+
+func (e *encoder) writeSPLT(name string, p SuggestedPalette) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(name)
+	buf.WriteByte(0x00) // null separator
+	buf.WriteByte(byte(p.SampleDepth))
+	switch p.SampleDepth {
+	case 8:
+		for _, entry := range p.Entries {
+			c := entry.Color
+			var b [6]byte
+			b[0] = byte(c.R >> 8)
+			b[1] = byte(c.G >> 8)
+			b[2] = byte(c.B >> 8)
+			b[3] = byte(c.A >> 8)
+			binary.BigEndian.PutUint16(b[4:6], entry.Frequency)
+			buf.Write(b[:])
+		}
+	case 16:
+		for _, entry := range p.Entries {
+			c := entry.Color
+			var b [10]byte
+			binary.BigEndian.PutUint16(b[0:2], c.R)
+			binary.BigEndian.PutUint16(b[2:4], c.G)
+			binary.BigEndian.PutUint16(b[4:6], c.B)
+			binary.BigEndian.PutUint16(b[6:8], c.A)
+			binary.BigEndian.PutUint16(b[8:10], entry.Frequency)
+			buf.Write(b[:])
+		}
+	default:
+		e.err = FormatError("invalid suggested palette sample depth: " + strconv.Itoa(p.SampleDepth))
+		return
+	}
+	e.writeChunk(buf.Bytes(), "sPLT")
+}
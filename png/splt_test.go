@@ -0,0 +1,92 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeWithMeta_SuggestedPalettes(t *testing.T) {
+	palettes := []SuggestedPalette{
+		{
+			Name:        "8-bit palette",
+			SampleDepth: 8,
+			Entries: []SuggestedPaletteEntry{
+				{Color: color.NRGBA64{0xffff, 0x0000, 0x0000, 0xffff}, Frequency: 100},
+				{Color: color.NRGBA64{0x0000, 0x8080, 0x0000, 0x8080}, Frequency: 10},
+			},
+		},
+		{
+			Name:        "16-bit palette",
+			SampleDepth: 16,
+			Entries: []SuggestedPaletteEntry{
+				{Color: color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xdef0}, Frequency: 0xffff},
+			},
+		},
+	}
+	decoded, err := encodeDecodeWithMeta(&ImageWithMeta{
+		Image:             image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+		SuggestedPalettes: palettes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(palettes, decoded.SuggestedPalettes); diff != "" {
+		t.Errorf("unexpected suggested palettes (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeWithMeta_InvalidSuggestedPalettes(t *testing.T) {
+	tests := []struct {
+		name     string
+		palettes []SuggestedPalette
+		want     error
+	}{
+		{
+			name:     "empty name",
+			palettes: []SuggestedPalette{{SampleDepth: 8}},
+		},
+		{
+			name:     "invalid sample depth",
+			palettes: []SuggestedPalette{{Name: "palette", SampleDepth: 4}},
+		},
+		{
+			name:     "non-Latin-1 name",
+			palettes: []SuggestedPalette{{Name: "aĀ", SampleDepth: 8}},
+			want:     FormatError("invalid suggested palette name: aĀ"),
+		},
+		{
+			name:     "leading space",
+			palettes: []SuggestedPalette{{Name: " palette", SampleDepth: 8}},
+			want:     FormatError("invalid suggested palette name:  palette"),
+		},
+		{
+			name:     "repeated spaces",
+			palettes: []SuggestedPalette{{Name: "my  palette", SampleDepth: 8}},
+			want:     FormatError("invalid suggested palette name: my  palette"),
+		},
+		{
+			name: "duplicated name",
+			palettes: []SuggestedPalette{
+				{Name: "palette", SampleDepth: 8},
+				{Name: "palette", SampleDepth: 16},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := encodeDecodeWithMeta(&ImageWithMeta{
+				Image:             image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+				SuggestedPalettes: tt.palettes,
+			})
+			if _, ok := err.(FormatError); !ok {
+				t.Errorf("want FormatError, got %v", err)
+			}
+			if tt.want != nil && err != tt.want {
+				t.Errorf("want %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
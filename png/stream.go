@@ -0,0 +1,146 @@
+package png
+
+import (
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+)
+
+// RowReader decodes a non-interlaced PNG image row by row.
+// It doesn't hold the whole image in memory,
+// so it can process images that are too large to decode with Decode.
+type RowReader struct {
+	d   *decoder
+	zr  io.ReadCloser
+	sr  *scanlineReader
+	y   int
+	err error
+}
+
+// NewRowReader reads the PNG header and the chunks before the image data from r,
+// and returns a RowReader that reads the rows of the image.
+// It returns an UnsupportedError if the image is interlaced.
+func NewRowReader(r io.Reader) (*RowReader, error) {
+	var dec Decoder
+	return dec.NewRowReader(r)
+}
+
+// NewRowReader reads the PNG header and the chunks before the image data from r,
+// and returns a RowReader that reads the rows of the image with the limits of dec.
+// It returns an UnsupportedError if the image is interlaced.
+func (dec *Decoder) NewRowReader(r io.Reader) (*RowReader, error) {
+	d := dec.newDecoder(r)
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	for d.stage != dsSeenIDAT {
+		if err := d.parseChunk(true); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	if d.interlace != itNone {
+		return nil, UnsupportedError("streaming interlaced images")
+	}
+	if err := d.checkPixels(d.width, d.height); err != nil {
+		return nil, err
+	}
+
+	sr, err := newScanlineReader(d.bitsPerPixel(), d.width)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zlib.NewReader(d)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &RowReader{
+		d:  d,
+		zr: zr,
+		sr: sr,
+	}, nil
+}
+
+// Config returns the color model and dimensions of the image.
+func (rr *RowReader) Config() image.Config {
+	return rr.d.config()
+}
+
+// Y returns the y coordinate of the next row.
+func (rr *RowReader) Y() int {
+	return rr.y
+}
+
+// ReadRows decodes at most n rows of the image, and returns them as a strip of the image.
+// The type of the strip is the same as the image that Decode returns.
+// The bounds of the strip are (0, y)-(width, y+k), where y is the value of Y before the call
+// and k is the number of rows read.
+//
+// After the last row is read, ReadRows verifies the rest of the PNG stream
+// and returns io.EOF.
+func (rr *RowReader) ReadRows(n int) (image.Image, error) {
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	if rr.y >= rr.d.height {
+		rr.err = rr.finish()
+		if rr.err == nil {
+			rr.err = io.EOF
+		}
+		return nil, rr.err
+	}
+
+	k := min(n, rr.d.height-rr.y)
+	if m := rr.d.dec.MaxMemory; m > 0 && int64(rr.d.width)*int64(k)*int64(rr.d.imageBytesPerPixel()) > m {
+		return nil, LimitError(fmt.Sprintf("too much memory: %d rows", k))
+	}
+	img := rr.d.newImage(image.Rect(0, rr.y, rr.d.width, rr.y+k))
+	for y := rr.y; y < rr.y+k; y++ {
+		cdat, err := rr.sr.readRow(rr.zr)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rr.err = err
+			return nil, err
+		}
+		rr.d.convertRow(img, y, cdat)
+	}
+	rr.y += k
+	return img, nil
+}
+
+// finish verifies the end of the image data and reads the remaining chunks.
+func (rr *RowReader) finish() error {
+	d := rr.d
+	if err := d.checkEOF(rr.zr); err != nil {
+		return err
+	}
+	if err := rr.zr.Close(); err != nil {
+		return err
+	}
+	if err := d.verifyChecksum(); err != nil {
+		return err
+	}
+	for d.stage != dsSeenIEND {
+		if err := d.parseChunk(false); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
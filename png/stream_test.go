@@ -0,0 +1,150 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRowReader(t *testing.T) {
+	for _, fn := range filenames {
+		qfn := "testdata/pngsuite/" + fn + ".png"
+		want, err := readPNG(qfn)
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+
+		f, err := os.Open(qfn)
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		rr, err := NewRowReader(f)
+		if err != nil {
+			f.Close()
+			var uerr UnsupportedError
+			if errors.As(err, &uerr) {
+				// interlaced images are not supported.
+				continue
+			}
+			t.Error(fn, err)
+			continue
+		}
+
+		config := rr.Config()
+		if config.Width != want.Bounds().Dx() || config.Height != want.Bounds().Dy() {
+			t.Errorf("%s: unexpected size: %dx%d", fn, config.Width, config.Height)
+		}
+
+		// read the image in strips of 3 rows.
+		for {
+			y := rr.Y()
+			strip, err := rr.ReadRows(3)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Error(fn, err)
+				break
+			}
+			if strip.Bounds().Min.Y != y {
+				t.Errorf("%s: unexpected bounds: %v", fn, strip.Bounds())
+			}
+			sub := want.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(strip.Bounds())
+			if err := diff(sub, strip); err != nil {
+				t.Errorf("%s: %v", fn, err)
+				break
+			}
+		}
+		if rr.Y() != config.Height {
+			t.Errorf("%s: unexpected number of rows: %d", fn, rr.Y())
+		}
+		f.Close()
+	}
+}
+
+func TestRowReader_Interlaced(t *testing.T) {
+	var buf bytes.Buffer
+	enc := &Encoder{Interlace: true}
+	if err := enc.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewRowReader(&buf)
+	var uerr UnsupportedError
+	if !errors.As(err, &uerr) {
+		t.Errorf("want UnsupportedError, got %v", err)
+	}
+}
+
+func TestRowReader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, gradient()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// cut the IEND chunk.
+	rr, err := NewRowReader(bytes.NewReader(data[:len(data)-12]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.ReadRows(64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.ReadRows(1); err != io.ErrUnexpectedEOF {
+		t.Errorf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecoder_NewRowReader(t *testing.T) {
+	var buf bytes.Buffer
+	m := &ImageWithMeta{
+		Image: gradient(),
+		Texts: []TextEntry{{Keyword: "Comment", Text: "hello"}},
+	}
+	if err := EncodeWithMeta(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	dec := &Decoder{MaxPixels: 64*64 - 1}
+	if _, err := dec.NewRowReader(bytes.NewReader(data)); err != LimitError("too many pixels: 64x64") {
+		t.Errorf("want LimitError, got %v", err)
+	}
+
+	dec = &Decoder{MaxAncillarySize: 1}
+	if _, err := dec.NewRowReader(bytes.NewReader(data)); err == nil {
+		t.Error("want LimitError, got nil")
+	} else if _, ok := err.(LimitError); !ok {
+		t.Errorf("want LimitError, got %v", err)
+	}
+
+	// The strips of ReadRows are limited by MaxMemory.
+	// The decoded image is *image.RGBA, 4 bytes per pixel.
+	dec = &Decoder{MaxMemory: 64 * 4 * 2}
+	rr, err := dec.NewRowReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.ReadRows(3); err != LimitError("too much memory: 3 rows") {
+		t.Errorf("want LimitError, got %v", err)
+	}
+	if _, err := rr.ReadRows(2); err != nil {
+		t.Error(err)
+	}
+
+	// corrupt the CRC of the tEXt chunk.
+	i := bytes.Index(data, []byte("tEXt"))
+	data[i+4+len("Comment\x00hello")+3] ^= 0xff
+	if _, err := NewRowReader(bytes.NewReader(data)); err != FormatError("invalid checksum") {
+		t.Errorf("want invalid checksum error, got %v", err)
+	}
+	dec = &Decoder{Lenient: true}
+	if _, err := dec.NewRowReader(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+}
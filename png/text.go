@@ -0,0 +1,315 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextEntry is a textual information of the image,
+// stored in a tEXt, zTXt or iTXt chunk.
+type TextEntry struct {
+	// Keyword is the keyword of the text, such as "Title", "Author" and "Comment".
+	// It must be 1-79 characters long and consist of printable Latin-1 characters,
+	// without leading, trailing or consecutive spaces.
+	Keyword string
+
+	// Text is the text.
+	Text string
+
+	// Compressed reports whether the text is compressed.
+	// A compressed Latin-1 text is stored in a zTXt chunk.
+	Compressed bool
+
+	// International reports whether the text is stored in an iTXt chunk.
+	// The text that can't be represented in Latin-1 is always stored in an iTXt chunk.
+	International bool
+
+	// LanguageTag is the language of the text, such as "en" and "ja-JP".
+	// It is available only in iTXt chunks.
+	LanguageTag string
+
+	// TranslatedKeyword is the translation of the keyword into the language.
+	// It is available only in iTXt chunks.
+	TranslatedKeyword string
+}
+
+// readChunkData reads the whole chunk data and computes the checksum.
+func (d *decoder) readChunkData(length uint32) ([]byte, error) {
+	if length > 0x7fffffff {
+		return nil, FormatError("bad chunk length")
+	}
+	data, err := io.ReadAll(io.LimitReader(d.r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	d.crc.Write(data)
+	return data, nil
+}
+
+// cutKeyword splits the null-terminated keyword from the chunk data.
+func cutKeyword(data []byte) (string, []byte, bool) {
+	keyword, rest, ok := bytes.Cut(data, []byte{0x00})
+	if !ok || len(keyword) == 0 || len(keyword) > 79 {
+		return "", nil, false
+	}
+	s, ok := iccProfileLatin1ToUTF8(string(keyword))
+	if !ok {
+		return "", nil, false
+	}
+	return s, rest, true
+}
+
+// latin1ToUTF8 converts a string from Latin-1 to UTF-8.
+func latin1ToUTF8(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, ch := range b {
+		runes[i] = rune(ch)
+	}
+	return string(runes)
+}
+
+// utf8ToLatin1 converts a string from UTF-8 to Latin-1.
+// It reports false if s contains characters that are not in Latin-1.
+func utf8ToLatin1(s string) ([]byte, bool) {
+	buf := make([]byte, 0, len(s))
+	for _, ch := range s {
+		if ch > 0xff {
+			return nil, false
+		}
+		buf = append(buf, byte(ch))
+	}
+	return buf, true
+}
+
+// textKeywordToLatin1 converts the keyword of a text chunk from UTF-8 to Latin-1.
+// It reports false if s is not a valid keyword.
+func textKeywordToLatin1(s string) (string, bool) {
+	buf := make([]byte, 0, len(s))
+	for _, ch := range s {
+		if (ch < 32 || ch > 126) && (ch < 161 || ch > 255) {
+			return "", false
+		}
+		if ch == ' ' && (len(buf) == 0 || buf[len(buf)-1] == ' ') {
+			return "", false
+		}
+		buf = append(buf, byte(ch))
+	}
+	if len(buf) == 0 || len(buf) > 79 || buf[len(buf)-1] == ' ' {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// isLanguageTag reports whether s consists of ASCII letters, digits and hyphens,
+// as the language tag of iTXt chunks does.
+func isLanguageTag(s string) bool {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch < 'a' || ch > 'z') && (ch < 'A' || ch > 'Z') && (ch < '0' || ch > '9') && ch != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *decoder) decompressText(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(&ancillaryReader{d: d, r: zr})
+}
+
+func (d *decoder) parseTEXT(length uint32) error {
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	keyword, text, ok := cutKeyword(data)
+	if !ok {
+		return FormatError("bad tEXt keyword")
+	}
+	d.texts = append(d.texts, TextEntry{
+		Keyword: keyword,
+		Text:    latin1ToUTF8(text),
+	})
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parseZTXT(length uint32) error {
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	keyword, rest, ok := cutKeyword(data)
+	if !ok {
+		return FormatError("bad zTXt keyword")
+	}
+
+	// Only compression method 0 is defined.
+	if len(rest) < 1 || rest[0] != 0 {
+		return FormatError("bad zTXt compression method")
+	}
+	text, err := d.decompressText(rest[1:])
+	if err != nil {
+		return decompressError("zTXt", err)
+	}
+	d.texts = append(d.texts, TextEntry{
+		Keyword:    keyword,
+		Text:       latin1ToUTF8(text),
+		Compressed: true,
+	})
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parseITXT(length uint32) error {
+	data, err := d.readChunkData(length)
+	if err != nil {
+		return err
+	}
+	keyword, rest, ok := cutKeyword(data)
+	if !ok {
+		return FormatError("bad iTXt keyword")
+	}
+
+	// Read the compression flag and the compression method.
+	if len(rest) < 2 {
+		return FormatError("bad iTXt")
+	}
+	compressed := rest[0] != 0
+	if rest[0] > 1 {
+		return FormatError("bad iTXt compression flag")
+	}
+	// Only compression method 0 is defined.
+	if compressed && rest[1] != 0 {
+		return FormatError("bad iTXt compression method")
+	}
+	rest = rest[2:]
+
+	// Read the null-terminated language tag and translated keyword.
+	lang, rest, ok := bytes.Cut(rest, []byte{0x00})
+	if !ok {
+		return FormatError("bad iTXt language tag")
+	}
+	translated, text, ok := bytes.Cut(rest, []byte{0x00})
+	if !ok {
+		return FormatError("bad iTXt translated keyword")
+	}
+
+	if compressed {
+		text, err = d.decompressText(text)
+		if err != nil {
+			return decompressError("iTXt", err)
+		}
+	}
+	d.texts = append(d.texts, TextEntry{
+		Keyword:           keyword,
+		Text:              string(text),
+		Compressed:        compressed,
+		International:     true,
+		LanguageTag:       string(lang),
+		TranslatedKeyword: string(translated),
+	})
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeTexts(texts []TextEntry) {
+	for _, t := range texts {
+		e.writeText(t)
+	}
+}
+
+func (e *encoder) writeText(t TextEntry) {
+	if e.err != nil {
+		return
+	}
+
+	keyword, ok := textKeywordToLatin1(t.Keyword)
+	if !ok {
+		e.err = FormatError("invalid text keyword: " + t.Keyword)
+		return
+	}
+
+	text, ok := utf8ToLatin1(t.Text)
+	if !ok || t.International || t.LanguageTag != "" || t.TranslatedKeyword != "" {
+		e.writeITXT(keyword, t)
+		return
+	}
+
+	if bytes.IndexByte(text, 0x00) >= 0 {
+		e.err = FormatError("null character in text")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(keyword)
+	buf.WriteByte(0x00) // null separator
+	if !t.Compressed {
+		buf.Write(text)
+		e.writeChunk(buf.Bytes(), "tEXt")
+		return
+	}
+
+	buf.WriteByte(0x00) // compression method: zlib
+	if err := compressText(buf, text); err != nil {
+		e.err = err
+		return
+	}
+	e.writeChunk(buf.Bytes(), "zTXt")
+}
+
+func (e *encoder) writeITXT(keyword string, t TextEntry) {
+	if !utf8.ValidString(t.Text) {
+		e.err = FormatError("invalid UTF-8 text")
+		return
+	}
+	if !utf8.ValidString(t.TranslatedKeyword) || strings.IndexByte(t.TranslatedKeyword, 0x00) >= 0 {
+		e.err = FormatError("invalid translated keyword")
+		return
+	}
+	if !isLanguageTag(t.LanguageTag) {
+		e.err = FormatError("invalid language tag: " + t.LanguageTag)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(keyword)
+	buf.WriteByte(0x00) // null separator
+	if t.Compressed {
+		buf.WriteByte(0x01) // compression flag
+	} else {
+		buf.WriteByte(0x00) // compression flag
+	}
+	buf.WriteByte(0x00) // compression method: zlib
+	buf.WriteString(t.LanguageTag)
+	buf.WriteByte(0x00) // null separator
+	buf.WriteString(t.TranslatedKeyword)
+	buf.WriteByte(0x00) // null separator
+	if t.Compressed {
+		if err := compressText(buf, []byte(t.Text)); err != nil {
+			e.err = err
+			return
+		}
+	} else {
+		buf.WriteString(t.Text)
+	}
+	e.writeChunk(buf.Bytes(), "iTXt")
+}
+
+func compressText(w io.Writer, text []byte) error {
+	zw, err := zlib.NewWriterLevel(w, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(text); err != nil {
+		return err
+	}
+	return zw.Close()
+}
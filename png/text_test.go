@@ -0,0 +1,218 @@
+package png
+
+import (
+	"image"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeWithMeta_Text(t *testing.T) {
+	f, err := os.Open("testdata/gamma.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := DecodeWithMeta(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TextEntry{
+		{
+			Keyword: "Comment",
+			Text:    "Screenshot",
+		},
+	}
+	if diff := cmp.Diff(want, img.Texts); diff != "" {
+		t.Errorf("unexpected texts (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecodeWithMeta_InternationalText(t *testing.T) {
+	f, err := os.Open("testdata/icc-profile.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := DecodeWithMeta(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(img.Texts) != 1 {
+		t.Fatalf("unexpected number of texts: %d, want 1", len(img.Texts))
+	}
+	text := img.Texts[0]
+	if text.Keyword != "XML:com.adobe.xmp" {
+		t.Errorf("unexpected keyword: %q, want %q", text.Keyword, "XML:com.adobe.xmp")
+	}
+	if !text.International {
+		t.Error("want international text")
+	}
+	if !strings.HasPrefix(text.Text, "<x:xmpmeta") {
+		t.Errorf("unexpected text: %q", text.Text)
+	}
+}
+
+func TestEncodeWithMeta_Text(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Texts: []TextEntry{
+			{
+				Keyword: "Title",
+				Text:    "tEXt chunk",
+			},
+			{
+				Keyword:    "Description",
+				Text:       strings.Repeat("zTXt chunk with Latin-1 characters: ¡¢£ ýþÿ\n", 10),
+				Compressed: true,
+			},
+			{
+				Keyword:           "Author",
+				Text:              "新潟県",
+				International:     true,
+				LanguageTag:       "ja",
+				TranslatedKeyword: "著者",
+			},
+			{
+				Keyword:       "Comment",
+				Text:          strings.Repeat("compressed iTXt chunk\n", 10),
+				Compressed:    true,
+				International: true,
+			},
+		},
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(m.Texts, decoded.Texts); diff != "" {
+		t.Errorf("unexpected texts (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeWithMeta_NonLatin1Text(t *testing.T) {
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Texts: []TextEntry{
+			{
+				Keyword: "Title",
+				Text:    "こんにちは",
+			},
+		},
+	}
+
+	decoded, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TextEntry{
+		{
+			Keyword:       "Title",
+			Text:          "こんにちは",
+			International: true,
+		},
+	}
+	if diff := cmp.Diff(want, decoded.Texts); diff != "" {
+		t.Errorf("unexpected texts (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeWithMeta_InvalidTextKeyword(t *testing.T) {
+	keywords := []string{
+		"",
+		strings.Repeat("a", 80),
+		"日本語",
+		"tab\tkeyword",
+		" leading space",
+		"trailing space ",
+		"double  space",
+		"invalid \xff UTF-8",
+	}
+	for _, keyword := range keywords {
+		m := &ImageWithMeta{
+			Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+			Texts: []TextEntry{{Keyword: keyword, Text: "text"}},
+		}
+		want := FormatError("invalid text keyword: " + keyword)
+		if err := EncodeWithMeta(io.Discard, m); err != want {
+			t.Errorf("%q: got %v, want %v", keyword, err, want)
+		}
+	}
+
+	// Latin-1 keywords with single spaces are valid.
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Texts: []TextEntry{{Keyword: strings.Repeat("é", 77) + " a", Text: "text"}},
+	}
+	got, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Texts[0].Keyword != m.Texts[0].Keyword {
+		t.Errorf("got keyword %q, want %q", got.Texts[0].Keyword, m.Texts[0].Keyword)
+	}
+}
+
+func TestEncodeWithMeta_InvalidUTF8Text(t *testing.T) {
+	texts := []struct {
+		entry TextEntry
+		want  error
+	}{
+		{TextEntry{Keyword: "Comment", Text: "invalid \xff UTF-8"}, FormatError("invalid UTF-8 text")},
+		{TextEntry{Keyword: "Comment", Text: "text", TranslatedKeyword: "\xff"}, FormatError("invalid translated keyword")},
+	}
+	for _, tt := range texts {
+		m := &ImageWithMeta{
+			Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+			Texts: []TextEntry{tt.entry},
+		}
+		if err := EncodeWithMeta(io.Discard, m); err != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.entry.Text, err, tt.want)
+		}
+	}
+}
+
+func TestEncodeWithMeta_InvalidTextNull(t *testing.T) {
+	texts := []struct {
+		entry TextEntry
+		want  error
+	}{
+		{TextEntry{Keyword: "Comment", Text: "a\x00b"}, FormatError("null character in text")},
+		{TextEntry{Keyword: "Comment", Text: "a\x00b", Compressed: true}, FormatError("null character in text")},
+		{TextEntry{Keyword: "Comment", Text: "text", TranslatedKeyword: "a\x00b"}, FormatError("invalid translated keyword")},
+		{TextEntry{Keyword: "Comment", Text: "text", LanguageTag: "en\x00zz"}, FormatError("invalid language tag: en\x00zz")},
+		{TextEntry{Keyword: "Comment", Text: "text", LanguageTag: "en_US"}, FormatError("invalid language tag: en_US")},
+	}
+	for _, tt := range texts {
+		m := &ImageWithMeta{
+			Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+			Texts: []TextEntry{tt.entry},
+		}
+		if _, err := encodeDecodeWithMeta(m); err != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.entry, err, tt.want)
+		}
+	}
+
+	// Language tags consist of letters, digits and hyphens.
+	m := &ImageWithMeta{
+		Image: image.NewNRGBA(image.Rect(0, 0, 100, 100)),
+		Texts: []TextEntry{{Keyword: "Comment", Text: "text", LanguageTag: "x-Klingon-2"}},
+	}
+	got, err := encodeDecodeWithMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Texts[0].LanguageTag != "x-Klingon-2" {
+		t.Errorf("got language tag %q, want %q", got.Texts[0].LanguageTag, "x-Klingon-2")
+	}
+}
@@ -0,0 +1,49 @@
+package png
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+func (d *decoder) parseTIME(length uint32) error {
+	if length != 7 {
+		return FormatError("bad tIME length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:7]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:7])
+
+	year := int(binary.BigEndian.Uint16(d.tmp[0:2]))
+	month := int(d.tmp[2])
+	day := int(d.tmp[3])
+	hour := int(d.tmp[4])
+	minute := int(d.tmp[5])
+	second := int(d.tmp[6])
+	// 60 is allowed for leap seconds.
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 60 {
+		return FormatError("bad tIME")
+	}
+	d.modTime = time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	return d.verifyChecksum()
+}
+
+func (e *encoder) writeTIME(t time.Time) {
+	if e.err != nil {
+		return
+	}
+
+	t = t.UTC()
+	if t.Year() < 0 || t.Year() > 0xffff {
+		e.err = FormatError("invalid modification time: " + t.String())
+		return
+	}
+	binary.BigEndian.PutUint16(e.tmp[0:2], uint16(t.Year()))
+	e.tmp[2] = byte(t.Month())
+	e.tmp[3] = byte(t.Day())
+	e.tmp[4] = byte(t.Hour())
+	e.tmp[5] = byte(t.Minute())
+	e.tmp[6] = byte(t.Second())
+	e.writeChunk(e.tmp[:7], "tIME")
+}
@@ -0,0 +1,297 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/shogo82148/float16"
+	"github.com/shogo82148/go-imaging/fp16"
+	"github.com/shogo82148/go-imaging/fp16/fp16color"
+	"github.com/shogo82148/go-imaging/icc"
+	"github.com/shogo82148/go-imaging/internal/parallels"
+	"github.com/shogo82148/go-imaging/srgb"
+)
+
+// DecodeLinear reads a PNG image from r and returns it as a linear color image.
+// See ImageWithMeta.DecodeTone for details.
+func DecodeLinear(r io.Reader) (*fp16.NRGBAh, error) {
+	img, err := DecodeWithMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	return img.DecodeTone(), nil
+}
+
+// DecodeTone decodes the tone of the image to a linear color image.
+// The transfer function is chosen from the color space information in the order of
+// cICP, iCCP, sRGB and gAMA.
+// If the image has no color space information, it is assumed to be sRGB.
+//
+// DecodeTone converts only the tone; the colors remain in the primaries of the image.
+// 16-bit images are decoded in 16-bit precision.
+func (m *ImageWithMeta) DecodeTone() *fp16.NRGBAh {
+	if m.CICP != nil {
+		if f := cicpTransferFunction(m.CICP.TransferFunction); f != nil {
+			if !m.CICP.VideoFullRange {
+				f = narrowRange(f, bitDepth(m.Image))
+			}
+			t := toneTable(f)
+			return decodeTone(m.Image, t, t, t)
+		}
+	}
+	if m.ICCProfile != nil {
+		if r, g, b, ok := iccToneTables(m.ICCProfile); ok {
+			return decodeTone(m.Image, r, g, b)
+		}
+	}
+	if m.SRGB != nil {
+		return srgb.DecodeTone(m.Image)
+	}
+	if m.Gamma > 0 {
+		// The gAMA chunk has the exponent of encoding.
+		exp := 1 / m.Gamma
+		t := toneTable(func(v float64) float64 {
+			return math.Pow(v, exp)
+		})
+		return decodeTone(m.Image, t, t, t)
+	}
+	return srgb.DecodeTone(m.Image)
+}
+
+// iccToneTables returns the lookup tables of the tone reproduction curves of the ICC profile.
+func iccToneTables(p *icc.Profile) (r, g, b []float16.Float16, ok bool) {
+	cr, okR := p.Get(icc.TagRedTRC).(icc.Curve)
+	cg, okG := p.Get(icc.TagGreenTRC).(icc.Curve)
+	cb, okB := p.Get(icc.TagBlueTRC).(icc.Curve)
+	if okR && okG && okB {
+		return toneTable(cr.DecodeTone), toneTable(cg.DecodeTone), toneTable(cb.DecodeTone), true
+	}
+	if ck, ok := p.Get(icc.TagGrayTRC).(icc.Curve); ok {
+		t := toneTable(ck.DecodeTone)
+		return t, t, t, true
+	}
+	return nil, nil, nil, false
+}
+
+// referenceWhite is the luminance of the HDR reference white in cd/m², defined in ITU-R BT.2408.
+// It is mapped to 1.0 in linear color images.
+const referenceWhite = 203
+
+// cicpTransferFunction returns the function that converts the encoded value to the linear value.
+// It returns nil if the transfer function is not supported.
+func cicpTransferFunction(tf TransferFunction) func(float64) float64 {
+	switch tf {
+	case TransferFunctionBT709, 6, 14, 15:
+		// BT.601 (6) and BT.2020 (14, 15) use the same transfer function as BT.709.
+		return bt709ToLinear
+	case TransferFunctionLinear:
+		return func(v float64) float64 { return v }
+	case TransferFunctionSRGB:
+		return srgbToLinear
+	case TransferFunctionPQ:
+		return pqToLinear
+	case TransferFunctionHLG:
+		return hlgToLinear
+	}
+	return nil
+}
+
+// narrowRange converts f to the function for narrow range values of the bit depth,
+// as defined in ITU-R BT.2100: black is 16 and white is 235, scaled by 2^(depth-8).
+func narrowRange(f func(float64) float64, depth int) func(float64) float64 {
+	maxValue := float64(int(1)<<depth - 1)
+	black := float64(int(16) << (depth - 8))
+	scale := float64(int(219) << (depth - 8))
+	return func(v float64) float64 {
+		return f((v*maxValue - black) / scale)
+	}
+}
+
+// bitDepth returns the bit depth of the samples of img, 8 or 16.
+func bitDepth(img image.Image) int {
+	switch img.(type) {
+	case *image.Gray16, *image.NRGBA64, *image.RGBA64:
+		return 16
+	}
+	return 8
+}
+
+func bt709ToLinear(v float64) float64 {
+	if v < 0.081 {
+		return v / 4.5
+	}
+	return math.Pow((v+0.099)/1.099, 1/0.45)
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// pqToLinear is the EOTF of SMPTE ST 2084.
+func pqToLinear(v float64) float64 {
+	const (
+		m1 = 2610.0 / 16384
+		m2 = 2523.0 / 4096 * 128
+		c1 = 3424.0 / 4096
+		c2 = 2413.0 / 4096 * 32
+		c3 = 2392.0 / 4096 * 32
+	)
+	if v <= 0 {
+		return 0
+	}
+	p := math.Pow(v, 1/m2)
+	y := math.Pow(max(p-c1, 0)/(c2-c3*p), 1/m1)
+	return y * 10000 / referenceWhite
+}
+
+// hlgToLinear is the inverse OETF of ARIB STD-B67.
+// The reference white (75% signal level) is mapped to 1.0.
+func hlgToLinear(v float64) float64 {
+	return hlgInverseOETF(v) / hlgInverseOETF(0.75)
+}
+
+func hlgInverseOETF(v float64) float64 {
+	const (
+		a = 0.17883277
+		b = 1 - 4*a
+		c = 0.55991073 // 0.5 - a*ln(4*a)
+	)
+	if v <= 0 {
+		return 0
+	}
+	if v <= 0.5 {
+		return v * v / 3
+	}
+	return (math.Exp((v-c)/a) + b) / 12
+}
+
+// toneTable returns the lookup table of f for 16-bit values.
+func toneTable(f func(float64) float64) []float16.Float16 {
+	table := make([]float16.Float16, 1<<16)
+	for i := range table {
+		table[i] = float16.FromFloat64(f(float64(i) / 0xffff))
+	}
+	return table
+}
+
+// decodeTone converts img to a linear color image with the lookup tables of each channel.
+// The tables are indexed by 16-bit values.
+func decodeTone(img image.Image, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return decodeToneNRGBA(img, tr, tg, tb)
+	case *image.NRGBA64:
+		return decodeToneNRGBA64(img, tr, tg, tb)
+	case *image.Gray:
+		return decodeToneGray(img, tr, tg, tb)
+	case *image.Gray16:
+		return decodeToneGray16(img, tr, tg, tb)
+	case *image.Paletted:
+		return decodeTonePaletted(img, tr, tg, tb)
+	}
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// NRGBA64Model keeps the precision of 16-bit images.
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			ret.SetNRGBAh(x, y, fp16color.NRGBAh{
+				R: tr[c.R],
+				G: tg[c.G],
+				B: tb[c.B],
+				A: float16.FromFloat64(float64(c.A) / 0xffff),
+			})
+		}
+	})
+	return ret
+}
+
+// alpha8 and alpha16 convert 8-bit and 16-bit alpha values to float16.
+func alpha8(a uint8) float16.Float16 {
+	return float16.FromFloat64(float64(a) / 0xff)
+}
+
+func alpha16(a uint16) float16.Float16 {
+	return float16.FromFloat64(float64(a) / 0xffff)
+}
+
+func decodeToneNRGBA(img *image.NRGBA, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			ret.SetNRGBAh(x, y, fp16color.NRGBAh{
+				R: tr[uint16(c.R)*0x101],
+				G: tg[uint16(c.G)*0x101],
+				B: tb[uint16(c.B)*0x101],
+				A: alpha8(c.A),
+			})
+		}
+	})
+	return ret
+}
+
+func decodeToneNRGBA64(img *image.NRGBA64, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBA64At(x, y)
+			ret.SetNRGBAh(x, y, fp16color.NRGBAh{
+				R: tr[c.R],
+				G: tg[c.G],
+				B: tb[c.B],
+				A: alpha16(c.A),
+			})
+		}
+	})
+	return ret
+}
+
+func decodeToneGray(img *image.Gray, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	one := alpha8(0xff)
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := uint16(img.GrayAt(x, y).Y) * 0x101
+			ret.SetNRGBAh(x, y, fp16color.NRGBAh{R: tr[v], G: tg[v], B: tb[v], A: one})
+		}
+	})
+	return ret
+}
+
+func decodeToneGray16(img *image.Gray16, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	one := alpha8(0xff)
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := img.Gray16At(x, y).Y
+			ret.SetNRGBAh(x, y, fp16color.NRGBAh{R: tr[v], G: tg[v], B: tb[v], A: one})
+		}
+	})
+	return ret
+}
+
+func decodeTonePaletted(img *image.Paletted, tr, tg, tb []float16.Float16) *fp16.NRGBAh {
+	bounds := img.Bounds()
+	ret := fp16.NewNRGBAh(bounds)
+	palette := make([]fp16color.NRGBAh, len(img.Palette))
+	for i, c := range img.Palette {
+		c := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		palette[i] = fp16color.NRGBAh{R: tr[c.R], G: tg[c.G], B: tb[c.B], A: alpha16(c.A)}
+	}
+	parallels.Parallel(bounds.Min.Y, bounds.Max.Y, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ret.SetNRGBAh(x, y, palette[img.ColorIndexAt(x, y)])
+		}
+	})
+	return ret
+}
@@ -0,0 +1,196 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/shogo82148/float16"
+)
+
+func TestImageWithMeta_DecodeTone(t *testing.T) {
+	// A 16-bit value that can't be represented in 8 bits.
+	const v = 0x1234
+	img := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA64(0, 0, color.NRGBA64{v, v, v, 0xffff})
+
+	linearProfile, err := srgbChromaticities.ICCProfile(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fv := float64(v) / 0xffff
+	tests := []struct {
+		name string
+		m    *ImageWithMeta
+		want float64
+	}{
+		{
+			name: "no color space",
+			m:    &ImageWithMeta{},
+			want: srgbToLinear(fv),
+		},
+		{
+			name: "gAMA",
+			m:    &ImageWithMeta{Gamma: 0.5},
+			want: fv * fv,
+		},
+		{
+			name: "sRGB over gAMA",
+			m:    &ImageWithMeta{Gamma: 0.5, SRGB: &SRGB{}},
+			want: srgbToLinear(fv),
+		},
+		{
+			name: "iCCP over sRGB",
+			m:    &ImageWithMeta{Gamma: 0.5, SRGB: &SRGB{}, ICCProfile: linearProfile},
+			want: fv,
+		},
+		{
+			name: "cICP over iCCP",
+			m: &ImageWithMeta{
+				ICCProfile: linearProfile,
+				CICP: &CICP{
+					ColorPrimaries:   ColorPrimariesBT709,
+					TransferFunction: TransferFunctionSRGB,
+					VideoFullRange:   true,
+				},
+			},
+			want: srgbToLinear(fv),
+		},
+		{
+			name: "unsupported cICP",
+			m: &ImageWithMeta{
+				ICCProfile: linearProfile,
+				CICP: &CICP{
+					ColorPrimaries:   ColorPrimariesBT709,
+					TransferFunction: 2, // unspecified
+					VideoFullRange:   true,
+				},
+			},
+			want: fv,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.Image = img
+			got := tt.m.DecodeTone().NRGBAhAt(0, 0)
+			want := float16.FromFloat64(tt.want)
+			if got.R != want || got.G != want || got.B != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if got.A.Float64() != 1 {
+				t.Errorf("unexpected alpha: %v", got.A)
+			}
+		})
+	}
+}
+
+func TestDecodeLinear(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	img.SetRGBA64(0, 0, color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+	img.SetRGBA64(1, 0, color.RGBA64{0x8000, 0x8000, 0x8000, 0xffff})
+	m := &ImageWithMeta{
+		Image: img,
+		CICP: &CICP{
+			ColorPrimaries:   ColorPrimariesBT2020,
+			TransferFunction: TransferFunctionPQ,
+			VideoFullRange:   true,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeWithMeta(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	linear, err := DecodeLinear(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The PQ signal 1.0 is 10000 cd/m², and the reference white is 203 cd/m².
+	if got, want := linear.NRGBAhAt(0, 0).R.Float64(), 10000.0/203; math.Abs(got-want) > 0.05 {
+		t.Errorf("got %f, want %f", got, want)
+	}
+	// The PQ signal 0.5 is about 92 cd/m².
+	if got, want := linear.NRGBAhAt(1, 0).R.Float64(), 92.25/203; math.Abs(got-want) > 0.01 {
+		t.Errorf("got %f, want %f", got, want)
+	}
+}
+
+func TestDecodeTone_ImageTypes(t *testing.T) {
+	// genericImage hides the concrete type of the image.
+	type genericImage struct{ image.Image }
+
+	r := image.Rect(0, 0, 16, 16)
+	nrgba := image.NewNRGBA(r)
+	nrgba64 := image.NewNRGBA64(r)
+	gray := image.NewGray(r)
+	gray16 := image.NewGray16(r)
+	paletted := image.NewPaletted(r, color.Palette{
+		color.NRGBA{0x00, 0x00, 0x00, 0xff},
+		color.NRGBA{0xff, 0x80, 0x00, 0x80},
+		color.NRGBA{0x12, 0x34, 0x56, 0x00},
+	})
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint8(x*16 + y)
+			nrgba.SetNRGBA(x, y, color.NRGBA{v, v ^ 0x55, v ^ 0xaa, 0xff})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{uint16(v) * 251, uint16(v) * 13, uint16(v) * 97, uint16(v) * 255})
+			gray.SetGray(x, y, color.Gray{v})
+			gray16.SetGray16(x, y, color.Gray16{uint16(v) * 251})
+			paletted.SetColorIndex(x, y, v%3)
+		}
+	}
+
+	tr := toneTable(srgbToLinear)
+	tg := toneTable(func(v float64) float64 { return v })
+	tb := toneTable(func(v float64) float64 { return v * v })
+	for _, img := range []image.Image{nrgba, nrgba64, gray, gray16, paletted} {
+		got := decodeTone(img, tr, tg, tb)
+		want := decodeTone(genericImage{img}, tr, tg, tb)
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%T: the fast path differs from the generic one", img)
+		}
+	}
+
+	// The colors of translucent NRGBA pixels are not premultiplied.
+	nrgba.SetNRGBA(0, 0, color.NRGBA{0x12, 0x34, 0x56, 0x01})
+	c := decodeTone(nrgba, tr, tg, tb).NRGBAhAt(0, 0)
+	if c.R != tr[0x1212] || c.G != tg[0x3434] || c.B != tb[0x5656] {
+		t.Errorf("got %v, want %v, %v, %v", c, tr[0x1212], tg[0x3434], tb[0x5656])
+	}
+}
+
+func TestImageWithMeta_DecodeToneNarrowRange(t *testing.T) {
+	cicp := &CICP{
+		ColorPrimaries:   ColorPrimariesBT709,
+		TransferFunction: TransferFunctionLinear,
+	}
+
+	// black and white are 16 and 235 in 8-bit images.
+	img := image.NewGray(image.Rect(0, 0, 2, 1))
+	img.SetGray(0, 0, color.Gray{16})
+	img.SetGray(1, 0, color.Gray{235})
+	got := (&ImageWithMeta{Image: img, CICP: cicp}).DecodeTone()
+	if v := got.NRGBAhAt(0, 0).R.Float64(); v != 0 {
+		t.Errorf("8-bit black: got %v, want 0", v)
+	}
+	if v := got.NRGBAhAt(1, 0).R.Float64(); v != 1 {
+		t.Errorf("8-bit white: got %v, want 1", v)
+	}
+
+	// and 4096 and 60160 in 16-bit images.
+	img16 := image.NewGray16(image.Rect(0, 0, 2, 1))
+	img16.SetGray16(0, 0, color.Gray16{4096})
+	img16.SetGray16(1, 0, color.Gray16{60160})
+	got = (&ImageWithMeta{Image: img16, CICP: cicp}).DecodeTone()
+	if v := got.NRGBAhAt(0, 0).R.Float64(); v != 0 {
+		t.Errorf("16-bit black: got %v, want 0", v)
+	}
+	if v := got.NRGBAhAt(1, 0).R.Float64(); v != 1 {
+		t.Errorf("16-bit white: got %v, want 1", v)
+	}
+}
@@ -6,19 +6,59 @@ package png
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/zlib"
 	"encoding/binary"
 	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
 	"strconv"
+
+	"github.com/shogo82148/go-imaging/internal/zlibrle"
 )
 
 // Encoder configures encoding PNG images.
 type Encoder struct {
 	CompressionLevel CompressionLevel
 
+	// Interlace specifies whether the image is encoded with Adam7 interlacing.
+	// Interlaced images can be displayed progressively while they are loaded,
+	// but they are usually larger than non-interlaced images.
+	Interlace bool
+
+	// FilterStrategy specifies how the filter type of each row is chosen.
+	FilterStrategy FilterStrategy
+
+	// CompressionStrategy specifies the strategy of the deflate compression.
+	CompressionStrategy CompressionStrategy
+
+	// Optimize makes the encoder try the combinations of the filter strategies and
+	// the compression strategies, and write the smallest output.
+	// FilterStrategy, CompressionStrategy and CompressionLevel are ignored.
+	// It is very slow.
+	Optimize bool
+
+	// Quantize makes the encoder convert truecolor images to paletted images.
+	// If the image has at most NumColors distinct colors, it is converted losslessly.
+	// Otherwise, the palette is made by Quantizer and the image is drawn with Drawer.
+	// It is ignored by EncodeAll.
+	Quantize bool
+
+	// NumColors is the maximum number of colors in the palette used by Quantize.
+	// It is in the range 1 to 256. If NumColors is 0, 256 is used.
+	NumColors int
+
+	// Quantizer is used to make the palette for the images that have more than NumColors colors.
+	// If Quantizer is nil, the median cut algorithm is used.
+	Quantizer draw.Quantizer
+
+	// Drawer is used to convert the image to the paletted image by the palette of Quantizer.
+	// If Drawer is nil, draw.FloydSteinberg is used. Use draw.Src to disable dithering.
+	Drawer draw.Drawer
+
 	// BufferPool optionally specifies a buffer pool to get temporary
 	// EncoderBuffers when encoding an image.
 	BufferPool EncoderBufferPool
@@ -46,9 +86,21 @@ type encoder struct {
 	tmp     [4 * 256]byte
 	cr      [nFilter][]uint8
 	pr      []uint8
-	zw      *zlib.Writer
+	zw      zlibWriter
 	zwLevel int
+	zwStrat CompressionStrategy
 	bw      *bufio.Writer
+
+	// tw and tc are used for trial compression of FilterBruteForce.
+	tw *flate.Writer
+	tc countingWriter
+	// fr is the previous filtered row.
+	fr []uint8
+
+	// seq is the sequence number of APNG fcTL and fdAT chunks.
+	seq uint32
+	// fdat is the buffer for fdAT chunks.
+	fdat []byte
 }
 
 // CompressionLevel indicates the compression level.
@@ -64,6 +116,96 @@ const (
 	// compression level, although that is not implemented yet.
 )
 
+// FilterStrategy indicates how the filter type of each row is chosen.
+type FilterStrategy int
+
+const (
+	// DefaultFilterStrategy chooses the filter type that minimizes the sum of absolute differences.
+	// Paletted images and images with NoCompression are not filtered.
+	DefaultFilterStrategy FilterStrategy = 0
+
+	// FilterNone uses the None filter type for all rows.
+	FilterNone FilterStrategy = 1
+
+	// FilterSub uses the Sub filter type for all rows.
+	FilterSub FilterStrategy = 2
+
+	// FilterUp uses the Up filter type for all rows.
+	FilterUp FilterStrategy = 3
+
+	// FilterAverage uses the Average filter type for all rows.
+	FilterAverage FilterStrategy = 4
+
+	// FilterPaeth uses the Paeth filter type for all rows.
+	FilterPaeth FilterStrategy = 5
+
+	// FilterMinSum chooses the filter type that minimizes the sum of absolute differences,
+	// including paletted images.
+	FilterMinSum FilterStrategy = 6
+
+	// FilterBruteForce compresses each row with every filter type,
+	// and chooses the filter type that makes the smallest output.
+	FilterBruteForce FilterStrategy = 7
+)
+
+// CompressionStrategy indicates the strategy of the deflate compression.
+type CompressionStrategy int
+
+const (
+	// DefaultCompressionStrategy uses the normal deflate compression with CompressionLevel.
+	DefaultCompressionStrategy CompressionStrategy = 0
+
+	// HuffmanOnly uses only Huffman coding without string matching.
+	// CompressionLevel is ignored.
+	HuffmanOnly CompressionStrategy = 1
+
+	// RLE limits the match distances to one (run-length encoding).
+	// CompressionLevel is ignored.
+	RLE CompressionStrategy = 2
+)
+
+// zlibWriter is a zlib compressor.
+type zlibWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func newZlibWriter(w io.Writer, level int, strategy CompressionStrategy) (zlibWriter, error) {
+	switch strategy {
+	case HuffmanOnly:
+		return zlib.NewWriterLevel(w, zlib.HuffmanOnly)
+	case RLE:
+		return zlibrle.NewWriter(w), nil
+	default:
+		return zlib.NewWriterLevel(w, level)
+	}
+}
+
+// imageOptions is the options for writing the image data.
+type imageOptions struct {
+	level     int
+	strategy  CompressionStrategy
+	filter    FilterStrategy
+	interlace bool
+}
+
+func (enc *Encoder) imageOptions() imageOptions {
+	return imageOptions{
+		level:     levelToZlib(enc.CompressionLevel),
+		strategy:  enc.CompressionStrategy,
+		filter:    enc.FilterStrategy,
+		interlace: enc.Interlace,
+	}
+}
+
+// countingWriter counts the number of bytes written.
+type countingWriter int
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
+
 type opaquer interface {
 	Opaque() bool
 }
@@ -162,7 +304,11 @@ func (e *encoder) writeIHDR() {
 	}
 	e.tmp[10] = 0 // default compression method
 	e.tmp[11] = 0 // default filter method
-	e.tmp[12] = 0 // non-interlaced
+	if e.enc.Interlace {
+		e.tmp[12] = itAdam7
+	} else {
+		e.tmp[12] = itNone
+	}
 	e.writeChunk(e.tmp[:13], "IHDR")
 }
 
@@ -295,25 +441,158 @@ func filter(cr *[nFilter][]byte, pr []byte, bpp int) int {
 	return filter
 }
 
+// applyFilter applies the filter type ft to the current row cr[0],
+// and stores the result in cr[ft].
+func applyFilter(cr *[nFilter][]byte, pr []byte, bpp int, ft int) {
+	cdat0 := cr[0][1:]
+	cdat := cr[ft][1:]
+	pdat := pr[1:]
+	n := len(cdat0)
+
+	switch ft {
+	case ftSub:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i]
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - cdat0[i-bpp]
+		}
+	case ftUp:
+		for i := 0; i < n; i++ {
+			cdat[i] = cdat0[i] - pdat[i]
+		}
+	case ftAverage:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i] - pdat[i]/2
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - uint8((int(cdat0[i-bpp])+int(pdat[i]))/2)
+		}
+	case ftPaeth:
+		for i := 0; i < bpp; i++ {
+			cdat[i] = cdat0[i] - pdat[i]
+		}
+		for i := bpp; i < n; i++ {
+			cdat[i] = cdat0[i] - paeth(cdat0[i-bpp], pdat[i], pdat[i-bpp])
+		}
+	}
+}
+
+// bruteForceFilter compresses the current row with every filter type,
+// and returns the filter type that makes the smallest output.
+// The previous filtered row is compressed together to take the matches between rows into account.
+func (e *encoder) bruteForceFilter(cr *[nFilter][]byte, pr []byte, bpp int) int {
+	if e.tw == nil {
+		tw, err := flate.NewWriter(&e.tc, flate.BestSpeed)
+		if err != nil {
+			panic(err) // BestSpeed is a valid level, so it never happens.
+		}
+		e.tw = tw
+	}
+
+	best, bestSize := ftNone, -1
+	for ft := 0; ft < nFilter; ft++ {
+		applyFilter(cr, pr, bpp, ft)
+		e.tc = 0
+		e.tw.Reset(&e.tc)
+		e.tw.Write(e.fr)
+		e.tw.Write(cr[ft])
+		e.tw.Close()
+		if bestSize < 0 || int(e.tc) < bestSize {
+			best, bestSize = ft, int(e.tc)
+		}
+	}
+	e.fr = append(e.fr[:0], cr[best]...)
+	return best
+}
+
 func zeroMemory(v []uint8) {
 	for i := range v {
 		v[i] = 0
 	}
 }
 
-func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) error {
-	if e.zw == nil || e.zwLevel != level {
-		zw, err := zlib.NewWriterLevel(w, level)
+// passImage is the reduced image of an Adam7 interlacing pass.
+type passImage struct {
+	image.Image
+	pass   interlaceScan
+	bounds image.Rectangle
+}
+
+func newPassImage(m image.Image, pass interlaceScan) *passImage {
+	b := m.Bounds()
+	width := (b.Dx() - pass.xOffset + pass.xFactor - 1) / pass.xFactor
+	height := (b.Dy() - pass.yOffset + pass.yFactor - 1) / pass.yFactor
+	if width < 0 {
+		width = 0
+	}
+	if height < 0 {
+		height = 0
+	}
+	return &passImage{
+		Image:  m,
+		pass:   pass,
+		bounds: image.Rect(0, 0, width, height),
+	}
+}
+
+func (m *passImage) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+func (m *passImage) At(x, y int) color.Color {
+	return m.Image.At(m.src(x, y))
+}
+
+func (m *passImage) ColorIndexAt(x, y int) uint8 {
+	return m.Image.(image.PalettedImage).ColorIndexAt(m.src(x, y))
+}
+
+// src returns the coordinates of the pixel in the original image.
+func (m *passImage) src(x, y int) (int, int) {
+	b := m.Image.Bounds()
+	return b.Min.X + x*m.pass.xFactor + m.pass.xOffset, b.Min.Y + y*m.pass.yFactor + m.pass.yOffset
+}
+
+func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, opts imageOptions) error {
+	if e.zw == nil || e.zwLevel != opts.level || e.zwStrat != opts.strategy {
+		zw, err := newZlibWriter(w, opts.level, opts.strategy)
 		if err != nil {
 			return err
 		}
 		e.zw = zw
-		e.zwLevel = level
+		e.zwLevel = opts.level
+		e.zwStrat = opts.strategy
 	} else {
 		e.zw.Reset(w)
 	}
-	defer e.zw.Close()
 
+	if err := e.writeImagePasses(m, cb, opts); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+func (e *encoder) writeImagePasses(m image.Image, cb int, opts imageOptions) error {
+	if !opts.interlace {
+		return e.writePass(m, cb, opts)
+	}
+	for _, pass := range interlacing {
+		pm := newPassImage(m, pass)
+		// Empty passes have no data, not even the filter type bytes.
+		if pm.bounds.Empty() {
+			continue
+		}
+		if err := e.writePass(pm, cb, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePass filters and compresses the rows of m.
+// Each interlacing pass is filtered independently of the others.
+func (e *encoder) writePass(m image.Image, cb int, opts imageOptions) error {
 	bitsPerPixel := 0
 
 	switch cb {
@@ -362,6 +641,7 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) erro
 		zeroMemory(e.pr)
 	}
 	pr := e.pr
+	e.fr = e.fr[:0]
 
 	gray, _ := m.(*image.Gray)
 	rgba, _ := m.(*image.RGBA)
@@ -527,15 +807,24 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level int) erro
 		}
 
 		// Apply the filter.
-		// Skip filter for NoCompression and paletted images (cbP8) as
-		// "filters are rarely useful on palette images" and will result
-		// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
+		// The filters operate on bytes, so bpp is rounded up to one for bit depths less than 8.
+		bpp := (bitsPerPixel + 7) / 8
 		f := ftNone
-		if level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
-			// Since we skip paletted images we don't have to worry about
-			// bitsPerPixel not being a multiple of 8
-			bpp := bitsPerPixel / 8
+		switch opts.filter {
+		case DefaultFilterStrategy:
+			// Skip filter for NoCompression and paletted images (cbP8) as
+			// "filters are rarely useful on palette images" and will result
+			// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
+			if opts.level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
+				f = filter(&cr, pr, bpp)
+			}
+		case FilterNone, FilterSub, FilterUp, FilterAverage, FilterPaeth:
+			f = int(opts.filter - FilterNone)
+			applyFilter(&cr, pr, bpp, f)
+		case FilterMinSum:
 			f = filter(&cr, pr, bpp)
+		case FilterBruteForce:
+			f = e.bruteForceFilter(&cr, pr, bpp)
 		}
 
 		// Write the compressed bytes.
@@ -559,13 +848,51 @@ func (e *encoder) writeIDATs() {
 	} else {
 		e.bw.Reset(e)
 	}
-	e.err = e.writeImage(e.bw, e.m, e.cb, levelToZlib(e.enc.CompressionLevel))
+	e.err = e.writeImageData(e.bw, e.m)
 	if e.err != nil {
 		return
 	}
 	e.err = e.bw.Flush()
 }
 
+// optimizeFilters and optimizeStrategies are the candidates for Encoder.Optimize.
+var (
+	optimizeFilters = []FilterStrategy{
+		FilterNone, FilterSub, FilterUp, FilterAverage, FilterPaeth, FilterMinSum, FilterBruteForce,
+	}
+	optimizeStrategies = []CompressionStrategy{
+		DefaultCompressionStrategy, HuffmanOnly, RLE,
+	}
+)
+
+// writeImageData writes the compressed image data of m to w.
+func (e *encoder) writeImageData(w io.Writer, m image.Image) error {
+	opts := e.enc.imageOptions()
+	if !e.enc.Optimize {
+		return e.writeImage(w, m, e.cb, opts)
+	}
+
+	// Try all combinations and keep the smallest output.
+	opts.level = zlib.BestCompression
+	var best []byte
+	buf := new(bytes.Buffer)
+	for _, strategy := range optimizeStrategies {
+		for _, filter := range optimizeFilters {
+			opts.strategy = strategy
+			opts.filter = filter
+			buf.Reset()
+			if err := e.writeImage(buf, m, e.cb, opts); err != nil {
+				return err
+			}
+			if best == nil || buf.Len() < len(best) {
+				best = append(best[:0], buf.Bytes()...)
+			}
+		}
+	}
+	_, err := w.Write(best)
+	return err
+}
+
 // This function is required because we want the zero value of
 // Encoder.CompressionLevel to map to zlib.DefaultCompression.
 func levelToZlib(l CompressionLevel) int {
@@ -615,6 +942,10 @@ func (enc *Encoder) Encode(w io.Writer, m image.Image) error {
 		defer enc.BufferPool.Put((*EncoderBuffer)(e))
 	}
 
+	if p := enc.quantize(m); p != nil {
+		m = p
+	}
+
 	e.enc = enc
 	e.w = w
 	e.m = m
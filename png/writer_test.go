@@ -87,6 +87,72 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterInterlace(t *testing.T) {
+	enc := &Encoder{Interlace: true}
+
+	// The filenames variable is declared in reader_test.go.
+	names := filenames
+	if testing.Short() {
+		names = filenamesShort
+	}
+	for _, fn := range names {
+		qfn := "testdata/pngsuite/" + fn + ".png"
+		m0, err := readPNG(qfn)
+		if err != nil {
+			t.Error(fn, err)
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, m0); err != nil {
+			t.Error(fn, err)
+			continue
+		}
+		// The interlace method is the last byte of the IHDR chunk data.
+		if got := buf.Bytes()[len(pngHeader)+8+12]; got != itAdam7 {
+			t.Errorf("%s: unexpected interlace method: %d", fn, got)
+		}
+		m1, err := Decode(&buf)
+		if err != nil {
+			t.Error(fn, err)
+			continue
+		}
+		if err := diff(m0, m1); err != nil {
+			t.Error(fn, err)
+		}
+	}
+}
+
+func TestWriterInterlace_SmallImages(t *testing.T) {
+	// Some of the Adam7 passes are empty for small images.
+	enc := &Encoder{Interlace: true}
+	for w := 1; w <= 9; w++ {
+		for h := 1; h <= 9; h++ {
+			m0 := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					m0.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), uint8(x ^ y), uint8(255 - x - y)})
+				}
+			}
+			sub := m0.SubImage(image.Rect(3, 2, 3+w, 2+h))
+
+			var buf bytes.Buffer
+			if err := enc.Encode(&buf, sub); err != nil {
+				t.Errorf("%dx%d: %v", w, h, err)
+				continue
+			}
+			m1, err := Decode(&buf)
+			if err != nil {
+				t.Errorf("%dx%d: %v", w, h, err)
+				continue
+			}
+			if err := diff(sub, m1); err != nil {
+				t.Errorf("%dx%d: %v", w, h, err)
+			}
+		}
+	}
+}
+
 func TestWriterPaletted(t *testing.T) {
 	const width, height = 32, 16
 
@@ -215,6 +281,106 @@ func TestWriterLevels(t *testing.T) {
 	}
 }
 
+func TestWriterStrategies(t *testing.T) {
+	filters := []FilterStrategy{
+		DefaultFilterStrategy, FilterNone, FilterSub, FilterUp, FilterAverage, FilterPaeth, FilterMinSum, FilterBruteForce,
+	}
+	strategies := []CompressionStrategy{
+		DefaultCompressionStrategy, HuffmanOnly, RLE,
+	}
+	for _, fn := range filenamesShort {
+		qfn := "testdata/pngsuite/" + fn + ".png"
+		m0, err := readPNG(qfn)
+		if err != nil {
+			t.Fatal(fn, err)
+		}
+		for _, filter := range filters {
+			for _, strategy := range strategies {
+				enc := &Encoder{
+					FilterStrategy:      filter,
+					CompressionStrategy: strategy,
+				}
+				var buf bytes.Buffer
+				if err := enc.Encode(&buf, m0); err != nil {
+					t.Errorf("%s, filter %d, strategy %d: %v", fn, filter, strategy, err)
+					continue
+				}
+				m1, err := Decode(&buf)
+				if err != nil {
+					t.Errorf("%s, filter %d, strategy %d: %v", fn, filter, strategy, err)
+					continue
+				}
+				if err := diff(m0, m1); err != nil {
+					t.Errorf("%s, filter %d, strategy %d: %v", fn, filter, strategy, err)
+				}
+			}
+		}
+	}
+}
+
+func TestWriterFixedFilter(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	enc := &Encoder{FilterStrategy: FilterPaeth}
+	if err := enc.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inflate the IDAT chunk and check the filter types of all rows.
+	b := buf.Bytes()[len(pngHeader):]
+	var idat []byte
+	for len(b) > 0 {
+		length := int(binary.BigEndian.Uint32(b[:4]))
+		if string(b[4:8]) == "IDAT" {
+			idat = append(idat, b[8:8+length]...)
+		}
+		b = b[12+length:]
+	}
+	r, err := zlib.NewReader(bytes.NewReader(idat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rowSize = 1 + 16*4
+	for y := 0; y < 16; y++ {
+		if got := data[y*rowSize]; got != ftPaeth {
+			t.Errorf("row %d: unexpected filter type: %d", y, got)
+		}
+	}
+}
+
+func TestWriterOptimize(t *testing.T) {
+	m, err := readPNG("testdata/pngsuite/basn6a08.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b1, b2 bytes.Buffer
+	if err := (&Encoder{CompressionLevel: BestCompression}).Encode(&b1, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Encoder{Optimize: true}).Encode(&b2, m); err != nil {
+		t.Fatal(err)
+	}
+	if b2.Len() > b1.Len() {
+		t.Errorf("optimized encoding was larger than BestCompression encoding: %d > %d", b2.Len(), b1.Len())
+	}
+
+	m1, err := Decode(&b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(m, m1); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestSubImage(t *testing.T) {
 	m0 := image.NewRGBA(image.Rect(0, 0, 256, 256))
 	for y := 0; y < 256; y++ {